@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// -baseline checks every scanned host against a policy listing the ports it should have
+// open. A policy maps entries to port lists:
+//
+//	"*": [22]                          # every host without a more specific entry
+//	"*.example.com": [22, 443]         # host names matching a glob
+//	10.0.0.0/24: [22, 8000-8100]       # addresses in a range; a bare IP is a /32 or /128
+//	db.internal:                       # one host, by name
+//	  - 22
+//	  - 5432
+//	  - 53/udp
+//
+// A host is checked against its most specific entry: its own name, then the narrowest
+// range holding its address, then the longest matching glob, then "*". Hosts no entry
+// matches, and hosts that failed or were down, are not checked. Ports without a protocol
+// are TCP.
+
+// Violation kinds
+const (
+	violationUnexpectedOpen = "unexpected_open"
+	violationExpectedClosed = "expected_closed"
+)
+
+// PolicyViolation is a port that breaks the -baseline policy
+type PolicyViolation struct {
+	// Violation is unexpected_open for an open port the entry does not list, or
+	// expected_closed for a listed port that was scanned and found not open
+	Violation string `json:"violation"`
+	Host      string `json:"host"`
+	IP        string `json:"ip"`
+	Port      int    `json:"port"`
+	Protocol  string `json:"protocol"`
+	Service   string `json:"service,omitempty"`
+	// Entry is the policy entry the host was checked against, as written in the file
+	Entry string `json:"entry"`
+}
+
+// PolicyCheck is the "policy" object of JSON output with -baseline
+type PolicyCheck struct {
+	Baseline   string            `json:"baseline"`
+	Violations []PolicyViolation `json:"violations"`
+}
+
+// policyEntry is one entry of a policy with the ports it allows
+type policyEntry struct {
+	Pattern string
+	Allowed map[portKey]bool
+	// Exactly one of name, prefix and glob is set, except for the "*" entry
+	name   string
+	prefix netip.Prefix
+	glob   string
+}
+
+// portPolicy is a -baseline file, its entries in the order they were written
+type portPolicy struct {
+	Entries []*policyEntry
+}
+
+// loadPolicy reads a -baseline file. Files ending in .yaml or .yml are read as YAML,
+// anything else as a JSON object of the same shape.
+func loadPolicy(path string) (*portPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []rawPolicyEntry
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		entries, err = parseYAMLPolicy(data)
+	default:
+		entries, err = parseJSONPolicy(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no entries found", path)
+	}
+	policy := &portPolicy{}
+	seen := make(map[string]bool)
+	for _, raw := range entries {
+		entry, err := newPolicyEntry(raw.Pattern, raw.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if seen[entry.Pattern] {
+			return nil, fmt.Errorf("%s: %q is listed twice", path, raw.Pattern)
+		}
+		seen[entry.Pattern] = true
+		policy.Entries = append(policy.Entries, entry)
+	}
+	return policy, nil
+}
+
+// rawPolicyEntry is an entry as written, before its pattern and ports are checked
+type rawPolicyEntry struct {
+	Pattern string
+	Ports   []string
+}
+
+// parseYAMLPolicy understands the part of YAML a policy needs: comments, and a top-level
+// mapping of plain or quoted keys to port lists written either as flow sequences ([22, 443])
+// or as block sequences of "- 22" lines
+func parseYAMLPolicy(data []byte) ([]rawPolicyEntry, error) {
+	var entries []rawPolicyEntry
+	// block is the entry whose "- item" lines are being read, if any
+	var block *rawPolicyEntry
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; lines.Scan(); number++ {
+		text := lines.Text()
+		if i := strings.Index(text, " #"); i >= 0 {
+			text = text[:i]
+		}
+		line := strings.TrimSpace(text)
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+
+		if text[0] == ' ' || text[0] == '\t' {
+			item, ok := strings.CutPrefix(line, "-")
+			if !ok || block == nil {
+				return nil, fmt.Errorf("line %d: expected an entry such as \"10.0.0.5: [22, 443]\"", number)
+			}
+			block.Ports = append(block.Ports, unquoteYAML(strings.TrimSpace(item)))
+			continue
+		}
+
+		key, value, err := splitYAMLKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+		entries = append(entries, rawPolicyEntry{Pattern: key, Ports: []string{}})
+		block = nil
+		switch {
+		case value == "":
+			block = &entries[len(entries)-1]
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					entries[len(entries)-1].Ports = append(entries[len(entries)-1].Ports, unquoteYAML(item))
+				}
+			}
+		default:
+			return nil, fmt.Errorf("line %d: %s must be a list of ports, e.g. [22, 443]", number, key)
+		}
+	}
+	return entries, lines.Err()
+}
+
+// splitYAMLKey splits a "key: value" line. Plain keys end at the first ": ", so IPv6
+// addresses and ranges such as fe80::/10 need no quotes.
+func splitYAMLKey(line string) (key, value string, err error) {
+	if line[0] == '"' || line[0] == '\'' {
+		end := strings.IndexByte(line[1:], line[0])
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated quote in %q", line)
+		}
+		key, rest := line[1:end+1], strings.TrimSpace(line[end+2:])
+		value, ok := strings.CutPrefix(rest, ":")
+		if !ok {
+			return "", "", fmt.Errorf("expected a colon after %q", key)
+		}
+		return key, strings.TrimSpace(value), nil
+	}
+	if key, value, ok := strings.Cut(line, ": "); ok {
+		return strings.TrimSpace(key), strings.TrimSpace(value), nil
+	}
+	if key, ok := strings.CutSuffix(line, ":"); ok {
+		return strings.TrimSpace(key), "", nil
+	}
+	return "", "", fmt.Errorf("expected key: [ports], not %q", line)
+}
+
+func unquoteYAML(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parseJSONPolicy reads an object of entries to arrays of ports, keeping the entries in
+// file order; ports may be numbers or strings such as "8000-8100" and "53/udp"
+func parseJSONPolicy(data []byte) ([]rawPolicyEntry, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object of entries to port lists")
+	}
+	var entries []rawPolicyEntry
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := token.(string)
+		var values []any
+		if err := decoder.Decode(&values); err != nil {
+			return nil, fmt.Errorf("%s must be a list of ports, e.g. [22, 443]", key)
+		}
+		entry := rawPolicyEntry{Pattern: key, Ports: []string{}}
+		for _, value := range values {
+			switch value := value.(type) {
+			case string:
+				entry.Ports = append(entry.Ports, value)
+			case json.Number:
+				entry.Ports = append(entry.Ports, value.String())
+			default:
+				return nil, fmt.Errorf("ports of %s must be numbers or strings", key)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func newPolicyEntry(pattern string, ports []string) (*policyEntry, error) {
+	entry := &policyEntry{Allowed: make(map[portKey]bool)}
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	switch {
+	case pattern == "*":
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		entry.glob = pattern
+	default:
+		host, err := cleanHostEntry(pattern)
+		if err != nil {
+			return nil, err
+		}
+		pattern = host
+		if prefix, err := netip.ParsePrefix(host); err == nil {
+			entry.prefix = prefix.Masked()
+		} else if addr, err := netip.ParseAddr(host); err == nil {
+			entry.prefix = netip.PrefixFrom(addr, addr.BitLen())
+		} else {
+			entry.name = host
+		}
+	}
+	entry.Pattern = pattern
+	for _, item := range ports {
+		keys, err := parsePolicyPorts(item)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pattern, err)
+		}
+		for _, key := range keys {
+			entry.Allowed[key] = true
+		}
+	}
+	return entry, nil
+}
+
+// parsePolicyPorts reads one item of a port list: a port or range in the -ports format,
+// optionally followed by /tcp or /udp
+func parsePolicyPorts(item string) ([]portKey, error) {
+	spec, protocol, found := strings.Cut(item, "/")
+	if !found {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("unknown protocol %q in %q (expected tcp or udp)", protocol, item)
+	}
+	if strings.Contains(spec, ",") {
+		return nil, fmt.Errorf("invalid port %q", item)
+	}
+	ports, err := parsePortSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]portKey, len(ports))
+	for i, port := range ports {
+		keys[i] = portKey{port, protocol}
+	}
+	return keys, nil
+}
+
+// Match returns the most specific entry covering a host, or nil if none does
+func (p *portPolicy) Match(host, ip string) *policyEntry {
+	addr, _ := netip.ParseAddr(ip)
+	var best *policyEntry
+	bestRank, bestScore := -1, -1
+	for _, entry := range p.Entries {
+		rank, score := -1, 0
+		switch {
+		case entry.name != "":
+			if entry.name == host {
+				rank = 3
+			}
+		case entry.prefix.IsValid():
+			if addr.IsValid() && entry.prefix.Contains(addr.Unmap()) {
+				rank, score = 2, entry.prefix.Bits()
+			}
+		case entry.glob != "":
+			if ok, _ := path.Match(entry.glob, host); ok {
+				rank, score = 1, len(strings.Trim(entry.glob, "*?"))
+			}
+		default:
+			rank = 0
+		}
+		if rank > bestRank || (rank == bestRank && score > bestScore) {
+			best, bestRank, bestScore = entry, rank, score
+		}
+	}
+	if bestRank < 0 {
+		return nil
+	}
+	return best
+}
+
+// Violation names how a single result breaks the entry, or returns "" if it does not
+func (e *policyEntry) Violation(result scanner.Result) string {
+	allowed := e.Allowed[portKey{result.Port, result.Protocol}]
+	switch {
+	case result.Open && !allowed:
+		return violationUnexpectedOpen
+	case !result.Open && allowed:
+		return violationExpectedClosed
+	}
+	return ""
+}
+
+// Check lists the violations of a scanned host: every open port the entry does not allow
+// and, unless the scan was cut short, every allowed port that was scanned but not found open.
+// scanned tells whether a port was part of this host's scan.
+func (e *policyEntry) Check(scan *hostScan, open []scanner.Result, partial bool, scanned func(portKey) bool) []PolicyViolation {
+	var violations []PolicyViolation
+	found := make(map[portKey]string, len(open))
+	for _, result := range open {
+		key := portKey{result.Port, result.Protocol}
+		found[key] = result.Service
+		if !e.Allowed[key] {
+			violations = append(violations, PolicyViolation{violationUnexpectedOpen, scan.Host, scan.IP, result.Port, result.Protocol, result.Service, e.Pattern})
+		}
+	}
+	if partial {
+		return violations
+	}
+	allowed := make(map[portKey]string, len(e.Allowed))
+	for key := range e.Allowed {
+		allowed[key] = ""
+	}
+	for _, key := range sortedPorts(allowed) {
+		if _, ok := found[key]; !ok && scanned(key) {
+			violations = append(violations, PolicyViolation{Violation: violationExpectedClosed, Host: scan.Host, IP: scan.IP, Port: key.Port, Protocol: key.Protocol, Entry: e.Pattern})
+		}
+	}
+	return violations
+}
+
+// describe renders a violation for text output, e.g.
+// "localhost: port 8081/tcp is open but entry "*" does not allow it (tproxy)"
+func (v PolicyViolation) describe() string {
+	host := hostLabel(&hostScan{Host: v.Host, IP: v.IP})
+	if v.Violation == violationUnexpectedOpen {
+		return fmt.Sprintf("%s: port %d/%s is open but entry %q does not allow it (%s)", host, v.Port, v.Protocol, v.Entry, v.Service)
+	}
+	return fmt.Sprintf("%s: port %d/%s is not open but entry %q expects it", host, v.Port, v.Protocol, v.Entry)
+}
+
+func writePolicyText(w io.Writer, check *PolicyCheck) error {
+	if len(check.Violations) == 0 {
+		_, err := fmt.Fprintf(w, "No policy violations against %s\n", check.Baseline)
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Policy violations against %s:\n", check.Baseline)
+	for _, violation := range check.Violations {
+		fmt.Fprintf(&buf, "! %s\n", violation.describe())
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writePolicyJSONLines writes one line per violation for -o jsonl, after every port line
+func writePolicyJSONLines(w io.Writer, violations []PolicyViolation) error {
+	var buf bytes.Buffer
+	for _, violation := range violations {
+		data, err := json.Marshal(violation)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// grepViolations renders a host's violations for -o grep, e.g. 8081/tcp/unexpected_open
+func grepViolations(violations []PolicyViolation) string {
+	parts := make([]string, len(violations))
+	for i, violation := range violations {
+		parts[i] = strconv.Itoa(violation.Port) + "/" + violation.Protocol + "/" + violation.Violation
+	}
+	return strings.Join(parts, ", ")
+}
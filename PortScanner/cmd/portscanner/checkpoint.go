@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// A -checkpoint file is JSON lines: a checkpointHeader describing the scan, followed by
+// one PortLine for every port probed, open or not, and a checkpointFooter once the scan
+// has finished. Lines are only ever appended, so a crash mid-write costs at most the
+// last line, which -resume ignores.
+
+// Buffered lines are written out this often, and whenever the scan ends or is interrupted
+const checkpointFlushInterval = time.Second
+
+// checkpointVersion is bumped whenever the layout of the file changes
+const checkpointVersion = 1
+
+type checkpointHeader struct {
+	Checkpoint int       `json:"checkpoint"`
+	Targets    []string  `json:"targets"`
+	Ports      string    `json:"ports"`
+	Protocols  []string  `json:"protocols"`
+	Created    time.Time `json:"created"`
+}
+
+// matches reports why a checkpoint cannot be resumed by a scan described by current,
+// or nil if it can
+func (h checkpointHeader) matches(current checkpointHeader) error {
+	switch {
+	case h.Checkpoint != checkpointVersion:
+		return fmt.Errorf("unsupported checkpoint version %d", h.Checkpoint)
+	case !reflect.DeepEqual(h.Targets, current.Targets):
+		return fmt.Errorf("it was made for targets %s, not %s", strings.Join(h.Targets, ", "), strings.Join(current.Targets, ", "))
+	case h.Ports != current.Ports:
+		return fmt.Errorf("it was made for ports %s, not %s", h.Ports, current.Ports)
+	case !reflect.DeepEqual(h.Protocols, current.Protocols):
+		return fmt.Errorf("it was made for protocols %s, not %s", strings.Join(h.Protocols, ", "), strings.Join(current.Protocols, ", "))
+	}
+	return nil
+}
+
+// checkpointFooter closes the file of a scan that ran to the end
+type checkpointFooter struct {
+	Complete time.Time `json:"complete"`
+}
+
+type checkpointKey struct {
+	IP       string
+	Port     int
+	Protocol string
+}
+
+// checkpoint is what a -resume file says was already scanned
+type checkpoint struct {
+	Header  checkpointHeader
+	Results map[checkpointKey]scanner.Result
+	// Lines holds every intact result line, to carry them over into a new -checkpoint file
+	Lines [][]byte
+	// Complete is when the scan finished, or zero if it never did
+	Complete time.Time
+	// size is where the intact lines end, so appending can drop a last line cut short
+	size int64
+}
+
+// Lookup is the scanner.Options.Resume hook
+func (c *checkpoint) Lookup(ip string, port int, protocol string) (scanner.Result, bool) {
+	result, ok := c.Results[checkpointKey{ip, port, protocol}]
+	return result, ok
+}
+
+// loadCheckpoint reads a checkpoint file. A last line cut short by a crash is dropped;
+// anything else that does not parse is an error.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &checkpoint{Results: make(map[checkpointKey]scanner.Result)}
+	c.size = int64(bytes.LastIndexByte(data, '\n') + 1)
+	lines := bytes.Split(data[:max(c.size-1, 0)], []byte("\n"))
+	if len(lines[0]) == 0 {
+		return nil, fmt.Errorf("%s: not a checkpoint file", path)
+	}
+	if err := json.Unmarshal(lines[0], &c.Header); err != nil || c.Header.Checkpoint == 0 {
+		return nil, fmt.Errorf("%s: not a checkpoint file", path)
+	}
+	for i, line := range lines[1:] {
+		if i == len(lines)-2 {
+			var footer checkpointFooter
+			if json.Unmarshal(line, &footer) == nil && !footer.Complete.IsZero() {
+				c.Complete = footer.Complete
+				break
+			}
+		}
+		var entry PortLine
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, i+2, err)
+		}
+		c.Results[checkpointKey{entry.IP, entry.Port, entry.Protocol}] = scanner.Result{
+			Port:        entry.Port,
+			Protocol:    entry.Protocol,
+			Open:        entry.Open,
+			State:       entry.State,
+			Banner:      entry.Banner,
+			SSH:         entry.SSH,
+			TLS:         entry.TLS,
+			HTTP:        entry.HTTP,
+			Annotations: entry.Annotations,
+			Error:       entry.Error,
+			Attempts:    entry.Attempts,
+			Latency:     time.Duration(entry.LatencyMS * float64(time.Millisecond)),
+			Timestamp:   entry.Time,
+		}
+		c.Lines = append(c.Lines, line)
+	}
+	return c, nil
+}
+
+// checkpointWriter appends probed ports to a checkpoint file from any number of workers
+type checkpointWriter struct {
+	mu        sync.Mutex
+	closeOnce sync.Once
+	file      *os.File
+	buf       *bufio.Writer
+	err       error
+	// hosts maps scanned IPs back to the target they came from, for the host field;
+	// it has to be filled in before the scan starts
+	hosts map[string]string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// createCheckpoint starts writing the checkpoint at path. Resuming from the same file
+// appends to it, after dropping any line a crash cut short; otherwise the file must not
+// exist yet, and the results carried over from resumed, if any, are copied in after the header.
+func createCheckpoint(path string, header checkpointHeader, resumed *checkpoint, resumedPath string) (*checkpointWriter, error) {
+	var file *os.File
+	var err error
+	appending := resumed != nil && sameFile(path, resumedPath)
+	if appending {
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err == nil {
+			if err = file.Truncate(resumed.size); err != nil {
+				file.Close()
+			}
+		}
+	} else {
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("%s already exists (pass it to -resume to continue that scan)", path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w := &checkpointWriter{file: file, buf: bufio.NewWriter(file), stop: make(chan struct{}), done: make(chan struct{})}
+	if !appending {
+		line, _ := json.Marshal(header)
+		w.buf.Write(append(line, '\n'))
+		if resumed != nil {
+			for _, line := range resumed.Lines {
+				w.buf.Write(append(line, '\n'))
+			}
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(checkpointFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.mu.Lock()
+				w.flush()
+				w.mu.Unlock()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// Record is the scanner.Options.OnResult hook
+func (w *checkpointWriter) Record(ip string, result scanner.Result) {
+	line, err := json.Marshal(newPortLine(&hostScan{Host: w.hosts[ip], IP: ip}, result))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err == nil && w.err == nil {
+		_, err = w.buf.Write(append(line, '\n'))
+	}
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *checkpointWriter) flush() {
+	if err := w.buf.Flush(); err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// Complete marks the scan as finished and closes the file; -resume refuses it from then on
+func (w *checkpointWriter) Complete() error {
+	line, _ := json.Marshal(checkpointFooter{Complete: time.Now()})
+	w.mu.Lock()
+	if w.err == nil {
+		if _, err := w.buf.Write(append(line, '\n')); err != nil {
+			w.err = err
+		}
+	}
+	w.mu.Unlock()
+	return w.Close()
+}
+
+// Close writes out everything buffered and reports the first error writing the file hit.
+// Only the first call closes the file; later ones return the same error.
+func (w *checkpointWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.flush()
+		if err := w.file.Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+	})
+	return w.err
+}
+
+func sameFile(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// ANSI escape sequences used by style
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiGray   = "\x1b[90m"
+)
+
+// useColor decides whether text output is colored for a -color mode. auto colors only
+// when the report goes to a terminal and NO_COLOR (https://no-color.org) is not set.
+func useColor(mode string, out *os.File) bool {
+	switch mode {
+	case "always":
+		return true
+	case "auto":
+		return isTerminal(out) && os.Getenv("NO_COLOR") == ""
+	}
+	return false
+}
+
+// style is how text output is highlighted: with ANSI colors when true, plain when false.
+// Every escape code the tool writes goes through it.
+type style bool
+
+// State wraps a port state in its color: open green, closed dim gray, filtered and
+// open|filtered yellow, errors red
+func (s style) State(state scanner.State) string {
+	switch state {
+	case scanner.StateOpen:
+		return s.wrap(ansiGreen, string(state))
+	case scanner.StateClosed:
+		return s.wrap(ansiGray, string(state))
+	case scanner.StateFiltered, scanner.StateOpenFiltered:
+		return s.wrap(ansiYellow, string(state))
+	case scanner.StateError:
+		return s.wrap(ansiRed, string(state))
+	}
+	return string(state)
+}
+
+// Header makes a host header stand out from the port lines below it
+func (s style) Header(text string) string {
+	return s.wrap(ansiBold, text)
+}
+
+func (s style) wrap(code, text string) string {
+	if !s {
+		return text
+	}
+	return code + text + ansiReset
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+// command is one of the tools of the binary, picked by its first argument
+type command struct {
+	Name    string
+	Summary string
+	// Run parses the arguments after the name and returns the exit status
+	Run func(args []string) int
+}
+
+var commands = []command{
+	{"scan", "Scan the TCP and UDP ports of hosts and subnets", run},
+	{"ping", "Check whether hosts are up, without scanning their ports", runPing},
+	{"resolve", "Print the addresses hosts resolve to", runResolve},
+	{"version", "Print the version and build of the binary", runVersion},
+}
+
+// dispatch runs the command named by the first argument, or the top-level help
+func dispatch(args []string) int {
+	cmd, rest, legacy := route(args, !isTerminal(os.Stdin))
+	if cmd == nil {
+		if len(args) > 1 {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[1])
+		}
+		topUsage()
+		if len(args) == 0 || len(args) > 1 {
+			return exitUsage
+		}
+		return 0
+	}
+	if legacy {
+		fmt.Fprintf(os.Stderr, "Note: scanning without the scan command is deprecated, run %s scan [flags] <host|cidr> instead\n", os.Args[0])
+	}
+	return cmd.Run(rest)
+}
+
+// route picks the command for args and the arguments it is given. Arguments that do not
+// start with a command's name are the flags and targets of a scan from before there were
+// commands, so they go to scan and legacy is true, as does a host list piped in with no
+// arguments at all. "help scan" is the same as "scan -h". The command is nil when args
+// ask for the top-level help, or "help" is not followed by just a command's name.
+func route(args []string, piped bool) (*command, []string, bool) {
+	if len(args) == 0 {
+		if piped {
+			return findCommand("scan"), nil, true
+		}
+		return nil, nil, false
+	}
+	if isHelp(args[0]) && len(args) == 1 {
+		return nil, nil, false
+	}
+	if args[0] == "-version" || args[0] == "--version" {
+		return findCommand("version"), args[1:], false
+	}
+	if args[0] == "help" {
+		if len(args) == 2 {
+			if cmd := findCommand(args[1]); cmd != nil {
+				return cmd, []string{"-h"}, false
+			}
+		}
+		return nil, nil, false
+	}
+	if cmd := findCommand(args[0]); cmd != nil {
+		return cmd, args[1:], false
+	}
+	return findCommand("scan"), args, true
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].Name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func isHelp(arg string) bool {
+	return arg == "help" || arg == "-h" || arg == "-help" || arg == "--help"
+}
+
+func topUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s <command> [flags] [arguments]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s help <command> for the flags of a command.\n", os.Args[0])
+}
+
+// familyFlags adds -4 and -6 to flags and returns a func giving the IPVersion they select,
+// or false after printing an error if both were set
+func familyFlags(flags *flag.FlagSet, verb string) func() (string, bool) {
+	ipv4Only := flags.Bool("4", false, "Only "+verb+" IPv4 addresses")
+	ipv6Only := flags.Bool("6", false, "Only "+verb+" IPv6 addresses")
+	return func() (string, bool) {
+		switch {
+		case *ipv4Only && *ipv6Only:
+			fmt.Println("Error: -4 and -6 cannot be used together")
+			return "", false
+		case *ipv4Only:
+			return "4", true
+		case *ipv6Only:
+			return "6", true
+		}
+		return "", true
+	}
+}
+
+// parseCommand parses the flags of a command other than scan, returning false with the
+// exit status when there is nothing to run
+func parseCommand(flags *flag.FlagSet, args []string) (int, bool) {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return exitUsage, false
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage, false
+	}
+	return 0, true
+}
+
+// runPing checks every host given with the host discovery of -ping, at the same time, and
+// prints whether each is up in the order given
+func runPing(args []string) int {
+	flags := flag.NewFlagSet(os.Args[0]+" ping", flag.ContinueOnError)
+	timeout := flags.Duration("t", time.Second, "How long to wait for each host to answer (default: 1s)")
+	portSpec := flags.String("ports", "80,443,22", "Ports to connect to next to the ICMP echo, in the same format as scan -ports")
+	family := familyFlags(flags, "ping")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s ping [flags] <host>...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "A host is up when it answers an ICMP echo (when privileged) or a TCP connect to any of\n")
+		fmt.Fprintf(os.Stderr, "the -ports, even by refusing it.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExit status:\n")
+		fmt.Fprintf(os.Stderr, "  0 if every host is up, 1 if any is down, 2 for usage errors and 3 if a host cannot be\n")
+		fmt.Fprintf(os.Stderr, "  resolved.\n")
+	}
+	if status, ok := parseCommand(flags, args); !ok {
+		return status
+	}
+	if *timeout <= 0 {
+		fmt.Println("Error: Timeout must be a positive duration (e.g. 500ms, 2s)")
+		return exitUsage
+	}
+	ports, err := parsePortSpec(*portSpec)
+	if err != nil {
+		fmt.Printf("Error parsing ports: %v\n", err)
+		return exitUsage
+	}
+	ipVersion, ok := family()
+	if !ok {
+		return exitUsage
+	}
+
+	s := scanner.New(scanner.Options{Timeout: *timeout, DiscoveryPorts: ports, IPVersion: ipVersion})
+	lines := make([]string, flags.NArg())
+	var unresolved, down bool
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentPings)
+	for i, host := range flags.Args() {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			ip, err := s.Resolve(context.Background(), host)
+			if err != nil {
+				mu.Lock()
+				unresolved = true
+				mu.Unlock()
+				lines[i] = fmt.Sprintf("%s: %v", host, err)
+				return
+			}
+			label := host
+			if ip != host {
+				label += " (" + ip + ")"
+			}
+			status := s.Discover(context.Background(), ip, *timeout)
+			if !status.Up {
+				mu.Lock()
+				down = true
+				mu.Unlock()
+				lines[i] = label + " is down"
+				return
+			}
+			lines[i] = fmt.Sprintf("%s is up (%s, %s)", label, status.Reason, formatLatency(status.Latency))
+		}(i, host)
+	}
+	wg.Wait()
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	switch {
+	case unresolved:
+		return exitRuntime
+	case down:
+		return exitNoOpenPorts
+	}
+	return 0
+}
+
+// runResolve prints every address each host given resolves to, in the order scan tries them
+func runResolve(args []string) int {
+	flags := flag.NewFlagSet(os.Args[0]+" resolve", flag.ContinueOnError)
+	family := familyFlags(flags, "print")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s resolve [flags] <host>...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Prints a line of addresses for each host, IPv4 ones first.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExit status:\n")
+		fmt.Fprintf(os.Stderr, "  0 if every host resolved, 2 for usage errors and 3 if any did not.\n")
+	}
+	if status, ok := parseCommand(flags, args); !ok {
+		return status
+	}
+	ipVersion, ok := family()
+	if !ok {
+		return exitUsage
+	}
+
+	s := scanner.New(scanner.Options{IPVersion: ipVersion})
+	status := 0
+	for _, host := range flags.Args() {
+		ips, err := s.ResolveAll(context.Background(), host)
+		if err != nil {
+			fmt.Printf("%s: %v\n", host, err)
+			status = exitRuntime
+			continue
+		}
+		fmt.Printf("%s: %s\n", host, strings.Join(ips, " "))
+	}
+	return status
+}
+
+// runVersion prints the version, commit and build date of the binary
+func runVersion(args []string) int {
+	flags := flag.NewFlagSet(os.Args[0]+" version", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print the build information as a JSON object")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s version [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --version\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return exitUsage
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(version.Get()); err != nil {
+			return exitRuntime
+		}
+		return 0
+	}
+	fmt.Println(version.Long())
+	return 0
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configKeys maps the keys of a -config file to the flags they set, listing aliases that
+// share a value after the flag that is set, so giving either on the command line wins
+var configKeys = map[string][]string{
+	"workers":    {"w"},
+	"timeout":    {"t"},
+	"start_port": {"p"},
+	"end_port":   {"e"},
+	"ports":      {"ports"},
+	"format":     {"o", "format"},
+}
+
+// loadConfig reads the defaults in a -config file, as flag values keyed by config key.
+// Files ending in .toml hold flat key = value lines; anything else is a JSON object.
+func loadConfig(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		values, err = parseTOMLConfig(data)
+	} else {
+		values, err = parseJSONConfig(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key := range values {
+		if _, ok := configKeys[key]; !ok {
+			return nil, fmt.Errorf("%s: unknown key %q (expected %s)", path, key, strings.Join(configKeyNames(), ", "))
+		}
+	}
+	return values, nil
+}
+
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var raw map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch value := value.(type) {
+		case string:
+			values[key] = value
+		case json.Number:
+			values[key] = value.String()
+		default:
+			return nil, fmt.Errorf("%s must be a string or a number", key)
+		}
+	}
+	return values, nil
+}
+
+// parseTOMLConfig understands the part of TOML a flat list of defaults needs: comments,
+// key = value lines, and values that are quoted strings or bare numbers
+func parseTOMLConfig(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; lines.Scan(); number++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported", number)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", number)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", number, err)
+			}
+			if rest := strings.TrimSpace(value[len(quoted):]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("line %d: unexpected %q after value", number, rest)
+			}
+			value, _ = strconv.Unquote(quoted)
+		} else {
+			value, _, _ = strings.Cut(value, "#")
+			value = strings.TrimSpace(value)
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("line %d: %s must be a quoted string or a number", number, key)
+			}
+		}
+		values[key] = value
+	}
+	return values, lines.Err()
+}
+
+// applyConfig sets every flag in flags from values that was not given on the command
+// line, so explicit flags always win over the config file
+func applyConfig(flags *flag.FlagSet, values map[string]string, explicit map[string]bool) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		names := configKeys[key]
+		given := false
+		for _, name := range names {
+			given = given || explicit[name]
+		}
+		if given {
+			continue
+		}
+		if err := flags.Set(names[0], values[key]); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", key, values[key], err)
+		}
+	}
+	return nil
+}
+
+func configKeyNames() []string {
+	names := make([]string, 0, len(configKeys))
+	for key := range configKeys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// -diff compares a scan with an earlier -o json report and reports only what changed,
+// keyed on host, port and protocol. A host counts as present when it was scanned without
+// an error and did not look down to -ping; every address of a host scanned with -all-ips
+// counts towards the same host.
+
+// ScanDiff is what changed since the previous report. It is the "diff" object of JSON
+// output and the source of every other rendering.
+type ScanDiff struct {
+	Previous string `json:"previous"`
+	// Hosts present now that were missing from the previous report, or down or failed in it
+	NewHosts []string `json:"new_hosts"`
+	// Hosts present in the previous report that are down, failed or were not scanned this time
+	GoneHosts []string `json:"gone_hosts"`
+	// Opened lists ports open now that were not open before, including every open port of a new host
+	Opened []PortChange `json:"opened"`
+	// Closed lists ports open before that were scanned again and found not open
+	Closed []PortChange `json:"closed"`
+}
+
+// PortChange is one port that opened or closed since the previous report
+type PortChange struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Service  string `json:"service"`
+}
+
+// Empty reports whether nothing changed
+func (d *ScanDiff) Empty() bool {
+	return len(d.NewHosts) == 0 && len(d.GoneHosts) == 0 && len(d.Opened) == 0 && len(d.Closed) == 0
+}
+
+type portKey struct {
+	Port     int
+	Protocol string
+}
+
+// hostPorts is the state of one host in a report: its open ports, with their service names
+type hostPorts struct {
+	Open map[portKey]string
+	// Partial hosts were not fully scanned, so a port missing from Open says nothing
+	Partial bool
+}
+
+// portSnapshot holds every present host of a report in the order they were first seen
+type portSnapshot struct {
+	Hosts map[string]*hostPorts
+	Order []string
+	// Unscanned hosts were left out of this run by an interrupt or the deadline, so they
+	// are neither new nor gone
+	Unscanned map[string]bool
+}
+
+func newPortSnapshot() *portSnapshot {
+	return &portSnapshot{Hosts: make(map[string]*hostPorts), Unscanned: make(map[string]bool)}
+}
+
+// Add records a present host with its open ports
+func (s *portSnapshot) Add(host string, open []scanner.Result, partial bool) {
+	ports, ok := s.Hosts[host]
+	if !ok {
+		ports = &hostPorts{Open: make(map[portKey]string)}
+		s.Hosts[host] = ports
+		s.Order = append(s.Order, host)
+	}
+	for _, result := range open {
+		if result.Open {
+			ports.Open[portKey{result.Port, result.Protocol}] = result.Service
+		}
+	}
+	ports.Partial = ports.Partial || partial
+}
+
+// jsonReport is the top level of -o json output with -stats, -diff or -baseline; plain reports
+// are a bare list of hosts
+type jsonReport struct {
+	Hosts   []HostResult `json:"hosts"`
+	Summary *RunStats    `json:"summary,omitempty"`
+	Diff    *ScanDiff    `json:"diff,omitempty"`
+	Policy  *PolicyCheck `json:"policy,omitempty"`
+}
+
+// loadPreviousReport reads the present hosts of a report written by -o json, with or
+// without -diff
+func loadPreviousReport(path string) (*portSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []HostResult
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var report jsonReport
+		err = json.Unmarshal(trimmed, &report)
+		hosts = report.Hosts
+	} else {
+		err = json.Unmarshal(trimmed, &hosts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: not a JSON report from -o json: %v", path, err)
+	}
+	snapshot := newPortSnapshot()
+	for _, host := range hosts {
+		if host.Error == "" && host.Status != "down" {
+			snapshot.Add(host.Host, host.Results, false)
+		}
+	}
+	return snapshot, nil
+}
+
+// diffSnapshots lists what changed from previous to current. A port only counts as closed
+// if current scanned it on that host, which scanned tells.
+func diffSnapshots(previousPath string, previous, current *portSnapshot, scanned func(host string, key portKey) bool) *ScanDiff {
+	diff := &ScanDiff{Previous: previousPath, NewHosts: []string{}, GoneHosts: []string{}, Opened: []PortChange{}, Closed: []PortChange{}}
+	for _, host := range current.Order {
+		now, before := current.Hosts[host], previous.Hosts[host]
+		if before == nil {
+			diff.NewHosts = append(diff.NewHosts, host)
+			before = &hostPorts{}
+		}
+		for _, key := range sortedPorts(now.Open) {
+			if _, ok := before.Open[key]; !ok {
+				diff.Opened = append(diff.Opened, PortChange{host, key.Port, key.Protocol, now.Open[key]})
+			}
+		}
+		if now.Partial {
+			continue
+		}
+		for _, key := range sortedPorts(before.Open) {
+			if _, ok := now.Open[key]; !ok && scanned(host, key) {
+				diff.Closed = append(diff.Closed, PortChange{host, key.Port, key.Protocol, before.Open[key]})
+			}
+		}
+	}
+	for _, host := range previous.Order {
+		if current.Hosts[host] == nil && !current.Unscanned[host] {
+			diff.GoneHosts = append(diff.GoneHosts, host)
+		}
+	}
+	return diff
+}
+
+// sortedPorts orders ports the way results are reported: TCP before UDP, then by number
+func sortedPorts(ports map[portKey]string) []portKey {
+	keys := make([]portKey, 0, len(ports))
+	for key := range ports {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Protocol != keys[j].Protocol {
+			return keys[i].Protocol < keys[j].Protocol
+		}
+		return keys[i].Port < keys[j].Port
+	})
+	return keys
+}
+
+// writeDiffText renders the changes for text output, e.g. "+ db1: port 8080/tcp is now open (http-alt)"
+func writeDiffText(w io.Writer, diff *ScanDiff) error {
+	if diff.Empty() {
+		_, err := fmt.Fprintf(w, "No changes since %s\n", diff.Previous)
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Changes since %s:\n", diff.Previous)
+	for _, line := range diffLines(diff) {
+		fmt.Fprintln(&buf, line)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// DiffLine is one change in -o jsonl output with -diff, written after every port line
+type DiffLine struct {
+	Change   string `json:"change"`
+	Host     string `json:"host"`
+	Port     int    `json:"port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Service  string `json:"service,omitempty"`
+}
+
+// String renders the change as a line of text output. Besides the changes of a diff,
+// -watch reports the open ports of its first scan with Change "open".
+func (line DiffLine) String() string {
+	switch line.Change {
+	case "new_host":
+		return fmt.Sprintf("+ host %s is new", line.Host)
+	case "gone_host":
+		return fmt.Sprintf("- host %s is gone", line.Host)
+	case "opened":
+		return fmt.Sprintf("+ %s: port %d/%s is now open (%s)", line.Host, line.Port, line.Protocol, line.Service)
+	case "closed":
+		return fmt.Sprintf("- %s: port %d/%s is no longer open (%s)", line.Host, line.Port, line.Protocol, line.Service)
+	}
+	return fmt.Sprintf("= %s: port %d/%s is open (%s)", line.Host, line.Port, line.Protocol, line.Service)
+}
+
+// diffLines lists the changes in report order: new and gone hosts, then opened and closed ports
+func diffLines(diff *ScanDiff) []DiffLine {
+	var lines []DiffLine
+	for _, host := range diff.NewHosts {
+		lines = append(lines, DiffLine{Change: "new_host", Host: host})
+	}
+	for _, host := range diff.GoneHosts {
+		lines = append(lines, DiffLine{Change: "gone_host", Host: host})
+	}
+	for _, change := range diff.Opened {
+		lines = append(lines, DiffLine{"opened", change.Host, change.Port, change.Protocol, change.Service})
+	}
+	for _, change := range diff.Closed {
+		lines = append(lines, DiffLine{"closed", change.Host, change.Port, change.Protocol, change.Service})
+	}
+	return lines
+}
+
+func writeDiffJSONLines(w io.Writer, diff *ScanDiff) error {
+	var buf bytes.Buffer
+	for _, line := range diffLines(diff) {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
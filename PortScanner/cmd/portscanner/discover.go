@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// -sn only runs host discovery and reports which hosts are up, without scanning any ports
+
+// DiscoveryResult is one host in the JSON output of -sn
+type DiscoveryResult struct {
+	Host   string  `json:"host"`
+	IP     string  `json:"ip,omitempty"`
+	Error  string  `json:"error,omitempty"`
+	Status string  `json:"status,omitempty"`
+	Reason string  `json:"reason,omitempty"`
+	RTTMS  float64 `json:"rtt_ms,omitempty"`
+}
+
+var discoveryCSVHeader = []string{"host", "ip", "status", "reason", "rtt_ms"}
+
+// writeDiscovery reports every pinged host in format, which is text, json or csv, with the
+// CSV header or the table heading only if header is set. Hosts that never resolved are only
+// listed in JSON, matching how scans report them; hosts left unpinged by an interrupt are
+// not listed at all.
+func writeDiscovery(w io.Writer, format string, scans []*hostScan, header bool) error {
+	switch format {
+	case "json":
+		results := []DiscoveryResult{}
+		for _, scan := range scans {
+			result := DiscoveryResult{Host: scan.Host, IP: scan.IP}
+			switch {
+			case scan.Err != nil:
+				result.Error = scan.Err.Error()
+			case scan.Discovery == nil:
+				continue
+			default:
+				result.Status, result.Reason = discoveryStatus(scan), scan.Discovery.Reason
+				result.RTTMS = math.Round(float64(scan.Discovery.Latency)/float64(time.Microsecond)) / 1000
+			}
+			results = append(results, result)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	case "csv":
+		csvWriter := csv.NewWriter(w)
+		if header {
+			csvWriter.Write(discoveryCSVHeader)
+		}
+		for _, scan := range scans {
+			if scan.Discovery == nil {
+				continue
+			}
+			rtt := ""
+			if scan.Discovery.Up {
+				rtt = strconv.FormatFloat(float64(scan.Discovery.Latency)/float64(time.Millisecond), 'f', 3, 64)
+			}
+			csvWriter.Write([]string{scan.Host, scan.IP, discoveryStatus(scan), scan.Discovery.Reason, rtt})
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	default:
+		table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		if header {
+			fmt.Fprintln(table, "HOST\tIP\tSTATUS\tREASON\tRTT")
+		}
+		for _, scan := range scans {
+			if scan.Discovery == nil {
+				continue
+			}
+			rtt := "-"
+			if scan.Discovery.Up {
+				rtt = formatLatency(scan.Discovery.Latency)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", scan.Host, scan.IP, discoveryStatus(scan), scan.Discovery.Reason, rtt)
+		}
+		return table.Flush()
+	}
+}
+
+func discoveryStatus(scan *hostScan) string {
+	if scan.Down() {
+		return "down"
+	}
+	return "up"
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// -dry-run works out every address and port a scan would probe, after CIDR expansion and
+// -exclude, and lists them instead of scanning. Hostnames are still resolved, as that is
+// what decides the addresses, but nothing is sent to the targets themselves.
+
+// How many addresses -dry-run lists without -v
+const dryRunSample = 10
+
+// writeDryRun lists the addresses of targets with their ports, only the first
+// dryRunSample of them unless all is set, followed by the totals. It returns how many
+// targets could not be resolved, which are left out of the list.
+func writeDryRun(w io.Writer, targets []*hostScan, ports []int, protocols []string, all bool) (int, error) {
+	var buf strings.Builder
+	listed, addresses, probes, failed := 0, 0, 0, 0
+	hosts := make(map[string]bool)
+	for _, scan := range targets {
+		if scan.Err != nil {
+			failed++
+			continue
+		}
+		hostPorts := ports
+		if scan.Ports != nil {
+			hostPorts = scan.Ports
+		}
+		addresses++
+		hosts[scan.Host] = true
+		probes += len(hostPorts) * len(protocols)
+		if all || listed < dryRunSample {
+			fmt.Fprintf(&buf, "%s: %s/%s\n", hostLabel(scan), formatPortSpec(hostPorts), strings.Join(protocols, ","))
+			listed++
+		}
+	}
+	if listed < addresses {
+		fmt.Fprintf(&buf, "... and %d more address(es), use -v to list them all\n", addresses-listed)
+	}
+	fmt.Fprintf(&buf, "Dry run: %d probe(s) to %d address(es) of %d host(s), nothing was sent\n", probes, addresses, len(hosts))
+	_, err := io.WriteString(w, buf.String())
+	return failed, err
+}
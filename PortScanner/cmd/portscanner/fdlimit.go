@@ -0,0 +1,20 @@
+package main
+
+import "github.com/Bikatr7/KaiTools/PortScanner/scanner"
+
+// fdReserve is how many descriptors are kept back from the workers: standard streams,
+// reports, checkpoints and DNS lookups, and the probes that dial a connection of their own
+const fdReserve = 32 + scanner.DefaultProbeConcurrency
+
+// maxWorkers returns how many workers per host fit in limit open files with parallelism
+// hosts scanned at once, each worker holding one socket; 0 means limit is unknown or too
+// small to say, and never less than 1 otherwise
+func maxWorkers(limit uint64, parallelism int) int {
+	if limit == 0 || limit > 1<<31 {
+		return 0
+	}
+	if limit <= fdReserve {
+		return 1
+	}
+	return max(1, int(limit-fdReserve)/parallelism)
+}
@@ -0,0 +1,8 @@
+//go:build windows || plan9
+
+package main
+
+// openFileLimit returns 0: this platform has no per-process descriptor limit to read
+func openFileLimit() uint64 {
+	return 0
+}
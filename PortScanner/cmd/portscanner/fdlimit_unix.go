@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package main
+
+import "syscall"
+
+// openFileLimit returns the soft limit on open file descriptors, which the Go runtime has
+// already raised to the hard limit at startup, or 0 if it cannot be read
+func openFileLimit() uint64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	return uint64(limit.Cur)
+}
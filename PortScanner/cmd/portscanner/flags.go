@@ -0,0 +1,896 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// scanFlags are the flags of the scan command
+type scanFlags struct {
+	set *flag.FlagSet
+	// explicit names the flags given on the command line or in the -config file
+	explicit map[string]bool
+
+	configFile       string
+	hostsFile        string
+	targetsFile      string
+	strict           bool
+	exclude          string
+	excludeFile      string
+	portsFile        string
+	portSpec         string
+	excludePorts     string
+	topN             int
+	startPort        int
+	endPort          int
+	numWorkers       int
+	hostParallelism  int
+	rate             int
+	retries          int
+	randomize        bool
+	seed             int64
+	timeout          time.Duration
+	adaptiveTimeout  bool
+	minTimeout       time.Duration
+	maxTimeout       time.Duration
+	adaptiveWorkers  bool
+	firstOpen        int
+	timing           string
+	help             bool
+	showAll          bool
+	failOnOpen       bool
+	diffFile         string
+	baselineFile     string
+	watchEvery       time.Duration
+	webhookURL       string
+	webhookHeaders   headerFlags
+	webhookTimeout   time.Duration
+	webhookRequired  bool
+	metricsListen    string
+	dryRun           bool
+	serveAddr        string
+	serveMaxScans    int
+	diffExit         int
+	verbose          bool
+	veryVerbose      bool
+	logFile          string
+	logJSON          bool
+	syslogOn         bool
+	syslogFacility   string
+	syslogTag        string
+	showStats        bool
+	groupResults     bool
+	quiet            bool
+	noProgress       bool
+	deadline         time.Duration
+	progressInterval time.Duration
+	ipv4Only         bool
+	ipv6Only         bool
+	bindAddr         string
+	bindInterface    string
+	sshJumpSpec      string
+	sshKey           string
+	sshKnownHosts    string
+	sshMaxChannels   int
+	allIPs           bool
+	ping             bool
+	pingPortSpec     string
+	skipPing         bool
+	discoverOnly     bool
+	pingTimeout      time.Duration
+	grabBanner       bool
+	bannerTimeout    time.Duration
+	sshProbe         bool
+	sshTimeout       time.Duration
+	dbProbe          bool
+	dbTimeout        time.Duration
+	tlsProbe         bool
+	tlsTimeout       time.Duration
+	tlsSNI           string
+	httpProbe        bool
+	httpTimeout      time.Duration
+	httpPortSpec     string
+	followRedirects  bool
+	outFile          string
+	checkpointFile   string
+	resumeFile       string
+	appendOut        bool
+	force            bool
+	proto            string
+	colorMode        string
+	noColor          bool
+	outputFormat     string
+	templateFlag     string
+	templateHost     bool
+	maxHosts         int
+	allowLarge       bool
+	includeBroadcast bool
+
+	// Worked out by parse and validate from the flags above
+	effectiveTiming timingSettings
+	timingName      string
+	pingPorts       []int
+	pingConcurrency int
+	httpPorts       []int
+	ipVersion       string
+	localAddr       net.IP
+	protocols       []string
+	outTemplate     *outputTemplate
+	hook            *webhook
+}
+
+func newScanFlags(prog string) *scanFlags {
+	set := flag.NewFlagSet(prog, flag.ContinueOnError)
+	f := &scanFlags{set: set}
+	set.StringVar(&f.configFile, "config", "", "JSON or TOML file with defaults for workers, timeout, start_port, end_port, ports and format (flags on the command line win)")
+	set.StringVar(&f.hostsFile, "f", "", "File containing list of hosts to scan, or - for stdin")
+	set.StringVar(&f.targetsFile, "targets", "", "File of host:port lines to scan, each pair once, instead of hosts and ports, or - for stdin")
+	set.BoolVar(&f.strict, "strict", false, "Stop before scanning if a line of the hosts file, -targets file or stdin is not a valid host, instead of skipping it")
+	set.StringVar(&f.exclude, "exclude", "", "Comma-separated hosts, IPs and CIDRs to leave out of the scan")
+	set.StringVar(&f.excludeFile, "exclude-file", "", "File containing hosts, IPs and CIDRs to leave out of the scan")
+	set.StringVar(&f.portsFile, "P", "", "File containing list of ports to scan")
+	set.StringVar(&f.portSpec, "ports", "", "Comma-separated ports and ranges to scan, e.g. 22,80,443,8000-8100")
+	set.StringVar(&f.excludePorts, "exclude-ports", "", "Ports and ranges to leave out of the scan, in the same format as -ports")
+	set.IntVar(&f.topN, "top-ports", 0, fmt.Sprintf("Scan the N most common TCP ports (up to %d) instead of a range", len(topTCPPorts)))
+	set.IntVar(&f.topN, "top", 0, "Same as -top-ports")
+	set.IntVar(&f.startPort, "p", 1, "Start port for scanning (default: 1)")
+	set.IntVar(&f.endPort, "e", 65535, "End port for scanning (default: 65535)")
+	set.IntVar(&f.numWorkers, "w", 100, "Number of worker goroutines (default: 100)")
+	set.IntVar(&f.hostParallelism, "host-parallelism", 1, "Number of hosts to scan at the same time, each with its own -w workers (default: 1)")
+	set.IntVar(&f.rate, "rate", 0, "Maximum connection attempts per second across all workers, 0 for unlimited (default: 0)")
+	set.IntVar(&f.retries, "retries", 0, "Number of times to retry a port whose connection attempt timed out (default: 0)")
+	set.BoolVar(&f.randomize, "randomize", false, "Probe ports in a random order instead of ascending (output is still sorted)")
+	set.Int64Var(&f.seed, "seed", 0, "Seed for -randomize so the port order can be reproduced, 0 for a new order every scan (default: 0)")
+	set.DurationVar(&f.timeout, "t", 1*time.Second, "Connection timeout per port, e.g. 300ms or 2s (default: 1s)")
+	set.BoolVar(&f.adaptiveTimeout, "adaptive-timeout", false, "Set the timeout per port to 4x the measured round-trip time to each host, within -min-timeout and -max-timeout (-t is used until the host answers)")
+	set.DurationVar(&f.minTimeout, "min-timeout", scanner.DefaultMinTimeout, "Lower bound for -adaptive-timeout (default: 100ms)")
+	set.DurationVar(&f.maxTimeout, "max-timeout", scanner.DefaultMaxTimeout, "Upper bound for -adaptive-timeout (default: 10s)")
+	set.BoolVar(&f.adaptiveWorkers, "adaptive", false, "Treat -w as a ceiling and adjust the concurrent probes per host to its latency and timeouts, starting at a quarter of -w")
+	set.IntVar(&f.firstOpen, "first-open", 0, "Stop scanning a host once this many open ports are found and move on to the next, 0 to scan every port (default: 0)")
+	set.StringVar(&f.timing, "timing", "", "Timing template setting -w, -t, -retries and -rate together: paranoid, sneaky, polite, normal, aggressive, insane or 0-5 (explicit flags still win)")
+	set.BoolVar(&f.help, "h", false, "Show help")
+	set.BoolVar(&f.showAll, "a", false, "Show all ports (including closed)")
+	set.BoolVar(&f.failOnOpen, "fail-on-open", false, "Check that hosts are fully closed: exit with status 3 if any open port is found, 0 if none are, 2 if a host is unresolvable or unreachable and 1 for usage errors")
+	set.StringVar(&f.diffFile, "diff", "", "Compare with this earlier -o json report and only report what changed: new and gone hosts, newly open and newly closed ports")
+	set.StringVar(&f.baselineFile, "baseline", "", "Check every host against this YAML or JSON policy of the ports it should have open, reporting unexpected open and expected but closed ports, and exit with status 6 on any violation")
+	set.DurationVar(&f.watchEvery, "watch", 0, "Scan again every interval, e.g. 5m, printing only what changed since the scan before, until Ctrl+C (text or jsonl output)")
+	set.StringVar(&f.webhookURL, "webhook", "", "POST the JSON report to this URL once the scan is done; only the changes with -diff, and after every scan that found any with -watch")
+	set.Var(&f.webhookHeaders, "webhook-header", "Header to send with -webhook, e.g. \"Authorization: Bearer x\" (repeatable)")
+	set.DurationVar(&f.webhookTimeout, "webhook-timeout", defaultWebhookTimeout, "How long each -webhook attempt may take (default: 10s)")
+	set.BoolVar(&f.webhookRequired, "webhook-required", false, "Exit with status 3 when -webhook cannot be delivered, instead of only logging it")
+	set.StringVar(&f.metricsListen, "metrics-listen", "", "Serve Prometheus metrics about the scan on this address, e.g. :9090, at /metrics until the run ends")
+	set.StringVar(&f.metricsListen, "metrics", "", "Same as -metrics-listen")
+	set.BoolVar(&f.dryRun, "dry-run", false, "List the addresses and ports the scan would probe, after CIDR expansion and exclusions, without scanning (the first 10 addresses, or all of them with -v)")
+	set.StringVar(&f.serveAddr, "serve", "", "Run as an HTTP service on this address, e.g. :8080, scanning one host per POST /scan request instead of the command line targets")
+	set.IntVar(&f.serveMaxScans, "serve-max-scans", defaultServeMaxScans, "Number of -serve requests scanned at the same time; more are answered with 503 (default: 4)")
+	set.IntVar(&f.diffExit, "diff-exit-code", exitNewOpenPorts, "Exit status for -diff when a port is open that was not before, 0 to always exit 0 (default: 5)")
+	set.BoolVar(&f.verbose, "v", false, "Verbose: log host resolution, each host's scan and its timings to stderr, and show when each port was probed")
+	set.BoolVar(&f.veryVerbose, "vv", false, "More verbose: everything -v logs, plus every connection attempt and its error")
+	set.StringVar(&f.logFile, "log-file", "", "Also append the -v/-vv log to this file")
+	set.BoolVar(&f.logJSON, "log-json", false, "Write the -v/-vv log as JSON lines instead of key=value text")
+	set.BoolVar(&f.syslogOn, "syslog", false, "Also send every open port to the system log as it is found, or every change with -watch (not available on Windows)")
+	set.StringVar(&f.syslogFacility, "syslog-facility", defaultSyslogFacility, "Syslog facility for -syslog, e.g. daemon or local0 (default: user)")
+	set.StringVar(&f.syslogTag, "syslog-tag", defaultSyslogTag, "Tag for -syslog messages (default: portscanner)")
+	set.BoolVar(&f.showStats, "stats", false, "Finish with a summary of the whole run: hosts scanned, open ports, the ports open on the most hosts and the hosts with the most open ports (also a \"summary\" object in -o json)")
+	set.BoolVar(&f.groupResults, "group", false, "Group each host's ports in text output by kind of service: web, db, mail, remote-access and other")
+	set.BoolVar(&f.quiet, "q", false, "Quiet: only print port results and errors, without host headers or summaries")
+	set.BoolVar(&f.noProgress, "no-progress", false, "Disable the progress display on stderr")
+	set.DurationVar(&f.deadline, "deadline", 0, "Stop the whole run after this long, e.g. 30m, and report what was found so far (default: no limit)")
+	set.DurationVar(&f.progressInterval, "progress-interval", time.Second, "How often to update the progress display (default: 1s)")
+	set.BoolVar(&f.ipv4Only, "4", false, "Only scan over IPv4 when a hostname resolves to both families")
+	set.BoolVar(&f.ipv6Only, "6", false, "Only scan over IPv6 when a hostname resolves to both families")
+	set.StringVar(&f.bindAddr, "bind", "", "Send every probe from this local IP address, e.g. to pick the interface on a multi-homed host (default: chosen by the routing table)")
+	set.StringVar(&f.bindAddr, "source-ip", "", "Same as -bind")
+	set.StringVar(&f.bindInterface, "interface", "", "Send every probe out through this network interface, e.g. eth1 (Linux only, needs root or CAP_NET_RAW)")
+	set.StringVar(&f.sshJumpSpec, "ssh-jump", "", "Dial every TCP port from this SSH server, [user@]host[:port], so results show what it can reach (TCP only; logs in with ssh-agent or -ssh-key)")
+	set.StringVar(&f.sshKey, "ssh-key", "", "Private key to log in to the -ssh-jump host with instead of ssh-agent")
+	set.StringVar(&f.sshKnownHosts, "ssh-known-hosts", defaultKnownHosts(), "known_hosts file the -ssh-jump host key is checked against (default: ~/.ssh/known_hosts)")
+	set.IntVar(&f.sshMaxChannels, "ssh-max-channels", 10, "Most ports dialed through the -ssh-jump connection at once; -w is lowered to fit (default: 10)")
+	set.BoolVar(&f.allIPs, "all-ips", false, "Scan every address a hostname resolves to instead of only the first")
+	set.BoolVar(&f.ping, "ping", false, "Check that each host is up with an ICMP echo (when privileged) and TCP connects to the -ping-ports, and skip hosts that do not answer")
+	set.StringVar(&f.pingPortSpec, "ping-ports", "80,443,22", "Ports host discovery connects to, in the same format as -ports")
+	set.BoolVar(&f.skipPing, "skip-ping", false, "Scan every host without checking that it is up first, even if -ping is given")
+	set.BoolVar(&f.discoverOnly, "sn", false, "Only run host discovery and print which hosts are up, without scanning ports (text, json or csv output)")
+	set.BoolVar(&f.discoverOnly, "discover", false, "Same as -sn")
+	set.BoolVar(&f.discoverOnly, "sweep", false, "Same as -sn")
+	set.DurationVar(&f.pingTimeout, "ping-timeout", time.Second, "How long host discovery waits for a host to answer (default: 1s)")
+	// Service names are always shown now; the flag is only kept so existing scripts keep working
+	set.Bool("services", false, "Deprecated: service names are always shown")
+	set.BoolVar(&f.grabBanner, "banner", false, "Read the first bytes sent by open TCP ports")
+	set.DurationVar(&f.bannerTimeout, "banner-timeout", 2*time.Second, "How long to wait for a banner on open ports (default: 2s)")
+	set.BoolVar(&f.sshProbe, "ssh-probe", false, "Read the version and offered algorithms of SSH servers on port 22 and ports whose banner is SSH")
+	set.DurationVar(&f.sshTimeout, "ssh-timeout", 2*time.Second, "How long an SSH server gets to identify itself and list its algorithms for -ssh-probe (default: 2s)")
+	set.BoolVar(&f.dbProbe, "db-probe", false, "Read the product, version and authentication of MySQL, PostgreSQL, Redis and MongoDB on their default ports")
+	set.DurationVar(&f.dbTimeout, "db-timeout", 3*time.Second, "How long each -db-probe handshake may take (default: 3s)")
+	set.BoolVar(&f.tlsProbe, "tls-probe", false, "Try a TLS handshake on open TCP ports and report the version, cipher and certificate")
+	set.DurationVar(&f.tlsTimeout, "tls-timeout", 2*time.Second, "How long an open port gets to complete the -tls-probe handshake (default: 2s)")
+	set.StringVar(&f.tlsSNI, "tls-sni", "", "Server name to send in the -tls-probe handshake (default: the target's hostname)")
+	set.BoolVar(&f.httpProbe, "http-probe", false, "Send GET / to open TCP ports and report the status, Server header, content length and page title")
+	set.DurationVar(&f.httpTimeout, "http-timeout", 3*time.Second, "How long an open port gets to answer the -http-probe request, per scheme tried (default: 3s)")
+	set.StringVar(&f.httpPortSpec, "http-ports", formatPortSpec(scanner.DefaultHTTPPorts), "Open ports -http-probe sends its request to, in the same format as -ports")
+	set.BoolVar(&f.followRedirects, "follow-redirects", false, "Follow up to 5 redirects in -http-probe instead of reporting the redirect")
+	set.StringVar(&f.outFile, "out", "", "Also write the scan report to this file, in the -o format, while the console shows the usual text output")
+	set.StringVar(&f.outFile, "output", "", "Same as -out")
+	set.StringVar(&f.checkpointFile, "checkpoint", "", "Record every probed port in this file, so an interrupted scan can be continued with -resume")
+	set.StringVar(&f.resumeFile, "resume", "", "Continue the scan recorded in this -checkpoint file, skipping the ports it covers (keeps recording to it unless -checkpoint names another file)")
+	set.BoolVar(&f.appendOut, "append", false, "Add the report to the end of an existing -out file (text, jsonl, csv, grep and list only)")
+	set.BoolVar(&f.force, "force", false, "Overwrite an existing -out file")
+	set.StringVar(&f.proto, "proto", "tcp", "Protocol to scan: tcp, udp or both (default: tcp)")
+	set.StringVar(&f.colorMode, "color", "auto", "Color port states and host headers in text output: auto (only when stdout is a terminal and NO_COLOR is unset), always or never (default: auto)")
+	set.BoolVar(&f.noColor, "no-color", false, "Same as -color never")
+	set.StringVar(&f.outputFormat, "o", "text", "Output format: text, json, jsonl (one object per port as it is found), csv, xml or grep (nmap-compatible), html (a report page), markdown, or list (just host:port of each open port) (default: text)")
+	set.StringVar(&f.outputFormat, "format", "text", "Same as -o")
+	set.StringVar(&f.templateFlag, "template", "", "Write each reported port through this Go text/template, or the template in this file, instead of an -o format, e.g. '{{.Host}}:{{.Port}} {{.Service}}'")
+	set.BoolVar(&f.templateHost, "template-host", false, "Run -template once per host, with the host's ports in .Results, instead of once per port")
+	set.IntVar(&f.maxHosts, "max-hosts", 65536, "Maximum number of hosts a single CIDR target may expand to (default: 65536)")
+	set.BoolVar(&f.allowLarge, "allow-large", false, "Allow CIDR targets larger than -max-hosts (up to a /8)")
+	set.BoolVar(&f.includeBroadcast, "include-broadcast", false, "Include network and broadcast addresses when expanding IPv4 CIDR targets")
+
+	set.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n")
+		fmt.Fprintf(os.Stderr, "  %s [flags] <host|cidr|range>[,...]\n", prog)
+		fmt.Fprintf(os.Stderr, "  %s [flags] -f <hosts_file>\n", prog)
+		fmt.Fprintf(os.Stderr, "  <host list> | %s [flags] [-f -]\n\n", prog)
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		set.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  Scan a single host with default settings:\n")
+		fmt.Fprintf(os.Stderr, "    %s example.com\n\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan a single host with a specific port range:\n")
+		fmt.Fprintf(os.Stderr, "    %s -p 80 -e 443 example.com\n\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan multiple hosts from a file:\n")
+		fmt.Fprintf(os.Stderr, "    %s -f hosts.txt\n\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan multiple hosts from a file with custom settings:\n")
+		fmt.Fprintf(os.Stderr, "    %s -f hosts.txt -p 1 -e 1024 -w 200\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan up to 5 hosts from a file at the same time:\n")
+		fmt.Fprintf(os.Stderr, "    %s -f hosts.txt -host-parallelism 5 -p 1 -e 1024\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan a single host with ports from a file:\n")
+		fmt.Fprintf(os.Stderr, "    %s -P ports.txt example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan only the host:port pairs listed in a file:\n")
+		fmt.Fprintf(os.Stderr, "    %s -targets services.txt\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan a list of ports and ranges:\n")
+		fmt.Fprintf(os.Stderr, "    %s -ports 22,80,443,8000-8100 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan every port except SSH and a noisy range:\n")
+		fmt.Fprintf(os.Stderr, "    %s -exclude-ports 22,6000-6100 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan only the 100 most common TCP ports:\n")
+		fmt.Fprintf(os.Stderr, "    %s -top-ports 100 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan the 1000 most common TCP ports across a subnet:\n")
+		fmt.Fprintf(os.Stderr, "    %s -top 1000 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan every usable address in a subnet:\n")
+		fmt.Fprintf(os.Stderr, "    %s -p 1 -e 1024 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan a host and print the results as JSON:\n")
+		fmt.Fprintf(os.Stderr, "    %s -o json -p 1 -e 1024 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Save a JSON report to disk while watching the scan:\n")
+		fmt.Fprintf(os.Stderr, "    %s -o json -out report.json -p 1 -e 1024 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Write an nmap-compatible XML report for other tools to import:\n")
+		fmt.Fprintf(os.Stderr, "    %s -o xml -out scan.xml -top-ports 100 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Write a report page to open in a browser, with every port and its banner:\n")
+		fmt.Fprintf(os.Stderr, "    %s -o html -out report.html -a -banner -top-ports 100 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Write the open ports as Markdown tables to paste into an issue:\n")
+		fmt.Fprintf(os.Stderr, "    %s -o markdown -banner -top-ports 100 -f hosts.txt\n", prog)
+		fmt.Fprintf(os.Stderr, "  Print host:port for every open port, in any shape another tool wants:\n")
+		fmt.Fprintf(os.Stderr, "    %s -template '{{.Host}}:{{.Port}} {{.Service}} {{.Latency}}' -top-ports 100 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Print one line per host listing its open ports, from a template kept in a file:\n")
+		fmt.Fprintf(os.Stderr, "    echo '{{.Host}}:{{range .Results}} {{.Port}}/{{.Protocol}}{{end}}' > hosts.tmpl\n")
+		fmt.Fprintf(os.Stderr, "    %s -template hosts.tmpl -template-host -f hosts.txt\n", prog)
+		fmt.Fprintf(os.Stderr, "  List the open ports of every host on one line each for grep and awk:\n")
+		fmt.Fprintf(os.Stderr, "    %s -o grep -top-ports 100 192.168.1.0/24 | grep /open/\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan hosts from a file and write the results as CSV:\n")
+		fmt.Fprintf(os.Stderr, "    %s -o csv -f hosts.txt -p 1 -e 1024 > results.csv\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan a host over IPv6 only:\n")
+		fmt.Fprintf(os.Stderr, "    %s -6 -p 1 -e 1024 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "    %s -p 1 -e 1024 [::1]\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan a subnet but leave out the gateway and the upper half:\n")
+		fmt.Fprintf(os.Stderr, "    %s -exclude 192.168.1.1,192.168.1.128/25 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Check what a scan would probe before running it:\n")
+		fmt.Fprintf(os.Stderr, "    %s -dry-run -v -exclude 10.0.0.0/24 -top-ports 100 10.0.0.0/16\n", prog)
+		fmt.Fprintf(os.Stderr, "  Probe ports in a random order, reproducibly:\n")
+		fmt.Fprintf(os.Stderr, "    %s -randomize -seed 1234 -p 1 -e 1024 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan every address behind a load-balanced hostname:\n")
+		fmt.Fprintf(os.Stderr, "    %s -all-ips -ports 80,443 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Print only open ports, e.g. for piping into other tools:\n")
+		fmt.Fprintf(os.Stderr, "    %s -q -top-ports 100 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Log every connection attempt and its error:\n")
+		fmt.Fprintf(os.Stderr, "    %s -v -ports 22,80,443 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Send open ports to syslog under the local3 facility:\n")
+		fmt.Fprintf(os.Stderr, "    %s -syslog -syslog-facility local3 -top-ports 100 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Check which hosts of a subnet have any web port open, without probing the rest:\n")
+		fmt.Fprintf(os.Stderr, "    %s -first-open 1 -ports 80,443,8080,8443 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan common UDP services:\n")
+		fmt.Fprintf(os.Stderr, "    %s -proto udp -ports 53,123,161 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Find which open ports speak TLS and when their certificates expire:\n")
+		fmt.Fprintf(os.Stderr, "    %s -tls-probe -ports 443,465,993,8443 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Check SSH servers for deprecated algorithms:\n")
+		fmt.Fprintf(os.Stderr, "    %s -ssh-probe -ports 22 -f hosts.txt\n", prog)
+		fmt.Fprintf(os.Stderr, "  See what the web servers of a subnet answer, with their page titles:\n")
+		fmt.Fprintf(os.Stderr, "    %s -http-probe -ports 80,443,8000-8100,8443 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Capture service banners from open ports:\n")
+		fmt.Fprintf(os.Stderr, "    %s -banner -ports 21,22,25 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Use many workers but cap the scan at 50 connections per second:\n")
+		fmt.Fprintf(os.Stderr, "    %s -w 500 -rate 50 -p 1 -e 1024 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan slowly with the polite timing template, but with a longer timeout:\n")
+		fmt.Fprintf(os.Stderr, "    %s -timing polite -t 5s -top-ports 100 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  List the live hosts of a subnet without scanning ports:\n")
+		fmt.Fprintf(os.Stderr, "    %s -sn 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Skip hosts that do not answer a ping before scanning a list:\n")
+		fmt.Fprintf(os.Stderr, "    %s -ping -f hosts.txt -top-ports 100\n", prog)
+		fmt.Fprintf(os.Stderr, "  Retry failed ports twice on a congested network:\n")
+		fmt.Fprintf(os.Stderr, "    %s -retries 2 -p 1 -e 1024 example.com\n", prog)
+		fmt.Fprintf(os.Stderr, "  Check hosts against a policy of the ports they should have open:\n")
+		fmt.Fprintf(os.Stderr, "    %s -baseline policy.yaml -top-ports 1000 -f hosts.txt\n", prog)
+		fmt.Fprintf(os.Stderr, "  Rescan the hosts in a file every 5 minutes and POST every change to a webhook:\n")
+		fmt.Fprintf(os.Stderr, "    %s -watch 5m -webhook https://hooks.example.com/ports -top-ports 1000 -f hosts.txt\n", prog)
+		fmt.Fprintf(os.Stderr, "  Serve scans over HTTP, e.g. curl -X POST localhost:8080/scan -d '{\"host\": \"example.com\"}':\n")
+		fmt.Fprintf(os.Stderr, "    %s -serve :8080 -top-ports 100\n", prog)
+		fmt.Fprintf(os.Stderr, "  Expose Prometheus metrics on :9090/metrics while scanning every port of a subnet:\n")
+		fmt.Fprintf(os.Stderr, "    %s -metrics-listen :9090 -p 1 -e 65535 192.168.1.0/24\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan a range, a subnet and a host given as one comma-separated target:\n")
+		fmt.Fprintf(os.Stderr, "    %s -top-ports 100 192.168.1.1-50,10.0.0.0/24,db.internal\n", prog)
+		fmt.Fprintf(os.Stderr, "  Scan a LAN host with a short connection timeout:\n")
+		fmt.Fprintf(os.Stderr, "    %s -t 200ms 192.168.1.10\n", prog)
+		fmt.Fprintf(os.Stderr, "\nNotes:\n")
+		fmt.Fprintf(os.Stderr, "  UDP detection is inherently unreliable. A UDP port is only reported open when it replies\n")
+		fmt.Fprintf(os.Stderr, "  and closed when the host answers with ICMP port unreachable. Silence within the timeout\n")
+		fmt.Fprintf(os.Stderr, "  is reported as open|filtered, and rate-limited ICMP can make closed ports look the same.\n")
+		fmt.Fprintf(os.Stderr, "\nExit status:\n")
+		fmt.Fprintf(os.Stderr, "  0 if any open port was found, 1 if none were, 2 for usage errors, 3 for runtime errors\n")
+		fmt.Fprintf(os.Stderr, "  such as unresolvable hosts, 124 when -deadline passed and 130 when interrupted. With -diff,\n")
+		fmt.Fprintf(os.Stderr, "  5 if a port opened since the previous report, and with -baseline, 6 if any host broke the\n")
+		fmt.Fprintf(os.Stderr, "  policy. -watch and -serve exit 0 when stopped with Ctrl+C, and -webhook-required exits 3\n")
+		fmt.Fprintf(os.Stderr, "  when the -webhook cannot be delivered.\n")
+		fmt.Fprintf(os.Stderr, "  -fail-on-open replaces these with: 0 if the scan completed and nothing was open, 1 for\n")
+		fmt.Fprintf(os.Stderr, "  usage errors, 2 if a host was unresolvable or unreachable and 3 if any open port was\n")
+		fmt.Fprintf(os.Stderr, "  found; 124 and 130 are kept.\n")
+	}
+	return f
+}
+
+// parse reads args, then applies the -config file and the -timing template to the flags
+// that were not given. ok is false when the command should stop with code: after -h, or on
+// a usage error, which has been reported.
+func (f *scanFlags) parse(args []string) (code int, ok bool) {
+	if err := f.set.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return exitUsage, false
+	}
+
+	if f.help {
+		f.set.Usage()
+		return 0, false
+	}
+
+	// Flags given on the command line win over both the config file and a timing template
+	f.explicit = make(map[string]bool)
+	f.set.Visit(func(given *flag.Flag) { f.explicit[given.Name] = true })
+	if f.configFile != "" {
+		values, err := loadConfig(f.configFile)
+		if err != nil {
+			fmt.Printf("Error reading config: %v\n", err)
+			return exitUsage, false
+		}
+		if err := applyConfig(f.set, values, f.explicit); err != nil {
+			fmt.Printf("Error in config %s: %v\n", f.configFile, err)
+			return exitUsage, false
+		}
+	}
+
+	// A timing template replaces the defaults of the flags it covers, before they are validated
+	f.effectiveTiming = timingSettings{Workers: f.numWorkers, Timeout: f.timeout, Retries: f.retries, Rate: f.rate}
+	if f.timing != "" {
+		name, template, err := lookupTiming(f.timing)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return exitUsage, false
+		}
+		f.effectiveTiming = resolveTiming(template, f.effectiveTiming, f.explicit)
+		f.timingName = name
+		f.numWorkers, f.timeout, f.retries, f.rate = f.effectiveTiming.Workers, f.effectiveTiming.Timeout, f.effectiveTiming.Retries, f.effectiveTiming.Rate
+	}
+	return 0, true
+}
+
+// validate reports the first invalid flag or combination of flags, and works out the
+// values the flags stand for. It returns false when the command should stop with exitUsage.
+func (f *scanFlags) validate() bool {
+	if f.topN < 0 || f.topN > len(topTCPPorts) {
+		fmt.Printf("Error: -top/-top-ports must be between 1 and %d\n", len(topTCPPorts))
+		return false
+	}
+
+	// A range counts as given when -p or -e is, even at its default, or a config file moved it
+	rangeGiven := f.explicit["p"] || f.explicit["e"] || f.startPort != 1 || f.endPort != 65535
+
+	if f.topN > 0 && (f.portSpec != "" || f.portsFile != "" || rangeGiven) {
+		fmt.Println("Invalid port configuration. -top/-top-ports cannot be combined with -p/-e, -P or -ports.")
+		return false
+	}
+
+	if f.portSpec != "" && (f.portsFile != "" || rangeGiven) {
+		fmt.Println("Invalid port configuration. -ports cannot be combined with -p/-e or -P.")
+		return false
+	}
+
+	if (f.portsFile == "" && (f.startPort < 1 || f.startPort > 65535 || f.endPort < 1 || f.endPort > 65535 || f.startPort > f.endPort)) ||
+		(f.portsFile != "" && rangeGiven) {
+		fmt.Println("Invalid port configuration. Provide a valid port range with -p and -e or use -P to specify a ports file.")
+		return false
+	}
+
+	if f.targetsFile != "" {
+		switch {
+		case f.hostsFile != "" || f.set.NArg() > 0:
+			fmt.Println("Error: -targets cannot be combined with -f or a host argument")
+			return false
+		case f.topN > 0 || f.portSpec != "" || f.portsFile != "" || rangeGiven || f.excludePorts != "":
+			fmt.Println("Invalid port configuration. -targets lists the ports itself and cannot be combined with -p/-e, -P, -ports, -top-ports or -exclude-ports.")
+			return false
+		case f.discoverOnly:
+			fmt.Println("Error: -targets cannot be used with -sn, which does not scan ports")
+			return false
+		}
+	}
+
+	if f.numWorkers <= 0 {
+		fmt.Println("Error: Number of workers must be greater than 0")
+		return false
+	}
+
+	if f.rate < 0 {
+		fmt.Println("Error: Rate cannot be negative")
+		return false
+	}
+
+	if f.retries < 0 {
+		fmt.Println("Error: Number of retries cannot be negative")
+		return false
+	}
+
+	if f.firstOpen < 0 {
+		fmt.Println("Error: -first-open cannot be negative")
+		return false
+	}
+
+	if f.deadline < 0 {
+		fmt.Println("Error: -deadline cannot be negative")
+		return false
+	}
+
+	switch {
+	case (f.explicit["min-timeout"] || f.explicit["max-timeout"]) && !f.adaptiveTimeout:
+		fmt.Println("Error: -min-timeout and -max-timeout only apply together with -adaptive-timeout")
+		return false
+	case f.minTimeout <= 0 || f.maxTimeout <= 0:
+		fmt.Println("Error: -min-timeout and -max-timeout must be greater than 0")
+		return false
+	case f.minTimeout > f.maxTimeout:
+		fmt.Printf("Error: -min-timeout %s is above -max-timeout %s\n", f.minTimeout, f.maxTimeout)
+		return false
+	}
+
+	if f.hostParallelism <= 0 {
+		fmt.Println("Error: Host parallelism must be greater than 0")
+		return false
+	}
+
+	if f.timeout <= 0 {
+		fmt.Println("Error: Timeout must be a positive duration (e.g. 500ms, 2s)")
+		return false
+	}
+
+	if f.progressInterval <= 0 {
+		fmt.Println("Error: Progress interval must be a positive duration (e.g. 500ms, 2s)")
+		return false
+	}
+
+	if f.explicit["ping-ports"] && !f.ping && !f.discoverOnly {
+		fmt.Println("Error: -ping-ports only applies together with -ping or -sn")
+		return false
+	}
+	var err error
+	f.pingPorts, err = parsePortSpec(f.pingPortSpec)
+	if err != nil {
+		fmt.Printf("Error parsing ping ports: %v\n", err)
+		return false
+	}
+
+	if f.pingTimeout <= 0 {
+		fmt.Println("Error: Ping timeout must be a positive duration (e.g. 500ms, 2s)")
+		return false
+	}
+	// A ping sweep has no ports to spend -w and -t on, so they size the sweep instead
+	f.pingConcurrency = maxConcurrentPings
+	if f.discoverOnly {
+		if f.explicit["t"] && f.explicit["ping-timeout"] {
+			fmt.Println("Error: -t and -ping-timeout cannot be used together with -sn, where -t is the ping timeout")
+			return false
+		}
+		if f.explicit["t"] {
+			f.pingTimeout = f.timeout
+		}
+		if f.explicit["w"] {
+			f.pingConcurrency = f.numWorkers
+		}
+	}
+
+	if f.bannerTimeout <= 0 {
+		fmt.Println("Error: Banner timeout must be a positive duration (e.g. 500ms, 2s)")
+		return false
+	}
+	if f.sshProbe {
+		if f.sshTimeout <= 0 {
+			fmt.Println("Error: -ssh-timeout must be a positive duration (e.g. 500ms, 2s)")
+			return false
+		}
+	} else if f.explicit["ssh-timeout"] {
+		fmt.Println("Error: -ssh-timeout only applies together with -ssh-probe")
+		return false
+	}
+	if f.dbProbe {
+		if f.dbTimeout <= 0 {
+			fmt.Println("Error: -db-timeout must be a positive duration (e.g. 500ms, 2s)")
+			return false
+		}
+	} else if f.explicit["db-timeout"] {
+		fmt.Println("Error: -db-timeout only applies together with -db-probe")
+		return false
+	}
+	if f.tlsProbe {
+		if f.tlsTimeout <= 0 {
+			fmt.Println("Error: -tls-timeout must be a positive duration (e.g. 500ms, 2s)")
+			return false
+		}
+	} else if f.explicit["tls-timeout"] || f.tlsSNI != "" {
+		fmt.Println("Error: -tls-timeout and -tls-sni only apply together with -tls-probe")
+		return false
+	}
+	if f.httpProbe {
+		if f.httpTimeout <= 0 {
+			fmt.Println("Error: -http-timeout must be a positive duration (e.g. 500ms, 2s)")
+			return false
+		}
+		if f.httpPorts, err = parsePortSpec(f.httpPortSpec); err != nil {
+			fmt.Printf("Error parsing HTTP ports: %v\n", err)
+			return false
+		}
+	} else if f.explicit["http-timeout"] || f.explicit["http-ports"] || f.followRedirects {
+		fmt.Println("Error: -http-timeout, -http-ports and -follow-redirects only apply together with -http-probe")
+		return false
+	}
+
+	if f.seed != 0 && !f.randomize {
+		fmt.Println("Error: -seed only applies together with -randomize")
+		return false
+	}
+
+	if (f.verbose || f.veryVerbose) && f.quiet {
+		fmt.Println("Error: -v and -q cannot be used together")
+		return false
+	}
+	if (f.logFile != "" || f.logJSON) && !f.verbose && !f.veryVerbose {
+		fmt.Println("Error: -log-file and -log-json only apply together with -v or -vv")
+		return false
+	}
+	if (f.explicit["syslog-facility"] || f.explicit["syslog-tag"]) && !f.syslogOn {
+		fmt.Println("Error: -syslog-facility and -syslog-tag only apply together with -syslog")
+		return false
+	}
+
+	if f.ipv4Only && f.ipv6Only {
+		fmt.Println("Error: -4 and -6 cannot be used together")
+		return false
+	}
+	if f.ipv4Only {
+		f.ipVersion = "4"
+	} else if f.ipv6Only {
+		f.ipVersion = "6"
+	}
+	if f.bindAddr != "" {
+		bindFlag := "-bind"
+		if f.explicit["source-ip"] {
+			bindFlag = "-source-ip"
+		}
+		f.localAddr, err = localIP(f.bindAddr)
+		if err != nil {
+			fmt.Printf("Error: invalid %s address: %v\n", bindFlag, err)
+			return false
+		}
+		if family := ipFamily(f.localAddr); f.ipVersion != "" && f.ipVersion != family {
+			fmt.Printf("Error: %s %s is an IPv%s address, so it cannot be combined with -%s\n", bindFlag, f.bindAddr, family, f.ipVersion)
+			return false
+		}
+	}
+	if f.bindInterface != "" {
+		if !scanner.CanBindInterface {
+			fmt.Printf("Error: -interface is not supported on %s\n", runtime.GOOS)
+			return false
+		}
+		if err := checkInterface(f.bindInterface, f.localAddr); err != nil {
+			fmt.Printf("Error: invalid -interface: %v\n", err)
+			return false
+		}
+	}
+
+	switch f.proto {
+	case "tcp", "udp":
+		f.protocols = []string{f.proto}
+	case "both":
+		f.protocols = []string{"tcp", "udp"}
+	default:
+		fmt.Printf("Error: Unknown protocol %q (expected tcp, udp or both)\n", f.proto)
+		return false
+	}
+	if f.sshJumpSpec != "" {
+		switch {
+		case f.proto != "tcp":
+			fmt.Println("Error: -ssh-jump only scans TCP, so it cannot be used with -proto udp or both")
+			return false
+		case f.bindAddr != "" || f.bindInterface != "":
+			fmt.Println("Error: -ssh-jump cannot be combined with -bind, -source-ip or -interface, since probes leave from the jump host")
+			return false
+		case f.sshMaxChannels <= 0:
+			fmt.Println("Error: -ssh-max-channels must be greater than 0")
+			return false
+		}
+		if _, _, err := parseJump(f.sshJumpSpec); err != nil {
+			fmt.Printf("Error: invalid -ssh-jump: %v\n", err)
+			return false
+		}
+	} else {
+		for _, name := range []string{"ssh-key", "ssh-known-hosts", "ssh-max-channels"} {
+			if f.explicit[name] {
+				fmt.Printf("Error: -%s only applies together with -ssh-jump\n", name)
+				return false
+			}
+		}
+	}
+
+	// "template" is not an -o format of its own but what -template selects
+	if _, ok := reportFormats[f.outputFormat]; !ok || f.outputFormat == "template" {
+		fmt.Printf("Error: Unknown output format %q (expected text, json, jsonl, csv, xml, grep, html, markdown or list)\n", f.outputFormat)
+		return false
+	}
+	if f.templateFlag != "" {
+		switch {
+		case f.explicit["o"] || f.explicit["format"]:
+			fmt.Println("Error: -template replaces the -o format, they cannot be used together")
+			return false
+		case f.discoverOnly || f.diffFile != "" || f.watchEvery != 0:
+			fmt.Println("Error: -template cannot be used with -sn, -diff or -watch")
+			return false
+		}
+		if f.outTemplate, err = parseOutputTemplate(f.templateFlag, f.templateHost); err != nil {
+			fmt.Printf("Error: invalid -template: %v\n", err)
+			return false
+		}
+		// A -o format from a config file gives way to the template
+		f.outputFormat = "template"
+	} else if f.templateHost {
+		fmt.Println("Error: -template-host only applies together with -template")
+		return false
+	}
+
+	if f.discoverOnly {
+		switch {
+		case f.skipPing:
+			fmt.Println("Error: -sn and -skip-ping cannot be used together")
+			return false
+		case f.failOnOpen:
+			fmt.Println("Error: -fail-on-open cannot be used with -sn, which does not scan ports")
+			return false
+		case f.checkpointFile != "" || f.resumeFile != "":
+			fmt.Println("Error: -checkpoint and -resume cannot be used with -sn, which does not scan ports")
+			return false
+		case f.syslogOn:
+			fmt.Println("Error: -syslog cannot be used with -sn, which does not scan ports")
+			return false
+		case f.baselineFile != "":
+			fmt.Println("Error: -baseline cannot be used with -sn, which does not scan ports")
+			return false
+		case f.firstOpen > 0:
+			fmt.Println("Error: -first-open cannot be used with -sn, which does not scan ports")
+			return false
+		case f.outputFormat != "text" && f.outputFormat != "json" && f.outputFormat != "csv":
+			fmt.Printf("Error: -sn only supports text, json and csv output, not %q\n", f.outputFormat)
+			return false
+		}
+	}
+
+	if f.diffFile != "" {
+		switch {
+		case f.discoverOnly:
+			fmt.Println("Error: -diff cannot be used with -sn, which does not scan ports")
+			return false
+		case f.failOnOpen:
+			fmt.Println("Error: -diff and -fail-on-open cannot be used together (-diff-exit-code sets the status for new open ports)")
+			return false
+		case f.outputFormat != "text" && f.outputFormat != "json" && f.outputFormat != "jsonl":
+			fmt.Printf("Error: -diff only supports text, json and jsonl output, not %q\n", f.outputFormat)
+			return false
+		}
+	} else if f.explicit["diff-exit-code"] {
+		fmt.Println("Error: -diff-exit-code only applies together with -diff")
+		return false
+	}
+	if f.baselineFile != "" && f.failOnOpen {
+		fmt.Println("Error: -baseline and -fail-on-open cannot be used together")
+		return false
+	}
+	if f.watchEvery != 0 {
+		switch {
+		case f.watchEvery < 0:
+			fmt.Println("Error: -watch must be greater than 0")
+			return false
+		case f.discoverOnly || f.diffFile != "" || f.baselineFile != "" || f.failOnOpen:
+			fmt.Println("Error: -watch reports its own changes and cannot be used with -sn, -diff, -baseline or -fail-on-open")
+			return false
+		case f.checkpointFile != "" || f.resumeFile != "" || f.deadline > 0 || f.outFile != "":
+			fmt.Println("Error: -watch runs until Ctrl+C and cannot be used with -checkpoint, -resume, -deadline or -out")
+			return false
+		case f.outputFormat != "text" && f.outputFormat != "jsonl":
+			fmt.Printf("Error: -watch only supports text and jsonl output, not %q\n", f.outputFormat)
+			return false
+		}
+	}
+	if f.groupResults {
+		switch {
+		case f.outputFormat != "text":
+			fmt.Printf("Error: -group only applies to text output, not %q\n", f.outputFormat)
+			return false
+		case f.discoverOnly || f.diffFile != "" || f.watchEvery != 0:
+			fmt.Println("Error: -group cannot be used with -sn, -diff or -watch")
+			return false
+		}
+	}
+	if f.showStats && (f.discoverOnly || f.watchEvery != 0) {
+		fmt.Println("Error: -stats cannot be used with -sn, which does not scan ports, or -watch, which never finishes")
+		return false
+	}
+	if f.webhookURL != "" {
+		switch u, err := url.Parse(f.webhookURL); {
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			fmt.Printf("Error: -webhook must be an http or https URL, not %q\n", f.webhookURL)
+			return false
+		case f.discoverOnly:
+			fmt.Println("Error: -webhook cannot be used with -sn, which does not scan ports")
+			return false
+		case f.webhookTimeout <= 0:
+			fmt.Println("Error: -webhook-timeout must be greater than 0")
+			return false
+		}
+		f.hook = &webhook{URL: f.webhookURL, Headers: f.webhookHeaders.Header(), Timeout: f.webhookTimeout, Required: f.webhookRequired}
+	} else if len(f.webhookHeaders) > 0 || f.explicit["webhook-timeout"] || f.webhookRequired {
+		fmt.Println("Error: -webhook-header, -webhook-timeout and -webhook-required only apply together with -webhook")
+		return false
+	}
+	if f.metricsListen != "" && (f.discoverOnly || f.serveAddr != "") {
+		fmt.Println("Error: -metrics-listen cannot be used with -sn or -serve")
+		return false
+	}
+	if f.serveAddr != "" {
+		switch {
+		case f.hostsFile != "" || f.targetsFile != "" || len(f.set.Args()) > 0:
+			fmt.Println("Error: -serve takes its hosts from requests and cannot be used with a host argument, -f or -targets")
+			return false
+		case f.discoverOnly || f.watchEvery != 0 || f.diffFile != "" || f.baselineFile != "" || f.failOnOpen || f.syslogOn || f.hook != nil:
+			fmt.Println("Error: -serve cannot be used with -sn, -watch, -diff, -baseline, -fail-on-open, -syslog or -webhook")
+			return false
+		case f.checkpointFile != "" || f.resumeFile != "" || f.deadline > 0 || f.outFile != "" || f.exclude != "" || f.excludeFile != "":
+			fmt.Println("Error: -serve cannot be used with -checkpoint, -resume, -deadline, -out, -exclude or -exclude-file")
+			return false
+		case f.serveMaxScans <= 0:
+			fmt.Println("Error: -serve-max-scans must be greater than 0")
+			return false
+		}
+	} else if f.explicit["serve-max-scans"] {
+		fmt.Println("Error: -serve-max-scans only applies together with -serve")
+		return false
+	}
+	if f.dryRun {
+		switch {
+		case f.discoverOnly || f.serveAddr != "" || f.watchEvery != 0:
+			fmt.Println("Error: -dry-run cannot be used with -sn, -serve or -watch")
+			return false
+		case f.checkpointFile != "" || f.resumeFile != "" || f.outFile != "" || f.syslogOn || f.hook != nil || f.metricsListen != "":
+			fmt.Println("Error: -dry-run cannot be used with -checkpoint, -resume, -out, -syslog, -webhook or -metrics-listen")
+			return false
+		case f.outputFormat != "text":
+			fmt.Printf("Error: -dry-run only writes text output, not %q\n", f.outputFormat)
+			return false
+		}
+	}
+	if f.diffExit < 0 || f.diffExit > 125 {
+		fmt.Println("Error: -diff-exit-code must be between 0 and 125")
+		return false
+	}
+
+	switch f.colorMode {
+	case "auto", "always", "never":
+	default:
+		fmt.Printf("Error: Unknown color mode %q (expected auto, always or never)\n", f.colorMode)
+		return false
+	}
+	if f.noColor {
+		if f.colorMode == "always" {
+			fmt.Println("Error: -no-color cannot be used with -color always")
+			return false
+		}
+		f.colorMode = "never"
+	}
+
+	if f.appendOut {
+		switch {
+		case f.outFile == "":
+			fmt.Println("Error: -append requires -out")
+			return false
+		case f.force:
+			fmt.Println("Error: -append and -force cannot be used together")
+			return false
+		case reportFormats[f.outputFormat].document:
+			fmt.Printf("Error: -append only works with line-oriented formats (text, jsonl, csv, grep, list), not %s\n", f.outputFormat)
+			return false
+		}
+	}
+	return true
+}
+
+// options are the scanner options the flags set for scanning ports. The -tls-probe and
+// -http-probe hooks look up the name a target was given by in hostNames.
+func (f *scanFlags) options(ports []int, hostNames map[string]string) scanner.Options {
+	opts := scanner.Options{
+		Ports:     ports,
+		Protocols: f.protocols,
+		IPVersion: f.ipVersion,
+		LocalAddr: f.localAddr,
+		Interface: f.bindInterface,
+		Workers:   f.numWorkers,
+		Timeout:   f.timeout,
+		Retries:   f.retries,
+		Rate:      f.rate,
+		Randomize: f.randomize,
+		Seed:      f.seed,
+		All:       f.showAll,
+		FirstOpen: f.firstOpen,
+
+		AdaptiveTimeout: f.adaptiveTimeout,
+		MinTimeout:      f.minTimeout,
+		MaxTimeout:      f.maxTimeout,
+		AdaptiveWorkers: f.adaptiveWorkers,
+
+		DiscoveryPorts: f.pingPorts,
+	}
+	if f.grabBanner {
+		opts.BannerTimeout = f.bannerTimeout
+	}
+	if f.sshProbe {
+		opts.SSHTimeout = f.sshTimeout
+	}
+	if f.dbProbe {
+		opts.DatabaseTimeout = f.dbTimeout
+	}
+	if f.tlsProbe {
+		opts.TLSTimeout = f.tlsTimeout
+		opts.TLSServerName = func(ip string) string {
+			if f.tlsSNI != "" {
+				return f.tlsSNI
+			}
+			return hostNames[ip]
+		}
+	}
+	if f.httpProbe {
+		opts.HTTPTimeout = f.httpTimeout
+		opts.HTTPPorts = f.httpPorts
+		opts.HTTPFollowRedirects = f.followRedirects
+		opts.HTTPHost = func(ip string) string { return hostNames[ip] }
+	}
+	return opts
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+// nmap's grepable output (-oG): every host gets a status line and, when it has reported
+// ports, a ports line; hosts that break the -baseline policy get a violations line as well. Fields on a line are separated by tabs and each port is written as
+// port/state/protocol/owner/service/rpc_info/version/, with the fields we do not know left empty.
+
+func writeGrepHeader(w io.Writer, args []string, start time.Time) error {
+	_, err := fmt.Fprintf(w, "# portscanner %s scan initiated %s as: %s\n", version.String(), start.Format(time.ANSIC), strings.Join(args, " "))
+	return err
+}
+
+func writeGrepFooter(w io.Writer, end time.Time, total, up int, elapsed time.Duration) error {
+	_, err := fmt.Fprintf(w, "# portscanner done at %s -- %d IP address(es) (%d host(s) up) scanned in %.2f seconds\n",
+		end.Format(time.ANSIC), total, up, elapsed.Seconds())
+	return err
+}
+
+// writeGrepHost writes the lines for one finished host. Hosts that could not be resolved
+// are reported as down under the name they were given, and hosts that did not answer
+// -ping as down under their address.
+func writeGrepHost(w io.Writer, scan *hostScan) error {
+	if scan.Err != nil {
+		_, err := fmt.Fprintf(w, "Host: %s ()\tStatus: Down\n", scan.Host)
+		return err
+	}
+
+	hostname := ""
+	if scan.Host != scan.IP {
+		hostname = scan.Host
+	}
+	prefix := fmt.Sprintf("Host: %s (%s)", scan.IP, hostname)
+	if scan.Down() {
+		_, err := fmt.Fprintf(w, "%s\tStatus: Down\n", prefix)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s\tStatus: Up\n", prefix); err != nil {
+		return err
+	}
+	if len(scan.Results) > 0 {
+		ports := make([]string, len(scan.Results))
+		for i, result := range scan.Results {
+			ports[i] = grepPort(result)
+		}
+		if _, err := fmt.Fprintf(w, "%s\tPorts: %s\n", prefix, strings.Join(ports, ", ")); err != nil {
+			return err
+		}
+	}
+	if len(scan.violations) > 0 {
+		_, err := fmt.Fprintf(w, "%s\tViolations: %s\n", prefix, grepViolations(scan.violations))
+		return err
+	}
+	return nil
+}
+
+// grepPort renders a result as e.g. 22/open/tcp//ssh///. The Server header of an
+// -http-probe answer goes in the version field, with slashes turned into bars as nmap
+// does; the rest of the answer has no field to go in.
+func grepPort(result scanner.Result) string {
+	version := ""
+	if result.HTTP != nil {
+		version = strings.ReplaceAll(result.HTTP.Server, "/", "|")
+	}
+	return fmt.Sprintf("%d/%s/%s//%s//%s/", result.Port, result.State, result.Protocol, result.Service, version)
+}
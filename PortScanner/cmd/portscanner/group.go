@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// serviceGroups are the -group buckets in the order they are printed; a port whose
+// service is in none of them goes under "other"
+var serviceGroups = []struct {
+	Name     string
+	Services []string
+}{
+	{"web", []string{"http", "https", "http-alt", "https-alt", "gopher"}},
+	{"db", []string{"mysql", "postgresql", "redis", "mongodb", "ms-sql-s", "ms-sql-m", "oracle", "memcache", "elasticsearch"}},
+	{"mail", []string{"smtp", "submission", "submissions", "pop3", "pop3s", "imap2", "imaps", "sieve"}},
+	{"remote-access", []string{"ssh", "telnet", "ms-wbt-server", "vnc", "x11", "exec", "login", "shell"}},
+}
+
+const otherGroup = "other"
+
+// serviceGroup returns the -group bucket of a result. A port that answered -http-probe is
+// web whatever its service name.
+func serviceGroup(result scanner.Result) string {
+	if result.HTTP != nil {
+		return "web"
+	}
+	for _, group := range serviceGroups {
+		for _, service := range group.Services {
+			if service == result.Service {
+				return group.Name
+			}
+		}
+	}
+	return otherGroup
+}
+
+// writeGrouped writes a host's results bucketed by serviceGroup, each bucket under a
+// "[web]"-style header unless headers is false, skipping empty buckets. Within a bucket
+// the results keep their order.
+func writeGrouped(w io.Writer, results []scanner.Result, style style, verbose, headers bool) error {
+	buckets := make(map[string][]scanner.Result)
+	for _, result := range results {
+		group := serviceGroup(result)
+		buckets[group] = append(buckets[group], result)
+	}
+	names := make([]string, 0, len(serviceGroups)+1)
+	for _, group := range serviceGroups {
+		names = append(names, group.Name)
+	}
+	for _, name := range append(names, otherGroup) {
+		if len(buckets[name]) == 0 {
+			continue
+		}
+		if headers {
+			if _, err := fmt.Fprintln(w, style.Header("["+name+"]")); err != nil {
+				return err
+			}
+		}
+		for _, result := range buckets[name] {
+			if _, err := fmt.Fprintln(w, formatResult(result, style, verbose)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+// -o html writes the whole run as one page that opens in any browser: a table with a
+// row per host and, under it, each host's ports in a table that unfolds when the host is
+// clicked. The styles are part of the page, so the file can be mailed or archived on its
+// own. Banners are whatever the target sent, so everything goes through html/template,
+// which escapes it.
+
+// htmlReport collects finished hosts until the page can be written
+type htmlReport struct {
+	Args    string
+	Version string
+	Start   time.Time
+	End     time.Time
+	Elapsed string
+	// Interrupted marks a run that was stopped before every host was scanned
+	Interrupted bool
+	Hosts       []htmlHost
+	Open        int
+}
+
+type htmlHost struct {
+	Label string
+	// Status is "up", "down" or "error"; Note says why a host is not up
+	Status   string
+	Note     string
+	Open     int
+	Closed   int
+	Filtered int
+	Elapsed  string
+	Ports    []htmlPort
+	// HTTP adds a column for -http-probe answers, when some port of the host gave one
+	HTTP bool
+	// Violations are the host's -baseline violations
+	Violations []string
+}
+
+type htmlPort struct {
+	Port     int
+	Protocol string
+	State    scanner.State
+	Service  string
+	Latency  string
+	Banner   string
+	HTTP     string
+}
+
+func newHTMLReport(args []string, start time.Time) *htmlReport {
+	return &htmlReport{Args: strings.Join(args, " "), Version: version.String(), Start: start}
+}
+
+// Add records a finished host
+func (r *htmlReport) Add(scan *hostScan) {
+	host := htmlHost{
+		Label:    hostLabel(scan),
+		Status:   "up",
+		Open:     scan.Summary.States[scanner.StateOpen],
+		Closed:   scan.Summary.States[scanner.StateClosed],
+		Filtered: scan.Summary.States[scanner.StateFiltered],
+		Elapsed:  formatElapsed(scan.Summary.Elapsed),
+	}
+	switch {
+	case scan.Err != nil:
+		host.Status, host.Note, host.Elapsed = "error", scan.Err.Error(), ""
+	case scan.Down():
+		host.Status, host.Note, host.Elapsed = "down", scan.Discovery.Reason, ""
+	}
+	for _, result := range scan.Results {
+		port := htmlPort{
+			Port:     result.Port,
+			Protocol: result.Protocol,
+			State:    result.State,
+			Service:  result.Service,
+			Banner:   result.Banner,
+		}
+		if result.Latency > 0 {
+			port.Latency = formatLatency(result.Latency)
+		}
+		if result.HTTP != nil {
+			port.HTTP = formatHTTP(result.HTTP)
+			host.HTTP = true
+		}
+		host.Ports = append(host.Ports, port)
+	}
+	for _, violation := range scan.violations {
+		host.Violations = append(host.Violations, violation.describe())
+	}
+	r.Open += host.Open
+	r.Hosts = append(r.Hosts, host)
+}
+
+// Write renders the page
+func (r *htmlReport) Write(w io.Writer, end time.Time, interrupted bool) error {
+	r.End, r.Interrupted = end, interrupted
+	r.Elapsed = formatElapsed(end.Sub(r.Start))
+	return htmlTemplate.Execute(w, r)
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Port scan report {{.Start.Format "2006-01-02 15:04:05"}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+.meta { color: #666; }
+.meta code { color: #222; }
+table { border-collapse: collapse; width: 100%; margin-top: 1em; }
+th, td { text-align: left; padding: 0.35em 0.7em; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f4f4f4; }
+td.num, th.num { text-align: right; }
+details > summary { cursor: pointer; }
+details table { margin: 0.5em 0 1em; }
+.open { color: #1a7f37; font-weight: bold; }
+.closed { color: #888; }
+.filtered, .open\|filtered { color: #9a6700; }
+.down, .error { color: #cf222e; }
+.violations { color: #cf222e; margin: 0.5em 0; }
+pre { margin: 0; white-space: pre-wrap; word-break: break-all; font-size: 0.9em; }
+.warning { background: #fff8c5; border: 1px solid #d4a72c; padding: 0.5em 1em; }
+</style>
+</head>
+<body>
+<h1>Port scan report</h1>
+<p class="meta">Started {{.Start.Format "2006-01-02 15:04:05 MST"}}, finished {{.End.Format "2006-01-02 15:04:05 MST"}} ({{.Elapsed}})<br>
+Command: <code>{{.Args}}</code><br>
+Scanner: portscanner {{.Version}}</p>
+{{- if .Interrupted}}
+<p class="warning">The scan was stopped early, so the results are partial.</p>
+{{- end}}
+<p>{{len .Hosts}} host(s), {{.Open}} open port(s) in total.</p>
+<table>
+<thead><tr><th>Host</th><th>Status</th><th class="num">Open</th><th class="num">Closed</th><th class="num">Filtered</th><th class="num">Duration</th></tr></thead>
+<tbody>
+{{- range $host := .Hosts}}
+<tr>
+<td>
+{{- if or .Ports .Violations}}
+<details>
+<summary>{{.Label}}</summary>
+{{- if .Violations}}
+<ul class="violations">
+{{- range .Violations}}
+<li>{{.}}</li>
+{{- end}}
+</ul>
+{{- end}}
+{{- if .Ports}}
+<table>
+<thead><tr><th>Port</th><th>State</th><th>Service</th><th class="num">Latency</th><th>Banner</th>{{if .HTTP}}<th>HTTP</th>{{end}}</tr></thead>
+<tbody>
+{{- range .Ports}}
+<tr><td>{{.Port}}/{{.Protocol}}</td><td class="{{.State}}">{{.State}}</td><td>{{.Service}}</td><td class="num">{{.Latency}}</td><td>{{if .Banner}}<pre>{{.Banner}}</pre>{{end}}</td>{{if $host.HTTP}}<td>{{.HTTP}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+{{- end}}
+</details>
+{{- else}}
+{{.Label}}
+{{- end}}
+</td>
+<td class="{{.Status}}">{{.Status}}{{if .Note}} ({{.Note}}){{end}}</td>
+<td class="num">{{.Open}}</td><td class="num">{{.Closed}}</td><td class="num">{{.Filtered}}</td><td class="num">{{.Elapsed}}</td>
+</tr>
+{{- end}}
+</tbody>
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanInputs are what a scan reads before it starts: its targets and ports, and the files
+// it is checked against, compared with or continues
+type scanInputs struct {
+	hosts []string
+	// targetPorts are the ports -targets lists for each host, nil without -targets
+	targetPorts map[string][]int
+	ports       []int
+	// excludedPorts is how many ports -exclude-ports removed
+	excludedPorts int
+	exclusions    []hostExclusion
+	// invalid are the skipped lines of host lists, reported once the logger is set up
+	invalid    []string
+	checkpoint checkpointHeader
+	policy     *portPolicy
+	previous   *portSnapshot
+	resumed    *checkpoint
+}
+
+// loadInputs reads the targets, ports and files the flags name. It returns false when the
+// command should stop with exitUsage, after reporting why.
+func loadInputs(flags *scanFlags) (*scanInputs, bool) {
+	var hosts []string
+	// Bad lines in host lists are reported once the logger is set up
+	var invalidEntries []string
+	noteInvalid := func(source string, invalid []error) {
+		for _, err := range invalid {
+			invalidEntries = append(invalidEntries, fmt.Sprintf("%s %v", source, err))
+		}
+	}
+	// With -targets every host has its own ports, in the order the file lists them
+	var targetPorts map[string][]int
+	var targetPairs []string
+	if flags.targetsFile != "" {
+		pairs, invalid, err := readTargetsFromFile(flags.targetsFile)
+		noteInvalid("targets file", invalid)
+		if err != nil {
+			fmt.Printf("Error reading targets file: %v\n", err)
+			return nil, false
+		}
+		targetPorts = make(map[string][]int)
+		for _, pair := range pairs {
+			if _, ok := targetPorts[pair.Host]; !ok {
+				hosts = append(hosts, pair.Host)
+			}
+			targetPorts[pair.Host] = append(targetPorts[pair.Host], pair.Port)
+			targetPairs = append(targetPairs, net.JoinHostPort(pair.Host, strconv.Itoa(pair.Port)))
+		}
+	} else if flags.hostsFile != "" {
+		var invalid []error
+		var err error
+		hosts, invalid, err = readHostsFromFile(flags.hostsFile)
+		noteInvalid("hosts file", invalid)
+		if err != nil {
+			fmt.Printf("Error reading hosts file: %v\n", err)
+			return nil, false
+		}
+	} else if len(flags.set.Args()) > 0 {
+		var err error
+		if hosts, err = parseTargets(flags.set.Arg(0)); err != nil {
+			fmt.Printf("Error: invalid target: %v\n", err)
+			return nil, false
+		}
+	} else if flags.serveAddr != "" {
+		// Every request names its own host
+	} else if !isTerminal(os.Stdin) {
+		// Piped input, e.g. from dig or amass, works like -f -
+		var invalid []error
+		var err error
+		hosts, invalid, err = readHosts(os.Stdin)
+		noteInvalid("stdin", invalid)
+		if err != nil {
+			fmt.Printf("Error reading hosts from stdin: %v\n", err)
+			return nil, false
+		}
+	} else {
+		flags.set.Usage()
+		return nil, false
+	}
+
+	if flags.strict && len(invalidEntries) > 0 {
+		for _, entry := range invalidEntries {
+			fmt.Printf("Error: %s\n", entry)
+		}
+		fmt.Printf("Error: -strict: %d invalid line(s), nothing was scanned\n", len(invalidEntries))
+		return nil, false
+	}
+
+	// Checkpoints name the targets as given, before CIDRs are expanded
+	targetList := hosts
+	if targetPorts != nil {
+		targetList = targetPairs
+	}
+	hosts, err := expandTargets(hosts, cidrOptions{
+		MaxHosts:         flags.maxHosts,
+		AllowLarge:       flags.allowLarge,
+		IncludeBroadcast: flags.includeBroadcast,
+	})
+	if err != nil {
+		fmt.Printf("Error expanding targets: %v\n", err)
+		return nil, false
+	}
+
+	var ports []int
+	if targetPorts != nil {
+		// Reports and checkpoints describe the scan by every port any target has
+		seen := make(map[int]bool)
+		for _, host := range hosts {
+			for _, port := range targetPorts[host] {
+				if !seen[port] {
+					seen[port] = true
+					ports = append(ports, port)
+				}
+			}
+		}
+		sort.Ints(ports)
+	} else if flags.topN > 0 {
+		ports = topPorts(flags.topN)
+	} else if flags.portSpec != "" {
+		ports, err = parsePortSpec(flags.portSpec)
+		if err != nil {
+			fmt.Printf("Error parsing port spec: %v\n", err)
+			return nil, false
+		}
+	} else if flags.portsFile != "" {
+		var err error
+		ports, err = readPortsFromFile(flags.portsFile)
+		if err != nil {
+			fmt.Printf("Error reading ports file: %v\n", err)
+			return nil, false
+		}
+	} else {
+		for port := flags.startPort; port <= flags.endPort; port++ {
+			ports = append(ports, port)
+		}
+	}
+
+	excludedPorts := 0
+	if flags.excludePorts != "" {
+		excluded, err := parsePortSpec(flags.excludePorts)
+		if err != nil {
+			fmt.Printf("Error parsing excluded ports: %v\n", err)
+			return nil, false
+		}
+		before := len(ports)
+		ports = excludePortList(ports, excluded)
+		excludedPorts = before - len(ports)
+		if len(ports) == 0 {
+			fmt.Println("Error: -exclude-ports removes every port from the scan")
+			return nil, false
+		}
+	}
+
+	var excludeEntries []string
+	if flags.exclude != "" {
+		for _, entry := range strings.Split(flags.exclude, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				excludeEntries = append(excludeEntries, entry)
+			}
+		}
+	}
+	if flags.excludeFile != "" {
+		entries, invalid, err := readHostsFromFile(flags.excludeFile)
+		noteInvalid("exclude file", invalid)
+		if err != nil {
+			fmt.Printf("Error reading exclude file: %v\n", err)
+			return nil, false
+		}
+		excludeEntries = append(excludeEntries, entries...)
+	}
+	exclusions, err := parseExclusions(context.Background(), excludeEntries)
+	if err != nil {
+		fmt.Printf("Error parsing exclusions: %v\n", err)
+		return nil, false
+	}
+
+	// A checkpoint only fits the same targets, ports and protocols it was made for
+	checkpointHead := checkpointHeader{
+		Checkpoint: checkpointVersion,
+		Targets:    targetList,
+		Ports:      formatPortSpec(ports),
+		Protocols:  flags.protocols,
+		Created:    time.Now().UTC(),
+	}
+	var policy *portPolicy
+	if flags.baselineFile != "" {
+		policy, err = loadPolicy(flags.baselineFile)
+		if err != nil {
+			fmt.Printf("Error reading baseline: %v\n", err)
+			return nil, false
+		}
+	}
+	var previous *portSnapshot
+	if flags.diffFile != "" {
+		previous, err = loadPreviousReport(flags.diffFile)
+		if err != nil {
+			fmt.Printf("Error reading previous report: %v\n", err)
+			return nil, false
+		}
+	}
+
+	var resumed *checkpoint
+	if flags.resumeFile != "" {
+		resumed, err = loadCheckpoint(flags.resumeFile)
+		if err != nil {
+			fmt.Printf("Error reading checkpoint: %v\n", err)
+			return nil, false
+		}
+		if err := resumed.Header.matches(checkpointHead); err != nil {
+			fmt.Printf("Error: cannot resume from %s: %v\n", flags.resumeFile, err)
+			return nil, false
+		}
+		if !resumed.Complete.IsZero() {
+			fmt.Printf("Error: cannot resume from %s: that scan already finished at %s\n", flags.resumeFile, resumed.Complete.Format(time.RFC3339))
+			return nil, false
+		}
+		if flags.checkpointFile == "" {
+			flags.checkpointFile = flags.resumeFile
+		}
+	}
+
+	return &scanInputs{
+		hosts:         hosts,
+		targetPorts:   targetPorts,
+		ports:         ports,
+		excludedPorts: excludedPorts,
+		exclusions:    exclusions,
+		invalid:       invalidEntries,
+		checkpoint:    checkpointHead,
+		policy:        policy,
+		previous:      previous,
+		resumed:       resumed,
+	}, true
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// jumpTimeout bounds connecting and logging in to the -ssh-jump host
+const jumpTimeout = 10 * time.Second
+
+// sshJump dials ports from an SSH server, over direct-tcpip channels of one connection
+// shared by every worker, so results are what the server can reach
+type sshJump struct {
+	// Address is the server's host:port
+	Address string
+	client  *ssh.Client
+	// channels holds a token for every channel open or being opened
+	channels chan struct{}
+}
+
+// parseJump splits a -ssh-jump spec, [user@]host[:port], into the user, the current one
+// when left out, and the host:port to connect to
+func parseJump(spec string) (string, string, error) {
+	name, hostPort := "", spec
+	if at := strings.LastIndex(spec, "@"); at >= 0 {
+		name, hostPort = spec[:at], spec[at+1:]
+		if name == "" {
+			return "", "", fmt.Errorf("%q has an empty user name", spec)
+		}
+	}
+	host, port := hostPort, "22"
+	if h, p, err := net.SplitHostPort(hostPort); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]") {
+		host = hostPort[1 : len(hostPort)-1]
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("%q has no host", spec)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("%q has an invalid port %q", spec, port)
+	}
+	if name == "" {
+		current, err := user.Current()
+		if err != nil {
+			return "", "", fmt.Errorf("no user in %q and the current one is unknown: %v", spec, err)
+		}
+		// Windows user names come with their domain, which the server does not know
+		name = current.Username[strings.LastIndex(current.Username, `\`)+1:]
+	}
+	return name, net.JoinHostPort(host, port), nil
+}
+
+// jumpAuth returns how to log in: with the key in keyFile, or with the keys of the
+// running ssh-agent when keyFile is empty
+func jumpAuth(keyFile string) (ssh.AuthMethod, func(), error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, nil, fmt.Errorf("%s is protected by a passphrase; add it to ssh-agent and leave out -ssh-key", keyFile)
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		return ssh.PublicKeys(signer), func() {}, nil
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, errors.New("no key to log in with: set -ssh-key or start ssh-agent")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot reach ssh-agent: %v", err)
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), func() { conn.Close() }, nil
+}
+
+// defaultKnownHosts is ~/.ssh/known_hosts, or "" when there is no home directory
+func defaultKnownHosts() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// dialJump connects and logs in to the server of a -ssh-jump spec, checking its host key
+// against knownHostsFile, and allows up to maxChannels ports to be dialed through it at once
+func dialJump(ctx context.Context, spec, keyFile, knownHostsFile string, maxChannels int) (*sshJump, error) {
+	name, address, err := parseJump(spec)
+	if err != nil {
+		return nil, err
+	}
+	if knownHostsFile == "" {
+		return nil, errors.New("no known_hosts file to check its host key against: set -ssh-known-hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot check its host key: %v", err)
+	}
+	auth, closeAgent, err := jumpAuth(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+
+	ctx, cancel := context.WithTimeout(ctx, jumpTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	config := &ssh.ClientConfig{
+		User:            name,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeys,
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil, fmt.Errorf("its host key is not in %s; add it with ssh-keyscan or by logging in with ssh once", knownHostsFile)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &sshJump{Address: address, client: ssh.NewClient(sshConn, chans, reqs), channels: make(chan struct{}, maxChannels)}, nil
+}
+
+// DialContext opens a direct-tcpip channel to address from the server, waiting for one of
+// the channels to be free first. A channel still being opened when ctx is done keeps its
+// token until the server answers, so there are never more than maxChannels in flight.
+func (j *sshJump) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	select {
+	case j.channels <- struct{}{}:
+	case <-ctx.Done():
+		return nil, jumpTimeoutError(network, ctx.Err())
+	}
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		conn, err := j.client.Dial(network, address)
+		done <- dialed{conn, err}
+	}()
+	select {
+	case d := <-done:
+		if d.err != nil {
+			<-j.channels
+			return nil, jumpDialError(network, d.err)
+		}
+		return newJumpConn(d.conn, address, func() { <-j.channels }), nil
+	case <-ctx.Done():
+		go func() {
+			if d := <-done; d.conn != nil {
+				d.conn.Close()
+			}
+			<-j.channels
+		}()
+		return nil, jumpTimeoutError(network, ctx.Err())
+	}
+}
+
+func (j *sshJump) Close() error {
+	return j.client.Close()
+}
+
+// jumpTimeoutError reports a dial that ran out of time like net.Dialer does, as an i/o timeout
+func jumpTimeoutError(network string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = os.ErrDeadlineExceeded
+	}
+	return &net.OpError{Op: "dial", Net: network, Err: err}
+}
+
+// jumpDialError turns the server's refusal to connect into the errno a local connect would
+// have failed with, going by the strerror text OpenSSH sends, so the port is classified
+// the same way
+func jumpDialError(network string, err error) error {
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || openErr.Reason != ssh.ConnectionFailed {
+		return err
+	}
+	message := strings.ToLower(openErr.Message)
+	for text, errno := range map[string]syscall.Errno{
+		"refused":   syscall.ECONNREFUSED,
+		"reset":     syscall.ECONNRESET,
+		"timed out": syscall.ETIMEDOUT,
+		"no route":  syscall.EHOSTUNREACH,
+	} {
+		if strings.Contains(message, text) {
+			return &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", errno)}
+		}
+	}
+	return err
+}
+
+// jumpConn is a channel dialed through the jump host. Channels have no deadlines, which
+// banner reads and probes rely on, so the channel is copied to and from one end of a
+// net.Pipe, which has them, and the other end is handed out.
+type jumpConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func newJumpConn(channel net.Conn, address string, release func()) net.Conn {
+	near, far := net.Pipe()
+	go func() {
+		io.Copy(far, channel)
+		far.Close()
+	}()
+	go func() {
+		io.Copy(channel, far)
+		channel.Close()
+		release()
+	}()
+	// The channel's own addresses are zero, so the remote one is the address dialed
+	var remote net.Addr = channel.RemoteAddr()
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if n, err := strconv.Atoi(port); err == nil && net.ParseIP(host) != nil {
+			remote = &net.TCPAddr{IP: net.ParseIP(host), Port: n}
+		}
+	}
+	return &jumpConn{Conn: near, remote: remote}
+}
+
+func (c *jumpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
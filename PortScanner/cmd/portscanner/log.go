@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// logLevel controls how much diagnostic output is written; port results are not affected
+type logLevel int
+
+const (
+	logQuiet   logLevel = iota // errors only
+	logNormal                  // host headers, summaries and errors
+	logVerbose                 // -v: host lifecycle events and timings on the diagnostic log as well
+	logDebug                   // -vv: every connection attempt and its error as well
+)
+
+// logger writes the console output around the results, dropping messages above its level,
+// and hands -v and -vv events to a structured diagnostic log. It is safe for concurrent use
+// so worker goroutines can log attempts while hosts are reported.
+type logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level logLevel
+	diag  *slog.Logger
+}
+
+// newLogger returns a logger writing console output to w and diagnostic events to diag,
+// as slog text or, with jsonLines, as one JSON object per line
+func newLogger(w io.Writer, level logLevel, diag io.Writer, jsonLines bool) *logger {
+	// Nothing is ever logged above Error, so this drops every event below -v
+	handlerOpts := &slog.HandlerOptions{Level: slog.LevelError + 1}
+	switch level {
+	case logVerbose:
+		handlerOpts.Level = slog.LevelInfo
+	case logDebug:
+		handlerOpts.Level = slog.LevelDebug
+	}
+	var handler slog.Handler = slog.NewTextHandler(diag, handlerOpts)
+	if jsonLines {
+		// Durations become milliseconds, like the _ms fields of the JSON report
+		handlerOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				return slog.Float64(a.Key+"_ms", math.Round(float64(a.Value.Duration())/float64(time.Microsecond))/1000)
+			}
+			return a
+		}
+		handler = slog.NewJSONHandler(diag, handlerOpts)
+	}
+	return &logger{w: w, level: level, diag: slog.New(handler)}
+}
+
+// Enabled reports whether messages at level are written
+func (l *logger) Enabled(level logLevel) bool {
+	return level <= l.level
+}
+
+func (l *logger) Errorf(format string, args ...any) {
+	l.logf(logQuiet, format, args...)
+}
+
+func (l *logger) Infof(format string, args ...any) {
+	l.logf(logNormal, format, args...)
+}
+
+// Verbose records a -v event on the diagnostic log, with args as slog key-value pairs
+func (l *logger) Verbose(msg string, args ...any) {
+	l.diag.Info(msg, args...)
+}
+
+// Debug records a -vv event on the diagnostic log, with args as slog key-value pairs
+func (l *logger) Debug(msg string, args ...any) {
+	l.diag.Debug(msg, args...)
+}
+
+// Write copies already formatted output, such as a buffered host header, as one block
+func (l *logger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func (l *logger) logf(level logLevel, format string, args ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, format+"\n", args...)
+}
@@ -0,0 +1,1955 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+type hostScan struct {
+	Host      string
+	IP        string
+	Err       error
+	ScannedAt time.Time
+	// FinishedAt is when the last port of the host was probed
+	FinishedAt time.Time
+	Results    []scanner.Result
+	Summary    scanner.Summary
+	Skipped    bool
+	// Discovery is the outcome of -ping, or nil when hosts were not pinged
+	Discovery *scanner.HostStatus
+	// Ports are the ports -targets lists for the host, or nil to scan the ports of the scanner
+	Ports []int
+	// Policy is the -baseline entry the host is checked against, or nil if none covers it
+	Policy *policyEntry
+	// Via is the -ssh-jump host the ports were dialed from, empty when they were dialed from here
+	Via string
+
+	// When hosts are scanned in parallel, output and lines hold a host's log messages
+	// and streamed results until it is its turn to be reported
+	output    bytes.Buffer
+	lines     bytes.Buffer
+	streamErr error
+	done      chan struct{}
+	// open collects the open ports for -diff, -baseline and -watch, whichever of them the output format keeps
+	open []scanner.Result
+	// violations are the host's -baseline violations, found once it is done
+	violations []PolicyViolation
+}
+
+// hostExclusion is one -exclude entry as it was written, with the address ranges it covers
+type hostExclusion struct {
+	Entry string
+	Nets  []*net.IPNet
+}
+
+type cidrOptions struct {
+	MaxHosts         int
+	AllowLarge       bool
+	IncludeBroadcast bool
+}
+
+// progressConfig drives the live progress line; Scanned is fed by the scanner's Progress hook
+type progressConfig struct {
+	Interval time.Duration
+	// Total is the number of ports probed on each host; with -targets it is worked out per
+	// host from its own ports and Protocols, the number of protocols each is probed over
+	Total     int
+	Protocols int
+	Scanned   *atomic.Int64
+	// RateLimit is -rate, shown next to the achieved rate so throttling can be checked
+	RateLimit int
+}
+
+// Upper bound on DNS lookups in flight while resolving targets
+const maxConcurrentLookups = 16
+
+// Upper bound on hosts being pinged at once by -ping, and by -sn unless -w is given, each
+// with up to four probes in flight; enough to sweep a /24 within a single -ping-timeout
+const maxConcurrentPings = 256
+
+// Exit statuses, so scripts can tell "nothing is listening" apart from a broken invocation
+const (
+	exitOpenPorts       = 0 // at least one open port across all hosts, none with -fail-on-open, no new ones with -diff, or no -baseline violations
+	exitNoOpenPorts     = 1 // every host was scanned and nothing was open
+	exitUsage           = 2 // invalid flags, arguments or input files
+	exitRuntime         = 3 // a host could not be resolved or the report could not be written
+	exitFailOnOpen      = 4 // -fail-on-open was given and at least one port was open; reported as checkOpen
+	exitNewOpenPorts    = 5 // -diff found a port that was not open in the previous report; -diff-exit-code changes it
+	exitPolicyViolation = 6 // a host broke the -baseline policy
+
+	// A scan cut short by -deadline, with the status timeout(1) uses
+	exitDeadline = 124
+	// A scan cut short by SIGINT/SIGTERM, following the 128+signal convention
+	exitInterrupted = 130
+)
+
+// With -fail-on-open the run follows the contract of a check that hosts are fully closed
+// instead, so that 0 only ever means a completed scan that found nothing open.
+// failOnOpenStatus translates the statuses above into it; 124 and 130 are kept.
+const (
+	checkClosed      = 0 // every host was scanned and nothing was open
+	checkUsage       = 1 // invalid flags, arguments or input files
+	checkUnreachable = 2 // a host could not be resolved or did not answer -ping, or the report could not be written
+	checkOpen        = 3 // at least one port was open
+)
+
+// failOnOpenStatus translates an exit status of the default contract into the -fail-on-open one
+func failOnOpenStatus(code int) int {
+	switch code {
+	case exitNoOpenPorts:
+		return checkClosed
+	case exitUsage:
+		return checkUsage
+	case exitRuntime:
+		return checkUnreachable
+	case exitFailOnOpen:
+		return checkOpen
+	}
+	return code
+}
+
+// CIDRs with more host bits than this are refused even with -allow-large
+const maxCIDRHostBits = 24
+
+type HostResult struct {
+	Host           string    `json:"host"`
+	IP             string    `json:"ip,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Status         string    `json:"status,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	ScannedAt      time.Time `json:"scanned_at"`
+	OpenPorts      int       `json:"open_ports"`
+	ClosedPorts    int       `json:"closed_ports"`
+	FilteredPorts  int       `json:"filtered_ports"`
+	ElapsedMS      float64   `json:"elapsed_ms"`
+	PortsPerSecond float64   `json:"ports_per_second"`
+	// Via is the -ssh-jump host the results are from the point of view of
+	Via string `json:"via,omitempty"`
+	// ScannerVersion is the version of the build that scanned the host
+	ScannerVersion string           `json:"scanner_version"`
+	Results        []scanner.Result `json:"results"`
+}
+
+// documentReport is an output format that can only be written once every host is done
+type documentReport interface {
+	// Add records a finished host, including one that failed to resolve or was down
+	Add(scan *hostScan)
+	Write(w io.Writer, end time.Time, interrupted bool) error
+}
+
+func main() {
+	os.Exit(dispatch(os.Args[1:]))
+}
+
+// run is the scan command: it parses args, scans and returns the exit status, so every
+// way out of a scan goes through one place and the whole command can be driven from tests
+func run(args []string) (code int) {
+	prog := os.Args[0] + " scan"
+	flags := newScanFlags(prog)
+
+	defer func() {
+		if flags.failOnOpen {
+			code = failOnOpenStatus(code)
+		}
+	}()
+
+	if code, ok := flags.parse(args); !ok {
+		return code
+	}
+	if !flags.validate() {
+		return exitUsage
+	}
+
+	in, ok := loadInputs(flags)
+	if !ok {
+		return exitUsage
+	}
+	var err error
+
+	// Failing to reach syslog is reported now rather than at the first open port
+	var findings syslogSender
+	if flags.syslogOn {
+		findings, err = openSyslog(flags.syslogFacility, flags.syslogTag)
+		if err != nil {
+			fmt.Printf("Error: -syslog: %v\n", err)
+			return exitUsage
+		}
+		defer findings.Close()
+	}
+
+	var recorder *checkpointWriter
+	if flags.checkpointFile != "" {
+		recorder, err = createCheckpoint(flags.checkpointFile, in.checkpoint, in.resumed, flags.resumeFile)
+		if err != nil {
+			fmt.Printf("Error creating checkpoint: %v\n", err)
+			return exitUsage
+		}
+		// Flushes what was recorded on every way out, including errors; exit checks the result
+		defer recorder.Close()
+	}
+
+	var diag io.Writer = os.Stderr
+	if flags.logFile != "" {
+		file, err := os.OpenFile(flags.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Printf("Error opening log file: %v\n", err)
+			return exitUsage
+		}
+		defer file.Close()
+		diag = io.MultiWriter(os.Stderr, file)
+	}
+
+	var out io.Writer = os.Stdout
+	var outHandle *reportFile
+	// Formats with a header leave it out when adding to a report that already has one
+	header := true
+	if flags.outFile != "" {
+		var nonEmpty bool
+		var err error
+		outHandle, nonEmpty, err = createReportFile(flags.outFile, flags.appendOut, flags.force)
+		if err != nil {
+			fmt.Printf("Error creating output file: %v\n", err)
+			return exitUsage
+		}
+		out = outHandle
+		header = !nonEmpty
+	}
+	// fail reports a write error and exits without leaving a partial -out file behind
+	fail := func(format string, args ...any) int {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+		if outHandle != nil {
+			outHandle.Abort()
+		}
+		return exitRuntime
+	}
+
+	// Keep the report clean for machine-readable formats by moving progress chatter to stderr.
+	// In quiet mode only errors are left, and they should not be mixed into the port list either.
+	// With -out the report goes to the file, so the console gets the human-readable output:
+	// host headers, summaries and, echoed as text, every port line.
+	status := os.Stdout
+	if (flags.outputFormat != "text" && flags.outFile == "") || flags.quiet {
+		status = os.Stderr
+	}
+	echo := flags.outFile != "" && !flags.quiet
+	echoStyle := style(useColor(flags.colorMode, os.Stdout))
+	headerStyle := style(useColor(flags.colorMode, status))
+	// Escape codes would corrupt the machine-readable formats, so they are never colored
+	outTarget := os.Stdout
+	if outHandle != nil {
+		outTarget = outHandle.File
+	}
+	lineStyle := style(flags.outputFormat == "text" && useColor(flags.colorMode, outTarget))
+	level := logNormal
+	switch {
+	case flags.veryVerbose:
+		level = logDebug
+	case flags.verbose:
+		level = logVerbose
+	case flags.quiet:
+		level = logQuiet
+	}
+	log := newLogger(status, level, diag, flags.logJSON)
+	for _, entry := range in.invalid {
+		log.Errorf("Skipping %s", entry)
+	}
+	if flags.timingName != "" {
+		log.Verbose("timing", "template", flags.timingName, "settings", flags.effectiveTiming.String())
+	} else {
+		log.Verbose("timing", "settings", flags.effectiveTiming.String())
+	}
+	if in.excludedPorts > 0 {
+		log.Verbose("excluded ports", "pattern", flags.excludePorts, "excluded", in.excludedPorts, "remaining", len(in.ports))
+	}
+
+	// Past the open file limit dials fail with "too many open files", so rather than let
+	// most ports come back as errors the workers are cut down to what fits
+	if limit := openFileLimit(); limit > 0 {
+		if fit := maxWorkers(limit, flags.hostParallelism); fit > 0 && flags.numWorkers > fit {
+			log.Errorf("Warning: -w %d needs more than the %d open files this process may use; scanning with -w %d instead. Raise the limit with ulimit -n to use more workers",
+				flags.numWorkers, limit, fit)
+			flags.numWorkers = fit
+		}
+	}
+
+	var jump *sshJump
+	if flags.sshJumpSpec != "" {
+		jump, err = dialJump(context.Background(), flags.sshJumpSpec, flags.sshKey, flags.sshKnownHosts, flags.sshMaxChannels)
+		if err != nil {
+			fmt.Printf("Error: cannot log in to -ssh-jump host %s: %v\n", flags.sshJumpSpec, err)
+			return exitRuntime
+		}
+		defer jump.Close()
+		// Workers beyond the channels would only wait for one, their timeout running
+		if fit := max(1, flags.sshMaxChannels/flags.hostParallelism); flags.numWorkers > fit {
+			log.Verbose("workers lowered to fit -ssh-max-channels", "workers", fit, "channels", flags.sshMaxChannels)
+			flags.numWorkers = fit
+		}
+		log.Infof("Scanning through %s: results are from its point of view, not this machine's", jump.Address)
+	}
+
+	// Filled in once the targets are resolved, before any of them is scanned
+	hostNames := make(map[string]string)
+	opts := flags.options(in.ports, hostNames)
+	if jump != nil {
+		opts.Dial = jump.DialContext
+	}
+	if in.resumed != nil {
+		opts.Resume = in.resumed.Lookup
+		log.Infof("Resuming from %s, %d port(s) already scanned", flags.resumeFile, len(in.resumed.Results))
+	}
+	if recorder != nil {
+		opts.OnResult = recorder.Record
+	}
+	progress := progressConfig{Total: len(in.ports) * len(flags.protocols), Protocols: len(flags.protocols), Scanned: new(atomic.Int64), RateLimit: flags.rate}
+	// Progress updates only make sense when a person is watching stderr, and
+	// concurrent hosts would fight over the single progress line, as would -v output
+	if !flags.noProgress && level == logNormal && flags.outputFormat == "text" && flags.hostParallelism == 1 && isTerminal(os.Stderr) {
+		progress.Interval = flags.progressInterval
+		opts.Progress = func(done, total int) {
+			progress.Scanned.Store(int64(done))
+		}
+	}
+	if log.Enabled(logDebug) {
+		opts.OnAttempt = func(attempt scanner.Attempt) {
+			log.Debug("attempt", attemptAttrs(attempt)...)
+		}
+	}
+	var metrics *scanMetrics
+	// The address is taken now so a busy one fails before anything is resolved, but it is
+	// only served once every host is registered with metrics
+	var metricsListener net.Listener
+	if flags.metricsListen != "" {
+		metricsListener, err = net.Listen("tcp", flags.metricsListen)
+		if err != nil {
+			fmt.Printf("Error: -metrics-listen: %v\n", err)
+			return exitRuntime
+		}
+		defer metricsListener.Close()
+		metrics = newScanMetrics()
+		record, attempt := opts.OnResult, opts.OnAttempt
+		opts.OnResult = func(ip string, result scanner.Result) {
+			metrics.Record(ip, result)
+			if record != nil {
+				record(ip, result)
+			}
+		}
+		opts.OnAttempt = func(a scanner.Attempt) {
+			metrics.Attempt(a)
+			if attempt != nil {
+				attempt(a)
+			}
+		}
+	}
+
+	if flags.serveAddr != "" {
+		listener, err := net.Listen("tcp", flags.serveAddr)
+		if err != nil {
+			fmt.Printf("Error: -serve: %v\n", err)
+			return exitRuntime
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		server := newScanServer(log, opts, flags.serveMaxScans)
+		defer server.Close()
+		if err := serve(ctx, log, listener, server); err != nil {
+			fmt.Printf("Error: -serve: %v\n", err)
+			return exitRuntime
+		}
+		return exitOpenPorts
+	}
+
+	startedAt := time.Now()
+	// Port lines share the logger's lock when they go to the same place, so -v attempts
+	// from hosts still being scanned cannot land in the middle of a report
+	var report io.Writer = out
+	if status == out {
+		report = log
+	}
+	// Without -diff a -webhook gets the whole report, which is put together from every host
+	postReport := flags.hook != nil && in.previous == nil
+	reports := &reportWriter{
+		format:    reportFormats[flags.outputFormat],
+		flags:     flags,
+		log:       log,
+		out:       out,
+		report:    report,
+		header:    header,
+		echo:      echo,
+		echoStyle: echoStyle,
+		lineStyle: lineStyle,
+		verbose:   level >= logVerbose,
+		// With -diff the text report is only the changes, written once every host is done
+		diffOnly:      in.previous != nil && flags.outputFormat == "text",
+		keepAll:       postReport,
+		policy:        in.policy,
+		excludedPorts: in.excludedPorts,
+		ports:         in.ports,
+		protocols:     flags.protocols,
+		start:         startedAt,
+	}
+	if !flags.discoverOnly {
+		if err := reports.Start(); err != nil {
+			return fail("Error writing %s: %v", reports.format.output, err)
+		}
+	}
+
+	// The first Ctrl+C stops dispatching new ports and reports what was found so far;
+	// restoring the default handler afterwards lets a second Ctrl+C kill the process outright
+	interrupted, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	interruptNoticed := make(chan struct{})
+	go func() {
+		<-interrupted.Done()
+		stop()
+		fmt.Fprintln(os.Stderr, "\nInterrupted, finishing in-flight probes (press Ctrl+C again to force exit)")
+		close(interruptNoticed)
+	}()
+	// Passing the -deadline winds the run down the same way, counted from the start of the scan
+	ctx := interrupted
+	if flags.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(interrupted, startedAt.Add(flags.deadline))
+		defer cancel()
+	}
+	deadlineReached := func() bool {
+		return interrupted.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+	}
+
+	// scanFinished is set once every target has been scanned, so that exit marks the
+	// checkpoint complete unless the scan was cut short after all
+	scanFinished := false
+
+	// exit closes the report file and returns code, or exitInterrupted after Ctrl+C and
+	// exitDeadline once -deadline has passed
+	exit := func(code int) int {
+		if recorder != nil {
+			closeRecorder := recorder.Close
+			if scanFinished && interrupted.Err() == nil && !deadlineReached() {
+				closeRecorder = recorder.Complete
+			}
+			if err := closeRecorder(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing checkpoint: %v\n", err)
+				code = exitRuntime
+			}
+		}
+		if outHandle != nil {
+			if err := outHandle.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing output file: %v\n", err)
+				return exitRuntime
+			}
+		}
+		switch {
+		case interrupted.Err() != nil:
+			<-interruptNoticed
+			code = exitInterrupted
+		case deadlineReached():
+			code = exitDeadline
+		}
+		return code
+	}
+
+	var hostResults []HostResult
+	current := newPortSnapshot()
+	scannedHosts, skippedHosts, failedHosts, downHosts, totalOpen := 0, 0, 0, 0, 0
+	s := scanner.New(opts)
+	defer s.Close()
+	targets := resolveTargets(ctx, s, in.hosts, flags.allIPs)
+	for _, scan := range targets {
+		if scan.IP != "" {
+			log.Verbose("resolved", "host", scan.Host, "ip", scan.IP)
+		}
+		if jump != nil {
+			scan.Via = jump.Address
+		}
+	}
+	log.Verbose("resolution finished", "targets", len(in.hosts), "addresses", len(targets), "elapsed", time.Since(startedAt))
+	if len(in.exclusions) > 0 {
+		var excluded []int
+		targets, excluded = excludeTargets(targets, in.exclusions)
+		if total := sumInts(excluded); total > 0 {
+			var reasons []string
+			for i, count := range excluded {
+				if count > 0 {
+					reasons = append(reasons, fmt.Sprintf("%d matching %s", count, in.exclusions[i].Entry))
+				}
+			}
+			log.Infof("Excluded %d target(s): %s", total, strings.Join(reasons, ", "))
+		}
+	}
+	for _, scan := range targets {
+		scan.Ports = in.targetPorts[scan.Host]
+		if in.policy != nil {
+			scan.Policy = in.policy.Match(scan.Host, scan.IP)
+		}
+		if metrics != nil && scan.IP != "" {
+			metrics.AddHost(scan.Host, scan.IP)
+		}
+		if scan.IP != "" {
+			hostNames[scan.IP] = scan.Host
+		}
+	}
+	if metrics != nil {
+		defer serveMetrics(metricsListener, metrics)()
+		log.Verbose("metrics listening", "address", metricsListener.Addr().String())
+	}
+	if flags.dryRun {
+		for _, scan := range targets {
+			if scan.Err != nil {
+				log.Errorf("Skipping host %s: %v", scan.Host, scan.Err)
+			}
+		}
+		failed, err := writeDryRun(out, targets, in.ports, flags.protocols, level >= logVerbose)
+		if err != nil {
+			return fail("Error writing output: %v", err)
+		}
+		if failed > 0 {
+			return exit(exitRuntime)
+		}
+		return exit(exitOpenPorts)
+	}
+	if recorder != nil {
+		recorder.hosts = make(map[string]string, len(targets))
+		for _, scan := range targets {
+			recorder.hosts[scan.IP] = scan.Host
+		}
+	}
+	if flags.discoverOnly {
+		if !s.CanPing() {
+			log.Infof("Sending ICMP echoes needs unprivileged ICMP sockets (net.ipv4.ping_group_range) or root or CAP_NET_RAW, so hosts are only checked with TCP connects to port(s) %s", formatPortSpec(flags.pingPorts))
+		}
+		up, pinged := discoverHosts(ctx, s, targets, flags.pingTimeout, flags.pingConcurrency)
+		failed := 0
+		for _, scan := range targets {
+			if scan.Err != nil {
+				failed++
+				log.Errorf("Skipping host %s: %v", scan.Host, scan.Err)
+			}
+		}
+		if err := writeDiscovery(out, flags.outputFormat, targets, header); err != nil {
+			return fail("Error writing output: %v", err)
+		}
+		log.Infof("Host discovery: %d of %d host(s) up in %s", up, pinged, formatElapsed(time.Since(startedAt)))
+		if deadlineReached() {
+			log.Errorf("Deadline of %s reached, the results are partial", flags.deadline)
+		}
+		switch {
+		case failed > 0:
+			return exit(exitRuntime)
+		case up == 0:
+			return exit(exitNoOpenPorts)
+		}
+		return exit(exitOpenPorts)
+	}
+	// scanned tells whether a port was part of a host's scan, for -diff, -baseline and -watch
+	scannedPorts := make(map[portKey]bool, len(in.ports)*len(flags.protocols))
+	for _, port := range in.ports {
+		for _, protocol := range flags.protocols {
+			scannedPorts[portKey{port, protocol}] = true
+		}
+	}
+	scanned := func(host string, key portKey) bool {
+		if in.targetPorts != nil && !slices.Contains(in.targetPorts[host], key.Port) {
+			return false
+		}
+		return scannedPorts[key]
+	}
+	if flags.watchEvery > 0 {
+		var watched []*hostScan
+		for _, scan := range targets {
+			switch {
+			case scan.Skipped:
+			case scan.Err != nil:
+				log.Errorf("Skipping host %s: %v", scan.Host, scan.Err)
+			default:
+				watched = append(watched, scan)
+			}
+		}
+		cfg := watchConfig{
+			Interval:    flags.watchEvery,
+			Format:      flags.outputFormat,
+			Ping:        flags.ping && !flags.skipPing,
+			PingTimeout: flags.pingTimeout,
+			Parallelism: flags.hostParallelism,
+			Progress:    progress,
+			Findings:    findings,
+			Webhook:     flags.hook,
+			Metrics:     metrics,
+			Scanned:     scanned,
+		}
+		if err := watchTargets(ctx, log, out, s, watched, cfg); err != nil {
+			return fail("Error %v", err)
+		}
+		// Ctrl+C is how a watch ends, so it is not reported as an interrupted scan
+		if interrupted.Err() != nil {
+			<-interruptNoticed
+		}
+		return exitOpenPorts
+	}
+	if flags.ping && !flags.skipPing {
+		up, pinged := discoverHosts(ctx, s, targets, flags.pingTimeout, flags.pingConcurrency)
+		for _, scan := range targets {
+			if scan.Discovery != nil && scan.Discovery.Up {
+				log.Verbose("host up", "host", scan.Host, "ip", scan.IP, "reason", scan.Discovery.Reason, "rtt", scan.Discovery.Latency)
+			}
+		}
+		log.Infof("Host discovery: %d of %d host(s) up", up, pinged)
+	}
+	keepHost := func(scan *hostScan) {
+		if flags.outputFormat == "json" || postReport {
+			hostResults = append(hostResults, newHostResult(scan))
+		}
+	}
+	var syslogFailed atomic.Bool
+	var stats *statsAggregator
+	if flags.showStats {
+		stats = newStatsAggregator()
+	}
+	stream := func(scan *hostScan, status, w io.Writer, result scanner.Result) error {
+		if stats != nil {
+			stats.Result(result)
+		}
+		// A lost syslog message is reported once but does not stop the scan
+		if findings != nil && result.Open {
+			if err := findings.Info(formatSyslogFinding(scan, result)); err != nil && syslogFailed.CompareAndSwap(false, true) {
+				log.Errorf("Error writing to syslog: %v", err)
+			}
+		}
+		if (in.previous != nil || in.policy != nil) && result.Open {
+			scan.open = append(scan.open, result)
+		}
+		return reports.Result(scan, status, w, result)
+	}
+	var policyCheck *PolicyCheck
+	if in.policy != nil {
+		policyCheck = &PolicyCheck{Baseline: flags.baselineFile, Violations: []PolicyViolation{}}
+	}
+	// A report that cannot be written stops the scan, which is reported once it has wound down
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	defer cancelScan()
+	writeErr := ""
+	abort := func(format string, args ...any) {
+		if writeErr == "" {
+			writeErr = fmt.Sprintf(format, args...)
+			cancelScan()
+		}
+	}
+	log.Verbose("scan started", "targets", len(targets), "ports", len(in.ports), "protocols", strings.Join(flags.protocols, ","),
+		"workers", opts.Workers, "host_parallelism", flags.hostParallelism)
+	scanHosts(scanCtx, log, report, targets, s, progress, headerStyle, flags.hostParallelism, stream, func(scan *hostScan) {
+		if writeErr != "" {
+			return
+		}
+		if scan.Skipped {
+			skippedHosts++
+			current.Unscanned[scan.Host] = true
+			return
+		}
+		if scan.Err != nil {
+			failedHosts++
+			log.Errorf("Skipping host %s: %v", scan.Host, scan.Err)
+			keepHost(scan)
+			if err := reports.Unscanned(scan); err != nil {
+				abort("Error writing %s: %v", reports.format.output, err)
+			}
+			return
+		}
+		if scan.Down() {
+			downHosts++
+			log.Infof("Host %s seems down (%s), skipping", hostLabel(scan), scan.Discovery.Reason)
+			keepHost(scan)
+			if err := reports.Unscanned(scan); err != nil {
+				abort("Error writing %s: %v", reports.format.output, err)
+			}
+			return
+		}
+		scannedHosts++
+		totalOpen += scan.Summary.States[scanner.StateOpen]
+		if stats != nil {
+			stats.Host(scan)
+		}
+		partial := scan.Summary.Scanned < scan.Summary.Total
+		current.Add(scan.Host, scan.open, partial)
+		if metrics != nil {
+			metrics.HostScanned(scan.IP, scan.Summary)
+		}
+		if in.policy != nil {
+			if scan.Policy == nil {
+				log.Verbose("no baseline entry", "host", scan.Host, "ip", scan.IP)
+			} else {
+				scan.violations = scan.Policy.Check(scan, scan.open, partial, func(key portKey) bool {
+					return scanned(scan.Host, key)
+				})
+				policyCheck.Violations = append(policyCheck.Violations, scan.violations...)
+			}
+		}
+		if scan.Summary.FileLimited > 0 {
+			log.Errorf("Warning: %d port(s) of %s could not be probed because the process ran out of open files; lower -w or raise the limit with ulimit -n",
+				scan.Summary.FileLimited, scan.Host)
+		}
+		log.Verbose("host scanned", "host", scan.Host, "ip", scan.IP, "scanned", scan.Summary.Scanned, "total", scan.Summary.Total,
+			"open", scan.Summary.States[scanner.StateOpen], "elapsed", scan.Summary.Elapsed, "ports_per_second", math.Round(scan.Summary.Rate()))
+		if flags.adaptiveTimeout {
+			// Without an RTT the host never answered and the static -t was kept
+			log.Verbose("adaptive timeout", "host", scan.Host, "ip", scan.IP, "timeout", scan.Summary.Timeout, "rtt", scan.Summary.RTT)
+		}
+		if flags.adaptiveWorkers {
+			log.Verbose("adaptive workers", "host", scan.Host, "ip", scan.IP, "workers", scan.Summary.Workers)
+		}
+
+		keepHost(scan)
+		if err := reports.Host(scan); err != nil {
+			abort("Error writing %s: %v", reports.format.output, err)
+		}
+	})
+	if writeErr != "" {
+		return fail("%s", writeErr)
+	}
+	// Hosts that failed to resolve are left for a -resume to try again
+	scanFinished = skippedHosts == 0 && failedHosts == 0
+
+	if skippedHosts > 0 {
+		reason := "interrupt"
+		if deadlineReached() {
+			reason = "the deadline"
+		}
+		log.Infof("Skipping %d remaining host(s) after %s", skippedHosts, reason)
+	}
+	if downHosts > 0 {
+		log.Infof("Skipped %d host(s) that did not answer host discovery", downHosts)
+	}
+	var runStats *RunStats
+	if stats != nil {
+		// Asked for explicitly, so printed even with -q
+		runStats = stats.Stats()
+		if err := writeStats(log, runStats); err != nil {
+			return fail("Error writing output: %v", err)
+		}
+	} else if len(targets) > 1 {
+		log.Infof("Scanned %d host(s), %d open port(s) in total", scannedHosts, totalOpen)
+	}
+	if deadlineReached() {
+		log.Errorf("Deadline of %s reached, the results are partial", flags.deadline)
+	}
+	log.Verbose("run finished", "scanned", scannedHosts, "failed", failedHosts, "down", downHosts, "skipped", skippedHosts,
+		"open", totalOpen, "elapsed", time.Since(startedAt))
+
+	var changes *ScanDiff
+	if in.previous != nil {
+		changes = diffSnapshots(flags.diffFile, in.previous, current, scanned)
+		if err := reports.Changes(changes); err != nil {
+			return fail("Error writing output: %v", err)
+		}
+	}
+	if policyCheck != nil {
+		if err := reports.Violations(policyCheck); err != nil {
+			return fail("Error writing output: %v", err)
+		}
+	}
+	end := reportEnd{
+		Time:        time.Now(),
+		Interrupted: ctx.Err() != nil,
+		Hosts:       scannedHosts + failedHosts + downHosts,
+		Up:          scannedHosts,
+		Results:     hostResults,
+		Diff:        changes,
+		Policy:      policyCheck,
+		Stats:       runStats,
+	}
+	if err := reports.Finish(end); err != nil {
+		return fail("Error writing %s: %v", reports.format.output, err)
+	}
+
+	if flags.hook != nil {
+		var body bytes.Buffer
+		var err error
+		if changes != nil {
+			err = json.NewEncoder(&body).Encode(changes)
+		} else {
+			err = writeJSONResults(&body, hostResults, nil, policyCheck, runStats)
+		}
+		// Not the scan's context, so what a scan cut short by Ctrl+C found is still
+		// delivered; a second Ctrl+C kills the process if the delivery hangs
+		if err == nil {
+			err = flags.hook.Post(context.Background(), log, body.Bytes())
+		}
+		if err != nil {
+			log.Errorf("Error sending webhook: %v", err)
+			if flags.hook.Required {
+				return exit(exitRuntime)
+			}
+		}
+	}
+
+	switch {
+	case failedHosts > 0:
+		return exit(exitRuntime)
+	case policyCheck != nil && len(policyCheck.Violations) > 0:
+		return exit(exitPolicyViolation)
+	case changes != nil && len(changes.Opened) > 0:
+		return exit(flags.diffExit)
+	case changes != nil || policyCheck != nil:
+		return exit(exitOpenPorts)
+	case flags.failOnOpen && totalOpen > 0:
+		return exit(exitFailOnOpen)
+	// A host that did not answer -ping was never checked, so it is no proof of being closed
+	case flags.failOnOpen && downHosts > 0:
+		return exit(exitRuntime)
+	case flags.failOnOpen:
+		return exit(checkClosed)
+	case totalOpen == 0:
+		return exit(exitNoOpenPorts)
+	}
+	return exit(exitOpenPorts)
+}
+
+// readHostsFromFile reads a hosts list from filename, or from stdin when filename is "-"
+func readHostsFromFile(filename string) ([]string, []error, error) {
+	if filename == "-" {
+		return readHosts(os.Stdin)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return readHosts(file)
+}
+
+// readHosts parses one host per line, skipping blank lines and # comments.
+// Trimming also drops the \r of CRLF line endings. Every entry goes through
+// cleanHostEntry and only its first occurrence is kept; entries that are not a
+// host are left out and returned in invalid, one error per line, instead of
+// failing the whole list.
+func readHosts(r io.Reader) (hosts []string, invalid []error, err error) {
+	seen := make(map[string]bool)
+	lines := bufio.NewScanner(r)
+	for number := 1; lines.Scan(); number++ {
+		line, _, _ := strings.Cut(lines.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		host, err := cleanHostEntry(line)
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("line %d: %w", number, err))
+			continue
+		}
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	if err := lines.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(hosts) == 0 && len(invalid) > 0 {
+		return nil, invalid, fmt.Errorf("no valid hosts found (%v)", invalid[0])
+	}
+	if len(hosts) == 0 {
+		return nil, nil, fmt.Errorf("no hosts found")
+	}
+
+	return hosts, invalid, nil
+}
+
+// hostPort is one line of a -targets file
+type hostPort struct {
+	Host string
+	Port int
+}
+
+// readTargetsFromFile reads a -targets list from filename, or from stdin when filename is "-"
+func readTargetsFromFile(filename string) ([]hostPort, []error, error) {
+	if filename == "-" {
+		return readTargets(os.Stdin)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return readTargets(file)
+}
+
+// readTargets parses one host:port per line, skipping blank lines and # comments the way
+// readHosts does. IPv6 addresses need brackets, as in [::1]:22. Hosts go through
+// cleanHostEntry, so spellings of the same target compare equal, and only the first
+// occurrence of each pair is kept. Malformed lines and CIDR ranges are left out and
+// returned in invalid, one error per line.
+func readTargets(r io.Reader) (targets []hostPort, invalid []error, err error) {
+	seen := make(map[hostPort]bool)
+	lines := bufio.NewScanner(r)
+	for number := 1; lines.Scan(); number++ {
+		line, _, _ := strings.Cut(lines.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		target, err := parseTarget(line)
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("line %d: %w", number, err))
+			continue
+		}
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	if err := lines.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(targets) == 0 && len(invalid) > 0 {
+		return nil, invalid, fmt.Errorf("no valid targets found (%v)", invalid[0])
+	}
+	if len(targets) == 0 {
+		return nil, nil, fmt.Errorf("no targets found")
+	}
+
+	return targets, invalid, nil
+}
+
+func parseTarget(line string) (hostPort, error) {
+	host, portText, err := net.SplitHostPort(line)
+	if err != nil {
+		return hostPort{}, fmt.Errorf("%q is not host:port", line)
+	}
+	port, err := parsePort(portText)
+	if err != nil {
+		return hostPort{}, fmt.Errorf("invalid port %q in %q", portText, line)
+	}
+	if strings.Contains(host, "/") {
+		return hostPort{}, fmt.Errorf("%q is a CIDR range, not a single host", line)
+	}
+	if host == "" {
+		return hostPort{}, fmt.Errorf("%q has no host", line)
+	}
+	host, err = cleanHostEntry(host)
+	if err != nil {
+		return hostPort{}, err
+	}
+	return hostPort{host, port}, nil
+}
+
+// cleanHostEntry turns a pasted entry such as https://Example.com:8443/login into the
+// target it names, example.com. It drops a URL scheme along with any user, path, query
+// and trailing slash, drops a port, lowercases host names and writes IP addresses in
+// their canonical form, so spellings of the same host compare equal. CIDR ranges are
+// kept as they are apart from the case.
+func cleanHostEntry(entry string) (string, error) {
+	host := entry
+	if scheme, rest, ok := strings.Cut(host, "://"); ok && scheme != "" {
+		host = rest
+		if end := strings.IndexAny(host, "/?#"); end >= 0 {
+			host = host[:end]
+		}
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+	}
+	host = strings.TrimRight(host, "/")
+	// Bare IPv6 addresses are full of colons too, but SplitHostPort only accepts them bracketed
+	if name, port, err := net.SplitHostPort(host); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); port != "" && err != nil {
+			return "", fmt.Errorf("invalid port %q in %q", port, entry)
+		}
+		host = name
+	}
+	host = normalizeHost(host)
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.String(), nil
+	}
+	host = strings.ToLower(host)
+	if strings.Contains(host, "/") {
+		if _, _, err := net.ParseCIDR(host); err != nil {
+			return "", fmt.Errorf("invalid CIDR %q", entry)
+		}
+		return host, nil
+	}
+	if !validHostname(host) {
+		return "", fmt.Errorf("%q is not a host name, IP address or CIDR", entry)
+	}
+	return strings.TrimSuffix(host, "."), nil
+}
+
+// localIP parses addr and checks that it is assigned to one of this machine's interfaces
+func localIP(addr string) (net.IP, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", addr)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not an address of any local interface", addr)
+}
+
+// checkInterface checks that the interface called name exists and is up, and that it
+// holds ip, if set
+func checkInterface(name string, ip net.IP) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("no interface called %s", name)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%s is down", name)
+	}
+	if ip == nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an address of %s", ip, name)
+}
+
+// ipFamily returns "4" or "6"
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "4"
+	}
+	return "6"
+}
+
+// validHostname checks host against the DNS limits on names, allowing underscores
+// since they turn up in real records, letters outside ASCII for internationalized
+// names, and one trailing dot
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseTargets splits an nmap-style target expression such as 192.168.1.1-50,10.0.0.0/24,example.com
+// into the targets it names, in order and each once. A range in the last octet of an IPv4
+// address is expanded to its addresses; CIDR blocks are kept for expandTargets, but count
+// towards the 2^maxCIDRHostBits addresses a whole expression may name.
+func parseTargets(expr string) ([]string, error) {
+	var targets []string
+	seen := make(map[string]bool)
+	total := 0
+	add := func(target string, addresses int) error {
+		if seen[target] {
+			return nil
+		}
+		if total += addresses; total > 1<<maxCIDRHostBits {
+			return fmt.Errorf("%q names more than %d addresses", expr, 1<<maxCIDRHostBits)
+		}
+		seen[target] = true
+		targets = append(targets, target)
+		return nil
+	}
+	for _, part := range strings.Split(expr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("%q has an empty target", expr)
+		}
+		if first, last, ok, err := parseOctetRange(part); err != nil {
+			return nil, err
+		} else if ok {
+			for octet := first[3]; ; octet++ {
+				if err := add(netip.AddrFrom4([4]byte{first[0], first[1], first[2], octet}).String(), 1); err != nil {
+					return nil, err
+				}
+				if octet == last {
+					break
+				}
+			}
+			continue
+		}
+		// Host names are left to the resolver, which reports the ones that do not exist
+		target, addresses := normalizeHost(part), 1
+		if strings.Contains(target, "/") {
+			_, ipNet, err := net.ParseCIDR(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", part)
+			}
+			// A block too large to expand on its own is refused by expandCIDR
+			if ones, bits := ipNet.Mask.Size(); bits-ones <= maxCIDRHostBits {
+				addresses = 1 << (bits - ones)
+			}
+		}
+		if err := add(target, addresses); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// parseOctetRange parses a range in the last octet of an IPv4 address, e.g. 192.168.1.1-50,
+// returning the first address and the last octet. ok is false for anything that is not an
+// IPv4 address with a hyphen, such as a host name.
+func parseOctetRange(part string) (first [4]byte, last byte, ok bool, err error) {
+	dot := strings.LastIndex(part, ".")
+	if !strings.Contains(part, "-") || dot < 0 {
+		return first, 0, false, nil
+	}
+	octets := strings.Split(part, ".")
+	if len(octets) != 4 {
+		return first, 0, false, nil
+	}
+	for _, octet := range octets {
+		for _, c := range octet {
+			if (c < '0' || c > '9') && c != '-' {
+				return first, 0, false, nil
+			}
+		}
+	}
+	if strings.Contains(part[:dot], "-") {
+		return first, 0, false, fmt.Errorf("invalid range %q: only the last octet can be a range", part)
+	}
+	base, err := netip.ParseAddr(part[:dot] + ".0")
+	if err != nil {
+		return first, 0, false, fmt.Errorf("invalid range %q: %q is not the start of an IPv4 address", part, part[:dot])
+	}
+	from, to, _ := strings.Cut(part[dot+1:], "-")
+	start, err1 := strconv.ParseUint(from, 10, 8)
+	end, err2 := strconv.ParseUint(to, 10, 8)
+	if err1 != nil || err2 != nil || strings.Contains(to, "-") {
+		return first, 0, false, fmt.Errorf("invalid range %q: want two octets from 0 to 255, e.g. 192.168.1.1-50", part)
+	}
+	if start > end {
+		return first, 0, false, fmt.Errorf("invalid range %q: %d is greater than %d", part, start, end)
+	}
+	first = base.As4()
+	first[3] = byte(start)
+	return first, byte(end), true, nil
+}
+
+func expandTargets(targets []string, opts cidrOptions) ([]string, error) {
+	var hosts []string
+	for _, target := range targets {
+		if !strings.Contains(target, "/") {
+			hosts = append(hosts, normalizeHost(target))
+			continue
+		}
+		expanded, err := expandCIDR(target, opts)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, expanded...)
+	}
+	return hosts, nil
+}
+
+// Bracketed IPv6 literals like [::1] would otherwise be bracketed twice by net.JoinHostPort
+func normalizeHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+func expandCIDR(cidr string, opts cidrOptions) ([]string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	hostBits := bits - ones
+	if hostBits > maxCIDRHostBits {
+		return nil, fmt.Errorf("%s is too large to expand (at most 2^%d addresses per CIDR)", cidr, maxCIDRHostBits)
+	}
+	if !opts.AllowLarge && 1<<hostBits > opts.MaxHosts {
+		return nil, fmt.Errorf("%s expands to more than %d hosts (raise -max-hosts or pass -allow-large to allow it)", cidr, opts.MaxHosts)
+	}
+
+	// Skip the network and broadcast addresses for IPv4 subnets that have them
+	skipEnds := bits == 32 && hostBits > 1 && !opts.IncludeBroadcast
+
+	total := 1 << hostBits
+	hosts := make([]string, 0, total)
+	ip := make(net.IP, len(ipNet.IP))
+	copy(ip, ipNet.IP)
+	for i := 0; i < total; i++ {
+		if !skipEnds || (i != 0 && i != total-1) {
+			hosts = append(hosts, ip.String())
+		}
+		incrementIP(ip)
+	}
+
+	return hosts, nil
+}
+
+func incrementIP(ip net.IP) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+}
+
+func readPortsFromFile(filename string) ([]int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readPorts(file)
+}
+
+// readPorts parses one port per line, skipping blank lines and # comments the
+// same way readHosts does, and keeps only the first occurrence of each port
+func readPorts(r io.Reader) ([]int, error) {
+	seen := make(map[int]bool) // Track seen ports
+	var ports []int
+	lines := bufio.NewScanner(r)
+	for number := 1; lines.Scan(); number++ {
+		line, _, _ := strings.Cut(lines.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		port, err := parsePort(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+		if !seen[port] { // Only add port if not seen before
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("empty ports file")
+	}
+
+	return ports, nil
+}
+
+func parsePortSpec(spec string) ([]int, error) {
+	seen := make(map[int]bool)
+	var ports []int
+	for _, token := range strings.Split(spec, ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			return nil, fmt.Errorf("empty entry in port spec %q", spec)
+		}
+
+		first, last := token, token
+		if i := strings.Index(token, "-"); i >= 0 {
+			first, last = strings.TrimSpace(token[:i]), strings.TrimSpace(token[i+1:])
+			if first == "" || last == "" {
+				return nil, fmt.Errorf("malformed port range %q", token)
+			}
+		}
+		start, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parsePort(last)
+		if err != nil {
+			return nil, err
+		}
+		if start > end {
+			return nil, fmt.Errorf("invalid port range %q: start is greater than end", token)
+		}
+
+		for port := start; port <= end; port++ {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// excludePortList returns ports without any of the excluded ones, keeping the original order
+func excludePortList(ports, excluded []int) []int {
+	skip := make(map[int]bool, len(excluded))
+	for _, port := range excluded {
+		skip[port] = true
+	}
+	kept := make([]int, 0, len(ports))
+	for _, port := range ports {
+		if !skip[port] {
+			kept = append(kept, port)
+		}
+	}
+	return kept
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port number: %s", s)
+	}
+	return port, nil
+}
+
+// resolveTargets looks every distinct host up once before scanning starts, so workers dial
+// an IP instead of repeating the lookup for every port and unresolvable hosts are known up
+// front. With allIPs each address a host resolves to becomes its own target.
+func resolveTargets(ctx context.Context, s *scanner.Scanner, hosts []string, allIPs bool) []*hostScan {
+	type lookup struct {
+		ips []string
+		err error
+		at  time.Time
+	}
+	cache := make(map[string]*lookup)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentLookups)
+	for _, host := range hosts {
+		if _, ok := cache[host]; ok {
+			continue
+		}
+		l := &lookup{}
+		cache[host] = l
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			l.at = time.Now()
+			l.ips, l.err = s.ResolveAll(ctx, host)
+		}()
+	}
+	wg.Wait()
+
+	var targets []*hostScan
+	for _, host := range hosts {
+		l := cache[host]
+		switch {
+		case ctx.Err() != nil:
+			targets = append(targets, &hostScan{Host: host, Skipped: true})
+		case l.err != nil:
+			targets = append(targets, &hostScan{Host: host, Err: l.err, ScannedAt: l.at})
+		case allIPs:
+			for _, ip := range l.ips {
+				targets = append(targets, &hostScan{Host: host, IP: ip})
+			}
+		default:
+			targets = append(targets, &hostScan{Host: host, IP: l.ips[0]})
+		}
+	}
+	return targets
+}
+
+// parseExclusions turns -exclude entries into address ranges. Hostnames are resolved
+// to every address they have, in either family, so matching can be done on IPs.
+func parseExclusions(ctx context.Context, entries []string) ([]hostExclusion, error) {
+	resolver := scanner.New(scanner.Options{})
+	var exclusions []hostExclusion
+	for _, entry := range entries {
+		exclusion := hostExclusion{Entry: entry}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			exclusion.Nets = []*net.IPNet{ipNet}
+		} else if strings.Contains(entry, "/") {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", entry, err)
+		} else {
+			ips, err := resolver.ResolveAll(ctx, normalizeHost(entry))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", entry, err)
+			}
+			for _, ip := range ips {
+				exclusion.Nets = append(exclusion.Nets, singleHostNet(ip))
+			}
+		}
+		exclusions = append(exclusions, exclusion)
+	}
+	return exclusions, nil
+}
+
+func singleHostNet(address string) *net.IPNet {
+	// Drop any IPv6 zone; exclusions match on the address alone
+	address, _, _ = strings.Cut(address, "%")
+	ip := net.ParseIP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// excludeTargets drops resolved targets whose address falls inside an exclusion and
+// reports how many targets each exclusion removed. Targets that failed to resolve are kept
+// so they are still reported.
+func excludeTargets(targets []*hostScan, exclusions []hostExclusion) ([]*hostScan, []int) {
+	counts := make([]int, len(exclusions))
+	kept := targets[:0]
+	for _, target := range targets {
+		if i := matchExclusion(target.IP, exclusions); i >= 0 {
+			counts[i]++
+			continue
+		}
+		kept = append(kept, target)
+	}
+	return kept, counts
+}
+
+// matchExclusion returns the index of the first exclusion containing address, or -1
+func matchExclusion(address string, exclusions []hostExclusion) int {
+	if address == "" {
+		return -1
+	}
+	address, _, _ = strings.Cut(address, "%")
+	ip := net.ParseIP(address)
+	for i, exclusion := range exclusions {
+		for _, ipNet := range exclusion.Nets {
+			if ipNet.Contains(ip) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func sumInts(values []int) int {
+	total := 0
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
+
+// discoverHosts pings every resolved target, up to concurrency at once, and records
+// the outcome on it. It returns how many hosts were found up out of how many were pinged.
+// Hosts not yet checked when ctx is cancelled keep a nil Discovery and are skipped later.
+func discoverHosts(ctx context.Context, s *scanner.Scanner, scans []*hostScan, timeout time.Duration, concurrency int) (int, int) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, scan := range scans {
+		if scan.Err != nil || scan.Skipped {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			startedAt := time.Now()
+			status := s.Discover(ctx, scan.IP, timeout)
+			if ctx.Err() == nil {
+				scan.Discovery = &status
+				// Down hosts are reported with the time they were pinged, as they are never scanned
+				scan.ScannedAt, scan.FinishedAt = startedAt, time.Now()
+			}
+		}()
+	}
+	wg.Wait()
+
+	up, pinged := 0, 0
+	for _, scan := range scans {
+		if scan.Discovery != nil {
+			pinged++
+			if scan.Discovery.Up {
+				up++
+			}
+		}
+	}
+	return up, pinged
+}
+
+// Down reports whether host discovery ran and got no answer from the host
+func (scan *hostScan) Down() bool {
+	return scan.Discovery != nil && !scan.Discovery.Up
+}
+
+// hostLabel names a host in log lines, with its address when it was given by name
+func hostLabel(scan *hostScan) string {
+	if scan.IP == "" || scan.IP == scan.Host {
+		return scan.Host
+	}
+	return fmt.Sprintf("%s (%s)", scan.Host, scan.IP)
+}
+
+// scanHosts scans up to parallelism hosts at once and hands each finished scan to
+// report in input order. Every result is passed to stream as the scanner produces it,
+// along with the writers for the host's log output and for its report lines. With parallelism 1 the "Scanning host" header
+// and the results are written live; otherwise they are buffered and flushed together
+// with the host's report.
+func scanHosts(ctx context.Context, log *logger, out io.Writer, scans []*hostScan, s *scanner.Scanner, progress progressConfig, headers style, parallelism int,
+	stream func(scan *hostScan, status, lines io.Writer, result scanner.Result) error, report func(*hostScan)) {
+	for _, scan := range scans {
+		scan.done = make(chan struct{})
+	}
+
+	live := parallelism == 1
+	slots := make(chan struct{}, parallelism)
+	go func() {
+		for i, scan := range scans {
+			// Hosts that failed to resolve or did not answer discovery are reported without taking a slot
+			if scan.Err != nil || scan.Down() {
+				close(scan.done)
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				for _, rest := range scans[i:] {
+					rest.Skipped = true
+					close(rest.done)
+				}
+				return
+			}
+
+			go func(i int, scan *hostScan) {
+				defer close(scan.done)
+				var status, lines io.Writer = &scan.output, &scan.lines
+				if live {
+					status, lines = log, out
+				} else {
+					defer func() { <-slots }()
+				}
+				progress := progress
+				if scan.Ports != nil {
+					progress.Total = len(scan.Ports) * progress.Protocols
+				}
+				scan.ScannedAt = time.Now()
+				log.Verbose("host scan started", "host", scan.Host, "ip", scan.IP, "ports", progress.Total)
+				if log.Enabled(logNormal) {
+					fmt.Fprintln(status, headers.Header("Scanning host: "+hostLabel(scan)))
+				}
+				stopProgress := func() {}
+				if progress.Interval > 0 {
+					label := ""
+					if len(scans) > 1 {
+						label = fmt.Sprintf("host %d/%d", i+1, len(scans))
+					}
+					progress.Scanned.Store(0)
+					stopProgress = startProgress(os.Stderr, label, progress)
+				}
+				emit := func(result scanner.Result) {
+					if err := stream(scan, status, lines, result); err != nil && scan.streamErr == nil {
+						scan.streamErr = err
+					}
+				}
+				// Cancellation is reported through the summary, so the error can be ignored here
+				if scan.Ports != nil {
+					scan.Summary, _ = s.StreamPorts(ctx, scan.IP, scan.Ports, emit)
+				} else {
+					scan.Summary, _ = s.Stream(ctx, scan.IP, emit)
+				}
+				scan.FinishedAt = time.Now()
+				stopProgress()
+			}(i, scan)
+		}
+	}()
+
+	for _, scan := range scans {
+		<-scan.done
+		log.Write(scan.output.Bytes())
+		if _, err := out.Write(scan.lines.Bytes()); err != nil && scan.streamErr == nil {
+			scan.streamErr = err
+		}
+		report(scan)
+		// Holding the slot until the report is written keeps the next live host from interleaving with it
+		if live && !scan.Skipped && scan.Err == nil && !scan.Down() {
+			<-slots
+		}
+	}
+}
+
+// formatResult renders a single result line, e.g. "Port 5432/tcp open postgresql (85µs)",
+// appending the first line of any banner, with the state highlighted by style. With
+// verbose the time the probe finished is added as well, to the millisecond, and for a port
+// that is not open the error that said so, e.g. "[error: connect: connection refused]".
+func formatResult(result scanner.Result, style style, verbose bool) string {
+	line := fmt.Sprintf("Port %d/%s %s %s", result.Port, result.Protocol, style.State(result.State), result.Service)
+	if result.Latency > 0 {
+		line += fmt.Sprintf(" (%s)", formatLatency(result.Latency))
+	}
+	// Only reachable with -retries, and worth calling out as a sign of a flaky path
+	if result.Attempts > 1 {
+		line += fmt.Sprintf(" after %d attempts", result.Attempts)
+	}
+	if verbose && !result.Timestamp.IsZero() {
+		line += " at " + result.Timestamp.Format("2006-01-02T15:04:05.000Z07:00")
+	}
+	if verbose && result.Error != "" {
+		line += fmt.Sprintf(" [error: %s]", result.Error)
+	}
+	if result.Banner != "" {
+		banner, _, _ := strings.Cut(result.Banner, "\n")
+		// Banners keep printable non-ASCII, so cut on runes to keep the line valid UTF-8
+		if runes := []rune(banner); len(runes) > 80 {
+			banner = string(runes[:77]) + "..."
+		}
+		line += fmt.Sprintf(" [%s]", banner)
+	}
+	if result.SSH != nil {
+		line += fmt.Sprintf(" [%s]", formatSSH(result.SSH))
+	}
+	if result.TLS != nil {
+		line += fmt.Sprintf(" [%s]", formatTLS(result.TLS))
+	}
+	if result.HTTP != nil {
+		line += fmt.Sprintf(" [%s]", formatHTTP(result.HTTP))
+	}
+	if database := formatDatabase(result.Annotations); database != "" {
+		line += fmt.Sprintf(" [%s]", database)
+	}
+	return line
+}
+
+// formatTLS summarizes a TLS probe, e.g. "tls: TLS1.3, CN=example.com, expires 2025-03-01"
+func formatTLS(info *scanner.TLSInfo) string {
+	parts := []string{"tls: " + info.Version}
+	if info.SubjectCN != "" {
+		parts = append(parts, "CN="+info.SubjectCN)
+	}
+	if !info.NotAfter.IsZero() {
+		parts = append(parts, "expires "+info.NotAfter.Format(time.DateOnly))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatSSH summarizes an SSH probe, e.g. "ssh: SSH-2.0-OpenSSH_9.6", warning about
+// deprecated algorithms with ", weak: ssh-rsa, aes128-cbc"
+func formatSSH(info *scanner.SSHInfo) string {
+	line := "ssh: " + info.Version
+	if len(info.Weak) > 0 {
+		line += ", weak: " + strings.Join(info.Weak, ", ")
+	}
+	return line
+}
+
+// databaseProbes are the names -db-probe annotates results under
+var databaseProbes = []string{"mysql", "postgresql", "redis", "mongodb"}
+
+// formatDatabase summarizes a -db-probe, e.g. "redis: Redis 7.2.4, no auth" or
+// "postgresql: PostgreSQL, auth required", or returns "" when there was none
+func formatDatabase(annotations map[string]string) string {
+	for _, name := range databaseProbes {
+		product := annotations[name+".product"]
+		if product == "" {
+			continue
+		}
+		line := name + ": " + product
+		if version := annotations[name+".version"]; version != "" {
+			line += " " + version
+		}
+		switch annotations[name+".auth"] {
+		case "none":
+			line += ", no auth"
+		case "required":
+			line += ", auth required"
+		}
+		return line
+	}
+	return ""
+}
+
+// formatHTTP summarizes an HTTP probe, e.g. `https: 200, Server: nginx, "Welcome"` or
+// "http: 301 -> https://example.com/"
+func formatHTTP(info *scanner.HTTPInfo) string {
+	scheme, _, _ := strings.Cut(info.URL, ":")
+	line := fmt.Sprintf("%s: %d", scheme, info.Status)
+	if info.Location != "" {
+		line += " -> " + info.Location
+	}
+	if info.Server != "" {
+		line += ", Server: " + info.Server
+	}
+	if info.Title != "" {
+		line += ", " + strconv.Quote(info.Title)
+	}
+	return line
+}
+
+// attemptAttrs describes one connection attempt for the -vv log, with the state its error
+// was classified as, e.g. state=closed error="connect: connection refused"
+func attemptAttrs(attempt scanner.Attempt) []any {
+	attrs := []any{"ip", attempt.IP, "port", attempt.Port, "protocol", attempt.Protocol,
+		"attempt", attempt.Number, "state", attempt.State}
+	if attempt.Latency > 0 {
+		attrs = append(attrs, "latency", attempt.Latency)
+	}
+	if err := attempt.Err; err != nil {
+		// The address is already logged, so drop the "dial tcp host:port" prefix
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			err = opErr.Err
+		}
+		attrs = append(attrs, "error", err.Error())
+	}
+	return attrs
+}
+
+// formatLatency keeps about two significant digits, e.g. 85µs, 1.3ms or 12ms
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= 10*time.Millisecond:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(100 * time.Microsecond).String()
+	default:
+		return d.Round(time.Microsecond).String()
+	}
+}
+
+// formatElapsed shows whole scans to a tenth of a second, e.g. 4.2s, and short ones like latencies
+func formatElapsed(d time.Duration) string {
+	if d >= time.Second {
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return formatLatency(d)
+}
+
+// startProgress redraws a single progress line on w every progress.Interval until the returned stop function is called
+func startProgress(w io.Writer, label string, progress progressConfig) func() {
+	start := time.Now()
+	ticker := time.NewTicker(progress.Interval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(w, "\r\033[K%s", formatProgress(label, int(progress.Scanned.Load()), progress.Total, progress.RateLimit, time.Since(start)))
+			case <-done:
+				fmt.Fprint(w, "\r\033[K")
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+func formatProgress(label string, done, total, rateLimit int, elapsed time.Duration) string {
+	line := "Progress: "
+	if label != "" {
+		line += label + ", "
+	}
+	line += fmt.Sprintf("%d/%d ports (%.1f%%), %.0f ports/s", done, total,
+		float64(done)*100/float64(total), float64(done)/elapsed.Seconds())
+	if rateLimit > 0 {
+		line += fmt.Sprintf(" (limit %d/s)", rateLimit)
+	}
+	if done > 0 && done < total {
+		eta := time.Duration(float64(elapsed) / float64(done) * float64(total-done))
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	return line
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func printSummary(w io.Writer, host string, summary scanner.Summary, excluded int) {
+	if summary.Stopped && summary.Scanned < summary.Total {
+		fmt.Fprintf(w, "Stopped after %d open port(s), %d of %d ports scanned\n", summary.States[scanner.StateOpen], summary.Scanned, summary.Total)
+	} else if summary.Scanned < summary.Total {
+		fmt.Fprintf(w, "Scan interrupted at port %d of %d\n", summary.Scanned, summary.Total)
+	}
+
+	if open := summary.States[scanner.StateOpen]; open == 0 {
+		fmt.Fprintln(w, "No open ports found.")
+	} else {
+		fmt.Fprintf(w, "Total open ports on %s: %d\n", host, open)
+		fmt.Fprintf(w, "Latency: min %s, avg %s, max %s\n",
+			formatLatency(summary.MinLatency), formatLatency(summary.AvgLatency), formatLatency(summary.MaxLatency))
+	}
+	fmt.Fprintf(w, "Closed: %d, Filtered: %d, Errors: %d\n",
+		summary.States[scanner.StateClosed], summary.States[scanner.StateFiltered], summary.States[scanner.StateError])
+	if openFiltered := summary.States[scanner.StateOpenFiltered]; openFiltered > 0 {
+		fmt.Fprintf(w, "Open|filtered (UDP, no response): %d\n", openFiltered)
+	}
+	if excluded > 0 {
+		fmt.Fprintf(w, "Excluded by -exclude-ports: %d\n", excluded)
+	}
+	fmt.Fprintf(w, "Scanned %s in %s (%.0f ports/s)\n", host, formatElapsed(summary.Elapsed), summary.Rate())
+}
+
+func newHostResult(scan *hostScan) HostResult {
+	hostResult := HostResult{
+		Host:           scan.Host,
+		IP:             scan.IP,
+		ScannedAt:      scan.ScannedAt,
+		Via:            scan.Via,
+		ScannerVersion: version.String(),
+		Results:        scan.Results,
+	}
+	if scan.Err != nil {
+		hostResult.Error = scan.Err.Error()
+	}
+	if scan.Discovery != nil {
+		hostResult.Status, hostResult.Reason = "up", scan.Discovery.Reason
+		if !scan.Discovery.Up {
+			hostResult.Status = "down"
+		}
+	}
+	if hostResult.Results == nil {
+		hostResult.Results = []scanner.Result{}
+	}
+	// Counted from the summary rather than the results, which only hold open ports without -a
+	hostResult.OpenPorts = scan.Summary.States[scanner.StateOpen]
+	hostResult.ClosedPorts = scan.Summary.States[scanner.StateClosed]
+	hostResult.FilteredPorts = scan.Summary.States[scanner.StateFiltered]
+	hostResult.ElapsedMS = math.Round(float64(scan.Summary.Elapsed)/float64(time.Microsecond)) / 1000
+	hostResult.PortsPerSecond = math.Round(scan.Summary.Rate())
+	return hostResult
+}
+
+// PortLine is one line of -o jsonl output: a result together with the host it belongs to
+type PortLine struct {
+	Time        time.Time         `json:"timestamp"`
+	Host        string            `json:"host"`
+	IP          string            `json:"ip"`
+	Port        int               `json:"port"`
+	Protocol    string            `json:"protocol"`
+	Open        bool              `json:"open"`
+	State       scanner.State     `json:"state"`
+	Service     string            `json:"service"`
+	Banner      string            `json:"banner,omitempty"`
+	SSH         *scanner.SSHInfo  `json:"ssh,omitempty"`
+	TLS         *scanner.TLSInfo  `json:"tls,omitempty"`
+	HTTP        *scanner.HTTPInfo `json:"http,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Attempts    int               `json:"attempts"`
+	LatencyMS   float64           `json:"latency_ms,omitempty"`
+}
+
+func newPortLine(scan *hostScan, result scanner.Result) PortLine {
+	return PortLine{
+		Time:        result.Timestamp.UTC(),
+		Host:        scan.Host,
+		IP:          scan.IP,
+		Port:        result.Port,
+		Protocol:    result.Protocol,
+		Open:        result.Open,
+		State:       result.State,
+		Service:     result.Service,
+		Banner:      result.Banner,
+		SSH:         result.SSH,
+		TLS:         result.TLS,
+		HTTP:        result.HTTP,
+		Annotations: result.Annotations,
+		Error:       result.Error,
+		Attempts:    result.Attempts,
+		LatencyMS:   math.Round(float64(result.Latency)/float64(time.Microsecond)) / 1000,
+	}
+}
+
+// writeJSONResults writes the hosts as a JSON list, or with diff or policy as an object
+// holding the list under "hosts" next to the "diff" and "policy"
+func writeJSONResults(w io.Writer, hostResults []HostResult, diff *ScanDiff, policy *PolicyCheck, stats *RunStats) error {
+	if hostResults == nil {
+		hostResults = []HostResult{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if diff != nil || policy != nil || stats != nil {
+		return encoder.Encode(jsonReport{Hosts: hostResults, Summary: stats, Diff: diff, Policy: policy})
+	}
+	return encoder.Encode(hostResults)
+}
+
+var csvHeader = []string{"host", "ip", "port", "protocol", "state", "service", "latency_ms", "banner", "timestamp"}
+
+// With -http-probe every row gets these columns after the usual ones, left empty for ports
+// that gave no HTTP answer
+var csvHTTPHeader = []string{"http_status", "http_server", "http_content_length", "http_title"}
+
+func csvHTTPColumns(info *scanner.HTTPInfo) []string {
+	if info == nil {
+		return []string{"", "", "", ""}
+	}
+	length := ""
+	if info.ContentLength >= 0 {
+		length = strconv.FormatInt(info.ContentLength, 10)
+	}
+	return []string{strconv.Itoa(info.Status), info.Server, length, info.Title}
+}
+
+// writeCSVRow writes the row for one result, followed by any extra columns, flushing it
+// straight away so rows reach stdout as the scan finds them
+func writeCSVRow(w io.Writer, scan *hostScan, result scanner.Result, extra ...string) error {
+	latency := ""
+	if result.Latency > 0 {
+		latency = strconv.FormatFloat(float64(result.Latency)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(append([]string{
+		scan.Host, scan.IP, strconv.Itoa(result.Port), result.Protocol,
+		string(result.State), result.Service, latency, result.Banner,
+		result.Timestamp.UTC().Format(time.RFC3339Nano),
+	}, extra...))
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// writeCSVViolation writes a row for a -baseline violation on a port that has no row of
+// its own, leaving the columns only a probe result fills in empty, the -http-probe ones
+// included when httpProbe is set
+func writeCSVViolation(w io.Writer, violation PolicyViolation, httpProbe bool) error {
+	row := []string{
+		violation.Host, violation.IP, strconv.Itoa(violation.Port), violation.Protocol,
+		"", violation.Service, "", "", "",
+	}
+	if httpProbe {
+		row = append(row, csvHTTPColumns(nil)...)
+	}
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(append(row, violation.Violation))
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
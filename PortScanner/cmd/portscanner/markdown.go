@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+// -o markdown writes the run as a document to paste into issues and wikis: a title with
+// when and how the scan ran, a section per host with a table of its ports, and a summary
+// at the end. Banners are cut to their first line and escaped, so a banner cannot break
+// out of its table cell or turn into markup.
+
+// markdownReport collects finished hosts until the document can be written
+type markdownReport struct {
+	args  []string
+	start time.Time
+	hosts bytes.Buffer
+	// Counts for the closing summary
+	total, up, open int
+}
+
+func newMarkdownReport(args []string, start time.Time) *markdownReport {
+	return &markdownReport{args: args, start: start}
+}
+
+// markdownEscaper escapes everything that means something inside a table cell
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "|", `\|`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "~", `\~`, "#", `\#`,
+)
+
+// Add writes the section of a finished host
+func (r *markdownReport) Add(scan *hostScan) {
+	r.total++
+	w := &r.hosts
+	fmt.Fprintf(w, "\n## %s\n\n", markdownEscaper.Replace(hostLabel(scan)))
+	switch {
+	case scan.Err != nil:
+		fmt.Fprintf(w, "Not scanned: %s\n", markdownEscaper.Replace(scan.Err.Error()))
+		return
+	case scan.Down():
+		fmt.Fprintf(w, "Down (%s), not scanned\n", markdownEscaper.Replace(scan.Discovery.Reason))
+		return
+	}
+	r.up++
+	open := scan.Summary.States[scanner.StateOpen]
+	r.open += open
+	fmt.Fprintf(w, "%d open, %d closed, %d filtered, scanned in %s\n", open, scan.Summary.States[scanner.StateClosed],
+		scan.Summary.States[scanner.StateFiltered], formatElapsed(scan.Summary.Elapsed))
+	if scan.Summary.Scanned < scan.Summary.Total {
+		fmt.Fprintf(w, "\nOnly %d of %d ports were scanned before the scan was stopped.\n", scan.Summary.Scanned, scan.Summary.Total)
+	}
+	if len(scan.Results) > 0 {
+		// The HTTP column is only there when some port of the host answered -http-probe
+		withHTTP := false
+		for _, result := range scan.Results {
+			withHTTP = withHTTP || result.HTTP != nil
+		}
+		if withHTTP {
+			fmt.Fprintf(w, "\n| Port | State | Service | Latency | Banner | HTTP |\n|---:|---|---|---:|---|---|\n")
+		} else {
+			fmt.Fprintf(w, "\n| Port | State | Service | Latency | Banner |\n|---:|---|---|---:|---|\n")
+		}
+		for _, result := range scan.Results {
+			latency := ""
+			if result.Latency > 0 {
+				latency = formatLatency(result.Latency)
+			}
+			fmt.Fprintf(w, "| %d/%s | %s | %s | %s | %s |", result.Port, result.Protocol, result.State,
+				markdownEscaper.Replace(result.Service), latency, markdownBanner(result.Banner))
+			if withHTTP {
+				cell := ""
+				if result.HTTP != nil {
+					cell = markdownBanner(formatHTTP(result.HTTP))
+				}
+				fmt.Fprintf(w, " %s |", cell)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	if len(scan.violations) > 0 {
+		fmt.Fprintf(w, "\nBaseline violations:\n\n")
+		for _, violation := range scan.violations {
+			fmt.Fprintf(w, "- %s\n", markdownEscaper.Replace(violation.describe()))
+		}
+	}
+}
+
+// Write writes the document
+func (r *markdownReport) Write(w io.Writer, end time.Time, interrupted bool) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Port scan report\n\n")
+	fmt.Fprintf(&buf, "- Started: %s\n", r.start.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(&buf, "- Command: `` %s ``\n", strings.Join(r.args, " "))
+	fmt.Fprintf(&buf, "- Scanner: portscanner %s\n", version.String())
+	buf.Write(r.hosts.Bytes())
+	fmt.Fprintf(&buf, "\n## Summary\n\n")
+	fmt.Fprintf(&buf, "Scanned %d of %d host(s) in %s, %d open port(s) in total.\n", r.up, r.total, formatElapsed(end.Sub(r.start)), r.open)
+	if interrupted {
+		fmt.Fprintf(&buf, "\nThe scan was stopped early, so the results are partial.\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// markdownBanner is the first line of a banner, fit for a table cell
+func markdownBanner(banner string) string {
+	line, _, _ := strings.Cut(banner, "\n")
+	line = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, line))
+	return markdownEscaper.Replace(line)
+}
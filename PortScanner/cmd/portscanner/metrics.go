@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// -metrics-listen serves Prometheus metrics about the run on /metrics for as long as the
+// run lasts. They live in a registry of their own, so the endpoint shows the scan and not
+// the Go runtime. The scanner's OnResult and OnAttempt hooks only touch counters looked up
+// when a host is added, so workers never wait on a label lookup, and without the flag the
+// hooks are not installed at all.
+
+// connectionErrorReasons label portscanner_connection_errors_total, indexed by
+// connectionErrorReason
+var connectionErrorReasons = [...]string{"refused", "timeout", "no_response", "error"}
+
+// connectionErrorReason maps the state of a failed attempt to its reason, or -1 when the
+// port answered
+func connectionErrorReason(state scanner.State) int {
+	switch state {
+	case scanner.StateClosed:
+		return 0
+	case scanner.StateFiltered:
+		return 1
+	case scanner.StateOpenFiltered:
+		return 2
+	case scanner.StateError:
+		return 3
+	}
+	return -1
+}
+
+// scanDurationBuckets are the upper bounds in seconds of portscanner_host_scan_duration_seconds
+var scanDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+type addrMetrics struct {
+	Host string
+	IP   string
+	// Open is the host's portscanner_ports_open_total, shared by every address of the host
+	Open prometheus.Counter
+}
+
+type scanMetrics struct {
+	handler http.Handler
+	// scanned backs portscanner_ports_scanned_total and the scan rate
+	scanned atomic.Int64
+	// byIP is filled by AddHost before serveMetrics is called and before the scan starts,
+	// and only read from then on, so it needs no lock
+	byIP      map[string]*addrMetrics
+	openPorts *prometheus.GaugeVec
+	errors    [len(connectionErrorReasons)]prometheus.Counter
+	durations prometheus.Histogram
+	rate      prometheus.Gauge
+	openTotal *prometheus.CounterVec
+}
+
+func newScanMetrics() *scanMetrics {
+	started := time.Now()
+	m := &scanMetrics{
+		byIP: make(map[string]*addrMetrics),
+		openTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "portscanner_ports_open_total",
+			Help: "Open ports found so far, by host.",
+		}, []string{"host"}),
+		openPorts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "portscanner_open_ports",
+			Help: "Open ports found by the last complete scan of each address.",
+		}, []string{"host", "ip"}),
+		durations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "portscanner_host_scan_duration_seconds",
+			Help:    "How long complete scans of a host took.",
+			Buckets: scanDurationBuckets,
+		}),
+		rate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "portscanner_scan_rate",
+			Help: "Ports probed per second over the last second.",
+		}),
+	}
+	connectionErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "portscanner_connection_errors_total",
+		Help: "Connection attempts that did not find a port open, by reason.",
+	}, []string{"reason"})
+	for i, reason := range connectionErrorReasons {
+		m.errors[i] = connectionErrors.WithLabelValues(reason)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "portscanner_ports_scanned_total",
+			Help: "Ports probed so far over every host.",
+		}, func() float64 { return float64(m.scanned.Load()) }),
+		m.openTotal,
+		m.openPorts,
+		connectionErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "portscanner_scan_duration_seconds",
+			Help: "Time since the scan started.",
+		}, func() float64 { return time.Since(started).Seconds() }),
+		m.durations,
+		m.rate,
+	)
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// AddHost registers a scanned address under its host name, so its open ports are labeled
+// with the name. It must not be called once m is served or the scan has started.
+func (m *scanMetrics) AddHost(host, ip string) {
+	m.byIP[ip] = &addrMetrics{Host: host, IP: ip, Open: m.openTotal.WithLabelValues(host)}
+}
+
+// Record is the scanner.Options.OnResult hook
+func (m *scanMetrics) Record(ip string, result scanner.Result) {
+	m.scanned.Add(1)
+	if addr := m.byIP[ip]; addr != nil && result.Open {
+		addr.Open.Inc()
+	}
+}
+
+// HostScanned records a finished scan of ip. One that was cut short tells neither how long
+// the host takes nor what it has open, so it is left out.
+func (m *scanMetrics) HostScanned(ip string, summary scanner.Summary) {
+	if summary.Scanned < summary.Total {
+		return
+	}
+	m.durations.Observe(summary.Elapsed.Seconds())
+	if addr := m.byIP[ip]; addr != nil {
+		m.openPorts.WithLabelValues(addr.Host, addr.IP).Set(float64(summary.States[scanner.StateOpen]))
+	}
+}
+
+// Attempt is the scanner.Options.OnAttempt hook
+func (m *scanMetrics) Attempt(attempt scanner.Attempt) {
+	if reason := connectionErrorReason(attempt.State); reason >= 0 {
+		m.errors[reason].Inc()
+	}
+}
+
+// measureRate samples the scan rate every second until ctx is done
+func (m *scanMetrics) measureRate(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last, lastAt := m.scanned.Load(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			scanned := m.scanned.Load()
+			m.rate.Set(float64(scanned-last) / now.Sub(lastAt).Seconds())
+			last, lastAt = scanned, now
+		}
+	}
+}
+
+func (m *scanMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// serveMetrics serves m on listener until the returned function is called, which stops the
+// server and waits for it to finish
+func serveMetrics(listener net.Listener, m *scanMetrics) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Serve(listener)
+	}()
+	go m.measureRate(ctx)
+	return func() {
+		cancel()
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+		defer cancelShutdown()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			server.Close()
+		}
+		<-done
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// reportFile is the -out file. The report is written to a temporary file in the same
+// directory and only renamed over the destination by Close, so a scan that crashes or
+// fails to write never leaves a half-written report behind. Appending copies the
+// existing report into the temporary file first, which keeps appends atomic as well.
+type reportFile struct {
+	*os.File
+	path string
+}
+
+// createReportFile starts a report at path. An existing file is only replaced with force,
+// or extended with appendTo; nonEmpty tells whether the report already has content, so
+// formats with a header can leave it out.
+func createReportFile(path string, appendTo, force bool) (file *reportFile, nonEmpty bool, err error) {
+	info, err := os.Stat(path)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, err
+	}
+	if exists && !appendTo && !force {
+		return nil, false, fmt.Errorf("%s already exists (use -force to overwrite it or -append to add to it)", path)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, false, err
+	}
+	file = &reportFile{File: tmp, path: path}
+	mode := fs.FileMode(0o644)
+	if exists {
+		mode = info.Mode().Perm()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		file.Abort()
+		return nil, false, err
+	}
+	if exists && appendTo {
+		if err := copyFile(tmp, path); err != nil {
+			file.Abort()
+			return nil, false, err
+		}
+		nonEmpty = info.Size() > 0
+	}
+	return file, nonEmpty, nil
+}
+
+// Close finishes the report and moves it into place
+func (f *reportFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort throws the report away, leaving any existing file at the destination untouched
+func (f *reportFile) Abort() {
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+func copyFile(w io.Writer, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(w, src)
+	return err
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// reportFormat is how one -o format is written over a run. Any step is left nil when the
+// format has nothing to write at that point.
+type reportFormat struct {
+	// output names the format in write errors, e.g. "CSV output"
+	output string
+	// document formats are written whole at the end of the run, so -append cannot add to them
+	document bool
+	// summaries puts each host's summary in the report instead of only in the log
+	summaries bool
+	// start writes the beginning of the report, before the first host is scanned
+	start func(r *reportWriter) error
+	// result writes a port as soon as it is found. keep asks for it to be added to the
+	// host's Results for host or finish to write; without result every port is kept.
+	result func(r *reportWriter, scan *hostScan, w io.Writer, result scanner.Result) (keep bool, err error)
+	// host writes a host once its scan is done
+	host func(r *reportWriter, scan *hostScan) error
+	// unscanned writes a host that could not be resolved or did not answer -ping
+	unscanned func(r *reportWriter, scan *hostScan) error
+	// changes writes what -diff found, and violations what -baseline found
+	changes    func(r *reportWriter, diff *ScanDiff) error
+	violations func(r *reportWriter, check *PolicyCheck) error
+	// finish writes the end of the report once every host is done
+	finish func(r *reportWriter, end reportEnd) error
+}
+
+// reportFormats are the -o formats, plus "template" for -template
+var reportFormats = map[string]reportFormat{
+	"text": {
+		output:    "output",
+		summaries: true,
+		result: func(r *reportWriter, scan *hostScan, w io.Writer, result scanner.Result) (bool, error) {
+			// Grouped lines are written once the host is done
+			if r.flags.groupResults {
+				return true, nil
+			}
+			_, err := fmt.Fprintln(w, formatResult(result, r.lineStyle, r.verbose))
+			return false, err
+		},
+		host: func(r *reportWriter, scan *hostScan) error {
+			if r.flags.groupResults {
+				if err := writeGrouped(r.report, scan.Results, r.lineStyle, r.verbose, r.log.Enabled(logNormal)); err != nil {
+					return err
+				}
+			}
+			if r.log.Enabled(logNormal) {
+				printSummary(r.report, scan.Host, scan.Summary, r.excludedPorts)
+				if r.echo {
+					printSummary(r.log, scan.Host, scan.Summary, r.excludedPorts)
+				}
+			}
+			return nil
+		},
+		changes: func(r *reportWriter, diff *ScanDiff) error {
+			return writeDiffText(r.out, diff)
+		},
+		violations: func(r *reportWriter, check *PolicyCheck) error {
+			return writePolicyText(r.out, check)
+		},
+	},
+	"json": {
+		output:   "JSON output",
+		document: true,
+		finish: func(r *reportWriter, end reportEnd) error {
+			return writeJSONResults(r.out, end.Results, end.Diff, end.Policy, end.Stats)
+		},
+	},
+	"jsonl": {
+		output: "JSONL output",
+		// JSON lines do not have to be grouped by host, so they skip the per-host buffer
+		// and go straight out, one whole line at a time
+		result: func(r *reportWriter, scan *hostScan, w io.Writer, result scanner.Result) (bool, error) {
+			line, err := json.Marshal(newPortLine(scan, result))
+			if err != nil {
+				return false, err
+			}
+			r.jsonlMu.Lock()
+			defer r.jsonlMu.Unlock()
+			_, err = r.out.Write(append(line, '\n'))
+			return false, err
+		},
+		changes: func(r *reportWriter, diff *ScanDiff) error {
+			return writeDiffJSONLines(r.out, diff)
+		},
+		violations: func(r *reportWriter, check *PolicyCheck) error {
+			return writePolicyJSONLines(r.out, check.Violations)
+		},
+	},
+	"csv": {
+		output: "CSV output",
+		start: func(r *reportWriter) error {
+			if !r.header {
+				return nil
+			}
+			columns := append([]string(nil), csvHeader...)
+			if r.flags.httpProbe {
+				columns = append(columns, csvHTTPHeader...)
+			}
+			if r.policy != nil {
+				columns = append(columns, "violation")
+			}
+			w := csv.NewWriter(r.out)
+			w.Write(columns)
+			w.Flush()
+			return w.Error()
+		},
+		result: func(r *reportWriter, scan *hostScan, w io.Writer, result scanner.Result) (bool, error) {
+			var extra []string
+			if r.flags.httpProbe {
+				extra = csvHTTPColumns(result.HTTP)
+			}
+			if r.policy != nil {
+				violation := ""
+				if scan.Policy != nil {
+					violation = scan.Policy.Violation(result)
+				}
+				extra = append(extra, violation)
+			}
+			return false, writeCSVRow(w, scan, result, extra...)
+		},
+		host: func(r *reportWriter, scan *hostScan) error {
+			// Ports that are not open only have a row of their own with -a
+			if r.flags.showAll {
+				return nil
+			}
+			for _, violation := range scan.violations {
+				if violation.Violation != violationExpectedClosed {
+					continue
+				}
+				if err := writeCSVViolation(r.report, violation, r.flags.httpProbe); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	"xml": documentFormat("XML output", func(r *reportWriter) documentReport {
+		return newXMLReport(os.Args, r.ports, r.protocols, r.start)
+	}),
+	"html": documentFormat("HTML output", func(r *reportWriter) documentReport {
+		return newHTMLReport(os.Args, r.start)
+	}),
+	"markdown": documentFormat("Markdown output", func(r *reportWriter) documentReport {
+		return newMarkdownReport(os.Args, r.start)
+	}),
+	"grep": {
+		output: "grep output",
+		start: func(r *reportWriter) error {
+			return writeGrepHeader(r.out, os.Args, r.start)
+		},
+		host:      writeGrepReportHost,
+		unscanned: writeGrepReportHost,
+		finish: func(r *reportWriter, end reportEnd) error {
+			return writeGrepFooter(r.out, end.Time, end.Hosts, end.Up, end.Time.Sub(r.start))
+		},
+	},
+	"list": {
+		output: "output",
+		result: func(r *reportWriter, scan *hostScan, w io.Writer, result scanner.Result) (bool, error) {
+			// Only open ports are listed, even with -a
+			if !result.Open {
+				return false, nil
+			}
+			_, err := fmt.Fprintln(w, net.JoinHostPort(scan.Host, strconv.Itoa(result.Port)))
+			return false, err
+		},
+	},
+	"template": {
+		output: "output",
+		result: func(r *reportWriter, scan *hostScan, w io.Writer, result scanner.Result) (bool, error) {
+			if r.flags.outTemplate.PerHost {
+				return true, nil
+			}
+			return false, r.flags.outTemplate.WriteResult(w, scan, result)
+		},
+		host:      writeTemplateReportHost,
+		unscanned: writeTemplateReportHost,
+	},
+}
+
+// documentFormat is a format whose documentReport collects every host, scanned or not, and
+// is written at the end of the run
+func documentFormat(output string, newDocument func(r *reportWriter) documentReport) reportFormat {
+	add := func(r *reportWriter, scan *hostScan) error {
+		r.document.Add(scan)
+		return nil
+	}
+	return reportFormat{
+		output:   output,
+		document: true,
+		start: func(r *reportWriter) error {
+			r.document = newDocument(r)
+			return nil
+		},
+		host:      add,
+		unscanned: add,
+		finish: func(r *reportWriter, end reportEnd) error {
+			return r.document.Write(r.out, end.Time, end.Interrupted)
+		},
+	}
+}
+
+func writeGrepReportHost(r *reportWriter, scan *hostScan) error {
+	return writeGrepHost(r.out, scan)
+}
+
+func writeTemplateReportHost(r *reportWriter, scan *hostScan) error {
+	if !r.flags.outTemplate.PerHost {
+		return nil
+	}
+	return r.flags.outTemplate.WriteHost(r.report, scan)
+}
+
+// reportEnd is what the end of a report is written from
+type reportEnd struct {
+	Time time.Time
+	// Interrupted tells that Ctrl+C or -deadline cut the run short
+	Interrupted bool
+	// Hosts counts every target that was resolved or failed to, Up the ones that were scanned
+	Hosts, Up int
+	Results   []HostResult
+	Diff      *ScanDiff
+	Policy    *PolicyCheck
+	Stats     *RunStats
+}
+
+// reportWriter writes the report of a run in the format of the table above
+type reportWriter struct {
+	format reportFormat
+	flags  *scanFlags
+	log    *logger
+	// out is where the report goes, and report is out or, when both go to stdout, the
+	// logger, so lines written once a host is done cannot land in a log message
+	out, report io.Writer
+	// header is false when -append adds to a report that already has one
+	header bool
+	// echo repeats the port lines as text on the console while the report goes to -out
+	echo                 bool
+	echoStyle, lineStyle style
+	verbose              bool
+	// diffOnly leaves the port lines out of a text report, which is only the -diff changes
+	diffOnly bool
+	// keepAll keeps every port in its host's Results, for a -webhook that posts the JSON report
+	keepAll       bool
+	policy        *portPolicy
+	excludedPorts int
+	ports         []int
+	protocols     []string
+	start         time.Time
+
+	document documentReport
+	jsonlMu  sync.Mutex
+}
+
+// Start writes the beginning of the report
+func (r *reportWriter) Start() error {
+	if r.format.start == nil {
+		return nil
+	}
+	return r.format.start(r)
+}
+
+// Result writes a port as it is found. It is the stream hook of scanHosts, with status and
+// w the host's log and port lines.
+func (r *reportWriter) Result(scan *hostScan, status, w io.Writer, result scanner.Result) error {
+	if r.diffOnly {
+		return nil
+	}
+	if r.echo {
+		fmt.Fprintln(status, formatResult(result, r.echoStyle, r.verbose))
+	}
+	keep, err := true, error(nil)
+	if r.format.result != nil {
+		keep, err = r.format.result(r, scan, w, result)
+	}
+	if keep || r.keepAll {
+		scan.Results = append(scan.Results, result)
+	}
+	return err
+}
+
+// Host writes a host once its scan is done, including any error from writing its ports
+func (r *reportWriter) Host(scan *hostScan) error {
+	if !r.format.summaries && r.log.Enabled(logNormal) {
+		printSummary(r.log, scan.Host, scan.Summary, r.excludedPorts)
+	}
+	if scan.streamErr != nil {
+		return scan.streamErr
+	}
+	if r.format.host == nil {
+		return nil
+	}
+	return r.format.host(r, scan)
+}
+
+// Unscanned writes a host that failed to resolve or did not answer -ping
+func (r *reportWriter) Unscanned(scan *hostScan) error {
+	if r.format.unscanned == nil {
+		return nil
+	}
+	return r.format.unscanned(r, scan)
+}
+
+// Changes writes what -diff found, for the formats that do not carry it in their end
+func (r *reportWriter) Changes(diff *ScanDiff) error {
+	if r.format.changes == nil {
+		return nil
+	}
+	return r.format.changes(r, diff)
+}
+
+// Violations writes what -baseline found, or only counts it in the log for formats that
+// carry the violations with their hosts
+func (r *reportWriter) Violations(check *PolicyCheck) error {
+	if r.format.violations == nil {
+		r.log.Infof("Baseline %s: %d violation(s)", r.flags.baselineFile, len(check.Violations))
+		return nil
+	}
+	return r.format.violations(r, check)
+}
+
+// Finish writes the end of the report
+func (r *reportWriter) Finish(end reportEnd) error {
+	if r.format.finish == nil {
+		return nil
+	}
+	return r.format.finish(r, end)
+}
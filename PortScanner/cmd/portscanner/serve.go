@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// -serve runs the scanner as an HTTP service. POST /scan takes one host with optional
+// ports and workers and answers with the host's JSON report, the same object -o json
+// writes for each host. The command line settings are the defaults for every request,
+// and -w is also the most workers a request may ask for. Every request scans through
+// one Scanner, so -rate caps the server as a whole rather than each scan. At most -serve-max-scans scans
+// run at once; requests beyond that are turned away with 503 rather than queued, so a
+// flood of requests cannot start an unbounded number of workers. A client that hangs up
+// cancels its scan.
+
+// Default for -serve-max-scans
+const defaultServeMaxScans = 4
+
+// How long a stopping server waits for scans in progress to be answered
+const serveShutdownTimeout = 5 * time.Second
+
+// ScanRequest is the body of POST /scan
+type ScanRequest struct {
+	Host string `json:"host"`
+	// Ports is a list of port numbers or a string in the -ports format, e.g. "22,80,8000-8100";
+	// the server's ports when left out
+	Ports json.RawMessage `json:"ports,omitempty"`
+	// Workers is the server's -w when zero
+	Workers int `json:"workers,omitempty"`
+}
+
+// serveError is the body of every response that is not a scan report
+type serveError struct {
+	Error string `json:"error"`
+}
+
+type scanServer struct {
+	log  *logger
+	opts scanner.Options
+	// scanner is narrowed to each request's ports and workers
+	scanner *scanner.Scanner
+	// slots holds a token for every scan in progress
+	slots chan struct{}
+	mux   *http.ServeMux
+}
+
+// newScanServer returns a server for opts, which must be closed once it stops serving
+func newScanServer(log *logger, opts scanner.Options, maxScans int) *scanServer {
+	// Progress is a single line for a single scan, which concurrent requests cannot share
+	opts.Progress = nil
+	server := &scanServer{log: log, opts: opts, scanner: scanner.New(opts), slots: make(chan struct{}, maxScans), mux: http.NewServeMux()}
+	server.mux.HandleFunc("/scan", server.handleScan)
+	return server
+}
+
+func (server *scanServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+// Close releases the scanner's rate limit
+func (server *scanServer) Close() {
+	server.scanner.Close()
+}
+
+// serve answers scan requests on listener until ctx is cancelled, then gives the scans
+// in progress a moment to be answered
+func serve(ctx context.Context, log *logger, listener net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+	log.Infof("Serving scans on http://%s/scan, press Ctrl+C to stop", listener.Addr())
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+	}
+	if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (server *scanServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeServeJSON(w, http.StatusMethodNotAllowed, serveError{"use POST"})
+		return
+	}
+	var req ScanRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeServeJSON(w, http.StatusBadRequest, serveError{fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	opts, host, err := server.requestOptions(req)
+	if err != nil {
+		writeServeJSON(w, http.StatusBadRequest, serveError{err.Error()})
+		return
+	}
+
+	select {
+	case server.slots <- struct{}{}:
+		defer func() { <-server.slots }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		writeServeJSON(w, http.StatusServiceUnavailable, serveError{fmt.Sprintf("%d scans are already running, try again later", cap(server.slots))})
+		return
+	}
+
+	// The request's context ends when the client disconnects, which stops the scan
+	ctx := r.Context()
+	s := server.scanner.Narrow(opts.Ports, opts.Workers)
+	scan := &hostScan{Host: host, ScannedAt: time.Now()}
+	server.log.Verbose("scan request", "remote", r.RemoteAddr, "host", host, "ports", len(opts.Ports), "workers", opts.Workers)
+	scan.IP, scan.Err = s.Resolve(ctx, host)
+	if scan.Err != nil {
+		if ctx.Err() == nil {
+			writeServeJSON(w, http.StatusUnprocessableEntity, newHostResult(scan))
+		}
+		return
+	}
+	scan.Results, scan.Summary, err = s.ScanWithSummary(ctx, scan.IP)
+	if err != nil {
+		server.log.Verbose("scan cancelled", "remote", r.RemoteAddr, "host", host, "scanned", scan.Summary.Scanned, "total", scan.Summary.Total)
+		return
+	}
+	server.log.Verbose("host scanned", "remote", r.RemoteAddr, "host", host, "ip", scan.IP, "open", scan.Summary.States[scanner.StateOpen],
+		"elapsed", scan.Summary.Elapsed)
+	writeServeJSON(w, http.StatusOK, newHostResult(scan))
+}
+
+// requestOptions checks a request and returns the scanner options for it along with its
+// cleaned host
+func (server *scanServer) requestOptions(req ScanRequest) (scanner.Options, string, error) {
+	opts := server.opts
+	if req.Host == "" {
+		return opts, "", errors.New("host is required")
+	}
+	host, err := cleanHostEntry(req.Host)
+	if err != nil {
+		return opts, "", err
+	}
+	if strings.Contains(host, "/") {
+		return opts, "", fmt.Errorf("%q is a CIDR range, not a single host", req.Host)
+	}
+	if len(req.Ports) > 0 {
+		if opts.Ports, err = parseRequestPorts(req.Ports); err != nil {
+			return opts, "", err
+		}
+	}
+	switch {
+	case req.Workers < 0 || req.Workers > server.opts.Workers:
+		return opts, "", fmt.Errorf("workers must be between 1 and %d, not %d", server.opts.Workers, req.Workers)
+	case req.Workers > 0:
+		opts.Workers = req.Workers
+	}
+	return opts, host, nil
+}
+
+// parseRequestPorts reads the ports of a request, either a list of numbers or a -ports spec
+func parseRequestPorts(raw json.RawMessage) ([]int, error) {
+	var spec string
+	if err := json.Unmarshal(raw, &spec); err == nil {
+		ports, err := parsePortSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ports: %v", err)
+		}
+		return ports, nil
+	}
+	var list []int
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.New(`ports must be a list of numbers or a string such as "22,80,8000-8100"`)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("ports must not be empty")
+	}
+	seen := make(map[int]bool, len(list))
+	var ports []int
+	for _, port := range list {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d (expected 1-65535)", port)
+		}
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+func writeServeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// statsTop is how many ports and hosts the -stats summary ranks
+const statsTop = 5
+
+// RunStats is the -stats summary of a whole run, in the "summary" object of JSON reports
+type RunStats struct {
+	HostsScanned int `json:"hosts_scanned"`
+	OpenPorts    int `json:"open_ports"`
+	// TopPorts are the ports open on the most hosts, TopHosts the hosts with the most open
+	// ports, statsTop of each at most
+	TopPorts []PortCount `json:"top_ports"`
+	TopHosts []HostCount `json:"top_hosts"`
+}
+
+type PortCount struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Service  string `json:"service"`
+	Hosts    int    `json:"hosts"`
+}
+
+type HostCount struct {
+	Host      string `json:"host"`
+	IP        string `json:"ip,omitempty"`
+	OpenPorts int    `json:"open_ports"`
+}
+
+// statsAggregator adds up -stats as results stream in from hosts scanned in parallel and as
+// each host finishes, so it is safe for concurrent use
+type statsAggregator struct {
+	mu       sync.Mutex
+	ports    map[portKey]*PortCount
+	hosts    []HostCount
+	scanned  int
+	openSeen int
+}
+
+func newStatsAggregator() *statsAggregator {
+	return &statsAggregator{ports: make(map[portKey]*PortCount)}
+}
+
+// Result counts an open port towards the hosts it is open on; a host reports each port once
+func (a *statsAggregator) Result(result scanner.Result) {
+	if !result.Open {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := portKey{result.Port, result.Protocol}
+	count, ok := a.ports[key]
+	if !ok {
+		count = &PortCount{Port: result.Port, Protocol: result.Protocol, Service: result.Service}
+		a.ports[key] = count
+	}
+	count.Hosts++
+}
+
+// Host records a host once it is done, with the open ports of its summary, which also
+// covers any cut short by -first-open
+func (a *statsAggregator) Host(scan *hostScan) {
+	open := scan.Summary.States[scanner.StateOpen]
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.scanned++
+	a.openSeen += open
+	if open > 0 {
+		a.hosts = append(a.hosts, HostCount{Host: scan.Host, IP: scan.IP, OpenPorts: open})
+	}
+}
+
+// Stats ranks what has been recorded so far. Ties go to the lower port, and to the host
+// that finished first.
+func (a *statsAggregator) Stats() *RunStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := &RunStats{HostsScanned: a.scanned, OpenPorts: a.openSeen, TopPorts: []PortCount{}, TopHosts: []HostCount{}}
+	for _, count := range a.ports {
+		stats.TopPorts = append(stats.TopPorts, *count)
+	}
+	sort.Slice(stats.TopPorts, func(i, j int) bool {
+		x, y := stats.TopPorts[i], stats.TopPorts[j]
+		if x.Hosts != y.Hosts {
+			return x.Hosts > y.Hosts
+		}
+		if x.Port != y.Port {
+			return x.Port < y.Port
+		}
+		return x.Protocol < y.Protocol
+	})
+	stats.TopHosts = append(stats.TopHosts, a.hosts...)
+	sort.SliceStable(stats.TopHosts, func(i, j int) bool {
+		return stats.TopHosts[i].OpenPorts > stats.TopHosts[j].OpenPorts
+	})
+	stats.TopPorts = stats.TopPorts[:min(len(stats.TopPorts), statsTop)]
+	stats.TopHosts = stats.TopHosts[:min(len(stats.TopHosts), statsTop)]
+	return stats
+}
+
+// writeStats prints the -stats summary, e.g.
+//
+//	Hosts scanned: 12, open ports: 31
+//	Most common open ports: 22/tcp (ssh) on 10 host(s), 80/tcp (http) on 6 host(s)
+//	Most open ports: web1 with 7, db.internal (10.0.0.5) with 5
+func writeStats(w io.Writer, stats *RunStats) error {
+	if _, err := fmt.Fprintf(w, "Hosts scanned: %d, open ports: %d\n", stats.HostsScanned, stats.OpenPorts); err != nil {
+		return err
+	}
+	if len(stats.TopPorts) == 0 {
+		return nil
+	}
+	ports := make([]string, len(stats.TopPorts))
+	for i, count := range stats.TopPorts {
+		ports[i] = fmt.Sprintf("%d/%s (%s) on %d host(s)", count.Port, count.Protocol, count.Service, count.Hosts)
+	}
+	hosts := make([]string, len(stats.TopHosts))
+	for i, count := range stats.TopHosts {
+		label := count.Host
+		if count.IP != "" && count.IP != count.Host {
+			label += " (" + count.IP + ")"
+		}
+		hosts[i] = fmt.Sprintf("%s with %d", label, count.OpenPorts)
+	}
+	_, err := fmt.Fprintf(w, "Most common open ports: %s\nMost open ports: %s\n", strings.Join(ports, ", "), strings.Join(hosts, ", "))
+	return err
+}
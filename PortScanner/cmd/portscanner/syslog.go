@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// -syslog sends every open port to the system log as it is found, alongside the normal
+// report; with -watch it sends every change instead. Opening the log is platform specific: log/syslog does not exist on Windows or
+// Plan 9, where openSyslog always fails, so -syslog is rejected before anything is scanned.
+
+// Defaults for -syslog-facility and -syslog-tag
+const (
+	defaultSyslogFacility = "user"
+	defaultSyslogTag      = "portscanner"
+)
+
+// syslogSender is the part of *syslog.Writer findings are sent through
+type syslogSender interface {
+	Info(msg string) error
+	Close() error
+}
+
+// formatSyslogFinding renders an open port as key=value pairs for log collectors, e.g.
+// "open port host=db1 ip=10.0.0.5 port=5432 protocol=tcp service=postgresql"
+func formatSyslogFinding(scan *hostScan, result scanner.Result) string {
+	msg := fmt.Sprintf("open port host=%s ip=%s port=%d protocol=%s service=%s",
+		scan.Host, scan.IP, result.Port, result.Protocol, result.Service)
+	if result.Banner != "" {
+		msg += " banner=" + strconv.Quote(result.Banner)
+	}
+	if info := result.HTTP; info != nil {
+		msg += fmt.Sprintf(" http_status=%d", info.Status)
+		if info.Title != "" {
+			msg += " http_title=" + strconv.Quote(info.Title)
+		}
+	}
+	return msg
+}
+
+// formatSyslogChange renders a -watch change the same way, e.g.
+// "opened host=db1 port=5432 protocol=tcp service=postgresql" or "gone_host host=db1"
+func formatSyslogChange(line DiffLine) string {
+	msg := fmt.Sprintf("%s host=%s", line.Change, line.Host)
+	if line.Port > 0 {
+		msg += fmt.Sprintf(" port=%d protocol=%s service=%s", line.Port, line.Protocol, line.Service)
+	}
+	return msg
+}
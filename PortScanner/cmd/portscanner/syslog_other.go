@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// openSyslog always fails: there is no syslog daemon to send to on this platform
+func openSyslog(facility, tag string) (syslogSender, error) {
+	return nil, fmt.Errorf("syslog is not available on %s", runtime.GOOS)
+}
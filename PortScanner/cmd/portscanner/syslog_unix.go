@@ -0,0 +1,51 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"sort"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// openSyslog connects to the local syslog daemon, logging under facility and tag
+func openSyslog(facility, tag string) (syslogSender, error) {
+	priority, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		names := make([]string, 0, len(syslogFacilities))
+		for name := range syslogFacilities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown facility %q (expected one of %s)", facility, strings.Join(names, ", "))
+	}
+	w, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %v", err)
+	}
+	return w, nil
+}
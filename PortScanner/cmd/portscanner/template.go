@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// -template renders the output through a text/template instead of one of the -o formats:
+// once for every reported port as it is found, or once for every host when
+// -template-host is given. The template is checked against an empty result before the
+// scan starts, so a typo in a field name is a usage error rather than a failed report.
+// Each rendering that is not empty becomes a line of its own.
+
+// TemplateResult is what -template renders for each port
+type TemplateResult struct {
+	Host     string
+	IP       string
+	Port     int
+	Protocol string
+	// Status is the port's state: open, closed, filtered, open|filtered or error
+	Status  scanner.State
+	Open    bool
+	Service string
+	Banner  string
+	// HTTP is the -http-probe answer; its Status is zero when there was none
+	HTTP scanner.HTTPInfo
+	// Latency is zero for ports that did not answer
+	Latency time.Duration
+	Time    time.Time
+}
+
+// TemplateHost is what -template renders for each host with -template-host
+type TemplateHost struct {
+	Host string
+	IP   string
+	// Status is up, down (for a host that did not answer -ping) or error (for one that
+	// could not be resolved), and Error says what went wrong
+	Status   string
+	Error    string
+	Open     int
+	Closed   int
+	Filtered int
+	Elapsed  time.Duration
+	// Results are the host's reported ports, the open ones unless -a is given
+	Results []TemplateResult
+}
+
+type outputTemplate struct {
+	tmpl    *template.Template
+	PerHost bool
+}
+
+// parseOutputTemplate reads the -template value, which is either the path of a file
+// holding the template or the template itself
+func parseOutputTemplate(value string, perHost bool) (*outputTemplate, error) {
+	text := value
+	if info, err := os.Stat(value); err == nil && info.Mode().IsRegular() {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("output").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t := &outputTemplate{tmpl: tmpl, PerHost: perHost}
+	var sample any = TemplateResult{}
+	if perHost {
+		sample = TemplateHost{Results: []TemplateResult{{}}}
+	}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func newTemplateResult(scan *hostScan, result scanner.Result) TemplateResult {
+	t := TemplateResult{
+		Host:     scan.Host,
+		IP:       scan.IP,
+		Port:     result.Port,
+		Protocol: result.Protocol,
+		Status:   result.State,
+		Open:     result.Open,
+		Service:  result.Service,
+		Banner:   result.Banner,
+		Latency:  result.Latency,
+		Time:     result.Timestamp,
+	}
+	if result.HTTP != nil {
+		t.HTTP = *result.HTTP
+	}
+	return t
+}
+
+// WriteResult renders one port
+func (t *outputTemplate) WriteResult(w io.Writer, scan *hostScan, result scanner.Result) error {
+	return t.execute(w, newTemplateResult(scan, result))
+}
+
+// WriteHost renders a finished host with every result it kept
+func (t *outputTemplate) WriteHost(w io.Writer, scan *hostScan) error {
+	host := TemplateHost{
+		Host:     scan.Host,
+		IP:       scan.IP,
+		Status:   "up",
+		Open:     scan.Summary.States[scanner.StateOpen],
+		Closed:   scan.Summary.States[scanner.StateClosed],
+		Filtered: scan.Summary.States[scanner.StateFiltered],
+		Elapsed:  scan.Summary.Elapsed,
+	}
+	switch {
+	case scan.Err != nil:
+		host.Status, host.Error = "error", scan.Err.Error()
+	case scan.Down():
+		host.Status, host.Error = "down", scan.Discovery.Reason
+	}
+	for _, result := range scan.Results {
+		host.Results = append(host.Results, newTemplateResult(scan, result))
+	}
+	return t.execute(w, host)
+}
+
+// execute renders data as a line of its own, or writes nothing when it renders empty,
+// so a template can filter with {{if}}
+func (t *outputTemplate) execute(w io.Writer, data any) error {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("rendering -template: %v", err)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timingSettings are the speed-related options a timing template sets together
+type timingSettings struct {
+	Workers int
+	Timeout time.Duration
+	Retries int
+	// Rate caps dials per second across all workers; polite's 100ms between dials is 10/s
+	Rate int
+}
+
+func (t timingSettings) String() string {
+	delay := "none"
+	if t.Rate > 0 {
+		delay = (time.Second / time.Duration(t.Rate)).String()
+	}
+	return fmt.Sprintf("workers %d, timeout %s, retries %d, delay between dials %s", t.Workers, t.Timeout, t.Retries, delay)
+}
+
+// Timing templates in the spirit of nmap's -T0 to -T5, indexed by level. The rate limiter
+// cannot wait longer than a second between dials, so the two slowest templates are far
+// quicker than nmap's. normal matches the defaults of the individual flags.
+var timingTemplates = []struct {
+	Name     string
+	Settings timingSettings
+}{
+	{"paranoid", timingSettings{Workers: 1, Timeout: 5 * time.Second, Retries: 2, Rate: 1}},
+	{"sneaky", timingSettings{Workers: 5, Timeout: 3 * time.Second, Retries: 2, Rate: 2}},
+	{"polite", timingSettings{Workers: 10, Timeout: 2 * time.Second, Retries: 1, Rate: 10}},
+	{"normal", timingSettings{Workers: 100, Timeout: time.Second}},
+	{"aggressive", timingSettings{Workers: 500, Timeout: 500 * time.Millisecond}},
+	{"insane", timingSettings{Workers: 1000, Timeout: 250 * time.Millisecond}},
+}
+
+// lookupTiming finds a template by name or by its 0-5 level and returns its name
+// along with its settings
+func lookupTiming(value string) (string, timingSettings, error) {
+	if level, err := strconv.Atoi(value); err == nil {
+		if level < 0 || level >= len(timingTemplates) {
+			return "", timingSettings{}, fmt.Errorf("timing level %d out of range (0-%d)", level, len(timingTemplates)-1)
+		}
+		return timingTemplates[level].Name, timingTemplates[level].Settings, nil
+	}
+	names := make([]string, len(timingTemplates))
+	for i, template := range timingTemplates {
+		if strings.EqualFold(value, template.Name) {
+			return template.Name, template.Settings, nil
+		}
+		names[i] = template.Name
+	}
+	return "", timingSettings{}, fmt.Errorf("unknown timing template %q (expected %s or 0-%d)",
+		value, strings.Join(names, ", "), len(timingTemplates)-1)
+}
+
+// resolveTiming starts from template and keeps the value of every flag in set, which
+// holds the names of the flags given on the command line, from flags
+func resolveTiming(template, flags timingSettings, set map[string]bool) timingSettings {
+	resolved := template
+	if set["w"] {
+		resolved.Workers = flags.Workers
+	}
+	if set["t"] {
+		resolved.Timeout = flags.Timeout
+	}
+	if set["retries"] {
+		resolved.Retries = flags.Retries
+	}
+	if set["rate"] {
+		resolved.Rate = flags.Rate
+	}
+	return resolved
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+)
+
+// -watch scans the same targets again every interval and reports only what changed since
+// the scan before, keeping the last scan's open ports in memory. The first scan reports
+// every open port to start from. Targets are resolved once, so a host that moves to
+// another address keeps being scanned at the old one. Ctrl+C ends the watch with a
+// summary of every change it saw.
+
+// WatchLine is one change in -watch output, stamped with when the scan that found it finished
+type WatchLine struct {
+	Time time.Time `json:"time"`
+	DiffLine
+}
+
+// WatchEvent is what -webhook receives as JSON after every scan that changed something
+type WatchEvent struct {
+	Time time.Time `json:"time"`
+	Diff *ScanDiff `json:"diff"`
+}
+
+type watchConfig struct {
+	Interval    time.Duration
+	Format      string
+	Ping        bool
+	PingTimeout time.Duration
+	Parallelism int
+	Progress    progressConfig
+	// Findings receives every change when -syslog is given
+	Findings syslogSender
+	// Webhook receives a WatchEvent for every scan that changed something, unless it is nil
+	Webhook *webhook
+	// Metrics is told about every host scan for -metrics-listen, unless it is nil
+	Metrics *scanMetrics
+	// Scanned tells whether a port is part of a host's scan, so a port missing from a
+	// host that was only partly scanned is not taken as closed
+	Scanned func(host string, key portKey) bool
+}
+
+// watchTargets scans targets every cfg.Interval, writing changes to out as they are found,
+// until ctx is cancelled. It fails when out cannot be written or a -webhook-required
+// delivery failed, with an error worded to follow "Error ".
+func watchTargets(ctx context.Context, log *logger, out io.Writer, s *scanner.Scanner, targets []*hostScan, cfg watchConfig) error {
+	startedAt := time.Now()
+	// Host headers and summaries would bury the changes, so the scans themselves only log errors
+	scanLog := &logger{w: log.w, level: logQuiet, diag: log.diag}
+	var previous *portSnapshot
+	var previousAt time.Time
+	var seen []WatchLine
+	scans := 0
+	log.Infof("Watching %d host(s) every %s, press Ctrl+C to stop", len(targets), cfg.Interval)
+	for {
+		scanStarted := time.Now()
+		current := watchScan(ctx, scanLog, s, targets, cfg)
+		finishedAt := time.Now()
+		scans++
+
+		var lines []WatchLine
+		var diff *ScanDiff
+		if previous == nil {
+			for _, host := range current.Order {
+				for _, key := range sortedPorts(current.Hosts[host].Open) {
+					lines = append(lines, WatchLine{finishedAt, DiffLine{"open", host, key.Port, key.Protocol, current.Hosts[host].Open[key]}})
+				}
+			}
+		} else {
+			diff = diffSnapshots(previousAt.Format(time.DateTime), previous, current, cfg.Scanned)
+			for _, line := range diffLines(diff) {
+				lines = append(lines, WatchLine{finishedAt, line})
+			}
+			seen = append(seen, lines...)
+		}
+		if err := writeWatchLines(out, cfg.Format, lines); err != nil {
+			return fmt.Errorf("writing output: %v", err)
+		}
+		if diff != nil && !diff.Empty() {
+			if err := notifyWatchChanges(ctx, log, cfg, lines, WatchEvent{finishedAt, diff}); err != nil {
+				// Only a -webhook-required delivery ends the watch
+				if summaryErr := writeWatchSummary(log, out, cfg.Format, len(targets), scans, time.Since(startedAt), seen); summaryErr != nil {
+					return fmt.Errorf("writing output: %v", summaryErr)
+				}
+				return fmt.Errorf("sending webhook: %v", err)
+			}
+		}
+		log.Verbose("watch scan finished", "scan", scans, "changes", len(lines), "elapsed", finishedAt.Sub(scanStarted))
+		previous, previousAt = current, scanStarted
+
+		// Intervals are counted from the start of each scan; a scan that overran starts the next one straight away
+		next := time.NewTimer(max(cfg.Interval-time.Since(scanStarted), 0))
+		select {
+		case <-ctx.Done():
+			next.Stop()
+			if err := writeWatchSummary(log, out, cfg.Format, len(targets), scans, time.Since(startedAt), seen); err != nil {
+				return fmt.Errorf("writing output: %v", err)
+			}
+			return nil
+		case <-next.C:
+		}
+	}
+}
+
+// watchScan runs one scan of targets and returns the open ports of every host that is up
+func watchScan(ctx context.Context, log *logger, s *scanner.Scanner, targets []*hostScan, cfg watchConfig) *portSnapshot {
+	scans := make([]*hostScan, len(targets))
+	for i, target := range targets {
+		scans[i] = &hostScan{Host: target.Host, IP: target.IP, Ports: target.Ports}
+	}
+	if cfg.Ping {
+		discoverHosts(ctx, s, scans, cfg.PingTimeout, maxConcurrentPings)
+	}
+	current := newPortSnapshot()
+	stream := func(scan *hostScan, status, w io.Writer, result scanner.Result) error {
+		if result.Open {
+			scan.open = append(scan.open, result)
+		}
+		return nil
+	}
+	scanHosts(ctx, log, io.Discard, scans, s, cfg.Progress, style(false), cfg.Parallelism, stream, func(scan *hostScan) {
+		switch {
+		case scan.Skipped:
+			current.Unscanned[scan.Host] = true
+		case scan.Down():
+			log.Verbose("host down", "host", scan.Host, "ip", scan.IP, "reason", scan.Discovery.Reason)
+		default:
+			current.Add(scan.Host, scan.open, scan.Summary.Scanned < scan.Summary.Total)
+			if cfg.Metrics != nil {
+				cfg.Metrics.HostScanned(scan.IP, scan.Summary)
+			}
+		}
+	})
+	return current
+}
+
+func writeWatchLines(w io.Writer, format string, lines []WatchLine) error {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if format == "jsonl" {
+			data, err := json.Marshal(line)
+			if err != nil {
+				return err
+			}
+			buf.Write(append(data, '\n'))
+			continue
+		}
+		fmt.Fprintf(&buf, "%s %s\n", line.Time.Format(time.DateTime), line.DiffLine)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeWatchSummary lists every change seen once the watch is stopped. JSON lines output
+// already holds all of them, so it only gets the count, on the console.
+func writeWatchSummary(log *logger, w io.Writer, format string, hosts, scans int, elapsed time.Duration, seen []WatchLine) error {
+	summary := fmt.Sprintf("Watched %d host(s) for %s over %d scan(s), %d change(s)", hosts, formatElapsed(elapsed), scans, len(seen))
+	if format == "jsonl" {
+		log.Infof("%s", summary)
+		return nil
+	}
+	if len(seen) == 0 {
+		_, err := fmt.Fprintln(w, summary)
+		return err
+	}
+	if _, err := fmt.Fprintln(w, summary+":"); err != nil {
+		return err
+	}
+	return writeWatchLines(w, format, seen)
+}
+
+// notifyWatchChanges hands the changes of one scan to -syslog and -webhook. Failures are
+// logged, and only returned for a webhook that is required. Cancelling ctx, which is how
+// a watch ends, gives up on a delivery still being retried.
+func notifyWatchChanges(ctx context.Context, log *logger, cfg watchConfig, lines []WatchLine, event WatchEvent) error {
+	if cfg.Findings != nil {
+		for _, line := range lines {
+			if err := cfg.Findings.Info(formatSyslogChange(line.DiffLine)); err != nil {
+				log.Errorf("Error writing to syslog: %v", err)
+				break
+			}
+		}
+	}
+	if cfg.Webhook == nil {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err == nil {
+		err = cfg.Webhook.Post(ctx, log, body)
+	}
+	if err != nil && !cfg.Webhook.Required {
+		log.Errorf("Error sending webhook: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+// -webhook POSTs the outcome of a run as JSON once it is written: the -o json report, only
+// the diff object with -diff, or a WatchEvent after every -watch scan that changed
+// something. A delivery that fails is logged and leaves the exit status alone, unless
+// -webhook-required is given.
+
+// Defaults for -webhook-timeout and the number of times a failed delivery is retried
+const (
+	defaultWebhookTimeout = 10 * time.Second
+	webhookRetries        = 3
+)
+
+// webhookBackoff is the wait before the first retry, doubled for every retry after it.
+// Tests shorten it.
+var webhookBackoff = time.Second
+
+type webhook struct {
+	URL     string
+	Headers http.Header
+	// Timeout bounds each attempt on its own, not the retries together
+	Timeout  time.Duration
+	Required bool
+}
+
+// headerFlags collects the repeatable -webhook-header flag
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	name, _, ok := strings.Cut(value, ":")
+	if !ok || strings.TrimSpace(name) == "" || strings.ContainsAny(strings.TrimSpace(name), " \t") {
+		return fmt.Errorf(`expected "Name: value", not %q`, value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// Header returns the collected headers, e.g. "Authorization: Bearer x" as Authorization
+func (h headerFlags) Header() http.Header {
+	header := make(http.Header)
+	for _, line := range h {
+		name, value, _ := strings.Cut(line, ":")
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return header
+}
+
+// Post sends body as JSON, retrying up to webhookRetries times with a growing backoff when
+// the request fails to get an answer or the answer is a 5xx. Cancelling ctx abandons the
+// attempt in flight and any retries still to come.
+func (hook *webhook) Post(ctx context.Context, log *logger, body []byte) error {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := hook.post(ctx, body)
+		if err == nil || !retry || attempt > webhookRetries {
+			return err
+		}
+		log.Verbose("webhook retry", "url", hook.URL, "attempt", attempt, "error", err, "backoff", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// post makes one attempt, and tells whether a failure is worth retrying
+func (hook *webhook) post(ctx context.Context, body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", version.UserAgent())
+	for name, values := range hook.Headers {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, fmt.Errorf("%s answered %s", hook.URL, resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/scanner"
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+// The subset of nmap's XML output (https://nmap.org/book/nmap-dtd.html) that tools like
+// Metasploit's db_import and ndiff rely on. Timestamps are Unix seconds, as in nmap.
+
+type xmlRun struct {
+	XMLName          xml.Name      `xml:"nmaprun"`
+	Scanner          string        `xml:"scanner,attr"`
+	Version          string        `xml:"version,attr"`
+	Args             string        `xml:"args,attr"`
+	Start            int64         `xml:"start,attr"`
+	StartStr         string        `xml:"startstr,attr"`
+	XMLOutputVersion string        `xml:"xmloutputversion,attr"`
+	ScanInfo         []xmlScanInfo `xml:"scaninfo"`
+	Hosts            []xmlHost     `xml:"host"`
+	RunStats         xmlRunStats   `xml:"runstats"`
+}
+
+type xmlScanInfo struct {
+	Type        string `xml:"type,attr"`
+	Protocol    string `xml:"protocol,attr"`
+	NumServices int    `xml:"numservices,attr"`
+	Services    string `xml:"services,attr"`
+}
+
+type xmlHost struct {
+	StartTime int64         `xml:"starttime,attr"`
+	EndTime   int64         `xml:"endtime,attr"`
+	Status    xmlStatus     `xml:"status"`
+	Address   xmlAddress    `xml:"address"`
+	Hostnames []xmlHostname `xml:"hostnames>hostname"`
+	Ports     []xmlPort     `xml:"ports>port"`
+	// -baseline violations are reported the way nmap reports host script results. A pointer,
+	// as omitempty does not drop the hostscript element of a "hostscript>script" path.
+	HostScripts *xmlHostScripts `xml:"hostscript,omitempty"`
+}
+
+type xmlHostScripts struct {
+	Scripts []xmlScript `xml:"script"`
+}
+
+type xmlScript struct {
+	ID     string `xml:"id,attr"`
+	Output string `xml:"output,attr"`
+}
+
+type xmlStatus struct {
+	State  string `xml:"state,attr"`
+	Reason string `xml:"reason,attr"`
+}
+
+type xmlAddress struct {
+	Addr     string `xml:"addr,attr"`
+	AddrType string `xml:"addrtype,attr"`
+}
+
+type xmlHostname struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type xmlPort struct {
+	Protocol string      `xml:"protocol,attr"`
+	PortID   int         `xml:"portid,attr"`
+	State    xmlState    `xml:"state"`
+	Service  *xmlService `xml:"service"`
+	// -http-probe answers are reported like nmap's http-title and http-server-header scripts
+	Scripts []xmlScript `xml:"script,omitempty"`
+}
+
+type xmlState struct {
+	State  string `xml:"state,attr"`
+	Reason string `xml:"reason,attr"`
+}
+
+type xmlService struct {
+	Name   string `xml:"name,attr"`
+	Method string `xml:"method,attr"`
+	Conf   int    `xml:"conf,attr"`
+}
+
+type xmlRunStats struct {
+	Finished xmlFinished `xml:"finished"`
+	Hosts    xmlHosts    `xml:"hosts"`
+}
+
+type xmlFinished struct {
+	Time    int64  `xml:"time,attr"`
+	TimeStr string `xml:"timestr,attr"`
+	Elapsed string `xml:"elapsed,attr"`
+	Exit    string `xml:"exit,attr"`
+}
+
+type xmlHosts struct {
+	Up    int `xml:"up,attr"`
+	Down  int `xml:"down,attr"`
+	Total int `xml:"total,attr"`
+}
+
+// xmlReport collects finished hosts until the whole nmaprun document can be written
+type xmlReport struct {
+	run   xmlRun
+	start time.Time
+}
+
+func newXMLReport(args []string, ports []int, protocols []string, start time.Time) *xmlReport {
+	report := &xmlReport{start: start, run: xmlRun{
+		Scanner:          "portscanner",
+		Version:          version.String(),
+		Args:             strings.Join(args, " "),
+		Start:            start.Unix(),
+		StartStr:         start.Format(time.ANSIC),
+		XMLOutputVersion: "1.05",
+	}}
+	services := formatPortSpec(ports)
+	for _, protocol := range protocols {
+		report.run.ScanInfo = append(report.run.ScanInfo, xmlScanInfo{
+			Type:        "connect",
+			Protocol:    protocol,
+			NumServices: len(ports),
+			Services:    services,
+		})
+	}
+	return report
+}
+
+// Add records a finished host. Hosts that never resolved have no address to report,
+// so like nmap they only count towards the down total; hosts that did not answer -ping
+// are listed as down with the reason and no ports.
+func (r *xmlReport) Add(scan *hostScan) {
+	if scan.Err != nil {
+		r.run.RunStats.Hosts.Down++
+		return
+	}
+
+	host := xmlHost{
+		StartTime: scan.ScannedAt.Unix(),
+		EndTime:   scan.FinishedAt.Unix(),
+		// Without -ping nothing was checked, so every scanned host is assumed up
+		Status:  xmlStatus{State: "up", Reason: "user-set"},
+		Address: xmlAddress{Addr: scan.IP, AddrType: "ipv4"},
+		Ports:   []xmlPort{},
+	}
+	if scan.Discovery != nil {
+		host.Status.Reason = scan.Discovery.Reason
+	}
+	if scan.Down() {
+		host.Status.State = "down"
+		r.run.RunStats.Hosts.Down++
+	} else {
+		r.run.RunStats.Hosts.Up++
+	}
+	if ip := net.ParseIP(scan.IP); ip != nil && ip.To4() == nil {
+		host.Address.AddrType = "ipv6"
+	}
+	if scan.Host != scan.IP {
+		host.Hostnames = []xmlHostname{{Name: scan.Host, Type: "user"}}
+	}
+	for _, result := range scan.Results {
+		port := xmlPort{
+			Protocol: result.Protocol,
+			PortID:   result.Port,
+			State:    xmlState{State: string(result.State), Reason: xmlReason(result)},
+		}
+		if result.Service != "" {
+			port.Service = &xmlService{Name: result.Service, Method: "table", Conf: 3}
+		}
+		if info := result.HTTP; info != nil {
+			port.Scripts = xmlHTTPScripts(info)
+		}
+		host.Ports = append(host.Ports, port)
+	}
+	if len(scan.violations) > 0 {
+		lines := make([]string, len(scan.violations))
+		for i, violation := range scan.violations {
+			lines[i] = violation.describe()
+		}
+		host.HostScripts = &xmlHostScripts{Scripts: []xmlScript{{ID: "baseline-violations", Output: strings.Join(lines, "\n")}}}
+	}
+	r.run.Hosts = append(r.run.Hosts, host)
+}
+
+// xmlHTTPScripts reports an -http-probe answer as script results, with the status in one
+// of its own as nmap has no script for it
+func xmlHTTPScripts(info *scanner.HTTPInfo) []xmlScript {
+	scripts := []xmlScript{{ID: "http-status", Output: fmt.Sprintf("%d %s", info.Status, http.StatusText(info.Status))}}
+	switch {
+	case info.Location != "":
+		scripts = append(scripts, xmlScript{ID: "http-title", Output: "Did not follow redirect to " + info.Location})
+	case info.Title != "":
+		scripts = append(scripts, xmlScript{ID: "http-title", Output: info.Title})
+	}
+	if info.Server != "" {
+		scripts = append(scripts, xmlScript{ID: "http-server-header", Output: info.Server})
+	}
+	return scripts
+}
+
+// Write finishes the run statistics and writes the document
+func (r *xmlReport) Write(w io.Writer, end time.Time, interrupted bool) error {
+	r.run.RunStats.Hosts.Total = r.run.RunStats.Hosts.Up + r.run.RunStats.Hosts.Down
+	r.run.RunStats.Finished = xmlFinished{
+		Time:    end.Unix(),
+		TimeStr: end.Format(time.ANSIC),
+		Elapsed: fmt.Sprintf("%.2f", end.Sub(r.start).Seconds()),
+		Exit:    "success",
+	}
+	if interrupted {
+		r.run.RunStats.Finished.Exit = "error"
+	}
+
+	if _, err := io.WriteString(w, xml.Header+"<!DOCTYPE nmaprun>\n"); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(r.run); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// xmlReason uses nmap's reason names for how a connect scan learned each state
+func xmlReason(result scanner.Result) string {
+	switch result.State {
+	case scanner.StateOpen:
+		if result.Protocol == "udp" {
+			return "udp-response"
+		}
+		return "syn-ack"
+	case scanner.StateClosed:
+		if result.Protocol == "udp" {
+			return "port-unreach"
+		}
+		return "conn-refused"
+	case scanner.StateFiltered, scanner.StateOpenFiltered:
+		return "no-response"
+	default:
+		return "error"
+	}
+}
+
+// formatPortSpec compresses ports into nmap's services list, e.g. "22,80,8000-8100"
+func formatPortSpec(ports []int) string {
+	sorted := append([]int(nil), ports...)
+	sort.Ints(sorted)
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
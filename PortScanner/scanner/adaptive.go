@@ -0,0 +1,200 @@
+package scanner
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Defaults for the bounds of Options.AdaptiveTimeout
+const (
+	DefaultMinTimeout = 100 * time.Millisecond
+	DefaultMaxTimeout = 10 * time.Second
+)
+
+// Each new sample moves the smoothed RTT an eighth of the way towards it, as in RFC 6298
+const rttGain = 8
+
+// The adaptive timeout leaves this many round trips for a port to answer
+const rttTimeoutFactor = 4
+
+// rttEstimator keeps a smoothed round-trip time to one host, fed by every port that
+// answers, and turns it into the timeout for the next dial. It is shared by all workers
+// scanning the host. A nil estimator always gives the static timeout.
+type rttEstimator struct {
+	mu       sync.Mutex
+	srtt     time.Duration
+	samples  int
+	min, max time.Duration
+}
+
+func newRTTEstimator(min, max time.Duration) *rttEstimator {
+	return &rttEstimator{min: min, max: max}
+}
+
+// Observe adds one measured round trip to the estimate
+func (e *rttEstimator) Observe(rtt time.Duration) {
+	if e == nil || rtt <= 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.srtt = rtt
+	} else {
+		e.srtt += (rtt - e.srtt) / rttGain
+	}
+	e.samples++
+}
+
+// Timeout is rttTimeoutFactor smoothed round trips within the estimator's bounds, or
+// fallback until the host has answered at least once
+func (e *rttEstimator) Timeout(fallback time.Duration) time.Duration {
+	if e == nil {
+		return fallback
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		return fallback
+	}
+	return min(max(rttTimeoutFactor*e.srtt, e.min), e.max)
+}
+
+// RTT returns the smoothed round-trip time, zero before the first sample
+func (e *rttEstimator) RTT() time.Duration {
+	if e == nil {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt
+}
+
+// seedRTT gives the estimate its first sample before any port is dialed, through host
+// discovery, so the first wave of workers does not have to wait out the static timeout
+func (s *Scanner) seedRTT(ctx context.Context, ip string, estimator *rttEstimator) {
+	if status := s.Discover(ctx, ip, s.opts.Timeout); status.Up {
+		estimator.Observe(status.Latency)
+	}
+}
+
+// Tuning of Options.AdaptiveWorkers
+const (
+	// The concurrency is reconsidered after every adaptiveWindow finished probes
+	adaptiveWindow = 20
+	// A window in which more than one probe in adaptiveTimeoutShare timed out halves it
+	adaptiveTimeoutShare = 10
+	// A window whose answers took more than adaptiveLatencyFactor times the fastest
+	// window's, plus adaptiveLatencySlack, takes it down by a quarter. The slack keeps the
+	// jitter of sub-millisecond round trips from passing for congestion.
+	adaptiveLatencyFactor = 2
+	adaptiveLatencySlack  = time.Millisecond
+)
+
+// workerLimit is the semaphore behind Options.AdaptiveWorkers. Every probe of a host holds
+// a slot of it while it dials, and the number of slots moves between min and max with what
+// the probes report: a window of probes in which too many timed out halves it, one whose
+// answers came back much slower than the fastest window so far takes it down by a
+// quarter, and any other window raises it by a quarter. It is shared by all workers
+// scanning the host. A nil limit never blocks.
+type workerLimit struct {
+	mu       sync.Mutex
+	limit    int
+	active   int
+	min, max int
+	// wake is closed, and replaced, whenever a slot may have become free
+	wake chan struct{}
+
+	// The window being collected, and the lowest average latency of any window so far
+	probes, timeouts int
+	answered         int
+	latency          time.Duration
+	best             time.Duration
+}
+
+// newWorkerLimit starts at a quarter of max slots and never goes below an eighth of it
+func newWorkerLimit(max int) *workerLimit {
+	return &workerLimit{
+		limit: (max + 3) / 4,
+		min:   (max + 7) / 8,
+		max:   max,
+		wake:  make(chan struct{}),
+	}
+}
+
+// Acquire waits for a free slot and reports whether it got one before ctx was cancelled
+func (l *workerLimit) Acquire(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	for {
+		l.mu.Lock()
+		if l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return true
+		}
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Release frees a slot taken by Acquire and records how its probe went
+func (l *workerLimit) Release(state State, latency time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.probes++
+	switch state {
+	case StateFiltered:
+		l.timeouts++
+	case StateOpen, StateClosed:
+		l.answered++
+		l.latency += latency
+	}
+	if l.probes >= adaptiveWindow {
+		l.adjust()
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// adjust sets the limit from the window just completed and starts the next one
+func (l *workerLimit) adjust() {
+	var average time.Duration
+	if l.answered > 0 {
+		average = l.latency / time.Duration(l.answered)
+		if l.best == 0 || average < l.best {
+			l.best = average
+		}
+	}
+	switch {
+	case l.timeouts*adaptiveTimeoutShare > l.probes:
+		l.limit /= 2
+	case average > adaptiveLatencyFactor*l.best+adaptiveLatencySlack:
+		l.limit -= max(1, l.limit/4)
+	default:
+		l.limit += max(1, l.limit/4)
+	}
+	l.limit = min(max(l.limit, l.min), l.max)
+	l.probes, l.timeouts, l.answered, l.latency = 0, 0, 0, 0
+}
+
+// Limit returns the number of slots, zero for a nil limit
+func (l *workerLimit) Limit() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
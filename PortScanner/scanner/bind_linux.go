@@ -0,0 +1,22 @@
+//go:build linux
+
+package scanner
+
+import "syscall"
+
+// CanBindInterface reports whether Options.Interface is supported on this platform
+const CanBindInterface = true
+
+// bindToDevice returns a net.Dialer Control function that ties the socket to the network
+// interface device with SO_BINDTODEVICE, which takes CAP_NET_RAW
+func bindToDevice(device string) func(network, address string, conn syscall.RawConn) error {
+	return func(network, address string, conn syscall.RawConn) error {
+		var err error
+		if controlErr := conn.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), device)
+		}); controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+}
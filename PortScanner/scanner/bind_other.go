@@ -0,0 +1,20 @@
+//go:build !linux
+
+package scanner
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// CanBindInterface reports whether Options.Interface is supported on this platform
+const CanBindInterface = false
+
+// bindToDevice returns a net.Dialer Control function that fails every dial: sockets can
+// only be tied to an interface on Linux
+func bindToDevice(device string) func(network, address string, conn syscall.RawConn) error {
+	return func(network, address string, conn syscall.RawConn) error {
+		return fmt.Errorf("binding to interface %s is not supported on %s", device, runtime.GOOS)
+	}
+}
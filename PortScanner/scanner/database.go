@@ -0,0 +1,464 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// databaseInfo is what a database server gave away before any credentials were sent
+type databaseInfo struct {
+	Product string
+	Version string
+	// Auth is "none" when the server answered a command without credentials, "required"
+	// when it asked for them, or empty when the handshake does not tell
+	Auth string
+	// Extra holds more annotations particular to the product, keyed without the probe name
+	Extra map[string]string
+}
+
+// databaseProbe dials a database port of its own and reads what the server says about
+// itself. The handshakes only ever read: no password is ever sent, and the only commands
+// are ones a server answers to anyone, like Redis PING and INFO or MongoDB isMaster.
+// A port that turns out to speak something else is left without annotations.
+type databaseProbe struct {
+	name      string
+	port      int
+	timeout   time.Duration
+	source    dialSource
+	handshake func(conn net.Conn) (*databaseInfo, error)
+}
+
+// newDatabaseProbes returns the probes for MySQL on 3306, PostgreSQL on 5432, Redis on
+// 6379 and MongoDB on 27017
+func newDatabaseProbes(timeout time.Duration, source dialSource) []Probe {
+	return []Probe{
+		databaseProbe{name: "mysql", port: 3306, timeout: timeout, source: source, handshake: mysqlHandshake},
+		databaseProbe{name: "postgresql", port: 5432, timeout: timeout, source: source, handshake: postgresHandshake},
+		databaseProbe{name: "redis", port: 6379, timeout: timeout, source: source, handshake: redisHandshake},
+		databaseProbe{name: "mongodb", port: 27017, timeout: timeout, source: source, handshake: mongoHandshake},
+	}
+}
+
+func (p databaseProbe) Name() string        { return p.name }
+func (p databaseProbe) Match(port int) bool { return port == p.port }
+
+// Run annotates the port with "<name>.product", "<name>.version" and "<name>.auth", each
+// when known, along with whatever else the handshake found
+func (p databaseProbe) Run(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+	conn, err := p.source.tcpDialer(p.timeout).DialContext(ctx, "tcp", net.JoinHostPort(target.IP, strconv.Itoa(target.Port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.timeout))
+
+	info, err := p.handshake(conn)
+	if info == nil {
+		return nil, err
+	}
+	annotations := map[string]string{p.name + ".product": info.Product}
+	if info.Version != "" {
+		annotations[p.name+".version"] = info.Version
+	}
+	if info.Auth != "" {
+		annotations[p.name+".auth"] = info.Auth
+	}
+	for key, value := range info.Extra {
+		annotations[p.name+"."+key] = value
+	}
+	return annotations, nil
+}
+
+// MySQL and MariaDB greet every client with the server version before it says anything.
+// Whether an account without a password exists is not something the greeting tells.
+func mysqlHandshake(conn net.Conn) (*databaseInfo, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	length := int(head[0]) | int(head[1])<<8 | int(head[2])<<16
+	if length == 0 || length > 1<<14 || head[3] != 0 {
+		return nil, nil
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+	switch payload[0] {
+	case 10:
+		version, _, ok := bytes.Cut(payload[1:], []byte{0})
+		if !ok {
+			return nil, nil
+		}
+		info := &databaseInfo{Product: "MySQL", Version: string(version)}
+		if bytes.Contains(version, []byte("MariaDB")) {
+			info.Product = "MariaDB"
+			// MariaDB puts "5.5.5-" in front to keep old clients happy
+			info.Version = strings.TrimPrefix(info.Version, "5.5.5-")
+		}
+		return info, nil
+	case 0xff:
+		// An error instead of a greeting, e.g. "Host '10.0.0.9' is not allowed to connect"
+		if len(payload) < 3 {
+			return nil, nil
+		}
+		message := payload[3:]
+		if len(message) > 0 && message[0] == '#' && len(message) >= 6 {
+			message = message[6:]
+		}
+		return &databaseInfo{Product: "MySQL", Auth: "required", Extra: map[string]string{"message": sanitizeBanner(message)}}, nil
+	}
+	return nil, nil
+}
+
+// PostgreSQL is asked whether it does TLS, switched to it if so, and sent a startup
+// packet for the user postgres with no password. The answer is a request for credentials,
+// an error, or, under trust authentication, the session parameters including the version,
+// after which the session is ended before any query.
+func postgresHandshake(conn net.Conn) (*databaseInfo, error) {
+	sslRequest := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), 80877103)
+	if _, err := conn.Write(sslRequest); err != nil {
+		return nil, err
+	}
+	var answer [1]byte
+	if _, err := io.ReadFull(conn, answer[:]); err != nil {
+		return nil, err
+	}
+	info := &databaseInfo{Product: "PostgreSQL", Extra: map[string]string{"ssl": "false"}}
+	switch answer[0] {
+	case 'S':
+		info.Extra["ssl"] = "true"
+		client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10})
+		if err := client.Handshake(); err != nil {
+			return info, nil
+		}
+		conn = client
+	case 'N':
+	default:
+		return nil, nil
+	}
+
+	var startup []byte
+	startup = binary.BigEndian.AppendUint32(startup, 196608)
+	for _, parameter := range []string{"user", "postgres", "database", "postgres", "application_name", "portscanner"} {
+		startup = append(append(startup, parameter...), 0)
+	}
+	startup = append(startup, 0)
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(4+len(startup))), startup...)); err != nil {
+		return info, nil
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		kind, body, err := readPostgresMessage(reader)
+		if err != nil {
+			return info, nil
+		}
+		switch kind {
+		case 'R':
+			if len(body) < 4 {
+				return info, nil
+			}
+			if binary.BigEndian.Uint32(body) != 0 {
+				info.Auth = "required"
+				return info, nil
+			}
+			info.Auth = "none"
+		case 'S':
+			if name, value, ok := bytes.Cut(bytes.TrimSuffix(body, []byte{0}), []byte{0}); ok && string(name) == "server_version" {
+				info.Version = string(value)
+			}
+		case 'E':
+			if info.Auth == "" {
+				info.Auth = "required"
+			}
+			for _, field := range bytes.Split(body, []byte{0}) {
+				if len(field) > 1 && field[0] == 'M' {
+					info.Extra["message"] = sanitizeBanner(field[1:])
+				}
+			}
+			return info, nil
+		case 'Z':
+			conn.Write([]byte{'X', 0, 0, 0, 4})
+			return info, nil
+		}
+	}
+}
+
+// readPostgresMessage reads one backend message: a type byte, then a length that counts
+// itself but not the type
+func readPostgresMessage(reader *bufio.Reader) (byte, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(head[1:])
+	if length < 4 || length > 1<<16 {
+		return 0, nil, fmt.Errorf("bad message length %d", length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return head[0], body, nil
+}
+
+// Redis answers PING with +PONG when no password is set, and then INFO server holds the
+// version; with one set, or in protected mode, it answers with an error instead.
+func redisHandshake(conn net.Conn) (*databaseInfo, error) {
+	if _, err := io.WriteString(conn, "PING\r\n"); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	info := &databaseInfo{Product: "Redis"}
+	switch {
+	case line == "+PONG":
+		info.Auth = "none"
+	case strings.HasPrefix(line, "-NOAUTH"), strings.HasPrefix(line, "-DENIED"), strings.HasPrefix(line, "-ERR operation not permitted"):
+		info.Auth = "required"
+		return info, nil
+	default:
+		return nil, nil
+	}
+
+	if _, err := io.WriteString(conn, "INFO server\r\n"); err != nil {
+		return info, nil
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "$") {
+		return info, nil
+	}
+	length, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+	if err != nil || length < 0 || length > 1<<16 {
+		return info, nil
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return info, nil
+	}
+	for _, field := range strings.Split(string(body), "\r\n") {
+		name, value, _ := strings.Cut(field, ":")
+		switch name {
+		case "redis_version":
+			info.Version = value
+		case "server_name":
+			if value == "valkey" {
+				info.Product = "Valkey"
+			}
+		case "valkey_version":
+			info.Version = value
+		}
+	}
+	return info, nil
+}
+
+// MongoDB wire protocol opcodes
+const (
+	mongoOpReply = 1
+	mongoOpQuery = 2004
+	mongoOpMsg   = 2013
+)
+
+// MongoDB answers isMaster, the opening of every driver's handshake, and buildInfo to
+// anyone. listDatabases, which only reads, tells whether it wants credentials.
+func mongoHandshake(conn net.Conn) (*databaseInfo, error) {
+	// isMaster goes out as a legacy OP_QUERY, which every version still takes for it
+	var query []byte
+	query = binary.LittleEndian.AppendUint32(query, 0)
+	query = append(query, "admin.$cmd\x00"...)
+	query = binary.LittleEndian.AppendUint32(query, 0)
+	query = binary.LittleEndian.AppendUint32(query, 1)
+	query = append(query, bsonDocument("isMaster", int32(1))...)
+	reply, err := mongoRoundTrip(conn, 1, mongoOpQuery, query)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil || !bsonOK(reply["ok"]) {
+		return nil, nil
+	}
+	info := &databaseInfo{Product: "MongoDB"}
+	if wire, ok := reply["maxWireVersion"].(int32); ok {
+		info.Extra = map[string]string{"wire_version": strconv.Itoa(int(wire))}
+	}
+
+	if reply, err := mongoCommand(conn, 2, "buildInfo"); err == nil && bsonOK(reply["ok"]) {
+		info.Version, _ = reply["version"].(string)
+	}
+	if reply, err := mongoCommand(conn, 3, "listDatabases", "nameOnly", true); err == nil && reply != nil {
+		info.Auth = "required"
+		if bsonOK(reply["ok"]) {
+			info.Auth = "none"
+		}
+	}
+	return info, nil
+}
+
+// mongoCommand runs a command against the admin database as an OP_MSG, given as the
+// command name followed by more field names and values
+func mongoCommand(conn net.Conn, requestID uint32, name string, fields ...any) (map[string]any, error) {
+	fields = append([]any{name, int32(1)}, fields...)
+	fields = append(fields, "$db", "admin")
+	var msg []byte
+	msg = binary.LittleEndian.AppendUint32(msg, 0)
+	msg = append(msg, 0)
+	msg = append(msg, bsonDocument(fields...)...)
+	return mongoRoundTrip(conn, requestID, mongoOpMsg, msg)
+}
+
+// mongoRoundTrip sends one message and returns the document of the reply, or nil when the
+// reply is not one the wire protocol has
+func mongoRoundTrip(conn net.Conn, requestID uint32, opCode uint32, body []byte) (map[string]any, error) {
+	var message []byte
+	message = binary.LittleEndian.AppendUint32(message, uint32(16+len(body)))
+	message = binary.LittleEndian.AppendUint32(message, requestID)
+	message = binary.LittleEndian.AppendUint32(message, 0)
+	message = binary.LittleEndian.AppendUint32(message, opCode)
+	if _, err := conn.Write(append(message, body...)); err != nil {
+		return nil, err
+	}
+
+	var head [16]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(head[:4])
+	if length < 16 || length > 1<<20 || binary.LittleEndian.Uint32(head[8:12]) != requestID {
+		return nil, nil
+	}
+	reply := make([]byte, length-16)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	switch binary.LittleEndian.Uint32(head[12:]) {
+	case mongoOpReply:
+		// Flags, cursor ID, starting position and document count come first
+		if len(reply) < 20 {
+			return nil, nil
+		}
+		return parseBSON(reply[20:]), nil
+	case mongoOpMsg:
+		// Flags, then a section of kind 0 holding the body
+		if len(reply) < 5 || reply[4] != 0 {
+			return nil, nil
+		}
+		return parseBSON(reply[5:]), nil
+	}
+	return nil, nil
+}
+
+// bsonDocument encodes alternating field names and int32, bool or string values
+func bsonDocument(fields ...any) []byte {
+	var elements []byte
+	for i := 0; i+1 < len(fields); i += 2 {
+		name := fields[i].(string)
+		switch value := fields[i+1].(type) {
+		case int32:
+			elements = append(append(append(elements, 0x10), name...), 0)
+			elements = binary.LittleEndian.AppendUint32(elements, uint32(value))
+		case bool:
+			elements = append(append(append(elements, 0x08), name...), 0)
+			if value {
+				elements = append(elements, 1)
+			} else {
+				elements = append(elements, 0)
+			}
+		case string:
+			elements = append(append(append(elements, 0x02), name...), 0)
+			elements = binary.LittleEndian.AppendUint32(elements, uint32(len(value)+1))
+			elements = append(append(elements, value...), 0)
+		}
+	}
+	document := binary.LittleEndian.AppendUint32(nil, uint32(4+len(elements)+1))
+	return append(append(document, elements...), 0)
+}
+
+// bsonSizes are the sizes of the fixed-size BSON types
+var bsonSizes = map[byte]int{0x01: 8, 0x07: 12, 0x08: 1, 0x09: 8, 0x0a: 0, 0x10: 4, 0x11: 8, 0x12: 8, 0x13: 16}
+
+// parseBSON returns the top-level double, string, bool, int32 and int64 fields of a
+// document; the others are skipped, and parsing stops at anything it does not know
+func parseBSON(data []byte) map[string]any {
+	fields := make(map[string]any)
+	if len(data) < 5 {
+		return fields
+	}
+	end := int(binary.LittleEndian.Uint32(data))
+	if end < 5 || end > len(data) {
+		return fields
+	}
+	data = data[4 : end-1]
+	for len(data) > 0 {
+		kind := data[0]
+		name, rest, ok := bytes.Cut(data[1:], []byte{0})
+		if !ok {
+			break
+		}
+		size, fixed := bsonSizes[kind]
+		switch {
+		case fixed:
+		case kind == 0x02 || kind == 0x03 || kind == 0x04 || kind == 0x05:
+			if len(rest) < 4 {
+				return fields
+			}
+			size = int(binary.LittleEndian.Uint32(rest))
+			switch kind {
+			case 0x02:
+				size += 4
+			case 0x05:
+				size += 5
+			}
+		default:
+			return fields
+		}
+		if size < 0 || size > len(rest) {
+			return fields
+		}
+		value := rest[:size]
+		switch kind {
+		case 0x01:
+			fields[string(name)] = math.Float64frombits(binary.LittleEndian.Uint64(value))
+		case 0x02:
+			if len(value) > 4 {
+				fields[string(name)] = string(value[4 : len(value)-1])
+			}
+		case 0x08:
+			fields[string(name)] = value[0] == 1
+		case 0x10:
+			fields[string(name)] = int32(binary.LittleEndian.Uint32(value))
+		case 0x12:
+			fields[string(name)] = int64(binary.LittleEndian.Uint64(value))
+		}
+		data = rest[size:]
+	}
+	return fields
+}
+
+// bsonOK reports whether a command's "ok" field says it succeeded
+func bsonOK(value any) bool {
+	switch ok := value.(type) {
+	case float64:
+		return ok == 1
+	case int32:
+		return ok == 1
+	case int64:
+		return ok == 1
+	case bool:
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package scanner
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// contextDialer opens connections the way net.Dialer does
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialSource is where every connection the scanner opens leaves from: Options.LocalAddr
+// and Options.Interface, or Options.Dial for TCP. The zero value leaves it to the
+// routing table.
+type dialSource struct {
+	ip     net.IP
+	device string
+	dial   func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// dialer returns a dialer for network that gives up after timeout, bound to the source
+// address and interface if set
+func (src dialSource) dialer(network string, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if src.ip != nil {
+		switch {
+		case strings.HasPrefix(network, "tcp"):
+			dialer.LocalAddr = &net.TCPAddr{IP: src.ip}
+		case strings.HasPrefix(network, "udp"):
+			dialer.LocalAddr = &net.UDPAddr{IP: src.ip}
+		default:
+			dialer.LocalAddr = &net.IPAddr{IP: src.ip}
+		}
+	}
+	if src.device != "" {
+		dialer.Control = bindToDevice(src.device)
+	}
+	return dialer
+}
+
+// tcpDialer returns a dialer for TCP connections that gives up after timeout: Options.Dial
+// when set, and otherwise a net.Dialer from dialer
+func (src dialSource) tcpDialer(timeout time.Duration) contextDialer {
+	if src.dial == nil {
+		return src.dialer("tcp", timeout)
+	}
+	return funcDialer{dial: src.dial, timeout: timeout}
+}
+
+// funcDialer gives Options.Dial the timeout a net.Dialer would have
+type funcDialer struct {
+	dial    func(ctx context.Context, network, address string) (net.Conn, error)
+	timeout time.Duration
+}
+
+func (d funcDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	return d.dial(ctx, network, address)
+}
@@ -0,0 +1,187 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// DefaultDiscoveryPorts are dialed next to the ICMP echo to find live hosts that drop ICMP,
+// unless Options.DiscoveryPorts says otherwise
+var DefaultDiscoveryPorts = []int{80, 443, 22}
+
+// HostStatus is the outcome of host discovery. Reason uses nmap's names for what
+// gave the host away: "echo-reply", "syn-ack", "conn-refused" or "no-response".
+type HostStatus struct {
+	Up      bool
+	Reason  string
+	Latency time.Duration
+}
+
+// Discover checks whether ip is up before it is scanned, with an ICMP echo when the process
+// may send one (see CanPing) and a TCP connect to each of Options.DiscoveryPorts, which covers
+// hosts that drop ICMP or processes without the privileges to send it. Any answer counts,
+// including a refused connection. The whole check takes at most timeout; Up is false if
+// ctx is cancelled first.
+func (s *Scanner) Discover(ctx context.Context, ip string, timeout time.Duration) HostStatus {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	statuses := make(chan HostStatus, len(s.opts.DiscoveryPorts)+1)
+	var wg sync.WaitGroup
+	// An echo would be sent from here rather than from wherever Options.Dial connects from
+	if s.opts.Dial == nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if latency, err := pingICMP(ctx, s.opts.source(), ip); err == nil {
+				statuses <- HostStatus{Up: true, Reason: "echo-reply", Latency: latency}
+			}
+		}()
+	}
+	for _, port := range s.opts.DiscoveryPorts {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			address := net.JoinHostPort(ip, strconv.Itoa(port))
+			network := "tcp" + s.opts.IPVersion
+			state, latency, _ := probeTCP(ctx, s.tcpDialer(timeout), network, address, nil)
+			switch state {
+			case StateOpen:
+				statuses <- HostStatus{Up: true, Reason: "syn-ack", Latency: latency}
+			case StateClosed:
+				statuses <- HostStatus{Up: true, Reason: "conn-refused", Latency: latency}
+			}
+		}(port)
+	}
+	go func() {
+		wg.Wait()
+		close(statuses)
+	}()
+
+	// The first probe to get an answer settles it; the rest are abandoned through ctx
+	if status, ok := <-statuses; ok {
+		return status
+	}
+	return HostStatus{Reason: "no-response"}
+}
+
+// CanPing reports whether Discover can send ICMP echoes: over an unprivileged ICMP socket
+// where the system allows them (Linux within net.ipv4.ping_group_range, macOS), or else
+// over a raw socket, which takes root or CAP_NET_RAW. It is never done when Options.Dial is
+// set. Without either Discover only connects to Options.DiscoveryPorts.
+func (s *Scanner) CanPing() bool {
+	if s.opts.Dial != nil {
+		return false
+	}
+	ip := net.IPv4zero
+	if s.opts.IPVersion == "6" {
+		ip = net.IPv6unspecified
+	}
+	conn, _, err := s.opts.source().listenICMP(context.Background(), ip)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// listenICMP opens a socket for echoes to the family of ip, trying an unprivileged ICMP
+// socket before a raw one. datagram is set for the former, whose echo ID the kernel picks
+// and which only ever gets the replies to its own requests. An unprivileged socket cannot
+// be tied to src.device, so only a raw one is tried when it is set.
+func (src dialSource) listenICMP(ctx context.Context, ip net.IP) (conn net.PacketConn, datagram bool, err error) {
+	network, raw, address := "udp4", "ip4:icmp", "0.0.0.0"
+	if ip.To4() == nil {
+		network, raw, address = "udp6", "ip6:ipv6-icmp", "::"
+	}
+	if src.ip != nil {
+		address = src.ip.String()
+	}
+	if src.device == "" {
+		if conn, err := icmp.ListenPacket(network, address); err == nil {
+			return conn, true, nil
+		}
+	}
+	var config net.ListenConfig
+	if src.device != "" {
+		config.Control = bindToDevice(src.device)
+	}
+	conn, err = config.ListenPacket(ctx, raw, address)
+	return conn, false, err
+}
+
+// pingICMP sends one ICMP echo request to ip from src and waits for the matching reply
+// until ctx is done. Without a socket to send it on (see CanPing) it fails straight away.
+func pingICMP(ctx context.Context, src dialSource, ip string) (time.Duration, error) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return 0, fmt.Errorf("%q is not an IP address", ip)
+	}
+	conn, datagram, err := src.listenICMP(ctx, dst)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var request, reply icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if dst.To4() == nil {
+		request, reply = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+	echo := &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: 1, Data: []byte("portscan")}
+	// The kernel fills in the checksum for ICMPv6
+	message, err := (&icmp.Message{Type: request, Body: echo}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	var peer net.Addr = &net.IPAddr{IP: dst}
+	if datagram {
+		peer = &net.UDPAddr{IP: dst}
+	}
+	sent := time.Now()
+	if _, err := conn.WriteTo(message, peer); err != nil {
+		return 0, err
+	}
+
+	// A raw socket gets every ICMP message the host receives, including the replies to
+	// echoes other scans of this process sent to other hosts with the same ID, so keep
+	// reading until the reply from ip turns up
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		answer, err := icmp.ParseMessage(request.Protocol(), buf[:n])
+		if err == nil && answer.Type == reply && addrIP(from).Equal(dst) {
+			if got, ok := answer.Body.(*icmp.Echo); ok && got.Seq == echo.Seq && (datagram || got.ID == echo.ID) {
+				return time.Since(sent), nil
+			}
+		}
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// addrIP is the IP address of a socket address ICMP arrived from
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
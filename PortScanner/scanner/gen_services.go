@@ -0,0 +1,120 @@
+//go:build ignore
+
+// gen_services turns a services(5) file into services_table.go, so service names do not
+// depend on the machine the scanner runs on. Run it through go generate:
+//
+//	go generate ./PortScanner/scanner
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type entry struct {
+	port     int
+	protocol string
+	name     string
+}
+
+// Common services that are not IANA-registered under these ports, or are missing from
+// the Debian list the table is usually generated from. Entries in the input file win.
+var extraServices = []entry{
+	{1521, "tcp", "oracle"},
+	{1723, "tcp", "pptp"},
+	{1900, "udp", "ssdp"},
+	{5900, "tcp", "vnc"},
+	{6379, "tcp", "redis"},
+	{8443, "tcp", "https-alt"},
+	{9200, "tcp", "elasticsearch"},
+	{11211, "tcp", "memcache"},
+	{27017, "tcp", "mongodb"},
+}
+
+func main() {
+	output := flag.String("o", "services_table.go", "File to write the generated table to")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("usage: go run gen_services.go [-o file] <services file>")
+	}
+
+	entries, err := readServices(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[key(e)] = true
+	}
+	for _, e := range extraServices {
+		if !seen[key(e)] {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].port != entries[j].port {
+			return entries[i].port < entries[j].port
+		}
+		return entries[i].protocol < entries[j].protocol
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gen_services.go from %s; DO NOT EDIT.\n\n", flag.Arg(0))
+	fmt.Fprintf(&buf, "package scanner\n\n")
+	fmt.Fprintf(&buf, "var serviceNames = map[serviceKey]string{\n")
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "\t{%d, %q}: %q,\n", e.port, e.protocol, e.name)
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*output, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readServices keeps the first name listed for each port/protocol pair
+func readServices(filename string) ([]entry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []entry
+	seen := make(map[string]bool)
+	lines := bufio.NewScanner(file)
+	for lines.Scan() {
+		line, _, _ := strings.Cut(lines.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		portText, protocol, ok := strings.Cut(fields[1], "/")
+		port, err := strconv.Atoi(portText)
+		if !ok || err != nil || port < 1 || port > 65535 || (protocol != "tcp" && protocol != "udp") {
+			continue
+		}
+		e := entry{port, protocol, fields[0]}
+		if !seen[key(e)] {
+			seen[key(e)] = true
+			entries = append(entries, e)
+		}
+	}
+	return entries, lines.Err()
+}
+
+func key(e entry) string {
+	return fmt.Sprintf("%d/%s", e.port, e.protocol)
+}
@@ -0,0 +1,190 @@
+package scanner
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+// HTTPInfo is the answer an open port gave to a GET /
+type HTTPInfo struct {
+	// URL is what answered, e.g. "https://10.0.0.5:8443/", after any redirects followed
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+	Server string `json:"server,omitempty"`
+	// ContentLength is the Content-Length the server sent, or what the body came to when
+	// it sent none; -1 when neither is known
+	ContentLength int64  `json:"content_length"`
+	Title         string `json:"title,omitempty"`
+	// Location is where a redirect that was not followed points
+	Location string `json:"location,omitempty"`
+}
+
+// Only this much of a body is read looking for its title
+const httpBodyLimit = 64 << 10
+
+// Titles longer than this are cut
+const httpTitleLimit = 200
+
+// Redirects followed at most with Options.HTTPFollowRedirects
+const httpMaxRedirects = 5
+
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// DefaultHTTPPorts are the ports the HTTP probe sends its request to, unless
+// Options.HTTPPorts says otherwise: the usual homes of web servers, admin consoles and
+// development servers
+var DefaultHTTPPorts = []int{80, 81, 443, 591, 3000, 5000, 8000, 8008, 8080, 8081, 8443, 8888, 9000, 9443}
+
+// httpsFirst lists the ports where HTTPS is tried before plain HTTP
+var httpsFirst = map[int]bool{443: true, 8443: true}
+
+// probeHTTP sends GET / to ip:port, over HTTPS first on the usual HTTPS ports and plain
+// HTTP first everywhere else, trying the other scheme when the first gets no answer. An
+// HTTPS server answering plain HTTP usually does so with a 400, so that gets HTTPS tried
+// as well, and its answer wins if there is one. hostName, when set, goes in the Host header and as SNI. It returns nil when neither
+// scheme got an HTTP answer within timeout. Each request has a transport of its own with
+// keep-alives off, so it opens one fresh connection, from source, and nothing is left
+// open afterwards.
+func probeHTTP(ctx context.Context, source dialSource, ip string, port int, hostName string, timeout time.Duration, follow bool) *HTTPInfo {
+	schemes := []string{"http", "https"}
+	if httpsFirst[port] {
+		schemes = []string{"https", "http"}
+	}
+	var answer *HTTPInfo
+	for _, scheme := range schemes {
+		if info := getHTTP(ctx, source, scheme, ip, port, hostName, timeout, follow); info != nil {
+			answer = info
+			if scheme == "https" || info.Status != http.StatusBadRequest {
+				break
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return answer
+}
+
+func getHTTP(ctx context.Context, source dialSource, scheme, ip string, port int, hostName string, timeout time.Duration, follow bool) *HTTPInfo {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	url := scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(port)) + "/"
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil
+	}
+	request.Header.Set("User-Agent", version.UserAgent())
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10}
+	if hostName != "" {
+		request.Host = hostName
+		tlsConfig.ServerName = hostName
+	}
+	transport := &http.Transport{
+		// A proxy from the environment would answer instead of the port
+		Proxy:             nil,
+		DialContext:       source.tcpDialer(timeout).DialContext,
+		DisableKeepAlives: true,
+		TLSClientConfig:   tlsConfig,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if !follow {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= httpMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, httpBodyLimit+1))
+	info := &HTTPInfo{
+		URL:           response.Request.URL.String(),
+		Status:        response.StatusCode,
+		Server:        response.Header.Get("Server"),
+		ContentLength: response.ContentLength,
+		Title:         pageTitle(body),
+	}
+	if info.ContentLength < 0 && len(body) <= httpBodyLimit {
+		info.ContentLength = int64(len(body))
+	}
+	if response.StatusCode >= 300 && response.StatusCode < 400 {
+		info.Location = response.Header.Get("Location")
+	}
+	return info
+}
+
+// pageTitle returns the text of the first <title> in body, unescaped and on one line
+func pageTitle(body []byte) string {
+	match := titlePattern.FindSubmatch(body)
+	if match == nil {
+		return ""
+	}
+	title := strings.Join(strings.Fields(html.UnescapeString(string(match[1]))), " ")
+	if len(title) > httpTitleLimit {
+		title = title[:httpTitleLimit-3] + "..."
+	}
+	return strings.ToValidUTF8(title, "")
+}
+
+// httpProbe runs probeHTTP on a connection of its own
+type httpProbe struct {
+	// ports are the ones the probe matches
+	ports   map[int]bool
+	timeout time.Duration
+	follow  bool
+	host    func(ip string) string
+	source  dialSource
+}
+
+func (httpProbe) Name() string          { return "http" }
+func (p httpProbe) Match(port int) bool { return p.ports[port] }
+
+func (p httpProbe) Run(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+	return ResultAnnotations(ctx, p, target)
+}
+
+func (p httpProbe) RunResult(ctx context.Context, target ProbeTarget) (func(*Result), error) {
+	hostName := ""
+	if p.host != nil {
+		hostName = p.host(target.IP)
+	}
+	info := probeHTTP(ctx, p.source, target.IP, target.Port, hostName, p.timeout, p.follow)
+	if info == nil {
+		return nil, nil
+	}
+	return func(result *Result) { result.HTTP = info }, nil
+}
+
+// annotate adds info to annotations under "http."
+func (info *HTTPInfo) annotate(annotations map[string]string) {
+	if info == nil {
+		return
+	}
+	annotations["http.url"] = info.URL
+	annotations["http.status"] = strconv.Itoa(info.Status)
+	annotations["http.content_length"] = strconv.FormatInt(info.ContentLength, 10)
+	for key, value := range map[string]string{"http.server": info.Server, "http.title": info.Title, "http.location": info.Location} {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package scanner
+
+import (
+	"fmt"
+	"time"
+)
+
+// Option configures a Scanner built by NewScanner. Options are applied in order, so a
+// later one overrides an earlier one setting the same thing.
+type Option func(*Options) error
+
+// NewScanner returns a Scanner with the same defaults as the command line tool, changed by
+// options: every TCP port from 1 to 65535, DefaultWorkers workers, DefaultTimeout per port
+// and no rate limit. Unlike New, which quietly fills in zero fields, it rejects invalid
+// settings with an error naming the first one.
+func NewScanner(options ...Option) (*Scanner, error) {
+	opts := Options{
+		Ports:     portRange(1, 65535),
+		Protocols: []string{"tcp"},
+		Workers:   DefaultWorkers,
+		Timeout:   DefaultTimeout,
+	}
+	for _, option := range options {
+		if err := option(&opts); err != nil {
+			return nil, err
+		}
+	}
+	return New(opts), nil
+}
+
+// WithPorts scans only ports, in any order; the results are still sorted
+func WithPorts(ports ...int) Option {
+	return func(opts *Options) error {
+		if len(ports) == 0 {
+			return fmt.Errorf("no ports to scan")
+		}
+		for _, port := range ports {
+			if port < 1 || port > 65535 {
+				return fmt.Errorf("invalid port %d (expected 1-65535)", port)
+			}
+		}
+		opts.Ports = append([]int(nil), ports...)
+		return nil
+	}
+}
+
+// WithPortRange scans every port from start to end, inclusive
+func WithPortRange(start, end int) Option {
+	return func(opts *Options) error {
+		if start < 1 || end > 65535 || start > end {
+			return fmt.Errorf("invalid port range %d-%d (expected 1-65535, start no higher than end)", start, end)
+		}
+		opts.Ports = portRange(start, end)
+		return nil
+	}
+}
+
+// WithWorkers sets how many ports are probed at the same time on each host
+func WithWorkers(n int) Option {
+	return func(opts *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("workers must be greater than 0, not %d", n)
+		}
+		opts.Workers = n
+		return nil
+	}
+}
+
+// WithTimeout sets how long to wait for each port to answer
+func WithTimeout(d time.Duration) Option {
+	return func(opts *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("timeout must be a positive duration, not %s", d)
+		}
+		opts.Timeout = d
+		return nil
+	}
+}
+
+// WithRate caps connection attempts per second across every scan the Scanner runs;
+// zero means unlimited
+func WithRate(perSecond int) Option {
+	return func(opts *Options) error {
+		if perSecond < 0 {
+			return fmt.Errorf("rate cannot be negative, not %d", perSecond)
+		}
+		opts.Rate = perSecond
+		return nil
+	}
+}
+
+// WithProtocol sets what to probe each port over: "tcp", "udp" or "both"
+func WithProtocol(protocol string) Option {
+	return func(opts *Options) error {
+		switch protocol {
+		case "tcp", "udp":
+			opts.Protocols = []string{protocol}
+		case "both":
+			opts.Protocols = []string{"tcp", "udp"}
+		default:
+			return fmt.Errorf("unknown protocol %q (expected tcp, udp or both)", protocol)
+		}
+		return nil
+	}
+}
+
+// WithRetries gives a timed-out probe n more attempts
+func WithRetries(n int) Option {
+	return func(opts *Options) error {
+		if n < 0 {
+			return fmt.Errorf("retries cannot be negative, not %d", n)
+		}
+		opts.Retries = n
+		return nil
+	}
+}
+
+// WithFirstOpen stops scanning a host once n of its ports are found open
+func WithFirstOpen(n int) Option {
+	return func(opts *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("first open must be greater than 0, not %d", n)
+		}
+		opts.FirstOpen = n
+		return nil
+	}
+}
+
+// WithAll reports every probed port instead of only the open ones
+func WithAll() Option {
+	return func(opts *Options) error {
+		opts.All = true
+		return nil
+	}
+}
+
+func portRange(start, end int) []int {
+	ports := make([]int, 0, end-start+1)
+	for port := start; port <= end; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// WithProbe adds probe to the ones run on every open TCP port it matches
+func WithProbe(probe Probe) Option {
+	return func(opts *Options) error {
+		if probe == nil {
+			return fmt.Errorf("probe must not be nil")
+		}
+		opts.Probes = append(opts.Probes, probe)
+		return nil
+	}
+}
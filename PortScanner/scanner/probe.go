@@ -0,0 +1,234 @@
+package scanner
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Probe takes a closer look at TCP ports found open and annotates their results.
+// Banner grabbing and the SSH, TLS and HTTP probes are probes themselves, set up from
+// Options.BannerTimeout, Options.SSHTimeout, Options.TLSTimeout and Options.HTTPTimeout;
+// Options.Probes registers more.
+type Probe interface {
+	// Name identifies the probe; a failed Run is reported under "<name>.error"
+	Name() string
+	// Match reports whether the probe wants to look at an open port
+	Match(port int) bool
+	// Run looks at the port and returns annotations for its Result, or none when there
+	// is nothing to say about it
+	Run(ctx context.Context, target ProbeTarget) (map[string]string, error)
+}
+
+// ConnProbe is a Probe that talks over the connection that found the port open rather
+// than dialing its own. Such probes run one after the other, in registration order, while
+// the connection is still open; all other probes run after it is closed, at the same time
+// as each other.
+type ConnProbe interface {
+	Probe
+	// UsesConn reports whether Run wants ProbeTarget.Conn
+	UsesConn() bool
+}
+
+// ProbeTarget is the open port a Probe is run against
+type ProbeTarget struct {
+	IP   string
+	Port int
+	// Conn is the connection that found the port open, for a ConnProbe; nil otherwise
+	Conn net.Conn
+	// Found is what the ResultProbes among the ConnProbes that ran before this one on Conn
+	// recorded, e.g. the Banner, SSH and TLS of the built-in ones; empty for probes
+	// dialing their own connection
+	Found Result
+	// Annotations are what the other ConnProbes that ran before this one on Conn returned
+	Annotations map[string]string
+}
+
+// DefaultProbeConcurrency is how many probes that dial their own connection may run at
+// once across every Scan on a Scanner, unless Options.ProbeConcurrency says otherwise
+const DefaultProbeConcurrency = 20
+
+// ResultProbe is a Probe whose findings have a home in the typed fields of Result, such as
+// Banner, SSH, TLS and HTTP, rather than in Result.Annotations. The scanner calls
+// RunResult instead of Run on it. The built-in banner, SSH, TLS and HTTP probes are
+// ResultProbes, whose Run reports the same findings as annotations (see ResultAnnotations).
+type ResultProbe interface {
+	Probe
+	// RunResult looks at the port like Run, and returns a function recording what it found
+	// on the port's Result, or nil when there is nothing to say
+	RunResult(ctx context.Context, target ProbeTarget) (func(*Result), error)
+}
+
+// ResultAnnotations runs probe and returns what it recorded as annotations: the Run of a
+// ResultProbe that only fills the fields ResultAnnotations knows about
+func ResultAnnotations(ctx context.Context, probe ResultProbe, target ProbeTarget) (map[string]string, error) {
+	record, err := probe.RunResult(ctx, target)
+	if err != nil || record == nil {
+		return nil, err
+	}
+	var result Result
+	record(&result)
+	annotations := make(map[string]string)
+	if result.Banner != "" {
+		annotations["banner"] = result.Banner
+	}
+	result.SSH.annotate(annotations)
+	result.TLS.annotate(annotations)
+	result.HTTP.annotate(annotations)
+	return annotations, nil
+}
+
+// newProbes lists the built-in probes opts asks for, followed by opts.Probes
+func newProbes(opts Options) []Probe {
+	var probes []Probe
+	if opts.BannerTimeout > 0 {
+		probes = append(probes, bannerProbe{timeout: opts.BannerTimeout})
+	}
+	// Ahead of the TLS probe, whose ClientHello would leave an SSH server nothing to say
+	if opts.SSHTimeout > 0 {
+		probes = append(probes, sshProbe{timeout: opts.SSHTimeout})
+	}
+	if opts.TLSTimeout > 0 {
+		probes = append(probes, tlsProbe{timeout: opts.TLSTimeout, serverName: opts.TLSServerName})
+	}
+	if opts.HTTPTimeout > 0 {
+		ports := make(map[int]bool, len(opts.HTTPPorts))
+		for _, port := range opts.HTTPPorts {
+			ports[port] = true
+		}
+		probes = append(probes, httpProbe{ports: ports, timeout: opts.HTTPTimeout, follow: opts.HTTPFollowRedirects, host: opts.HTTPHost, source: opts.source()})
+	}
+	if opts.DatabaseTimeout > 0 {
+		probes = append(probes, newDatabaseProbes(opts.DatabaseTimeout, opts.source())...)
+	}
+	return append(probes, opts.Probes...)
+}
+
+func usesConn(probe Probe) bool {
+	connProbe, ok := probe.(ConnProbe)
+	return ok && connProbe.UsesConn()
+}
+
+// probeRun is what one probe found on a port: record for a ResultProbe, annotations for
+// any other, and for a failed run of either
+type probeRun struct {
+	probe       Probe
+	record      func(*Result)
+	annotations map[string]string
+}
+
+// run runs the probe of r on target, through RunResult for a ResultProbe
+func (r *probeRun) run(ctx context.Context, target ProbeTarget) {
+	resultProbe, ok := r.probe.(ResultProbe)
+	if !ok {
+		r.annotations = runProbe(ctx, r.probe, target)
+		return
+	}
+	record, err := resultProbe.RunResult(ctx, target)
+	if err != nil {
+		r.annotations = map[string]string{r.probe.Name() + ".error": err.Error()}
+		return
+	}
+	r.record = record
+}
+
+// runConnProbes runs the matching ConnProbes on conn, the connection that found ip:port open
+func (s *Scanner) runConnProbes(ctx context.Context, ip string, port int, conn net.Conn) []probeRun {
+	var runs []probeRun
+	var found Result
+	seen := make(map[string]string)
+	for _, probe := range s.probes {
+		if !usesConn(probe) || !probe.Match(port) {
+			continue
+		}
+		run := probeRun{probe: probe}
+		run.run(ctx, ProbeTarget{IP: ip, Port: port, Conn: conn, Found: found, Annotations: seen})
+		if run.record != nil {
+			run.record(&found)
+		}
+		for key, value := range run.annotations {
+			seen[key] = value
+		}
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// runDialProbes runs the matching probes that dial their own connection to ip:port, each
+// once it has a slot of the scanner's probe concurrency and a token of the rate limit,
+// and returns what they found in registration order
+func (s *Scanner) runDialProbes(ctx context.Context, ip string, port int) []probeRun {
+	var runs []probeRun
+	for _, probe := range s.probes {
+		if !usesConn(probe) && probe.Match(port) {
+			runs = append(runs, probeRun{probe: probe})
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range runs {
+		wg.Add(1)
+		go func(run *probeRun) {
+			defer wg.Done()
+			select {
+			case s.probeSlots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-s.probeSlots }()
+			if s.limiter.Wait(ctx) {
+				run.run(ctx, ProbeTarget{IP: ip, Port: port})
+			}
+		}(&runs[i])
+	}
+	wg.Wait()
+	return runs
+}
+
+// runProbe runs probe, turning an error into a "<name>.error" annotation
+func runProbe(ctx context.Context, probe Probe, target ProbeTarget) map[string]string {
+	annotations, err := probe.Run(ctx, target)
+	if err != nil {
+		return map[string]string{probe.Name() + ".error": err.Error()}
+	}
+	return annotations
+}
+
+// applyProbes merges what the probes found into result, in the order they ran
+func applyProbes(result *Result, runs []probeRun) {
+	for _, run := range runs {
+		if run.record != nil {
+			run.record(result)
+		}
+		if len(run.annotations) == 0 {
+			continue
+		}
+		if result.Annotations == nil {
+			result.Annotations = make(map[string]string)
+		}
+		for key, value := range run.annotations {
+			result.Annotations[key] = value
+		}
+	}
+}
+
+// bannerProbe reads what a service sends before it is spoken to
+type bannerProbe struct {
+	timeout time.Duration
+}
+
+func (bannerProbe) Name() string        { return "banner" }
+func (bannerProbe) Match(port int) bool { return true }
+func (bannerProbe) UsesConn() bool      { return true }
+
+func (p bannerProbe) Run(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+	return ResultAnnotations(ctx, p, target)
+}
+
+func (p bannerProbe) RunResult(ctx context.Context, target ProbeTarget) (func(*Result), error) {
+	banner := readBanner(target.Conn, p.timeout)
+	if banner == "" {
+		return nil, nil
+	}
+	return func(result *Result) { result.Banner = banner }, nil
+}
@@ -0,0 +1,914 @@
+// Package scanner probes TCP and UDP ports on a single host and classifies
+// each one as open, closed, filtered or errored.
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type State string
+
+const (
+	StateOpen     State = "open"
+	StateClosed   State = "closed"
+	StateFiltered State = "filtered"
+	StateError    State = "error"
+
+	// UDP has no handshake, so silence can mean either an open service or a dropped probe
+	StateOpenFiltered State = "open|filtered"
+)
+
+// Windows reports socket failures as WSA error codes, which never match the
+// POSIX errno values exported by package syscall
+const (
+	wsaeconnreset   syscall.Errno = 10054
+	wsaetimedout    syscall.Errno = 10060
+	wsaeconnrefused syscall.Errno = 10061
+	wsaehostunreach syscall.Errno = 10065
+	wsaemfile       syscall.Errno = 10024
+)
+
+// Upper bound on resolving a single host before it is skipped
+const resolveTimeout = 5 * time.Second
+
+// Base delay between retries of a failed probe; attempt n waits n times this long
+const retryBackoff = 100 * time.Millisecond
+
+// Minimum number of ports a scan may run ahead of the lowest port still in flight. It caps
+// how many finished results are held back to report them in order.
+const reorderWindow = 1024
+
+// Defaults used for zero-valued Options fields
+const (
+	DefaultWorkers = 100
+	DefaultTimeout = 1 * time.Second
+)
+
+type Result struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Open     bool   `json:"open"`
+	State    State  `json:"state"`
+	// Service is the well-known service name for the port, or "unknown"
+	Service string `json:"service"`
+	Banner  string `json:"banner,omitempty"`
+	// TLS is the session an open port negotiated when Options.TLSTimeout is set, or nil
+	// if it did not complete a handshake
+	TLS *TLSInfo `json:"tls,omitempty"`
+	// SSH is what an SSH server offered before key exchange when Options.SSHTimeout is set,
+	// or nil if the port is not SSH
+	SSH *SSHInfo `json:"ssh,omitempty"`
+	// HTTP is the answer an open TCP port gave to GET / when Options.HTTPTimeout is set,
+	// or nil if it did not answer over HTTP or HTTPS
+	HTTP *HTTPInfo `json:"http,omitempty"`
+	// Annotations are what the probes of Options.Probes found, keyed the way they chose
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Error is why the last attempt did not find the port open, e.g. "connect: connection
+	// refused", "i/o timeout" or "connect: no route to host"; empty for open ports
+	Error    string `json:"error,omitempty"`
+	Attempts int    `json:"attempts"`
+	// Latency is how long the port took to answer; only set for open and closed ports
+	Latency time.Duration `json:"-"`
+	// Timestamp is when the probe finished, for lining results up with logs on the target
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MarshalJSON adds Latency as latency_ms, since a nanosecond count is awkward to read,
+// and writes Timestamp in UTC
+func (r Result) MarshalJSON() ([]byte, error) {
+	type plain Result
+	r.Timestamp = r.Timestamp.UTC()
+	return json.Marshal(struct {
+		plain
+		LatencyMS float64 `json:"latency_ms,omitempty"`
+	}{plain(r), math.Round(float64(r.Latency)/float64(time.Microsecond)) / 1000})
+}
+
+// Summary counts every probed port by state, including the ones left out of
+// the returned results. Scanned is lower than Total when the scan was cancelled.
+type Summary struct {
+	Scanned int
+	Total   int
+	States  map[State]int
+
+	// Latency spread across open ports; all zero when nothing was open
+	MinLatency time.Duration
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+
+	// Elapsed is how long probing took, from the first port to the last
+	Elapsed time.Duration
+
+	// With AdaptiveTimeout, the smoothed round-trip time at the end of the scan and the
+	// timeout it gave; RTT is zero and Timeout the static one if the host never answered
+	RTT     time.Duration
+	Timeout time.Duration
+
+	// Workers is the number of concurrent probes AdaptiveWorkers had settled on by the end
+	// of the scan, zero without it
+	Workers int
+
+	// Stopped is set when FirstOpen open ports were found and the rest of the host was skipped
+	Stopped bool
+
+	// FileLimited counts the ports left in StateError because every attempt found the
+	// process out of file descriptors, which says nothing about the port; more Workers
+	// than the open file limit allows leave it above zero
+	FileLimited int
+}
+
+// Rate is the number of ports probed per second
+func (s Summary) Rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Scanned) / s.Elapsed.Seconds()
+}
+
+type Options struct {
+	Ports []int
+	// Protocols to probe each port over, "tcp" and/or "udp"; defaults to tcp only
+	Protocols []string
+	// IPVersion is "4" or "6" to only use that address family, or empty for either; it
+	// defaults to the family of LocalAddr when that is set
+	IPVersion string
+	// LocalAddr, when set, is the source address every probe is sent from. It has to be an
+	// address of a local interface, or every dial fails.
+	LocalAddr net.IP
+	// Interface, when set, ties every probe to that network interface, e.g. "eth1", so it
+	// leaves through it whatever the routing table says. Only Linux supports it (see
+	// CanBindInterface), and it takes CAP_NET_RAW; elsewhere every dial fails.
+	Interface string
+	// Dial, when set, opens every TCP connection in place of a net.Dialer, e.g. through a
+	// jump host, so LocalAddr and Interface no longer apply to TCP. Its context carries the
+	// probe's timeout. A dial that fails with an error wrapping syscall.ECONNREFUSED counts
+	// as closed, one that times out as filtered, and anything else as an error. UDP probes
+	// and the ICMP echo of Discover cannot go through it, so Discover only tries TCP ports.
+	Dial    func(ctx context.Context, network, address string) (net.Conn, error)
+	Workers int
+	Timeout time.Duration
+	// Retries is how many extra attempts a timed-out probe gets
+	Retries int
+
+	// AdaptiveTimeout replaces Timeout with four times the smoothed round-trip time to the
+	// host, measured by host discovery before the scan and by every port that answers during
+	// it, kept between MinTimeout and MaxTimeout. Timeout is used until the host has answered.
+	AdaptiveTimeout bool
+	// Bounds for AdaptiveTimeout; default to DefaultMinTimeout and DefaultMaxTimeout
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+
+	// AdaptiveWorkers treats Workers as a ceiling: a host's scan starts with a quarter of
+	// them probing at once and raises or lowers that as it goes, backing off when probes
+	// time out or answers slow down and growing while the host keeps up. It never goes
+	// below an eighth of Workers.
+	AdaptiveWorkers bool
+
+	// Rate caps connection attempts per second across every Scan on this Scanner; zero means unlimited
+	Rate int
+
+	// Randomize probes ports in a shuffled order instead of ascending; results are still sorted
+	Randomize bool
+	// Seed makes the Randomize order reproducible, with every host probed in the same order;
+	// zero picks a new order for every scan
+	Seed int64
+
+	// All reports every probed port instead of only the open ones
+	All bool
+
+	// FirstOpen stops scanning a host once that many of its ports are open; zero scans
+	// every port. Probes already in flight still finish, so a few more open ports can be
+	// reported when Workers is above one.
+	FirstOpen int
+
+	// BannerTimeout is how long to wait for an open port to speak first; zero disables banner grabbing
+	BannerTimeout time.Duration
+
+	// TLSTimeout is how long an open TCP port gets to complete a TLS handshake on the
+	// connection that found it open; zero disables the TLS probe. A port that sent a
+	// banner spoke first, which TLS servers never do, so it is not probed.
+	TLSTimeout time.Duration
+	// TLSServerName, when set, returns the name to send as SNI in handshakes with ip;
+	// without it no name is sent
+	TLSServerName func(ip string) string
+
+	// SSHTimeout is how long an open TCP port gets to identify as SSH and send its KEXINIT
+	// on the connection that found it open; zero disables the SSH probe. Only port 22 and
+	// ports whose banner is an SSH identification are probed.
+	SSHTimeout time.Duration
+
+	// HTTPTimeout is how long an open TCP port gets to answer a GET / on a connection of its
+	// own, once the port's latency has been measured; zero disables the HTTP probe. HTTPS
+	// is tried first on 443 and 8443 and plain HTTP everywhere else, then the other one.
+	HTTPTimeout time.Duration
+	// HTTPPorts are the open ports the HTTP probe is run on; defaults to DefaultHTTPPorts
+	HTTPPorts []int
+	// HTTPFollowRedirects follows up to five redirects instead of reporting the first answer
+	HTTPFollowRedirects bool
+	// HTTPHost, when set, returns the name to send as Host and SNI in requests to ip;
+	// without it the address is used
+	HTTPHost func(ip string) string
+
+	// DatabaseTimeout is how long the MySQL, PostgreSQL, Redis and MongoDB probes get, each
+	// on a connection of its own, for the handshake on 3306, 5432, 6379 and 27017; zero
+	// disables them. What they find goes in Result.Annotations under "mysql.",
+	// "postgresql.", "redis." and "mongodb.": the product, its version and whether it
+	// answers without credentials ("auth" of "none" or "required").
+	DatabaseTimeout time.Duration
+
+	// Probes are run on every open TCP port they match, after the ones set up by
+	// BannerTimeout, SSHTimeout, TLSTimeout, HTTPTimeout and DatabaseTimeout, and what they return ends up in
+	// Result.Annotations
+	Probes []Probe
+	// ProbeConcurrency caps how many probes that dial their own connection run at once;
+	// defaults to DefaultProbeConcurrency
+	ProbeConcurrency int
+
+	// DiscoveryPorts are the TCP ports Discover connects to; defaults to DefaultDiscoveryPorts
+	DiscoveryPorts []int
+
+	// Progress, when set, is called from the worker goroutines after each
+	// port is probed with the number probed so far and the total
+	Progress func(done, total int)
+
+	// OnAttempt, when set, is called from the worker goroutines after every
+	// connection attempt, including retries
+	OnAttempt func(Attempt)
+
+	// OnResult, when set, is called with every port probed on ip, whether or not it is
+	// reported, so a caller can record how far a scan got. Ports left unfinished by
+	// cancellation are not passed, and neither are the ones Resume supplied.
+	OnResult func(ip string, result Result)
+
+	// Resume, when set, is asked about every port before it is probed; if it returns a
+	// result from an earlier scan of ip, that result is used without dialing the port
+	Resume func(ip string, port int, protocol string) (Result, bool)
+}
+
+// Attempt describes a single connection attempt against one port
+type Attempt struct {
+	IP       string
+	Port     int
+	Protocol string
+	// Number is 1 for the first attempt and counts up with each retry
+	Number  int
+	State   State
+	Latency time.Duration
+	// Err is what the dial or read failed with; nil when the port answered
+	Err error
+}
+
+type Scanner struct {
+	opts    Options
+	limiter *rateLimiter
+	// probes are every probe run on open TCP ports, built-in ones first
+	probes []Probe
+	// probeSlots holds a token for every probe dialing its own connection
+	probeSlots chan struct{}
+}
+
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+type scanJob struct {
+	Port     int
+	Protocol string
+}
+
+// queuedJob and finishedJob carry a job's position in the scan order, so results can be
+// put back in that order however the workers finish
+type queuedJob struct {
+	scanJob
+	seq int
+}
+
+type finishedJob struct {
+	Result
+	seq int
+	// resumed results came from Options.Resume rather than a probe
+	resumed bool
+	// fileLimited is set when the last attempt could not open a socket
+	fileLimited bool
+}
+
+// New returns a Scanner for opts, filling in defaults for unset fields.
+func New(opts Options) *Scanner {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if len(opts.Protocols) == 0 {
+		opts.Protocols = []string{"tcp"}
+	}
+	if len(opts.DiscoveryPorts) == 0 {
+		opts.DiscoveryPorts = DefaultDiscoveryPorts
+	}
+	if len(opts.HTTPPorts) == 0 {
+		opts.HTTPPorts = DefaultHTTPPorts
+	}
+	if opts.MinTimeout <= 0 {
+		opts.MinTimeout = DefaultMinTimeout
+	}
+	if opts.MaxTimeout <= 0 {
+		opts.MaxTimeout = DefaultMaxTimeout
+	}
+	if opts.ProbeConcurrency <= 0 {
+		opts.ProbeConcurrency = DefaultProbeConcurrency
+	}
+	if opts.LocalAddr != nil && opts.IPVersion == "" {
+		opts.IPVersion = "6"
+		if opts.LocalAddr.To4() != nil {
+			opts.IPVersion = "4"
+		}
+	}
+	s := &Scanner{opts: opts, probes: newProbes(opts), probeSlots: make(chan struct{}, opts.ProbeConcurrency)}
+	if opts.Rate > 0 {
+		s.limiter = newRateLimiter(opts.Rate)
+	}
+	return s
+}
+
+// Narrow returns a Scanner that probes ports with at most workers workers per host and
+// shares everything else with s, including the Rate limit and the probe slots, so scans
+// run through s and any Scanner narrowed from it draw on one budget. Nil ports and zero
+// workers keep s's own; workers are capped at s's.
+func (s *Scanner) Narrow(ports []int, workers int) *Scanner {
+	narrowed := *s
+	if ports != nil {
+		narrowed.opts.Ports = ports
+	}
+	if workers > 0 {
+		narrowed.opts.Workers = min(workers, s.opts.Workers)
+	}
+	return &narrowed
+}
+
+// Close releases the ticker behind Options.Rate. Neither s nor any Scanner narrowed
+// from it may be used afterwards.
+func (s *Scanner) Close() {
+	s.limiter.Stop()
+}
+
+// Scan resolves host and probes every configured port on it. The results are
+// sorted by protocol and port. If ctx is cancelled mid-scan the results found
+// so far are returned along with ctx.Err().
+func (s *Scanner) Scan(ctx context.Context, host string) ([]Result, error) {
+	results, _, err := s.ScanWithSummary(ctx, host)
+	return results, err
+}
+
+// ScanWithSummary is like Scan but also returns per-state counts for every
+// probed port.
+func (s *Scanner) ScanWithSummary(ctx context.Context, host string) ([]Result, Summary, error) {
+	var results []Result
+	summary, err := s.Stream(ctx, host, func(result Result) {
+		results = append(results, result)
+	})
+	return results, summary, err
+}
+
+// Stream is like ScanWithSummary but hands each result to emit as soon as it can be
+// reported instead of collecting them, so memory stays flat however many ports are
+// scanned. Results still arrive sorted by protocol and port; emit is called from the
+// calling goroutine.
+func (s *Scanner) Stream(ctx context.Context, host string, emit func(Result)) (Summary, error) {
+	ip, err := s.Resolve(ctx, host)
+	if err != nil {
+		return Summary{}, err
+	}
+	summary := s.scanIP(ctx, ip, s.opts.Ports, emit)
+	return summary, ctx.Err()
+}
+
+// StreamPorts is like Stream but probes ports on host instead of the ports in Options,
+// over every configured protocol. It lets one Scanner cover a different set of ports on
+// each host.
+func (s *Scanner) StreamPorts(ctx context.Context, host string, ports []int, emit func(Result)) (Summary, error) {
+	ip, err := s.Resolve(ctx, host)
+	if err != nil {
+		return Summary{}, err
+	}
+	summary := s.scanIP(ctx, ip, ports, emit)
+	return summary, ctx.Err()
+}
+
+// Resolve looks host up and picks the address to scan: the first IPv4 address
+// by default, falling back to IPv6, or only the family set in IPVersion
+func (s *Scanner) Resolve(ctx context.Context, host string) (string, error) {
+	ips, err := s.ResolveAll(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return ips[0], nil
+}
+
+// ResolveAll returns every address host resolves to in the family set in
+// IPVersion, IPv4 addresses first. An IPv6 literal may be bracketed, as in "[::1]".
+// It never returns an empty slice without an error.
+func (s *Scanner) ResolveAll(ctx context.Context, host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve: %w", err)
+	}
+
+	var v4, v6 []string
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr.String())
+		} else {
+			v6 = append(v6, addr.String())
+		}
+	}
+
+	var ips []string
+	if s.opts.IPVersion != "6" {
+		ips = append(ips, v4...)
+	}
+	if s.opts.IPVersion != "4" {
+		ips = append(ips, v6...)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IPv%s address found", s.opts.IPVersion)
+	}
+	return ips, nil
+}
+
+// scanOrder lists every port/protocol pair of ports in the order it will be probed: sorted by
+// protocol and port, which is also the order results are reported in, or shuffled with Randomize
+func (s *Scanner) scanOrder(ports []int) []scanJob {
+	ports = append([]int(nil), ports...)
+	sort.Ints(ports)
+	protocols := append([]string(nil), s.opts.Protocols...)
+	sort.Strings(protocols)
+
+	order := make([]scanJob, 0, len(ports)*len(protocols))
+	for _, protocol := range protocols {
+		for _, port := range ports {
+			order = append(order, scanJob{Port: port, Protocol: protocol})
+		}
+	}
+	if s.opts.Randomize {
+		shuffle := rand.Shuffle
+		if s.opts.Seed != 0 {
+			shuffle = rand.New(rand.NewSource(s.opts.Seed)).Shuffle
+		}
+		shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	return order
+}
+
+// scanIP probes ports on ip and hands the results worth reporting (open ports, or
+// everything with All) to emit sorted by protocol and port, returning per-state counts
+// covering all probed ports. Results that finish ahead of a slower port are held back until
+// it is done; dispatching stops once reorderWindow results are outstanding, so only that many
+// are ever held. With Randomize the probe order says nothing about the report order, so every
+// reported result is held and sorted at the end instead.
+func (s *Scanner) scanIP(ctx context.Context, ip string, ports []int, emit func(Result)) Summary {
+	// Cancelling this context stops only this host, once FirstOpen is reached
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	var rtt *rttEstimator
+	if s.opts.AdaptiveTimeout {
+		rtt = newRTTEstimator(s.opts.MinTimeout, s.opts.MaxTimeout)
+		s.seedRTT(ctx, ip, rtt)
+	}
+	var limit *workerLimit
+	if s.opts.AdaptiveWorkers {
+		limit = newWorkerLimit(min(s.opts.Workers, len(ports)*len(s.opts.Protocols)))
+	}
+	start := time.Now()
+	order := s.scanOrder(ports)
+	total := len(order)
+	// Workers beyond one per port would only sit idle
+	workers := min(s.opts.Workers, total)
+	window := total
+	if !s.opts.Randomize {
+		window = min(total, max(4*workers, reorderWindow))
+	}
+	// A job holds a slot from dispatch until its result is emitted
+	slots := make(chan struct{}, window)
+	jobs := make(chan queuedJob, workers)
+	results := make(chan finishedJob, workers)
+	var wg sync.WaitGroup
+	var scanned atomic.Int64
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go s.worker(ctx, ip, rtt, limit, jobs, results, total, &scanned, &wg)
+	}
+
+	go func() {
+		defer close(jobs)
+		for seq, job := range order {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- queuedJob{scanJob: job, seq: seq}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Close the results channel once all workers are done
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	report := func(result Result) {
+		if result.Open || s.opts.All {
+			result.Service = lookupService(result.Port, result.Protocol)
+			emit(result)
+		}
+	}
+
+	// Process results as they come
+	summary := Summary{Total: total, States: make(map[State]int)}
+	var totalLatency time.Duration
+	pending := make(map[int]Result)
+	next := 0
+	var shuffled []Result
+	for finished := range results {
+		result := finished.Result
+		if s.opts.OnResult != nil && !finished.resumed {
+			recorded := result
+			recorded.Service = lookupService(result.Port, result.Protocol)
+			s.opts.OnResult(ip, recorded)
+		}
+		summary.States[result.State]++
+		if finished.fileLimited {
+			summary.FileLimited++
+		}
+		if s.opts.FirstOpen > 0 && !summary.Stopped && summary.States[StateOpen] >= s.opts.FirstOpen {
+			summary.Stopped = true
+			stop()
+		}
+		if result.Open {
+			totalLatency += result.Latency
+			if summary.MinLatency == 0 || result.Latency < summary.MinLatency {
+				summary.MinLatency = result.Latency
+			}
+			summary.MaxLatency = max(summary.MaxLatency, result.Latency)
+		}
+		if s.opts.Randomize {
+			if result.Open || s.opts.All {
+				shuffled = append(shuffled, result)
+			}
+			continue
+		}
+		pending[finished.seq] = result
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-slots
+			report(result)
+		}
+	}
+
+	// Ports skipped after cancellation leave gaps, so whatever is still held goes out in order
+	seqs := make([]int, 0, len(pending))
+	for seq := range pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		report(pending[seq])
+	}
+	sort.Slice(shuffled, func(i, j int) bool {
+		if shuffled[i].Protocol != shuffled[j].Protocol {
+			return shuffled[i].Protocol < shuffled[j].Protocol
+		}
+		return shuffled[i].Port < shuffled[j].Port
+	})
+	for _, result := range shuffled {
+		report(result)
+	}
+
+	summary.Scanned = int(scanned.Load())
+	summary.Elapsed = time.Since(start)
+	if rtt != nil {
+		summary.RTT, summary.Timeout = rtt.RTT(), rtt.Timeout(s.opts.Timeout)
+	}
+	summary.Workers = limit.Limit()
+	if open := summary.States[StateOpen]; open > 0 {
+		summary.AvgLatency = totalLatency / time.Duration(open)
+	}
+	return summary
+}
+
+func (s *Scanner) worker(ctx context.Context, host string, rtt *rttEstimator, limit *workerLimit, jobs <-chan queuedJob, results chan<- finishedJob, total int, scanned *atomic.Int64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for job := range jobs {
+		// Drain anything still buffered after cancellation without dialing it
+		if ctx.Err() != nil {
+			continue
+		}
+		if s.opts.Resume != nil {
+			if result, ok := s.opts.Resume(host, job.Port, job.Protocol); ok {
+				done := scanned.Add(1)
+				if s.opts.Progress != nil {
+					s.opts.Progress(int(done), total)
+				}
+				results <- finishedJob{seq: job.seq, Result: result, resumed: true}
+				continue
+			}
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(job.Port))
+		// IPVersion narrows "tcp"/"udp" to "tcp4"/"udp6" and friends
+		network := job.Protocol + s.opts.IPVersion
+		var state State
+		var latency time.Duration
+		var probeRuns []probeRun
+		var onOpen func(net.Conn)
+		if len(s.probes) > 0 {
+			onOpen = func(conn net.Conn) {
+				probeRuns = s.runConnProbes(ctx, host, job.Port, conn)
+			}
+		}
+		var dialErr error
+		attempt := 0
+		fileLimitRetries := 0
+		for {
+			if !limit.Acquire(ctx) {
+				break
+			}
+			if !s.limiter.Wait(ctx) {
+				limit.Release(StateError, 0)
+				break
+			}
+			attempt++
+			timeout := rtt.Timeout(s.opts.Timeout)
+			var err error
+			if job.Protocol == "udp" {
+				state, latency, err = probeUDP(ctx, s.dialer(network, timeout), network, address)
+			} else {
+				state, latency, err = probeTCP(ctx, s.tcpDialer(timeout), network, address, onOpen)
+			}
+			limit.Release(state, latency)
+			dialErr = err
+			if state == StateOpen || state == StateClosed {
+				rtt.Observe(latency)
+			}
+			if s.opts.OnAttempt != nil {
+				s.opts.OnAttempt(Attempt{
+					IP:       host,
+					Port:     job.Port,
+					Protocol: job.Protocol,
+					Number:   attempt,
+					State:    state,
+					Latency:  latency,
+					Err:      err,
+				})
+			}
+			// Only timeouts are worth retrying; a refusal or hard error is definitive. Running
+			// out of file descriptors is not about the port either, and other workers closing
+			// theirs may well let the next attempt through, so it gets a retry of its own.
+			timedOut := state == StateFiltered || state == StateOpenFiltered
+			if isFileLimit(err) && fileLimitRetries == 0 {
+				fileLimitRetries++
+				if sleepContext(ctx, retryBackoff) {
+					continue
+				}
+				break
+			}
+			if !timedOut || attempt > s.opts.Retries+fileLimitRetries || !sleepContext(ctx, retryBackoff*time.Duration(attempt)) {
+				break
+			}
+		}
+		// A dial aborted by cancellation says nothing about the port, so leave it unreported
+		if ctx.Err() != nil && state != StateOpen {
+			continue
+		}
+		// Timeouts and errors only measure how long we waited, not the port
+		if state != StateOpen && state != StateClosed {
+			latency = 0
+		}
+		// Probes dialing a connection of their own only start now, so none of them is
+		// counted in the port's latency
+		if state == StateOpen && job.Protocol == "tcp" && len(s.probes) > 0 {
+			probeRuns = append(probeRuns, s.runDialProbes(ctx, host, job.Port)...)
+		}
+		done := scanned.Add(1)
+		if s.opts.Progress != nil {
+			s.opts.Progress(int(done), total)
+		}
+		result := Result{
+			Port:      job.Port,
+			Protocol:  job.Protocol,
+			Open:      state == StateOpen,
+			State:     state,
+			Error:     errorText(dialErr),
+			Attempts:  attempt,
+			Latency:   latency,
+			Timestamp: time.Now(),
+		}
+		applyProbes(&result, probeRuns)
+		results <- finishedJob{seq: job.seq, Result: result, fileLimited: isFileLimit(dialErr)}
+	}
+}
+
+// errorText describes a failed dial or read for Result.Error, without the "dial tcp
+// host:port" prefix that only repeats the port; empty for a nil err
+func errorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		err = opErr.Err
+	}
+	return err.Error()
+}
+
+// isFileLimit reports whether err is the process or the system running out of file
+// descriptors, which fails a dial before any packet is sent
+func isFileLimit(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EMFILE || errno == syscall.ENFILE || errno == wsaemfile
+}
+
+func classifyDialError(err error) State {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return StateFiltered
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED, syscall.ECONNRESET, wsaeconnrefused, wsaeconnreset:
+			return StateClosed
+		case syscall.ETIMEDOUT, syscall.EHOSTUNREACH, wsaetimedout, wsaehostunreach:
+			return StateFiltered
+		}
+	}
+
+	// Unreachable networks, DNS failures and anything unexpected say nothing about the port itself
+	return StateError
+}
+
+// newRateLimiter hands out one token per 1/perSecond. The ticker keeps at most one tick
+// buffered, so an idle limiter never lets a burst through once dialing resumes.
+func newRateLimiter(perSecond int) *rateLimiter {
+	// Rates above a billion per second would round the interval down to nothing
+	interval := max(time.Second/time.Duration(perSecond), time.Nanosecond)
+	return &rateLimiter{ticker: time.NewTicker(interval)}
+}
+
+// Wait blocks until the next connection attempt is allowed and reports whether
+// it returned without ctx being cancelled. A nil limiter never blocks.
+func (l *rateLimiter) Wait(ctx context.Context) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case <-l.ticker.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Stop releases the ticker. A nil limiter has nothing to stop.
+func (l *rateLimiter) Stop() {
+	if l != nil {
+		l.ticker.Stop()
+	}
+}
+
+// sleepContext waits for d and reports whether it did so without ctx being cancelled
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// dialer returns a dialer for network that gives up after timeout and sends from
+// Options.LocalAddr and Options.Interface, if set
+func (s *Scanner) dialer(network string, timeout time.Duration) *net.Dialer {
+	return s.opts.source().dialer(network, timeout)
+}
+
+// tcpDialer returns a dialer for TCP that gives up after timeout, going through
+// Options.Dial if set
+func (s *Scanner) tcpDialer(timeout time.Duration) contextDialer {
+	return s.opts.source().tcpDialer(timeout)
+}
+
+// source is where the scanner's connections leave from
+func (opts Options) source() dialSource {
+	return dialSource{ip: opts.LocalAddr, device: opts.Interface, dial: opts.Dial}
+}
+
+// probeTCP reports the port state and how long dialer took to connect. When the port is
+// open and onOpen is set, it is handed the connection before it is closed, e.g. to read
+// a banner; the latency does not include the time onOpen takes.
+func probeTCP(ctx context.Context, dialer contextDialer, network, address string, onOpen func(net.Conn)) (State, time.Duration, error) {
+	dialStart := time.Now()
+	conn, err := dialer.DialContext(ctx, network, address)
+	latency := time.Since(dialStart)
+	if err != nil {
+		return classifyDialError(err), latency, err
+	}
+	defer conn.Close()
+
+	if onOpen != nil {
+		onOpen(conn)
+	}
+	return StateOpen, latency, nil
+}
+
+// readBanner passively waits for the service to speak first; services like HTTP
+// that wait for the client simply yield an empty banner
+func readBanner(conn net.Conn, timeout time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1024)
+	n, _ := conn.Read(buf)
+	return sanitizeBanner(buf[:n])
+}
+
+func sanitizeBanner(data []byte) string {
+	var sb strings.Builder
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		switch {
+		case r == '\n':
+			sb.WriteRune(r)
+		case r == '\r':
+		case r == utf8.RuneError || !unicode.IsPrint(r):
+			sb.WriteByte('.')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// probeUDP reports the port state and the round trip from sending the probe
+// to the reply or ICMP error, which is waited for as long as dialer's timeout
+func probeUDP(ctx context.Context, dialer *net.Dialer, network, address string) (State, time.Duration, error) {
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return classifyDialError(err), 0, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	sent := time.Now()
+	if _, err := conn.Write([]byte{}); err != nil {
+		return classifyDialError(err), time.Since(sent), err
+	}
+
+	// A connected UDP socket surfaces ICMP port unreachable as ECONNREFUSED on the next read
+	buf := make([]byte, 512)
+	if _, err := conn.Read(buf); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return StateOpenFiltered, time.Since(sent), err
+		}
+		return classifyDialError(err), time.Since(sent), err
+	}
+	return StateOpen, time.Since(sent), nil
+}
@@ -0,0 +1,1616 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Bikatr7/KaiTools/PortScanner/version"
+)
+
+// listenTCP starts a TCP server on an ephemeral port that writes banner (if any)
+// to every client, and returns its port
+func listenTCP(t *testing.T, banner string) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if banner != "" {
+				conn.Write([]byte(banner))
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// closedPort returns a port that was just released, so connecting to it is refused
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+func TestScanOpenAndClosed(t *testing.T) {
+	open, closed := listenTCP(t, ""), closedPort(t)
+	s := New(Options{Ports: []int{closed, open}, All: true})
+
+	started := time.Now()
+	results, summary, err := s.ScanWithSummary(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("ScanWithSummary: %v", err)
+	}
+	finished := time.Now()
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(results), results)
+	}
+	states := map[int]State{}
+	for _, result := range results {
+		states[result.Port] = result.State
+		if result.Protocol != "tcp" || result.Attempts != 1 {
+			t.Errorf("unexpected result %+v", result)
+		}
+		// The error says why a port is closed, without repeating the address
+		want := ""
+		if !result.Open {
+			want = "connect: connection refused"
+		}
+		if result.Error != want {
+			t.Errorf("port %d error = %q, want %q", result.Port, result.Error, want)
+		}
+	}
+	if states[open] != StateOpen || states[closed] != StateClosed {
+		t.Errorf("states = %v, want %d open and %d closed", states, open, closed)
+	}
+	if results[0].Port > results[1].Port {
+		t.Errorf("results not sorted by port: %+v", results)
+	}
+	if summary.Scanned != 2 || summary.Total != 2 || summary.States[StateOpen] != 1 || summary.States[StateClosed] != 1 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	for _, result := range results {
+		if result.Latency <= 0 {
+			t.Errorf("port %d has no latency", result.Port)
+		}
+		if result.Timestamp.Before(started) || result.Timestamp.After(finished) {
+			t.Errorf("port %d finished at %s, outside the scan", result.Port, result.Timestamp)
+		}
+	}
+	if summary.MinLatency <= 0 || summary.MinLatency != summary.AvgLatency || summary.AvgLatency != summary.MaxLatency {
+		t.Errorf("latency stats for a single open port should match: %+v", summary)
+	}
+	if summary.Elapsed <= 0 || summary.Rate() <= 0 {
+		t.Errorf("summary has no timing: %+v", summary)
+	}
+}
+
+func TestScanReportsOnlyOpenByDefault(t *testing.T) {
+	open, closed := listenTCP(t, ""), closedPort(t)
+	s := New(Options{Ports: []int{open, closed}})
+
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(results) != 1 || results[0].Port != open || !results[0].Open {
+		t.Fatalf("got %+v, want only port %d open", results, open)
+	}
+	if results[0].Latency <= 0 {
+		t.Errorf("open port has no latency: %+v", results[0])
+	}
+}
+
+func TestScanBanner(t *testing.T) {
+	port := listenTCP(t, "SSH-2.0-Test\r\n")
+	s := New(Options{Ports: []int{port}, BannerTimeout: time.Second})
+
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(results) != 1 || results[0].Banner != "SSH-2.0-Test" {
+		t.Fatalf("got %+v, want banner SSH-2.0-Test", results)
+	}
+}
+
+func TestScanTLSProbe(t *testing.T) {
+	var sni atomic.Value
+	tlsServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsServer.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni.Store(hello.ServerName)
+		return nil, nil
+	}}
+	// The probe hangs up right after the handshake, which the server would log
+	tlsServer.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	// A plain HTTP server answers the ClientHello with an error straight away
+	plainServer := httptest.NewServer(http.NotFoundHandler())
+	defer plainServer.Close()
+	portOf := func(server *httptest.Server) int {
+		return server.Listener.Addr().(*net.TCPAddr).Port
+	}
+	tlsPort, plainPort := portOf(tlsServer), portOf(plainServer)
+	bannerPort := listenTCP(t, "SSH-2.0-Test\r\n")
+
+	s := New(Options{
+		Ports:         []int{tlsPort, plainPort, bannerPort},
+		BannerTimeout: 200 * time.Millisecond,
+		TLSTimeout:    5 * time.Second,
+		TLSServerName: func(ip string) string { return "example.com" },
+	})
+	start := time.Now()
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("scan took %s, the TLS probe should not wait out its timeout on ports that are not TLS", elapsed)
+	}
+	byPort := make(map[int]Result)
+	for _, result := range results {
+		byPort[result.Port] = result
+	}
+
+	info := byPort[tlsPort].TLS
+	if info == nil {
+		t.Fatalf("port %d has no TLS info: %+v", tlsPort, byPort[tlsPort])
+	}
+	if info.Version != "TLS1.3" || info.Cipher == "" || !strings.Contains(info.Issuer, "Acme Co") || info.NotAfter.IsZero() {
+		t.Errorf("TLS info = %+v", info)
+	}
+	if !reflect.DeepEqual(info.SANs, []string{"example.com", "*.example.com", "127.0.0.1", "::1"}) {
+		t.Errorf("SANs = %v", info.SANs)
+	}
+	if got, _ := sni.Load().(string); got != "example.com" {
+		t.Errorf("SNI = %q, want example.com", got)
+	}
+	if byPort[plainPort].TLS != nil {
+		t.Errorf("plain HTTP port %d reported TLS: %+v", plainPort, byPort[plainPort].TLS)
+	}
+	if result := byPort[bannerPort]; result.TLS != nil || result.Banner != "SSH-2.0-Test" {
+		t.Errorf("banner port %d = %+v, want its banner and no TLS", bannerPort, result)
+	}
+}
+
+// sshKexInit builds the unencrypted packet of a KEXINIT offering the given name-lists
+func sshKexInit(lists ...string) []byte {
+	payload := append([]byte{sshMsgKexInit}, make([]byte, 16)...)
+	for i := range 10 {
+		list := ""
+		if i < len(lists) {
+			list = lists[i]
+		}
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(list)))
+		payload = append(payload, list...)
+	}
+	payload = append(payload, 0, 0, 0, 0, 0)
+	padding := 8 - (5+len(payload))%8 + 8
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)+padding))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	return append(packet, make([]byte, padding)...)
+}
+
+// listenSSH starts a server that identifies as version and answers the client's
+// identification with kexinit, and returns its port and a channel with everything each
+// client sent
+func listenSSH(t *testing.T, version string, kexinit []byte) (int, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				conn.Write([]byte(version))
+				reader := bufio.NewReader(conn)
+				line, err := reader.ReadString('\n')
+				if err == nil {
+					conn.Write(kexinit)
+				}
+				rest, _ := io.ReadAll(reader)
+				received <- line + string(rest)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, received
+}
+
+func TestScanSSHProbe(t *testing.T) {
+	kexinit := sshKexInit(
+		"curve25519-sha256,diffie-hellman-group14-sha1",
+		"ssh-ed25519,ssh-rsa",
+		"aes128-ctr,aes128-cbc", "aes128-ctr,3des-cbc",
+		"hmac-sha2-256", "hmac-sha2-256,hmac-md5-96",
+	)
+	sshPort, received := listenSSH(t, "SSH-2.0-OpenSSH_9.6\r\n", kexinit)
+	oldPort, _ := listenSSH(t, "SSH-1.5-Legacy\r\n", nil)
+	otherPort := listenTCP(t, "220 ready\r\n")
+
+	s := New(Options{
+		Ports:         []int{sshPort, oldPort, otherPort},
+		BannerTimeout: time.Second,
+		SSHTimeout:    2 * time.Second,
+		TLSTimeout:    2 * time.Second,
+	})
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	byPort := make(map[int]Result)
+	for _, result := range results {
+		byPort[result.Port] = result
+	}
+
+	want := &SSHInfo{
+		Version:           "SSH-2.0-OpenSSH_9.6",
+		KexAlgorithms:     []string{"curve25519-sha256", "diffie-hellman-group14-sha1"},
+		HostKeyAlgorithms: []string{"ssh-ed25519", "ssh-rsa"},
+		Ciphers:           []string{"aes128-ctr", "aes128-cbc", "3des-cbc"},
+		MACs:              []string{"hmac-sha2-256", "hmac-md5-96"},
+		Weak:              []string{"diffie-hellman-group14-sha1", "ssh-rsa", "aes128-cbc", "3des-cbc", "hmac-md5-96"},
+	}
+	if got := byPort[sshPort]; !reflect.DeepEqual(got.SSH, want) || got.TLS != nil {
+		t.Errorf("SSH port = %+v, want SSH info %+v and no TLS", got, want)
+	}
+	// Nothing is sent past the identification, so there is no key exchange, let alone a login
+	if got := <-received; got != sshIdentification {
+		t.Errorf("server received %q, want only %q", got, sshIdentification)
+	}
+	if got := byPort[oldPort].SSH; got == nil || got.Version != "SSH-1.5-Legacy" || !reflect.DeepEqual(got.Weak, []string{"protocol 1.5"}) {
+		t.Errorf("SSH-1.5 port = %+v, want the version flagged as weak", got)
+	}
+	if got := byPort[otherPort]; got.SSH != nil {
+		t.Errorf("non-SSH port = %+v, want no SSH info", got)
+	}
+}
+
+func TestProbeSSHWithoutBanner(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		server.Write([]byte("Welcome\r\nSSH-2.0-Test\r\n"))
+		bufio.NewReader(server).ReadString('\n')
+		server.Write(sshKexInit("kex", "ssh-ed25519", "chacha20-poly1305@openssh.com"))
+	}()
+	info := probeSSH(client, "", 2*time.Second)
+	if info == nil || info.Version != "SSH-2.0-Test" || !reflect.DeepEqual(info.Ciphers, []string{"chacha20-poly1305@openssh.com"}) || info.Weak != nil {
+		t.Errorf("probeSSH = %+v", info)
+	}
+
+	// A server that never speaks costs no more than the timeout
+	client, server = net.Pipe()
+	defer server.Close()
+	start := time.Now()
+	if info := probeSSH(client, "", 100*time.Millisecond); info != nil {
+		t.Errorf("probeSSH on a silent server = %+v, want nil", info)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probeSSH took %s, want it to stop at its timeout", elapsed)
+	}
+}
+
+func TestScanHTTPProbe(t *testing.T) {
+	var host, userAgent atomic.Value
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+		userAgent.Store(r.UserAgent())
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		w.Header().Set("Server", "test/1.0")
+		io.WriteString(w, "<html><head><TITLE>\n  Home &amp; away\n</TITLE></head></html>")
+	})
+	plainServer := httptest.NewServer(mux)
+	defer plainServer.Close()
+	tlsServer := httptest.NewUnstartedServer(mux)
+	// The plain HTTP attempt on the TLS port makes the server log a bad handshake
+	tlsServer.Config.ErrorLog = log.New(io.Discard, "", 0)
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	portOf := func(server *httptest.Server) int {
+		return server.Listener.Addr().(*net.TCPAddr).Port
+	}
+	plainPort, tlsPort := portOf(plainServer), portOf(tlsServer)
+	bannerPort := listenTCP(t, "SSH-2.0-Test\r\n")
+
+	probe := func(follow bool) map[int]Result {
+		s := New(Options{
+			Ports:               []int{plainPort, tlsPort, bannerPort},
+			HTTPTimeout:         5 * time.Second,
+			HTTPPorts:           []int{plainPort, tlsPort, bannerPort},
+			HTTPFollowRedirects: follow,
+			HTTPHost:            func(ip string) string { return "example.com" },
+		})
+		results, err := s.Scan(context.Background(), "127.0.0.1")
+		if err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		byPort := make(map[int]Result)
+		for _, result := range results {
+			byPort[result.Port] = result
+		}
+		return byPort
+	}
+
+	byPort := probe(false)
+	want := &HTTPInfo{URL: fmt.Sprintf("http://127.0.0.1:%d/", plainPort), Status: http.StatusFound, ContentLength: 28, Location: "/home"}
+	if got := byPort[plainPort].HTTP; got == nil || *got != *want {
+		t.Errorf("HTTP = %+v, want %+v", got, want)
+	}
+	if got, _ := host.Load().(string); got != "example.com" {
+		t.Errorf("Host = %q, want example.com", got)
+	}
+	if got, _ := userAgent.Load().(string); got != version.UserAgent() {
+		t.Errorf("User-Agent = %q, want %q", got, version.UserAgent())
+	}
+	// The TLS port answers plain HTTP with a 400, which gets HTTPS tried too
+	if got := byPort[tlsPort].HTTP; got == nil || got.Status != http.StatusFound || !strings.HasPrefix(got.URL, "https://") {
+		t.Errorf("HTTP = %+v, want the redirect over HTTPS", got)
+	}
+	if got := byPort[bannerPort].HTTP; got != nil {
+		t.Errorf("port %d that does not speak HTTP reported %+v", bannerPort, got)
+	}
+
+	byPort = probe(true)
+	want = &HTTPInfo{URL: fmt.Sprintf("http://127.0.0.1:%d/home", plainPort), Status: http.StatusOK, Server: "test/1.0", ContentLength: 60, Title: "Home & away"}
+	if got := byPort[plainPort].HTTP; got == nil || *got != *want {
+		t.Errorf("HTTP = %+v, want %+v", got, want)
+	}
+
+	// Without HTTPPorts only the usual web ports are sent a request
+	results, err := New(Options{Ports: []int{plainPort}, HTTPTimeout: 5 * time.Second}).Scan(context.Background(), "127.0.0.1")
+	if err != nil || len(results) != 1 || results[0].HTTP != nil {
+		t.Errorf("Scan = %+v, %v, want port %d open without an HTTP answer", results, err, plainPort)
+	}
+	s := New(Options{HTTPTimeout: time.Second})
+	for port, want := range map[int]bool{80: true, 443: true, 8080: true, 8443: true, 22: false, 5432: false} {
+		if got := s.probes[0].Match(port); got != want {
+			t.Errorf("Match(%d) = %t, want %t", port, got, want)
+		}
+	}
+}
+
+// testProbe is a Probe made of functions, dialing its own connection unless conn is set
+type testProbe struct {
+	name  string
+	conn  bool
+	match func(port int) bool
+	run   func(ctx context.Context, target ProbeTarget) (map[string]string, error)
+}
+
+func (p testProbe) Name() string        { return p.name }
+func (p testProbe) Match(port int) bool { return p.match == nil || p.match(port) }
+func (p testProbe) UsesConn() bool      { return p.conn }
+func (p testProbe) Run(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+	return p.run(ctx, target)
+}
+
+func TestScanProbes(t *testing.T) {
+	bannerPort, silentPort := listenTCP(t, "SSH-2.0-Test\r\n"), listenTCP(t, "")
+	var active, peak atomic.Int64
+	s := New(Options{
+		Ports:            []int{bannerPort, silentPort, closedPort(t)},
+		All:              true,
+		BannerTimeout:    200 * time.Millisecond,
+		ProbeConcurrency: 1,
+		Probes: []Probe{
+			// Runs on the scan's own connection, after the banner was read from it
+			testProbe{name: "conn", conn: true, run: func(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+				if target.Conn == nil {
+					return nil, errors.New("no connection")
+				}
+				return map[string]string{"conn.banner_seen": fmt.Sprint(target.Found.Banner != "")}, nil
+			}},
+			testProbe{name: "dial", run: func(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+				n := active.Add(1)
+				defer active.Add(-1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+				time.Sleep(20 * time.Millisecond)
+				if target.Conn != nil {
+					return nil, errors.New("got a connection")
+				}
+				return map[string]string{"dial.port": strconv.Itoa(target.Port)}, nil
+			}},
+			testProbe{name: "fails", run: func(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+				return nil, errors.New("no luck")
+			}},
+			testProbe{name: "unmatched", match: func(int) bool { return false }, run: func(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+				t.Error("ran a probe that did not match the port")
+				return nil, nil
+			}},
+		},
+	})
+
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	for _, result := range results {
+		var want map[string]string
+		switch result.Port {
+		case bannerPort:
+			want = map[string]string{"conn.banner_seen": "true", "dial.port": strconv.Itoa(bannerPort), "fails.error": "no luck"}
+			if result.Banner != "SSH-2.0-Test" {
+				t.Errorf("Banner = %q, the built-in banner probe should still fill it", result.Banner)
+			}
+		case silentPort:
+			want = map[string]string{"conn.banner_seen": "false", "dial.port": strconv.Itoa(silentPort), "fails.error": "no luck"}
+		}
+		if !reflect.DeepEqual(result.Annotations, want) {
+			t.Errorf("port %d annotations = %v, want %v", result.Port, result.Annotations, want)
+		}
+	}
+	if got := peak.Load(); got != 1 {
+		t.Errorf("%d dialing probes ran at once, want ProbeConcurrency 1", got)
+	}
+}
+
+// testResultProbe is a ConnProbe recording straight into the Result through record
+type testResultProbe struct {
+	testProbe
+	record func(target ProbeTarget) (func(*Result), error)
+}
+
+func (p testResultProbe) RunResult(ctx context.Context, target ProbeTarget) (func(*Result), error) {
+	return p.record(target)
+}
+
+func TestScanResultProbes(t *testing.T) {
+	silentPort := listenTCP(t, "")
+	s := New(Options{
+		Ports: []int{silentPort},
+		Probes: []Probe{
+			testResultProbe{testProbe{name: "greeter", conn: true}, func(target ProbeTarget) (func(*Result), error) {
+				return func(result *Result) { result.Banner = "hello" }, nil
+			}},
+			// Sees what the ResultProbe before it recorded in Found
+			testProbe{name: "reader", conn: true, run: func(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+				return map[string]string{"reader.found": target.Found.Banner}, nil
+			}},
+			testResultProbe{testProbe{name: "broken"}, func(target ProbeTarget) (func(*Result), error) {
+				return nil, errors.New("no luck")
+			}},
+		},
+	})
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Scan = %+v, %v, want the port open", results, err)
+	}
+	want := map[string]string{"reader.found": "hello", "broken.error": "no luck"}
+	if results[0].Banner != "hello" || !reflect.DeepEqual(results[0].Annotations, want) {
+		t.Errorf("Banner = %q, annotations = %v, want hello and %v", results[0].Banner, results[0].Annotations, want)
+	}
+
+	// Run on a built-in probe reports its findings as annotations
+	bannerPort := listenTCP(t, "SSH-2.0-Test\r\n")
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bannerPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	annotations, err := bannerProbe{timeout: time.Second}.Run(context.Background(), ProbeTarget{IP: "127.0.0.1", Port: bannerPort, Conn: conn})
+	if err != nil || !reflect.DeepEqual(annotations, map[string]string{"banner": "SSH-2.0-Test"}) {
+		t.Errorf("Run = %v, %v, want the banner", annotations, err)
+	}
+	info := &HTTPInfo{URL: "http://127.0.0.1/", Status: 200, ContentLength: -1, Title: "Home"}
+	annotations, _ = ResultAnnotations(context.Background(), testResultProbe{record: func(ProbeTarget) (func(*Result), error) {
+		return func(result *Result) { result.HTTP = info }, nil
+	}}, ProbeTarget{})
+	want = map[string]string{"http.url": "http://127.0.0.1/", "http.status": "200", "http.content_length": "-1", "http.title": "Home"}
+	if !reflect.DeepEqual(annotations, want) {
+		t.Errorf("ResultAnnotations = %v, want %v", annotations, want)
+	}
+}
+
+func TestScanLocalAddr(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux routes all of 127.0.0.0/8 to the loopback interface")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sources := make(chan string, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			sources <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	s := New(Options{Ports: []int{port}, LocalAddr: net.ParseIP("127.0.0.2")})
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Scan = %+v, %v, want the port open", results, err)
+	}
+	if source := <-sources; source != "127.0.0.2" {
+		t.Errorf("connection came from %s, want 127.0.0.2", source)
+	}
+
+	// The address family follows the local address
+	s = New(Options{Ports: []int{port}, LocalAddr: net.ParseIP("127.0.0.2")})
+	if s.opts.IPVersion != "4" {
+		t.Errorf("IPVersion = %q, want 4", s.opts.IPVersion)
+	}
+}
+
+func TestScanDial(t *testing.T) {
+	var dialed sync.Map
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed.Store(address, network)
+		switch address {
+		case "192.0.2.1:22":
+			client, server := net.Pipe()
+			go func() {
+				server.Write([]byte("SSH-2.0-jump\r\n"))
+				server.Close()
+			}()
+			return client, nil
+		case "192.0.2.1:23":
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	s := New(Options{Ports: []int{22, 23, 24}, All: true, Timeout: 100 * time.Millisecond, BannerTimeout: time.Second, Dial: dial})
+	results, err := s.Scan(context.Background(), "192.0.2.1")
+	if err != nil || len(results) != 3 {
+		t.Fatalf("Scan = %+v, %v, want three results", results, err)
+	}
+	for i, want := range []State{StateOpen, StateClosed, StateFiltered} {
+		if results[i].State != want {
+			t.Errorf("port %d is %s, want %s", results[i].Port, results[i].State, want)
+		}
+	}
+	if results[0].Banner != "SSH-2.0-jump" {
+		t.Errorf("banner = %q, want the one sent over the dialed connection", results[0].Banner)
+	}
+
+	// Discovery dials the same way, without the ICMP echo
+	s = New(Options{DiscoveryPorts: []int{23}, Dial: dial})
+	if status := s.Discover(context.Background(), "192.0.2.1", time.Second); !status.Up || status.Reason != "conn-refused" {
+		t.Errorf("Discover = %+v, want up through the refused port", status)
+	}
+	if _, ok := dialed.Load("192.0.2.1:24"); !ok {
+		t.Error("Dial was not used for port 24")
+	}
+}
+
+func TestDialSource(t *testing.T) {
+	ip := net.ParseIP("10.0.0.5")
+	source := Options{LocalAddr: ip, Interface: "eth1"}.source()
+	for network, want := range map[string]net.Addr{
+		"tcp4":     &net.TCPAddr{IP: ip},
+		"udp":      &net.UDPAddr{IP: ip},
+		"ip4:icmp": &net.IPAddr{IP: ip},
+	} {
+		dialer := source.dialer(network, time.Second)
+		if !reflect.DeepEqual(dialer.LocalAddr, want) || dialer.Timeout != time.Second || dialer.Control == nil {
+			t.Errorf("dialer(%s) = %+v, want it bound to %v and eth1", network, dialer, want)
+		}
+	}
+	if dialer := (dialSource{}).dialer("tcp", time.Second); dialer.LocalAddr != nil || dialer.Control != nil {
+		t.Errorf("dialer without a source = %+v, want the routing table to decide", dialer)
+	}
+
+	// Binding to the loopback interface still reaches a loopback listener
+	if !CanBindInterface {
+		return
+	}
+	port := listenTCP(t, "")
+	dialer := dialSource{device: "lo"}.dialer("tcp", time.Second)
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to an interface needs CAP_NET_RAW")
+	}
+	if err != nil {
+		t.Fatalf("dial bound to lo: %v", err)
+	}
+	conn.Close()
+	dialer = dialSource{device: "no-such-interface"}.dialer("tcp", time.Second)
+	if conn, err := dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+		conn.Close()
+		t.Error("dial bound to a missing interface succeeded")
+	}
+}
+
+func TestScanDoesNotRetryRefusedPorts(t *testing.T) {
+	closed := closedPort(t)
+	s := New(Options{Ports: []int{closed}, Retries: 3, All: true})
+
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(results) != 1 || results[0].Attempts != 1 {
+		t.Fatalf("got %+v, want a single attempt", results)
+	}
+}
+
+func TestScanProgress(t *testing.T) {
+	ports := []int{listenTCP(t, ""), closedPort(t), closedPort(t)}
+	var calls, lastTotal int
+	s := New(Options{
+		Ports:   ports,
+		Workers: 1,
+		Progress: func(done, total int) {
+			calls++
+			lastTotal = total
+		},
+	})
+
+	if _, err := s.Scan(context.Background(), "127.0.0.1"); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if calls != len(ports) || lastTotal != len(ports) {
+		t.Errorf("Progress called %d times with total %d, want %d", calls, lastTotal, len(ports))
+	}
+}
+
+func TestScanRate(t *testing.T) {
+	closed := closedPort(t)
+	// Five attempts at 20 per second take at least four intervals, however many workers dial
+	s := New(Options{Ports: []int{closed, closed, closed, closed, closed}, Workers: 5, Rate: 20, All: true})
+
+	start := time.Now()
+	if _, err := s.Scan(context.Background(), "127.0.0.1"); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("scan took %s, want at least 200ms at 20 attempts per second", elapsed)
+	}
+}
+
+func TestRTTEstimator(t *testing.T) {
+	var none *rttEstimator
+	if got := none.Timeout(time.Second); got != time.Second {
+		t.Errorf("nil estimator Timeout = %s, want the fallback", got)
+	}
+
+	e := newRTTEstimator(100*time.Millisecond, 2*time.Second)
+	if got := e.Timeout(time.Second); got != time.Second {
+		t.Errorf("Timeout without samples = %s, want the fallback", got)
+	}
+	e.Observe(80 * time.Millisecond)
+	if got := e.Timeout(time.Second); got != 320*time.Millisecond {
+		t.Errorf("Timeout = %s, want 4x the first sample", got)
+	}
+	// Later samples only move the estimate an eighth of the way
+	e.Observe(160 * time.Millisecond)
+	if got := e.RTT(); got != 90*time.Millisecond {
+		t.Errorf("RTT = %s, want 90ms", got)
+	}
+
+	e = newRTTEstimator(100*time.Millisecond, 2*time.Second)
+	e.Observe(time.Millisecond)
+	if got := e.Timeout(time.Second); got != 100*time.Millisecond {
+		t.Errorf("Timeout = %s, want the lower bound", got)
+	}
+	e = newRTTEstimator(100*time.Millisecond, 2*time.Second)
+	e.Observe(time.Second)
+	if got := e.Timeout(time.Second); got != 2*time.Second {
+		t.Errorf("Timeout = %s, want the upper bound", got)
+	}
+}
+
+func TestScanAdaptiveTimeout(t *testing.T) {
+	s := New(Options{Ports: []int{listenTCP(t, ""), closedPort(t)}, AdaptiveTimeout: true, All: true})
+
+	_, summary, err := s.ScanWithSummary(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("ScanWithSummary: %v", err)
+	}
+	// Loopback answers far quicker than a quarter of the lower bound
+	if summary.RTT <= 0 || summary.Timeout != DefaultMinTimeout {
+		t.Errorf("got RTT %s and timeout %s, want a measured RTT and the %s lower bound", summary.RTT, summary.Timeout, DefaultMinTimeout)
+	}
+
+	_, summary, _ = New(Options{Ports: []int{closedPort(t)}}).ScanWithSummary(context.Background(), "127.0.0.1")
+	if summary.RTT != 0 || summary.Timeout != 0 {
+		t.Errorf("got RTT %s and timeout %s without AdaptiveTimeout", summary.RTT, summary.Timeout)
+	}
+}
+
+func TestWorkerLimit(t *testing.T) {
+	const ceiling = 8
+	l := newWorkerLimit(ceiling)
+	if got := l.Limit(); got != 2 {
+		t.Fatalf("Limit = %d at the start, want a quarter of %d", got, ceiling)
+	}
+
+	// Fast, steady answers keep raising the limit, but never past the ceiling
+	var active, peak atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4*ceiling; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if !l.Acquire(context.Background()) {
+					t.Error("Acquire failed without cancellation")
+					return
+				}
+				n := active.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(100 * time.Microsecond)
+				active.Add(-1)
+				l.Release(StateOpen, time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := peak.Load(); got > ceiling {
+		t.Errorf("%d probes held a slot at once, want at most %d", got, ceiling)
+	}
+	if got := l.Limit(); got != ceiling {
+		t.Errorf("Limit = %d after fast answers, want %d", got, ceiling)
+	}
+
+	// Windows full of timeouts bring it down to the floor
+	for i := 0; i < 5*adaptiveWindow; i++ {
+		l.Acquire(context.Background())
+		l.Release(StateFiltered, 0)
+	}
+	if got := l.Limit(); got != 1 {
+		t.Errorf("Limit = %d after timeouts, want an eighth of %d", got, ceiling)
+	}
+
+	// Answers slowing down back it off as well
+	l = newWorkerLimit(ceiling)
+	for _, latency := range []time.Duration{time.Millisecond, 10 * time.Millisecond} {
+		before := l.Limit()
+		for i := 0; i < adaptiveWindow; i++ {
+			l.Acquire(context.Background())
+			l.Release(StateClosed, latency)
+		}
+		if latency > time.Millisecond && l.Limit() >= before {
+			t.Errorf("Limit went from %d to %d when answers slowed down", before, l.Limit())
+		}
+	}
+
+	// Waiting for a slot gives up with ctx
+	l = newWorkerLimit(1)
+	l.Acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if l.Acquire(ctx) {
+		t.Error("Acquire got a second slot of a limit of one")
+	}
+}
+
+func TestScanAdaptiveWorkers(t *testing.T) {
+	ports := []int{listenTCP(t, "")}
+	for i := 0; i < 3*adaptiveWindow; i++ {
+		ports = append(ports, closedPort(t))
+	}
+	s := New(Options{Ports: ports, Workers: 16, AdaptiveWorkers: true})
+	results, summary, err := s.ScanWithSummary(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("ScanWithSummary: %v", err)
+	}
+	if len(results) != 1 || results[0].Port != ports[0] {
+		t.Errorf("got %v, want only port %d open", results, ports[0])
+	}
+	if summary.Workers < 2 || summary.Workers > 16 {
+		t.Errorf("Workers = %d, want between 2 and 16", summary.Workers)
+	}
+
+	_, summary, _ = New(Options{Ports: ports[:1]}).ScanWithSummary(context.Background(), "127.0.0.1")
+	if summary.Workers != 0 {
+		t.Errorf("Workers = %d without AdaptiveWorkers", summary.Workers)
+	}
+}
+
+func TestRateLimiterCancelled(t *testing.T) {
+	limiter := newRateLimiter(1)
+	limiter.Wait(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// The next token is a second away, but cancellation must not wait for it
+	start := time.Now()
+	if limiter.Wait(ctx) {
+		t.Error("Wait reported a token after ctx was cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Wait returned %s after cancellation", elapsed)
+	}
+	if newRateLimiter(2_000_000_000) == nil {
+		t.Error("newRateLimiter should accept rates above one per nanosecond")
+	}
+}
+
+func TestNarrow(t *testing.T) {
+	s := New(Options{Ports: []int{22, 80}, Workers: 8, Rate: 100})
+	defer s.Close()
+
+	narrowed := s.Narrow([]int{443}, 4)
+	if !reflect.DeepEqual(narrowed.opts.Ports, []int{443}) || narrowed.opts.Workers != 4 {
+		t.Errorf("narrowed options = %+v, want port 443 and 4 workers", narrowed.opts)
+	}
+	if narrowed.limiter != s.limiter || narrowed.probeSlots != s.probeSlots {
+		t.Error("a narrowed Scanner must share the rate limit and probe slots")
+	}
+	if !reflect.DeepEqual(s.opts.Ports, []int{22, 80}) || s.opts.Workers != 8 {
+		t.Errorf("Narrow changed the original options to %+v", s.opts)
+	}
+	if kept := s.Narrow(nil, 64); !reflect.DeepEqual(kept.opts.Ports, []int{22, 80}) || kept.opts.Workers != 8 {
+		t.Errorf("Narrow(nil, 64) options = %+v, want the original ports and workers capped at 8", kept.opts)
+	}
+	New(Options{}).Close()
+}
+
+func TestScanResume(t *testing.T) {
+	open, closed := listenTCP(t, ""), closedPort(t)
+	var recorded []int
+	s := New(Options{
+		Ports:   []int{open, closed},
+		All:     true,
+		Workers: 1,
+		// Claim the closed port was open last time, which only a resumed result can explain
+		Resume: func(ip string, port int, protocol string) (Result, bool) {
+			if ip == "127.0.0.1" && port == closed && protocol == "tcp" {
+				return Result{Port: closed, Protocol: "tcp", Open: true, State: StateOpen, Attempts: 1}, true
+			}
+			return Result{}, false
+		},
+		OnResult: func(ip string, result Result) {
+			recorded = append(recorded, result.Port)
+		},
+	})
+
+	results, summary, err := s.ScanWithSummary(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("ScanWithSummary: %v", err)
+	}
+	if len(results) != 2 || !results[0].Open || !results[1].Open || summary.States[StateOpen] != 2 {
+		t.Errorf("got %+v, want the resumed result merged in", results)
+	}
+	if !reflect.DeepEqual(recorded, []int{open}) {
+		t.Errorf("OnResult saw ports %v, want only the probed %d", recorded, open)
+	}
+}
+
+func TestScanFirstOpen(t *testing.T) {
+	ports := make([]int, 20)
+	for i := range ports {
+		ports[i] = listenTCP(t, "")
+	}
+	s := New(Options{Ports: ports, Workers: 1, FirstOpen: 1})
+
+	results, summary, err := s.ScanWithSummary(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("ScanWithSummary: %v", err)
+	}
+	// One worker can have picked up at most one more port before the scan was stopped
+	if !summary.Stopped || len(results) == 0 || len(results) > 2 || summary.Scanned >= summary.Total {
+		t.Errorf("got %d results and summary %+v, want the scan stopped after the first open port", len(results), summary)
+	}
+
+	summary, _ = New(Options{Ports: ports[:3], Workers: 1}).Stream(context.Background(), "127.0.0.1", func(Result) {})
+	if summary.Stopped || summary.Scanned != 3 {
+		t.Errorf("without FirstOpen got summary %+v, want every port scanned", summary)
+	}
+}
+
+func TestScanLargeRangeBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("scans 30000 ports")
+	}
+	// Results only wait in channels sized by the worker count and the reorder window, so
+	// the heap must not grow with the range. Holding every result of a range this size
+	// would take several megabytes.
+	var mu sync.Mutex
+	var samples []uint64
+	var baseline runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&baseline)
+	s := New(Options{
+		Ports:   portRange(1, 30000),
+		Workers: 4,
+		Timeout: 200 * time.Millisecond,
+		All:     true,
+		Progress: func(done, total int) {
+			if done%5000 == 0 {
+				var stats runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				mu.Lock()
+				samples = append(samples, stats.HeapAlloc)
+				mu.Unlock()
+			}
+		},
+	})
+
+	emitted := 0
+	summary, err := s.Stream(context.Background(), "127.0.0.1", func(Result) { emitted++ })
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if emitted != 30000 || summary.Scanned != 30000 {
+		t.Fatalf("emitted %d results and scanned %d ports, want 30000", emitted, summary.Scanned)
+	}
+	for i, heap := range samples {
+		if heap > baseline.HeapAlloc+2<<20 {
+			t.Errorf("heap at sample %d is %d bytes, more than 2MB above the %d it started at", i, heap, baseline.HeapAlloc)
+		}
+	}
+}
+
+func TestNewScanner(t *testing.T) {
+	s, err := NewScanner()
+	if err != nil {
+		t.Fatalf("NewScanner: %v", err)
+	}
+	if len(s.opts.Ports) != 65535 || s.opts.Workers != DefaultWorkers || s.opts.Timeout != DefaultTimeout || s.limiter != nil || !reflect.DeepEqual(s.opts.Protocols, []string{"tcp"}) {
+		t.Errorf("defaults = %+v, want the command line defaults", s.opts)
+	}
+
+	s, err = NewScanner(WithPortRange(20, 25), WithWorkers(5), WithTimeout(time.Second/2), WithRate(50), WithProtocol("both"), WithRetries(2), WithPorts(443, 80))
+	if err != nil {
+		t.Fatalf("NewScanner: %v", err)
+	}
+	if !reflect.DeepEqual(s.opts.Ports, []int{443, 80}) || s.opts.Workers != 5 || s.opts.Timeout != time.Second/2 || s.opts.Retries != 2 ||
+		s.opts.Rate != 50 || s.limiter == nil || !reflect.DeepEqual(s.opts.Protocols, []string{"tcp", "udp"}) {
+		t.Errorf("options = %+v, want every option applied, the later ports winning", s.opts)
+	}
+
+	for _, tc := range []struct {
+		option Option
+		err    string
+	}{
+		{WithWorkers(0), "workers must be greater than 0, not 0"},
+		{WithTimeout(-time.Second), "timeout must be a positive duration, not -1s"},
+		{WithRate(-1), "rate cannot be negative, not -1"},
+		{WithProtocol("sctp"), `unknown protocol "sctp" (expected tcp, udp or both)`},
+		{WithRetries(-1), "retries cannot be negative, not -1"},
+		{WithPorts(), "no ports to scan"},
+		{WithPorts(80, 70000), "invalid port 70000 (expected 1-65535)"},
+		{WithPortRange(100, 10), "invalid port range 100-10 (expected 1-65535, start no higher than end)"},
+		{WithProbe(nil), "probe must not be nil"},
+	} {
+		if s, err := NewScanner(WithWorkers(10), tc.option); s != nil || err == nil || err.Error() != tc.err {
+			t.Errorf("NewScanner = %v, %v, want error %q", s, err, tc.err)
+		}
+	}
+
+	// The same Scanner can scan again and again
+	open, closed := listenTCP(t, ""), closedPort(t)
+	s, err = NewScanner(WithPorts(open, closed), WithWorkers(2), WithAll())
+	if err != nil {
+		t.Fatalf("NewScanner: %v", err)
+	}
+	for range 2 {
+		_, summary, err := s.ScanWithSummary(context.Background(), "127.0.0.1")
+		if err != nil || summary.States[StateOpen] != 1 || summary.States[StateClosed] != 1 {
+			t.Errorf("ScanWithSummary = %+v, %v, want %d open and %d closed", summary, err, open, closed)
+		}
+	}
+}
+
+func TestScanOrder(t *testing.T) {
+	ports := make([]int, 100)
+	for i := range ports {
+		ports[i] = i + 1
+	}
+	opts := Options{Ports: ports, Protocols: []string{"tcp", "udp"}}
+	if order := New(opts).scanOrder(opts.Ports); order[0] != (scanJob{1, "tcp"}) || order[199] != (scanJob{100, "udp"}) {
+		t.Errorf("default order should be ascending per protocol, got %v ... %v", order[0], order[199])
+	}
+
+	opts.Randomize, opts.Seed = true, 42
+	first, second := New(opts).scanOrder(opts.Ports), New(opts).scanOrder(opts.Ports)
+	if len(first) != 200 {
+		t.Fatalf("got %d jobs, want 200", len(first))
+	}
+	ascending, seen := true, map[scanJob]bool{}
+	for i, job := range first {
+		seen[job] = true
+		if job != second[i] {
+			t.Fatalf("seeded orders differ at %d: %v != %v", i, job, second[i])
+		}
+		if i > 0 && job.Protocol == first[i-1].Protocol && job.Port < first[i-1].Port {
+			ascending = false
+		}
+	}
+	if len(seen) != 200 {
+		t.Errorf("shuffle lost jobs: %d distinct", len(seen))
+	}
+	if ascending {
+		t.Error("randomized order is still ascending")
+	}
+}
+
+func TestScanRandomizedResultsSorted(t *testing.T) {
+	ports := []int{listenTCP(t, ""), listenTCP(t, ""), closedPort(t), closedPort(t), listenTCP(t, "")}
+	s := New(Options{Ports: ports, All: true, Randomize: true})
+
+	results, err := s.Scan(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(results) != len(ports) {
+		t.Fatalf("got %d results, want %d", len(results), len(ports))
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i-1].Port > results[i].Port {
+			t.Fatalf("results not sorted by port: %+v", results)
+		}
+	}
+}
+
+func TestScanOnAttempt(t *testing.T) {
+	open, closed := listenTCP(t, ""), closedPort(t)
+	var mu sync.Mutex
+	attempts := map[int]Attempt{}
+	s := New(Options{
+		Ports: []int{open, closed},
+		OnAttempt: func(a Attempt) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts[a.Port] = a
+		},
+	})
+
+	if _, err := s.Scan(context.Background(), "127.0.0.1"); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if a := attempts[open]; a.IP != "127.0.0.1" || a.Number != 1 || a.State != StateOpen || a.Err != nil {
+		t.Errorf("unexpected attempt for open port: %+v", a)
+	}
+	if a := attempts[closed]; a.State != StateClosed || a.Err == nil {
+		t.Errorf("closed port attempt should carry the dial error: %+v", a)
+	}
+}
+
+func TestStreamSorted(t *testing.T) {
+	// More ports than the reorder window, so results have to be released while the scan runs
+	ports := make([]int, 0, 3*reorderWindow)
+	for port := 1; len(ports) < cap(ports); port++ {
+		ports = append(ports, port)
+	}
+	ports = append(ports, listenTCP(t, ""))
+	s := New(Options{Ports: ports, All: true, Timeout: 200 * time.Millisecond})
+
+	var got []Result
+	summary, err := s.Stream(context.Background(), "127.0.0.1", func(r Result) {
+		got = append(got, r)
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if len(got) != summary.Total || summary.Scanned != summary.Total {
+		t.Fatalf("emitted %d results for summary %+v", len(got), summary)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i-1].Port >= got[i].Port {
+			t.Fatalf("results out of order at %d: %d then %d", i, got[i-1].Port, got[i].Port)
+		}
+	}
+}
+
+func TestStreamPorts(t *testing.T) {
+	open, closed := listenTCP(t, ""), closedPort(t)
+	// The configured port would be open too, so seeing it would mean ports was ignored
+	s := New(Options{Ports: []int{listenTCP(t, "")}, All: true})
+
+	var got []int
+	summary, err := s.StreamPorts(context.Background(), "127.0.0.1", []int{closed, open}, func(r Result) {
+		got = append(got, r.Port)
+	})
+	if err != nil {
+		t.Fatalf("StreamPorts: %v", err)
+	}
+	want := []int{min(open, closed), max(open, closed)}
+	if !reflect.DeepEqual(got, want) || summary.Total != 2 || summary.States[StateOpen] != 1 {
+		t.Errorf("got ports %v and summary %+v, want ports %v with one open", got, summary, want)
+	}
+}
+
+// benchmarkFullRange scans every TCP port on localhost, where nearly all of them are
+// refused straight away, through scan
+func benchmarkFullRange(b *testing.B, scan func(*Scanner) error) {
+	ports := make([]int, 65535)
+	for i := range ports {
+		ports[i] = i + 1
+	}
+	s := New(Options{Ports: ports, Workers: 500, All: true, Timeout: 200 * time.Millisecond})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := scan(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamFullRange(b *testing.B) {
+	benchmarkFullRange(b, func(s *Scanner) error {
+		count := 0
+		_, err := s.Stream(context.Background(), "127.0.0.1", func(Result) { count++ })
+		return err
+	})
+}
+
+func BenchmarkScanFullRange(b *testing.B) {
+	benchmarkFullRange(b, func(s *Scanner) error {
+		_, err := s.Scan(context.Background(), "127.0.0.1")
+		return err
+	})
+}
+
+func TestScanCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := New(Options{Ports: []int{closedPort(t)}, All: true})
+
+	results, summary, err := s.ScanWithSummary(ctx, "127.0.0.1")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if len(results) != 0 || summary.Scanned != 0 || summary.Total != 1 {
+		t.Errorf("got results %+v and summary %+v after cancellation", results, summary)
+	}
+}
+
+func TestScanUnresolvableHost(t *testing.T) {
+	s := New(Options{Ports: []int{80}})
+	if _, err := s.Scan(context.Background(), "nonexistent.invalid"); err == nil || !strings.Contains(err.Error(), "could not resolve") {
+		t.Fatalf("err = %v, want a resolution error", err)
+	}
+}
+
+func TestResolveAddressFamily(t *testing.T) {
+	if _, err := New(Options{IPVersion: "6"}).Resolve(context.Background(), "127.0.0.1"); err == nil {
+		t.Error("resolving an IPv4 literal with IPVersion 6 should fail")
+	}
+	ip, err := New(Options{IPVersion: "4"}).Resolve(context.Background(), "127.0.0.1")
+	if err != nil || ip != "127.0.0.1" {
+		t.Errorf("Resolve = %q, %v, want 127.0.0.1", ip, err)
+	}
+}
+
+func TestScanIPv6Loopback(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 unavailable: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	// Literals go into the dial address bracketed, never as "::1:port"
+	for _, host := range []string{"::1", "[::1]"} {
+		results, err := New(Options{Ports: []int{port}}).Scan(context.Background(), host)
+		if err != nil || len(results) != 1 || !results[0].Open {
+			t.Errorf("Scan(%s) = %+v, %v, want port %d open", host, results, err, port)
+		}
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	ips, err := New(Options{}).ResolveAll(context.Background(), "::1")
+	if err != nil || len(ips) != 1 || ips[0] != "::1" {
+		t.Errorf("ResolveAll(::1) = %v, %v", ips, err)
+	}
+	if _, err := New(Options{IPVersion: "4"}).ResolveAll(context.Background(), "::1"); err == nil {
+		t.Error("ResolveAll(::1) with IPVersion 4 should fail")
+	}
+	if ips, err := New(Options{}).ResolveAll(context.Background(), "[::1]"); err != nil || len(ips) != 1 || ips[0] != "::1" {
+		t.Errorf("ResolveAll([::1]) = %v, %v", ips, err)
+	}
+}
+
+func TestDiscoverUp(t *testing.T) {
+	s := New(Options{})
+	status := s.Discover(context.Background(), "127.0.0.1", time.Second)
+	if !status.Up {
+		t.Fatalf("localhost should be up: %+v", status)
+	}
+	// Depending on privileges localhost answers the echo, or refuses or accepts a connect
+	switch status.Reason {
+	case "echo-reply", "syn-ack", "conn-refused":
+	default:
+		t.Errorf("unexpected reason %q", status.Reason)
+	}
+}
+
+func TestDiscoverPorts(t *testing.T) {
+	if s := New(Options{}); !reflect.DeepEqual(s.opts.DiscoveryPorts, DefaultDiscoveryPorts) {
+		t.Errorf("DiscoveryPorts = %v, want the defaults", s.opts.DiscoveryPorts)
+	}
+	open := listenTCP(t, "")
+	s := New(Options{DiscoveryPorts: []int{open}})
+	// Without raw sockets only the connect to the listener can give localhost away
+	switch status := s.Discover(context.Background(), "127.0.0.1", time.Second); status.Reason {
+	case "echo-reply", "syn-ack":
+	default:
+		t.Errorf("got %+v with an open discovery port", status)
+	}
+}
+
+func TestDiscoverCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := New(Options{})
+	status := s.Discover(ctx, "127.0.0.1", time.Second)
+	if status.Up || status.Reason != "no-response" {
+		t.Errorf("got %+v after cancellation", status)
+	}
+}
+
+func TestCanPing(t *testing.T) {
+	// CanPing must agree with whether an echo to localhost gets a reply
+	s := New(Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := pingICMP(ctx, s.opts.source(), "127.0.0.1")
+	if got := s.CanPing(); got != (err == nil) {
+		t.Errorf("CanPing() = %v, but pinging localhost returned %v", got, err)
+	}
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("unused")
+	}
+	if New(Options{Dial: dial}).CanPing() {
+		t.Error("CanPing() = true with Options.Dial set")
+	}
+}
+
+func TestLookupService(t *testing.T) {
+	tests := []struct {
+		port     int
+		protocol string
+		want     string
+	}{
+		{22, "tcp", "ssh"},
+		{53, "udp", "domain"},
+		{5432, "tcp", "postgresql"},
+		{27017, "tcp", "mongodb"},
+		{22, "udp", "unknown"},
+		{47823, "tcp", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := lookupService(tt.port, tt.protocol); got != tt.want {
+			t.Errorf("lookupService(%d, %q) = %q, want %q", tt.port, tt.protocol, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want State
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, StateClosed},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, StateFiltered},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", wsaeconnrefused)}, StateClosed},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, StateError},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("socket", syscall.EMFILE)}, StateError},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, StateError},
+	}
+	for _, tt := range tests {
+		if got := classifyDialError(tt.err); got != tt.want {
+			t.Errorf("classifyDialError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsFileLimit(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("socket", syscall.EMFILE)}, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("socket", syscall.ENFILE)}, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("socket", wsaemfile)}, true},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isFileLimit(tt.err); got != tt.want {
+			t.Errorf("isFileLimit(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeBanner(t *testing.T) {
+	tests := map[string]string{
+		"SSH-2.0-OpenSSH_9.6\r\n": "SSH-2.0-OpenSSH_9.6",
+		"220 ready\r\n250 ok\r\n": "220 ready\n250 ok",
+		"bin\x00\x01ary\xff":      "bin..ary.",
+		"  padded  ":              "padded",
+		"":                        "",
+	}
+	for in, want := range tests {
+		if got := sanitizeBanner([]byte(in)); got != want {
+			t.Errorf("sanitizeBanner(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// scriptedConn returns the client end of a connection whose server end is driven by
+// script, which should hang up when it is done
+func scriptedConn(t *testing.T, script func(server net.Conn)) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		server.SetDeadline(time.Now().Add(5 * time.Second))
+		script(server)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// expect reads len(want) bytes from conn and reports whether they are want
+func expect(conn net.Conn, want []byte) bool {
+	got := make([]byte, len(want))
+	_, err := io.ReadFull(conn, got)
+	return err == nil && string(got) == string(want)
+}
+
+func TestMySQLHandshake(t *testing.T) {
+	greeting := func(version string) []byte {
+		payload := append(append([]byte{10}, version...), 0)
+		payload = append(payload, 1, 0, 0, 0, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 0)
+		return append([]byte{byte(len(payload)), 0, 0, 0}, payload...)
+	}
+	denied := append([]byte{0x2a, 0, 0, 0, 0xff, 0x6a, 0x04}, "Host '10.0.0.9' is not allowed to connect"...)
+	denied[0] = byte(len(denied) - 4)
+
+	for _, test := range []struct {
+		name string
+		sent []byte
+		want *databaseInfo
+	}{
+		{"mysql", greeting("8.0.36"), &databaseInfo{Product: "MySQL", Version: "8.0.36"}},
+		{"mariadb", greeting("5.5.5-10.11.6-MariaDB"), &databaseInfo{Product: "MariaDB", Version: "10.11.6-MariaDB"}},
+		{"denied", denied, &databaseInfo{Product: "MySQL", Auth: "required", Extra: map[string]string{"message": "Host '10.0.0.9' is not allowed to connect"}}},
+		{"http", []byte("HTTP/1.1 400 Bad Request\r\n\r\n"), nil},
+	} {
+		conn := scriptedConn(t, func(server net.Conn) { server.Write(test.sent) })
+		if info, _ := mysqlHandshake(conn); !reflect.DeepEqual(info, test.want) {
+			t.Errorf("%s: mysqlHandshake = %+v, want %+v", test.name, info, test.want)
+		}
+	}
+}
+
+func TestPostgresHandshake(t *testing.T) {
+	sslRequest := []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+	message := func(kind byte, body string) []byte {
+		return append(append([]byte{kind}, binary.BigEndian.AppendUint32(nil, uint32(4+len(body)))...), body...)
+	}
+	// readStartup reads the startup packet and reports whether it asks for user postgres
+	readStartup := func(server net.Conn) bool {
+		var length [4]byte
+		if _, err := io.ReadFull(server, length[:]); err != nil {
+			return false
+		}
+		startup := make([]byte, binary.BigEndian.Uint32(length[:])-4)
+		io.ReadFull(server, startup)
+		return strings.Contains(string(startup), "user\x00postgres\x00")
+	}
+
+	conn := scriptedConn(t, func(server net.Conn) {
+		if !expect(server, sslRequest) {
+			return
+		}
+		server.Write([]byte{'N'})
+		if readStartup(server) {
+			server.Write(message('R', "\x00\x00\x00\x0a"+"SCRAM-SHA-256\x00\x00"))
+		}
+	})
+	want := &databaseInfo{Product: "PostgreSQL", Auth: "required", Extra: map[string]string{"ssl": "false"}}
+	if info, _ := postgresHandshake(conn); !reflect.DeepEqual(info, want) {
+		t.Errorf("postgresHandshake with a password = %+v, want %+v", info, want)
+	}
+
+	// Under trust authentication the version comes with the session parameters, and the
+	// session is terminated at once
+	terminated := make(chan bool, 1)
+	conn = scriptedConn(t, func(server net.Conn) {
+		if !expect(server, sslRequest) {
+			return
+		}
+		server.Write([]byte{'N'})
+		if !readStartup(server) {
+			return
+		}
+		server.Write(message('R', "\x00\x00\x00\x00"))
+		server.Write(message('S', "server_version\x0016.2\x00"))
+		server.Write(message('Z', "I"))
+		terminated <- expect(server, []byte{'X', 0, 0, 0, 4})
+	})
+	want = &databaseInfo{Product: "PostgreSQL", Version: "16.2", Auth: "none", Extra: map[string]string{"ssl": "false"}}
+	if info, _ := postgresHandshake(conn); !reflect.DeepEqual(info, want) {
+		t.Errorf("postgresHandshake under trust = %+v, want %+v", info, want)
+	}
+	if !<-terminated {
+		t.Error("the session was not terminated")
+	}
+
+	conn = scriptedConn(t, func(server net.Conn) {
+		if expect(server, sslRequest) {
+			server.Write([]byte{'N'})
+			readStartup(server)
+			server.Write(message('E', "SFATAL\x00C28000\x00Mno pg_hba.conf entry for host \"10.0.0.9\"\x00\x00"))
+		}
+	})
+	want = &databaseInfo{Product: "PostgreSQL", Auth: "required", Extra: map[string]string{"ssl": "false", "message": `no pg_hba.conf entry for host "10.0.0.9"`}}
+	if info, _ := postgresHandshake(conn); !reflect.DeepEqual(info, want) {
+		t.Errorf("postgresHandshake refused = %+v, want %+v", info, want)
+	}
+}
+
+func TestRedisHandshake(t *testing.T) {
+	conn := scriptedConn(t, func(server net.Conn) {
+		if !expect(server, []byte("PING\r\n")) {
+			return
+		}
+		server.Write([]byte("+PONG\r\n"))
+		if expect(server, []byte("INFO server\r\n")) {
+			info := "# Server\r\nredis_version:7.2.4\r\nredis_mode:standalone\r\n"
+			fmt.Fprintf(server, "$%d\r\n%s\r\n", len(info), info)
+		}
+	})
+	want := &databaseInfo{Product: "Redis", Version: "7.2.4", Auth: "none"}
+	if info, _ := redisHandshake(conn); !reflect.DeepEqual(info, want) {
+		t.Errorf("redisHandshake without a password = %+v, want %+v", info, want)
+	}
+
+	conn = scriptedConn(t, func(server net.Conn) {
+		if expect(server, []byte("PING\r\n")) {
+			server.Write([]byte("-NOAUTH Authentication required.\r\n"))
+		}
+	})
+	want = &databaseInfo{Product: "Redis", Auth: "required"}
+	if info, _ := redisHandshake(conn); !reflect.DeepEqual(info, want) {
+		t.Errorf("redisHandshake with a password = %+v, want %+v", info, want)
+	}
+}
+
+func TestMongoHandshake(t *testing.T) {
+	// readMessage reads one request and returns its ID, opcode and body
+	readMessage := func(server net.Conn) (uint32, uint32, []byte) {
+		var head [16]byte
+		if _, err := io.ReadFull(server, head[:]); err != nil {
+			return 0, 0, nil
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(head[:4])-16)
+		io.ReadFull(server, body)
+		return binary.LittleEndian.Uint32(head[4:]), binary.LittleEndian.Uint32(head[12:]), body
+	}
+	reply := func(server net.Conn, requestID, opCode uint32, body []byte) {
+		var head []byte
+		head = binary.LittleEndian.AppendUint32(head, uint32(16+len(body)))
+		head = binary.LittleEndian.AppendUint32(head, 100)
+		head = binary.LittleEndian.AppendUint32(head, requestID)
+		head = binary.LittleEndian.AppendUint32(head, opCode)
+		server.Write(append(head, body...))
+	}
+	ok := func(v float64) []byte {
+		return binary.LittleEndian.AppendUint64(append([]byte{0x01}, "ok\x00"...), math.Float64bits(v))
+	}
+	document := func(elements ...[]byte) []byte {
+		body := bytes.Join(elements, nil)
+		return append(append(binary.LittleEndian.AppendUint32(nil, uint32(len(body)+5)), body...), 0)
+	}
+
+	for _, auth := range []string{"none", "required"} {
+		conn := scriptedConn(t, func(server net.Conn) {
+			id, opCode, body := readMessage(server)
+			if opCode != mongoOpQuery || !bytes.Contains(body, []byte("isMaster")) {
+				return
+			}
+			wire := binary.LittleEndian.AppendUint32(append([]byte{0x10}, "maxWireVersion\x00"...), 21)
+			nested := append(append([]byte{0x03}, "topologyVersion\x00"...), document(ok(1))...)
+			reply(server, id, mongoOpReply, append(make([]byte, 20), document(nested, wire, ok(1))...))
+			for {
+				id, opCode, body := readMessage(server)
+				if opCode != mongoOpMsg {
+					return
+				}
+				command := parseBSON(body[5:])
+				switch {
+				case command["buildInfo"] != nil:
+					version := append(append([]byte{0x02}, "version\x00"...), binary.LittleEndian.AppendUint32(nil, 6)...)
+					version = append(version, "7.0.5\x00"...)
+					reply(server, id, mongoOpMsg, append(make([]byte, 5), document(version, ok(1))...))
+				case command["listDatabases"] != nil:
+					result := 1.0
+					if auth == "required" {
+						result = 0
+					}
+					reply(server, id, mongoOpMsg, append(make([]byte, 5), document(ok(result))...))
+				}
+			}
+		})
+		want := &databaseInfo{Product: "MongoDB", Version: "7.0.5", Auth: auth, Extra: map[string]string{"wire_version": "21"}}
+		if info, _ := mongoHandshake(conn); !reflect.DeepEqual(info, want) {
+			t.Errorf("mongoHandshake = %+v, want %+v", info, want)
+		}
+		conn.Close()
+	}
+}
+
+func TestDatabaseProbeRun(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("-DENIED Redis is running in protected mode\r\n"))
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	probe := databaseProbe{name: "redis", port: port, timeout: time.Second, handshake: redisHandshake}
+	annotations, err := probe.Run(context.Background(), ProbeTarget{IP: "127.0.0.1", Port: port})
+	want := map[string]string{"redis.product": "Redis", "redis.auth": "required"}
+	if err != nil || !reflect.DeepEqual(annotations, want) {
+		t.Errorf("Run = %v, %v, want %v", annotations, err, want)
+	}
+	if probe.Match(6379) || !probe.Match(port) {
+		t.Errorf("Match should only take port %d", port)
+	}
+}
@@ -0,0 +1,19 @@
+package scanner
+
+//go:generate go run gen_services.go -o services_table.go /etc/services
+
+// serviceKey identifies a well-known service by port and protocol, since the same
+// port can mean different things over tcp and udp
+type serviceKey struct {
+	port     uint16
+	protocol string
+}
+
+// lookupService returns the well-known service name for port/proto from the
+// embedded table, or "unknown"
+func lookupService(port int, proto string) string {
+	if name, ok := serviceNames[serviceKey{uint16(port), proto}]; ok {
+		return name
+	}
+	return "unknown"
+}
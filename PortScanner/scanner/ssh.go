@@ -0,0 +1,222 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SSHInfo is what an SSH server said about itself before key exchange. Nothing past the
+// server's KEXINIT is exchanged, so no authentication is ever attempted.
+type SSHInfo struct {
+	// Version is the identification line the server sent, e.g. "SSH-2.0-OpenSSH_9.6"
+	Version           string   `json:"version"`
+	KexAlgorithms     []string `json:"kex_algorithms,omitempty"`
+	HostKeyAlgorithms []string `json:"host_key_algorithms,omitempty"`
+	// Ciphers and MACs are the ones offered in either direction
+	Ciphers []string `json:"ciphers,omitempty"`
+	MACs    []string `json:"macs,omitempty"`
+	// Weak lists the offered algorithms that are deprecated, e.g. "ssh-rsa" or "aes128-cbc"
+	Weak []string `json:"weak,omitempty"`
+}
+
+// sshIdentification is what the probe calls itself in the version exchange
+const sshIdentification = "SSH-2.0-portscanner\r\n"
+
+// An identification line is at most 255 bytes, and a server may send a few other
+// lines before it
+const (
+	sshLineLimit  = 255
+	sshLineBudget = 16
+)
+
+// A KEXINIT is a few kilobytes at most; anything claiming to be larger is not SSH
+const sshPacketLimit = 35000
+
+const sshMsgKexInit = 20
+
+// weakSSHAlgorithms are deprecated algorithms that are not caught by their suffix
+var weakSSHAlgorithms = map[string]bool{
+	"ssh-rsa":                            true,
+	"ssh-dss":                            true,
+	"diffie-hellman-group1-sha1":         true,
+	"diffie-hellman-group14-sha1":        true,
+	"diffie-hellman-group-exchange-sha1": true,
+}
+
+// weakSSHAlgorithm reports whether an offered algorithm is deprecated: SHA-1 host keys and
+// key exchanges, CBC mode and RC4 ciphers, MD5 and truncated MACs
+func weakSSHAlgorithm(name string) bool {
+	return weakSSHAlgorithms[name] || strings.HasSuffix(name, "-cbc") || strings.HasSuffix(name, "-cbc@lysator.liu.se") ||
+		strings.HasPrefix(name, "arcfour") || strings.HasPrefix(name, "hmac-md5") || strings.Contains(name, "-96")
+}
+
+// probeSSH reads the server's identification from conn, unless the banner already held it
+// as version, sends ours and reads the server's KEXINIT, all within timeout. It returns nil
+// when the port does not identify as SSH, and just the version when the server speaks a
+// protocol before 2.0 or no KEXINIT arrives in time.
+func probeSSH(conn net.Conn, version string, timeout time.Duration) *SSHInfo {
+	conn.SetDeadline(time.Now().Add(timeout))
+	reader := bufio.NewReader(conn)
+	if version == "" {
+		if version = readSSHVersion(reader); version == "" {
+			return nil
+		}
+	}
+	info := &SSHInfo{Version: version}
+	if !strings.HasPrefix(version, "SSH-2.0-") && !strings.HasPrefix(version, "SSH-1.99-") {
+		info.Weak = []string{"protocol " + strings.SplitN(version, "-", 3)[1]}
+		return info
+	}
+	if _, err := io.WriteString(conn, sshIdentification); err != nil {
+		return info
+	}
+	payload, err := readSSHPacket(reader)
+	if err != nil || parseKexInit(payload, info) != nil {
+		return info
+	}
+	for _, list := range [][]string{info.KexAlgorithms, info.HostKeyAlgorithms, info.Ciphers, info.MACs} {
+		for _, name := range list {
+			if weakSSHAlgorithm(name) {
+				info.Weak = append(info.Weak, name)
+			}
+		}
+	}
+	return info
+}
+
+// readSSHVersion returns the first line starting with "SSH-", or "" when the port sends
+// something else or nothing
+func readSSHVersion(reader *bufio.Reader) string {
+	for range sshLineBudget {
+		line, err := reader.ReadSlice('\n')
+		if err != nil || len(line) > sshLineLimit {
+			return ""
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			return sanitizeBanner(line)
+		}
+	}
+	return ""
+}
+
+// readSSHPacket reads one unencrypted binary packet and returns its payload
+func readSSHPacket(reader *bufio.Reader) ([]byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head[:4])
+	padding := uint32(head[4])
+	if length > sshPacketLimit || padding+1 > length {
+		return nil, fmt.Errorf("bad packet length %d", length)
+	}
+	packet := make([]byte, length-1)
+	if _, err := io.ReadFull(reader, packet); err != nil {
+		return nil, err
+	}
+	return packet[:len(packet)-int(padding)], nil
+}
+
+// parseKexInit fills info from a KEXINIT payload: the message number, a 16-byte cookie and
+// ten name-lists, of which the first six are kept
+func parseKexInit(payload []byte, info *SSHInfo) error {
+	if len(payload) < 17 || payload[0] != sshMsgKexInit {
+		return errors.New("no KEXINIT from the server")
+	}
+	data := payload[17:]
+	var lists [6][]string
+	for i := range lists {
+		if len(data) < 4 {
+			return errors.New("truncated KEXINIT")
+		}
+		length := binary.BigEndian.Uint32(data[:4])
+		if uint32(len(data)-4) < length {
+			return errors.New("truncated KEXINIT")
+		}
+		if length > 0 {
+			lists[i] = strings.Split(string(data[4:4+length]), ",")
+		}
+		data = data[4+length:]
+	}
+	info.KexAlgorithms = lists[0]
+	info.HostKeyAlgorithms = lists[1]
+	info.Ciphers = mergeNames(lists[2], lists[3])
+	info.MACs = mergeNames(lists[4], lists[5])
+	return nil
+}
+
+// mergeNames returns a followed by the names of b it does not already hold
+func mergeNames(a, b []string) []string {
+	merged := append([]string(nil), a...)
+	for _, name := range b {
+		if !slices.Contains(merged, name) {
+			merged = append(merged, name)
+		}
+	}
+	return merged
+}
+
+// sshProbe runs probeSSH on the connection that found a port open, on port 22 and on any
+// port whose banner is an SSH identification
+type sshProbe struct {
+	timeout time.Duration
+}
+
+func (sshProbe) Name() string        { return "ssh" }
+func (sshProbe) Match(port int) bool { return true }
+func (sshProbe) UsesConn() bool      { return true }
+
+func (p sshProbe) Run(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+	return ResultAnnotations(ctx, p, target)
+}
+
+func (p sshProbe) RunResult(ctx context.Context, target ProbeTarget) (func(*Result), error) {
+	version := ""
+	if banner := target.Found.Banner; banner != "" {
+		for _, line := range strings.Split(banner, "\n") {
+			if strings.HasPrefix(line, "SSH-") {
+				version = line
+				break
+			}
+		}
+		if version == "" {
+			return nil, nil
+		}
+	} else if target.Port != 22 {
+		return nil, nil
+	}
+	info := probeSSH(target.Conn, version, p.timeout)
+	if info == nil {
+		return nil, nil
+	}
+	return func(result *Result) { result.SSH = info }, nil
+}
+
+// annotate adds info to annotations under "ssh.", with lists joined by commas
+func (info *SSHInfo) annotate(annotations map[string]string) {
+	if info == nil {
+		return
+	}
+	annotations["ssh.version"] = info.Version
+	for key, list := range map[string][]string{
+		"ssh.kex":      info.KexAlgorithms,
+		"ssh.host_key": info.HostKeyAlgorithms,
+		"ssh.ciphers":  info.Ciphers,
+		"ssh.macs":     info.MACs,
+		"ssh.weak":     info.Weak,
+	} {
+		if len(list) > 0 {
+			annotations[key] = strings.Join(list, ",")
+		}
+	}
+}
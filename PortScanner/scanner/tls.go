@@ -0,0 +1,106 @@
+package scanner
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// TLSInfo describes the TLS session an open port negotiated and the certificate it
+// presented. The certificate is not verified, so expired and self-signed ones are
+// reported like any other.
+type TLSInfo struct {
+	// Version is e.g. "TLS1.3"
+	Version   string `json:"version"`
+	Cipher    string `json:"cipher"`
+	SubjectCN string `json:"subject_cn,omitempty"`
+	// SANs are the certificate's DNS names and IP addresses
+	SANs     []string  `json:"sans,omitempty"`
+	Issuer   string    `json:"issuer,omitempty"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// probeTLS tries a TLS handshake on conn, sending serverName as SNI unless it is empty,
+// and returns nil when the port does not complete one within timeout. A service that
+// speaks something else usually answers the ClientHello with an error or hangs up, so
+// it costs about one round trip.
+func probeTLS(conn net.Conn, serverName string, timeout time.Duration) *TLSInfo {
+	conn.SetDeadline(time.Now().Add(timeout))
+	client := tls.Client(conn, &tls.Config{
+		ServerName: serverName,
+		// The point is to see what the port presents, not to trust it
+		InsecureSkipVerify: true,
+		// Old servers are worth finding too
+		MinVersion: tls.VersionTLS10,
+	})
+	if err := client.Handshake(); err != nil {
+		return nil
+	}
+	state := client.ConnectionState()
+	info := &TLSInfo{
+		Version: strings.ReplaceAll(tls.VersionName(state.Version), " ", ""),
+		Cipher:  tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		info.SubjectCN = cert.Subject.CommonName
+		info.SANs = append(info.SANs, cert.DNSNames...)
+		for _, ip := range cert.IPAddresses {
+			info.SANs = append(info.SANs, ip.String())
+		}
+		info.Issuer = cert.Issuer.String()
+		info.NotAfter = cert.NotAfter.UTC()
+	}
+	return info
+}
+
+// tlsProbe runs probeTLS on the connection that found a port open, unless the port sent a
+// banner or identified as SSH: it spoke first, which TLS servers never do
+type tlsProbe struct {
+	timeout    time.Duration
+	serverName func(ip string) string
+}
+
+func (tlsProbe) Name() string        { return "tls" }
+func (tlsProbe) Match(port int) bool { return true }
+func (tlsProbe) UsesConn() bool      { return true }
+
+func (p tlsProbe) Run(ctx context.Context, target ProbeTarget) (map[string]string, error) {
+	return ResultAnnotations(ctx, p, target)
+}
+
+func (p tlsProbe) RunResult(ctx context.Context, target ProbeTarget) (func(*Result), error) {
+	if target.Found.Banner != "" || target.Found.SSH != nil {
+		return nil, nil
+	}
+	serverName := ""
+	if p.serverName != nil {
+		serverName = p.serverName(target.IP)
+	}
+	info := probeTLS(target.Conn, serverName, p.timeout)
+	if info == nil {
+		return nil, nil
+	}
+	return func(result *Result) { result.TLS = info }, nil
+}
+
+// annotate adds info to annotations under "tls.", with the SANs joined by commas
+func (info *TLSInfo) annotate(annotations map[string]string) {
+	if info == nil {
+		return
+	}
+	annotations["tls.version"] = info.Version
+	annotations["tls.cipher"] = info.Cipher
+	annotations["tls.not_after"] = info.NotAfter.Format(time.RFC3339)
+	if info.SubjectCN != "" {
+		annotations["tls.subject_cn"] = info.SubjectCN
+	}
+	if len(info.SANs) > 0 {
+		annotations["tls.sans"] = strings.Join(info.SANs, ",")
+	}
+	if info.Issuer != "" {
+		annotations["tls.issuer"] = info.Issuer
+	}
+}
@@ -0,0 +1,142 @@
+// Package version identifies the build of the port scanner, for -version, the reports it
+// writes and what the scanner package sends when it probes.
+//
+// Release builds set the variables with -ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/Bikatr7/KaiTools/PortScanner/version.Version=1.2.0 \
+//	  -X github.com/Bikatr7/KaiTools/PortScanner/version.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/Bikatr7/KaiTools/PortScanner/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+//	  ./PortScanner/cmd/portscanner
+//
+// Whatever is left unset comes from the build information Go embeds in every binary: the
+// module version when built with go install or from a tagged checkout, and the commit and
+// its time when built from a git checkout. Without a release version, Version is "devel".
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Set with -ldflags -X; see the package documentation
+var (
+	Version string
+	Commit  string
+	Date    string
+)
+
+// modulePath is the module the scanner is built from, found among the dependencies of
+// programs that use it as a library
+const modulePath = "github.com/Bikatr7/KaiTools"
+
+// Info describes a build
+type Info struct {
+	// Version is a semantic version such as "1.2.0", or "devel"
+	Version string `json:"version"`
+	// Commit is the git commit, with "-dirty" when the checkout had uncommitted changes,
+	// and Date when it was built or committed; either may be empty
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+var (
+	once sync.Once
+	info Info
+)
+
+// Get returns the build information, worked out once
+func Get() Info {
+	once.Do(func() {
+		info = Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+		if build, ok := debug.ReadBuildInfo(); ok {
+			fillFromBuild(&info, build)
+		}
+		info.Version = strings.TrimPrefix(info.Version, "v")
+		if info.Version == "" {
+			info.Version = "devel"
+		}
+	})
+	return info
+}
+
+// fillFromBuild fills the fields -ldflags left empty from what Go recorded about the build
+func fillFromBuild(info *Info, build *debug.BuildInfo) {
+	module := &build.Main
+	if module.Path != modulePath {
+		module = nil
+		for _, dep := range build.Deps {
+			if dep.Path == modulePath {
+				module = dep
+				if dep.Replace != nil {
+					module = dep.Replace
+				}
+				break
+			}
+		}
+	}
+	// Builds from a checkout with no release tag get a v0.0.0 pseudo-version, which says no
+	// more than the commit does
+	if info.Version == "" && module != nil && module.Version != "(devel)" && !strings.HasPrefix(module.Version, "v0.0.0-") {
+		info.Version = module.Version
+	}
+	// The commit is only recorded for the main module, built from its own checkout
+	if module != &build.Main {
+		return
+	}
+	var revision, modified string
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.time":
+			if info.Date == "" {
+				info.Date = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if info.Commit == "" && revision != "" {
+		info.Commit = revision
+		if modified == "true" {
+			info.Commit += "-dirty"
+		}
+	}
+}
+
+// String returns the version, e.g. "1.2.0" or "devel"
+func String() string {
+	return Get().Version
+}
+
+// Long describes the build on one line, e.g.
+//
+//	portscanner 1.2.0 (commit 3f2c1d0a9b7e, built 2026-10-15T09:00:00Z, go1.23.4 linux/amd64)
+func Long() string {
+	info := Get()
+	details := []string{}
+	if info.Commit != "" {
+		commit, dirty := strings.CutSuffix(info.Commit, "-dirty")
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		if dirty {
+			commit += "-dirty"
+		}
+		details = append(details, "commit "+commit)
+	}
+	if info.Date != "" {
+		details = append(details, "built "+info.Date)
+	}
+	details = append(details, info.GoVersion+" "+info.Platform)
+	return "portscanner " + info.Version + " (" + strings.Join(details, ", ") + ")"
+}
+
+// UserAgent is the User-Agent of the scanner's HTTP probes, e.g. "portscanner/1.2.0"
+func UserAgent() string {
+	return "portscanner/" + String()
+}
@@ -0,0 +1,81 @@
+package version
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestFillFromBuild(t *testing.T) {
+	vcs := []debug.BuildSetting{
+		{Key: "vcs.revision", Value: "3f2c1d0a9b7e5c4d3b2a1f0e9d8c7b6a5f4e3d2c"},
+		{Key: "vcs.time", Value: "2026-10-15T09:00:00Z"},
+		{Key: "vcs.modified", Value: "true"},
+	}
+	tests := []struct {
+		name  string
+		set   Info
+		build debug.BuildInfo
+		want  Info
+	}{
+		{
+			"checkout",
+			Info{},
+			debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "(devel)"}, Settings: vcs},
+			Info{Commit: "3f2c1d0a9b7e5c4d3b2a1f0e9d8c7b6a5f4e3d2c-dirty", Date: "2026-10-15T09:00:00Z"},
+		},
+		{
+			"untagged checkout",
+			Info{},
+			debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "v0.0.0-20261015123508-a0fab4b12285+dirty"}},
+			Info{},
+		},
+		{
+			"go install",
+			Info{},
+			debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "v1.2.0"}},
+			Info{Version: "v1.2.0"},
+		},
+		{
+			"ldflags win",
+			Info{Version: "1.3.0", Commit: "abc", Date: "2026-01-01"},
+			debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "v1.2.0"}, Settings: vcs},
+			Info{Version: "1.3.0", Commit: "abc", Date: "2026-01-01"},
+		},
+		{
+			"library",
+			Info{},
+			debug.BuildInfo{Main: debug.Module{Path: "example.com/tool"}, Deps: []*debug.Module{{Path: modulePath, Version: "v1.1.0"}}, Settings: vcs},
+			Info{Version: "v1.1.0"},
+		},
+		{
+			"replaced library",
+			Info{},
+			debug.BuildInfo{Main: debug.Module{Path: "example.com/tool"}, Deps: []*debug.Module{{Path: modulePath, Version: "v1.1.0", Replace: &debug.Module{Path: "../KaiTools"}}}},
+			Info{},
+		},
+	}
+	for _, test := range tests {
+		got := test.set
+		fillFromBuild(&got, &test.build)
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLong(t *testing.T) {
+	once.Do(func() {})
+	defer func(saved Info) { info = saved }(info)
+
+	info = Info{Version: "1.2.0", Commit: "3f2c1d0a9b7e5c4d3b2a1f0e9d8c7b6a5f4e3d2c-dirty", Date: "2026-10-15T09:00:00Z", GoVersion: "go1.23.4", Platform: "linux/amd64"}
+	if got, want := Long(), "portscanner 1.2.0 (commit 3f2c1d0a9b7e-dirty, built 2026-10-15T09:00:00Z, go1.23.4 linux/amd64)"; got != want {
+		t.Errorf("Long() = %q, want %q", got, want)
+	}
+	info = Info{Version: "devel", GoVersion: "go1.23.4", Platform: "linux/amd64"}
+	if got, want := Long(), "portscanner devel (go1.23.4 linux/amd64)"; got != want {
+		t.Errorf("Long() = %q, want %q", got, want)
+	}
+	if got, want := UserAgent(), "portscanner/devel"; got != want {
+		t.Errorf("UserAgent() = %q, want %q", got, want)
+	}
+}
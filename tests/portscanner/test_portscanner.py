@@ -1,12 +1,21 @@
 import subprocess
+import csv
+import re
+import io
+import json
 import os
+import shutil
 import tempfile
 import unittest
+import xml.etree.ElementTree as ET
 import socket
+import struct
 import threading
 import time
 import sys
-from typing import List, Tuple
+import urllib.error
+import urllib.request
+from typing import List, Optional, Tuple
 
 class TestPortScanner(unittest.TestCase):
     @classmethod
@@ -27,7 +36,7 @@ class TestPortScanner(unittest.TestCase):
         else:
             exe_path = "portscanner"
 
-        subprocess.run(["go", "build", "-o", exe_path, "PortScanner/portscanner.go"], 
+        subprocess.run(["go", "build", "-o", exe_path, "./PortScanner/cmd/portscanner"], 
                       check=True)
         return os.path.abspath(exe_path)
 
@@ -37,7 +46,7 @@ class TestPortScanner(unittest.TestCase):
         server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
         server_socket.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
         server_socket.bind(('localhost', port))
-        server_socket.listen(1)
+        server_socket.listen(128)  ## Parallel host scans can open many connections at once
 
         def server_thread():
             while True:
@@ -62,36 +71,72 @@ class TestPortScanner(unittest.TestCase):
         for server_socket, thread in servers:
             server_socket.close()
 
-    def _create_temp_file(self, content: str) -> str:
-        """Create a temporary file with the given content."""
-        temp = tempfile.NamedTemporaryFile(mode='w', delete=False, encoding='utf-8')
+    def _create_temp_file(self, content: str, suffix: str = "") -> str:
+        """Create a temporary file with the given content and file name suffix."""
+        temp = tempfile.NamedTemporaryFile(mode='w', delete=False, encoding='utf-8', suffix=suffix)
         temp.write(content)
         temp.close()
         return temp.name
 
-    def _run_scanner(self, args: List[str]) -> Tuple[str, str, int]:
-        """Run the port scanner with given arguments."""
+    def _run_scanner(self, args: List[str], stdin: Optional[str] = None) -> Tuple[str, str, int]:
+        """Run the scan command with given arguments, piping stdin to it if given."""
         process = subprocess.Popen(
-            [self.exe_path] + args,
+            [self.exe_path, "scan"] + args,
+            stdin=subprocess.DEVNULL if stdin is None else subprocess.PIPE,
             stdout=subprocess.PIPE,
             stderr=subprocess.PIPE,
             text=True
         )
-        stdout, stderr = process.communicate()
+        stdout, stderr = process.communicate(stdin)
         return stdout, stderr, process.returncode
 
+    @staticmethod
+    def _mask_latency(text: str) -> str:
+        """Replace measured latencies like 85µs or 1.3ms with <t> and scan rates with <n> so output can be compared exactly."""
+        text = re.sub(r"\b\d+ ports/s\b", "<n> ports/s", text)
+        return re.sub(r"\b\d+(\.\d+)?(ns|µs|ms|s)\b", "<t>", text)
+
     def test_single_open_port(self):
         """Test scanning a single known open port."""
         stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "localhost"])
-        self.assertIn("Port 8080: open", stdout)
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_output_format_locked(self):
+        """Test the exact text output: each port printed once, sorted, followed by the summary."""
+        stdout, stderr, rc = self._run_scanner(["-a", "-ports", "9999,8082,8080,8081", "localhost"])
+        self.assertEqual(rc, 0)
+        self.assertEqual(self._mask_latency(stdout), (
+            "Scanning host: localhost (127.0.0.1)\n"
+            "Port 8080/tcp open http-alt (<t>)\n"
+            "Port 8081/tcp open tproxy (<t>)\n"
+            "Port 8082/tcp open unknown (<t>)\n"
+            "Port 9999/tcp closed unknown (<t>)\n"
+            "Total open ports on localhost: 3\n"
+            "Latency: min <t>, avg <t>, max <t>\n"
+            "Closed: 1, Filtered: 0, Errors: 0\n"
+            "Scanned localhost in <t> (<n> ports/s)\n"
+        ))
+
+    def test_output_format_open_only(self):
+        """Test that closed ports are counted but not printed without -a."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080,9999", "127.0.0.1"])
         self.assertEqual(rc, 0)
+        self.assertEqual(self._mask_latency(stdout), (
+            "Scanning host: 127.0.0.1\n"
+            "Port 8080/tcp open http-alt (<t>)\n"
+            "Total open ports on 127.0.0.1: 1\n"
+            "Latency: min <t>, avg <t>, max <t>\n"
+            "Closed: 1, Filtered: 0, Errors: 0\n"
+            "Scanned 127.0.0.1 in <t> (<n> ports/s)\n"
+        ))
 
     def test_port_range(self):
         """Test scanning a range of ports."""
         stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8082", "localhost"])
-        self.assertIn("Port 8080: open", stdout)
-        self.assertIn("Port 8081: open", stdout)
-        self.assertIn("Port 8082: open", stdout)
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertIn("Port 8081/tcp open", stdout)
+        self.assertIn("Port 8082/tcp open", stdout)
         self.assertEqual(rc, 0)
 
     def test_ports_file(self):
@@ -99,9 +144,9 @@ class TestPortScanner(unittest.TestCase):
         ports_file = self._create_temp_file("8080\n8081\n8082\n")
         try:
             stdout, stderr, rc = self._run_scanner(["-P", ports_file, "localhost"])
-            self.assertIn("Port 8080: open", stdout)
-            self.assertIn("Port 8081: open", stdout)
-            self.assertIn("Port 8082: open", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertIn("Port 8081/tcp open", stdout)
+            self.assertIn("Port 8082/tcp open", stdout)
             self.assertEqual(rc, 0)
         finally:
             os.unlink(ports_file)
@@ -117,6 +162,522 @@ class TestPortScanner(unittest.TestCase):
         finally:
             os.unlink(hosts_file)
 
+    def test_custom_timeout(self):
+        """Test scanning with a custom connection timeout."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8082", "-t", "250ms", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertIn("Port 8082/tcp open", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_adaptive_timeout(self):
+        """Test that -adaptive-timeout derives the timeout from the measured RTT and shows it with -v."""
+        stdout, stderr, rc = self._run_scanner(["-adaptive-timeout", "-v", "-ports", "8080,9999", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertRegex(stderr, r'msg="adaptive timeout" host=localhost ip=127\.0\.0\.1 timeout=100ms rtt=\S+')
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-adaptive-timeout", "-min-timeout", "50ms", "-max-timeout", "200ms", "-ports", "8080", "localhost"])
+        self.assertNotIn("adaptive timeout", stderr)  ## Only logged with -v
+        self.assertEqual(rc, 0)
+
+        for args, message in [
+            (["-min-timeout", "50ms"], "only apply together with -adaptive-timeout"),
+            (["-adaptive-timeout", "-max-timeout", "0s"], "must be greater than 0"),
+            (["-adaptive-timeout", "-min-timeout", "2s", "-max-timeout", "1s"], "-min-timeout 2s is above -max-timeout 1s"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080", "localhost"])
+            self.assertIn(message, stdout)
+            self.assertEqual(rc, 2)
+
+    def test_adaptive_workers(self):
+        """Test that -adaptive reports the same ports and logs the concurrency it settled on with -v."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8070", "-e", "8090", "localhost"])
+        expected = self._mask_latency(stdout)
+        stdout, stderr, rc = self._run_scanner(["-adaptive", "-w", "40", "-p", "8070", "-e", "8090", "localhost"])
+        self.assertEqual(self._mask_latency(stdout), expected)
+        self.assertNotIn("adaptive workers", stderr)  ## Only logged with -v
+
+        stdout, stderr, rc = self._run_scanner(["-adaptive", "-v", "-w", "40", "-p", "8070", "-e", "8090", "localhost"])
+        match = re.search(r'msg="adaptive workers" host=localhost ip=127\.0\.0\.1 workers=(\d+)', stderr)
+        self.assertIsNotNone(match)
+        self.assertTrue(5 <= int(match.group(1)) <= 21)  ## Never below an eighth of -w or above the 21 ports
+        self.assertEqual(rc, 0)
+
+    def test_invalid_timeout(self):
+        """Test that zero, negative and malformed timeouts are rejected."""
+        for value in ["0", "0s", "-1s", "abc"]:
+            stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "-t", value, "localhost"])
+            self.assertNotEqual(rc, 0, f"Timeout {value} should be rejected")
+
+    def test_cidr_single_host(self):
+        """Test that a /32 CIDR scans exactly one address."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "127.0.0.1/32"])
+        self.assertIn("Scanning host: 127.0.0.1", stdout)
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertEqual(stdout.count("Scanning host:"), 1)
+        self.assertEqual(rc, 0)
+
+    def test_cidr_point_to_point(self):
+        """Test that a /31 CIDR keeps both addresses."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "-t", "200ms", "127.0.0.0/31"])
+        self.assertIn("Scanning host: 127.0.0.0", stdout)
+        self.assertIn("Scanning host: 127.0.0.1", stdout)
+        self.assertEqual(stdout.count("Scanning host:"), 2)
+        self.assertEqual(rc, 0)
+
+    def test_cidr_skips_network_and_broadcast(self):
+        """Test that IPv4 subnets skip their network and broadcast addresses."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "-t", "200ms", "127.0.0.0/30"])
+        self.assertNotIn("Scanning host: 127.0.0.0\n", stdout)
+        self.assertIn("Scanning host: 127.0.0.1", stdout)
+        self.assertIn("Scanning host: 127.0.0.2", stdout)
+        self.assertNotIn("Scanning host: 127.0.0.3", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_cidr_ipv6(self):
+        """Test that IPv6 prefixes expand to every address."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "-t", "200ms", "::/127"])
+        self.assertIn("Scanning host: ::\n", stdout)
+        self.assertIn("Scanning host: ::1", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_hosts_file_normalization(self):
+        """Test that hosts file entries are cleaned up, deduplicated in order, and bad lines skipped."""
+        hosts_file = self._create_temp_file(
+            "http://LOCALHOST/\nlocalhost:8080\n127.0.0.1\nhttps://127.0.0.1:443/login\nnot a host\nLocalhost\n"
+        )
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-ports", "8080"])
+            scanned = [line.split(": ", 1)[1].split(" (")[0] for line in stdout.splitlines() if line.startswith("Scanning host: ")]
+            self.assertEqual(scanned, ["localhost", "127.0.0.1"])
+            self.assertIn('Skipping hosts file line 5: "not a host" is not a host name, IP address or CIDR', stdout)
+            self.assertEqual(rc, 0)
+
+            ## Skipped lines are still reported in quiet mode, on stderr
+            stdout, stderr, rc = self._run_scanner(["-q", "-f", hosts_file, "-ports", "8080"])
+            self.assertIn("Skipping hosts file line 5", stderr)
+            self.assertNotIn("Skipping", stdout)
+
+            ## -strict stops before anything is scanned
+            stdout, stderr, rc = self._run_scanner(["-strict", "-f", hosts_file, "-ports", "8080"])
+            self.assertEqual(stdout, 'Error: hosts file line 5: "not a host" is not a host name, IP address or CIDR\n'
+                                     "Error: -strict: 1 invalid line(s), nothing was scanned\n")
+            self.assertEqual(rc, 2)
+
+            stdout, stderr, rc = self._run_scanner(["-strict", "-ports", "8080"], stdin="localhost\nexa mple.com\n")
+            self.assertIn('Error: stdin line 2: "exa mple.com" is not a host name, IP address or CIDR', stdout)
+            self.assertNotIn("Scanning host", stdout)
+            self.assertEqual(rc, 2)
+        finally:
+            os.unlink(hosts_file)
+
+        hosts_file = self._create_temp_file("not a host\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-ports", "8080"])
+            self.assertIn("Error reading hosts file: no valid hosts found (line 1:", stdout)
+            self.assertEqual(rc, 2)
+        finally:
+            os.unlink(hosts_file)
+
+    def test_cidr_in_hosts_file(self):
+        """Test that CIDR entries in the hosts file are expanded."""
+        hosts_file = self._create_temp_file("localhost\n127.0.0.0/31\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-p", "8080", "-e", "8080", "-t", "200ms"])
+            self.assertIn("Scanning host: localhost", stdout)
+            self.assertIn("Scanning host: 127.0.0.0", stdout)
+            self.assertIn("Scanning host: 127.0.0.1", stdout)
+            self.assertEqual(rc, 0)
+        finally:
+            os.unlink(hosts_file)
+
+    def test_cidr_too_large(self):
+        """Test that huge CIDR expansions are refused unless -max-hosts allows them."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "10.0.0.0/8"])
+        self.assertIn("Error expanding targets", stdout)
+        self.assertNotEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "-max-hosts", "2", "127.0.0.0/29"])
+        self.assertNotEqual(rc, 0)
+
+    def test_cidr_include_broadcast(self):
+        """Test that -include-broadcast keeps the IPv4 network and broadcast addresses."""
+        stdout, stderr, rc = self._run_scanner(["-include-broadcast", "-p", "8080", "-e", "8080", "-t", "200ms", "127.0.0.0/30"])
+        for host in ["127.0.0.0", "127.0.0.1", "127.0.0.2", "127.0.0.3"]:
+            self.assertIn(f"Scanning host: {host}\n", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_cidr_allow_large(self):
+        """Test that -allow-large lifts the -max-hosts guard but not the hard ceiling."""
+        stdout, stderr, rc = self._run_scanner(["-max-hosts", "2", "-p", "8080", "-e", "8080", "-t", "200ms", "127.0.0.0/30"])
+        self.assertNotEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-allow-large", "-max-hosts", "2", "-p", "8080", "-e", "8080", "-t", "200ms", "127.0.0.0/30"])
+        self.assertIn("Scanning host: 127.0.0.2", stdout)
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-allow-large", "-p", "8080", "-e", "8080", "10.0.0.0/7"])
+        self.assertIn("too large", stdout)
+        self.assertNotEqual(rc, 0)
+
+    def test_invalid_cidr(self):
+        """Test that malformed CIDR targets are rejected."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "127.0.0.1/33"])
+        self.assertNotEqual(rc, 0)
+
+    def test_json_output(self):
+        """Test that -o json writes a parseable report to stdout."""
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-p", "8080", "-e", "8081", "localhost"])
+        self.assertEqual(rc, 0)
+        report = json.loads(stdout)
+        self.assertEqual(len(report), 1)
+        self.assertEqual(report[0]["host"], "localhost")
+        self.assertEqual(report[0]["open_ports"], 2)
+        ports = {result["port"]: result["open"] for result in report[0]["results"]}
+        self.assertEqual(ports, {8080: True, 8081: True})
+        self.assertIn("Scanning host: localhost", stderr)
+
+    def test_json_output_multiple_hosts(self):
+        """Test that JSON output contains one object per host and hides closed ports without -a."""
+        hosts_file = self._create_temp_file("localhost\n127.0.0.1\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "json", "-f", hosts_file, "-p", "9999", "-e", "9999"])
+            self.assertEqual(rc, 1)
+            report = json.loads(stdout)
+            self.assertEqual([host["host"] for host in report], ["localhost", "127.0.0.1"])
+            for host in report:
+                self.assertEqual(host["results"], [])
+                self.assertEqual(host["open_ports"], 0)
+        finally:
+            os.unlink(hosts_file)
+
+    def test_host_timing(self):
+        """Test the per-host timing line in text mode and the matching fields in JSON."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8079", "-e", "8082", "localhost"])
+        self.assertRegex(stdout, r"\nScanned localhost in \d+(\.\d+)?(µs|ms|s) \(\d+ ports/s\)\n$")
+
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-p", "8079", "-e", "8082", "localhost"])
+        host = json.loads(stdout)[0]
+        self.assertEqual((host["open_ports"], host["closed_ports"], host["filtered_ports"]), (3, 1, 0))
+        self.assertGreater(host["elapsed_ms"], 0)
+        self.assertGreater(host["ports_per_second"], 0)
+        self.assertIn("Scanned localhost in ", stderr)
+
+    CSV_HEADER = ["host", "ip", "port", "protocol", "state", "service", "latency_ms", "banner", "timestamp"]
+
+    def test_csv_output(self):
+        """Test that -o csv writes a header and one row per open port across hosts."""
+        hosts_file = self._create_temp_file("localhost\n127.0.0.1\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "csv", "-f", hosts_file, "-p", "8080", "-e", "8081"])
+            self.assertEqual(rc, 0)
+            rows = list(csv.reader(io.StringIO(stdout)))
+            self.assertEqual(rows[0], self.CSV_HEADER)
+            self.assertCountEqual([(row[0], row[1], row[2], row[3], row[4]) for row in rows[1:]], [
+                ("localhost", "127.0.0.1", "8080", "tcp", "open"),
+                ("localhost", "127.0.0.1", "8081", "tcp", "open"),
+                ("127.0.0.1", "127.0.0.1", "8080", "tcp", "open"),
+                ("127.0.0.1", "127.0.0.1", "8081", "tcp", "open"),
+            ])
+            for row in rows[1:]:
+                self.assertGreater(float(row[6]), 0)
+            self.assertIn("Scanning host: localhost", stderr)
+        finally:
+            os.unlink(hosts_file)
+
+    def test_csv_output_closed_ports(self):
+        """Test that closed ports only appear in CSV output with -a."""
+        stdout, stderr, rc = self._run_scanner(["-o", "csv", "-p", "9999", "-e", "9999", "localhost"])
+        self.assertEqual(rc, 1)
+        self.assertEqual(list(csv.reader(io.StringIO(stdout))), [self.CSV_HEADER])
+
+        stdout, stderr, rc = self._run_scanner(["-format", "csv", "-a", "-p", "9999", "-e", "9999", "localhost"])
+        self.assertEqual(rc, 1)
+        rows = list(csv.reader(io.StringIO(stdout)))
+        self.assertEqual(len(rows), 2)
+        self.assertEqual(rows[1][:5], ["localhost", "127.0.0.1", "9999", "tcp", "closed"])
+
+    def test_csv_round_trip(self):
+        """Test that CSV written to a file parses back with banners containing commas and quotes intact."""
+        server_socket, port = self._create_banner_server(b'220 mail.example.com, ESMTP "ready"\r\n')
+        out_dir = tempfile.mkdtemp()
+        csv_path = os.path.join(out_dir, "results.csv")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-format", "csv", "-banner", "-out", csv_path, "-a",
+                                                    "-ports", f"{port},9999", "127.0.0.1"])
+            self.assertEqual(rc, 0)
+            ## The console still gets the text report
+            self.assertIn("Port 9999/tcp closed", stdout)
+            with open(csv_path, newline="") as f:
+                rows = list(csv.DictReader(f))
+            by_port = {row["port"]: row for row in rows}
+            self.assertCountEqual(by_port.keys(), [str(port), "9999"])
+            self.assertEqual(by_port[str(port)]["state"], "open")
+            self.assertEqual(by_port[str(port)]["banner"], '220 mail.example.com, ESMTP "ready"')
+            self.assertEqual(by_port["9999"]["state"], "closed")
+            self.assertEqual(by_port["9999"]["banner"], "")
+            for row in rows:
+                self.assertEqual(row["host"], "127.0.0.1")
+                self.assertEqual(row["protocol"], "tcp")
+        finally:
+            server_socket.close()
+            if os.path.exists(csv_path):
+                os.unlink(csv_path)
+            os.rmdir(out_dir)
+
+    def test_output_file(self):
+        """Test that -out writes the report to a file while the console keeps the text output."""
+        out_dir = tempfile.mkdtemp()
+        text_path = os.path.join(out_dir, "report.txt")
+        json_path = os.path.join(out_dir, "report.json")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-out", text_path, "-p", "8080", "-e", "8080", "127.0.0.1"])
+            self.assertEqual(rc, 0)
+            self.assertIn("Scanning host: 127.0.0.1", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertIn("Total open ports on 127.0.0.1: 1", stdout)
+            with open(text_path, encoding="utf-8") as f:
+                report = f.read()
+            self.assertIn("Port 8080/tcp open", report)
+            self.assertIn("Total open ports on 127.0.0.1: 1", report)
+            self.assertNotIn("Scanning host", report)
+
+            stdout, stderr, rc = self._run_scanner(["-o", "json", "-out", json_path, "-p", "8080", "-e", "8080", "127.0.0.1"])
+            self.assertEqual(rc, 0)
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertIn("Total open ports on 127.0.0.1: 1", stdout)
+            with open(json_path, encoding="utf-8") as f:
+                self.assertEqual(json.load(f)[0]["open_ports"], 1)
+
+            ## -q leaves the console empty
+            stdout, stderr, rc = self._run_scanner(["-q", "-force", "-o", "json", "-out", json_path, "-p", "8080", "-e", "8080", "127.0.0.1"])
+            self.assertEqual(stdout, "")
+        finally:
+            for path in [text_path, json_path]:
+                if os.path.exists(path):
+                    os.unlink(path)
+            os.rmdir(out_dir)
+
+    def test_output_file_existing(self):
+        """Test that -out refuses to overwrite a report without -force and appends with -append."""
+        out_dir = tempfile.mkdtemp()
+        csv_path = os.path.join(out_dir, "report.csv")
+        json_path = os.path.join(out_dir, "report.json")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "csv", "-out", csv_path, "-ports", "8080", "127.0.0.1"])
+            self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-o", "csv", "-out", csv_path, "-ports", "8080", "localhost"])
+            self.assertIn("already exists (use -force to overwrite it or -append to add to it)", stdout)
+            self.assertEqual(rc, 2)
+
+            ## Appending keeps the rows and does not repeat the header
+            stdout, stderr, rc = self._run_scanner(["-o", "csv", "-append", "-out", csv_path, "-ports", "8080", "localhost"])
+            self.assertEqual(rc, 0)
+            with open(csv_path, newline="") as f:
+                rows = list(csv.reader(f))
+            self.assertEqual([row[0] for row in rows], ["host", "127.0.0.1", "localhost"])
+
+            stdout, stderr, rc = self._run_scanner(["-o", "csv", "-force", "-out", csv_path, "-ports", "8080", "localhost"])
+            self.assertEqual(rc, 0)
+            with open(csv_path, newline="") as f:
+                self.assertEqual([row[0] for row in csv.reader(f)], ["host", "localhost"])
+
+            stdout, stderr, rc = self._run_scanner(["-o", "json", "-append", "-out", json_path, "localhost"])
+            self.assertIn("-append only works with line-oriented formats", stdout)
+            self.assertEqual(rc, 2)
+
+            ## The report is written next to the destination and renamed into place
+            self.assertEqual(os.listdir(out_dir), ["report.csv"])
+        finally:
+            for path in [csv_path, json_path]:
+                if os.path.exists(path):
+                    os.unlink(path)
+            os.rmdir(out_dir)
+
+    def test_output_file_unwritable(self):
+        """Test that an unwritable -out path is reported before scanning."""
+        stdout, stderr, rc = self._run_scanner(["-out", "/nonexistent-dir/report.txt", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertIn("Error creating output file", stdout)
+        self.assertNotEqual(rc, 0)
+
+    def test_invalid_output_format(self):
+        """Test that unknown output formats are rejected."""
+        stdout, stderr, rc = self._run_scanner(["-o", "yaml", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)
+
+    def test_port_spec_single_ports(self):
+        """Test -ports with a comma-separated list of single ports."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080,8082", "-a", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertIn("Port 8082/tcp open", stdout)
+        self.assertNotIn("Port 8081", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_port_spec_range(self):
+        """Test -ports with a range."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080-8082", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertIn("Port 8081/tcp open", stdout)
+        self.assertIn("Port 8082/tcp open", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_port_spec_mixed_and_overlapping(self):
+        """Test -ports with mixed entries and overlapping ranges, which must be deduplicated."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080,8079-8081,8081-8082,8080", "localhost"])
+        self.assertEqual(rc, 0)
+        port_lines = [line for line in stdout.split('\n') if line.startswith('Port ')]
+        for port in ["8080", "8081", "8082"]:
+            matching_lines = [line for line in port_lines if line.startswith(f'Port {port}/')]
+            self.assertEqual(len(matching_lines), 1, f"Port {port} should be scanned exactly once")
+
+    def test_port_spec_reversed_range(self):
+        """Test that reversed ranges in -ports are rejected."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "100-50", "localhost"])
+        self.assertIn("100-50", stdout)
+        self.assertNotEqual(rc, 0)
+
+    def test_port_spec_out_of_range(self):
+        """Test that out-of-range ports in -ports are rejected and named."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "22,70000", "localhost"])
+        self.assertIn("70000", stdout)
+        self.assertNotEqual(rc, 0)
+
+    def test_port_spec_malformed_tokens(self):
+        """Test that malformed -ports entries are rejected with a clear error."""
+        for spec in ["80-", "-80", "abc", "22,,80", "22-abc", "0"]:
+            stdout, stderr, rc = self._run_scanner(["-ports", spec, "localhost"])
+            self.assertIn("Error parsing port spec", stdout, f"Spec {spec!r} should be rejected")
+            self.assertNotEqual(rc, 0, f"Spec {spec!r} should be rejected")
+
+    def test_port_spec_conflicts(self):
+        """Test that -ports cannot be combined with -p/-e or -P."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "-p", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)
+
+        ## -p and -e count as given even at their defaults
+        stdout, stderr, rc = self._run_scanner(["-ports", "22", "-p", "1", "-e", "65535", "127.0.0.1"])
+        self.assertIn("-ports cannot be combined with -p/-e or -P", stdout)
+        self.assertEqual(rc, 2)
+
+        ports_file = self._create_temp_file("8080\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-ports", "8080", "-P", ports_file, "localhost"])
+            self.assertNotEqual(rc, 0)
+        finally:
+            os.unlink(ports_file)
+
+    def test_top_ports(self):
+        """Test that -top-ports scans only the most common ports."""
+        stdout, stderr, rc = self._run_scanner(["-top-ports", "100", "localhost"])
+        self.assertEqual(rc, 0)
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertIn("Port 8081/tcp open", stdout)
+        self.assertNotIn("Port 8082", stdout)  ## Not in the top 100
+
+    def test_top_ports_conflicts(self):
+        """Test that -top-ports cannot be combined with other port selections."""
+        ## -p and -e conflict even when passed at their defaults
+        for extra in (["-p", "80"], ["-e", "1024"], ["-p", "1"], ["-e", "65535"], ["-ports", "8080"]):
+            stdout, stderr, rc = self._run_scanner(["-top-ports", "10"] + extra + ["localhost"])
+            self.assertIn("-top/-top-ports cannot be combined", stdout)
+            self.assertNotEqual(rc, 0)
+
+        ports_file = self._create_temp_file("8080\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-top-ports", "10", "-P", ports_file, "localhost"])
+            self.assertNotEqual(rc, 0)
+        finally:
+            os.unlink(ports_file)
+
+        stdout, stderr, rc = self._run_scanner(["-top-ports", "100000", "localhost"])
+        self.assertNotEqual(rc, 0)
+
+    def test_top_shorthand(self):
+        """Test that -top 1000 covers the full built-in list and rejects other port selections."""
+        stdout, stderr, rc = self._run_scanner(["-top", "1000", "127.0.0.1"])
+        self.assertEqual(rc, 0)
+        for port in ["8080", "8081", "8082"]:
+            self.assertIn(f"Port {port}/tcp open", stdout)
+
+        stdout, stderr, rc = self._run_scanner(["-top", "1000", "-p", "1", "-e", "1024", "127.0.0.1"])
+        self.assertIn("-top/-top-ports cannot be combined", stdout)
+        self.assertNotEqual(rc, 0)
+
+    def test_exclude_ports(self):
+        """Test that -exclude-ports removes ports from every kind of port selection."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8082", "-exclude-ports", "8081", "localhost"])
+        self.assertEqual(rc, 0)
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertNotIn("Port 8081", stdout)
+        self.assertIn("Port 8082/tcp open", stdout)
+        self.assertIn("Excluded by -exclude-ports: 1", stdout)
+        self.assertNotIn("Excluded 1 port(s)", stdout)
+
+        stdout, stderr, rc = self._run_scanner(["-v", "-p", "8080", "-e", "8082", "-exclude-ports", "8081", "localhost"])
+        self.assertIn('msg="excluded ports" pattern=8081 excluded=1 remaining=2', stderr)
+
+        stdout, stderr, rc = self._run_scanner(["-top-ports", "100", "-exclude-ports", "8000-8080", "localhost"])
+        self.assertNotIn("Port 8080", stdout)
+        self.assertIn("Port 8081/tcp open", stdout)
+
+        ports_file = self._create_temp_file("8080\n8082\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-P", ports_file, "-exclude-ports", "8082", "localhost"])
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertNotIn("Port 8082", stdout)
+        finally:
+            os.unlink(ports_file)
+
+        ## Exclusions outside the selected ports are not counted
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "-exclude-ports", "1-1000", "localhost"])
+        self.assertNotIn("Excluded by", stdout)
+
+    def test_exclude_all_ports(self):
+        """Test that excluding every selected port is an error rather than an empty scan."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080-8082", "-exclude-ports", "8000-9000", "localhost"])
+        self.assertIn("removes every port", stdout)
+        self.assertEqual(rc, 2)
+
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "-exclude-ports", "80-", "localhost"])
+        self.assertIn("Error parsing excluded ports", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_exit_codes(self):
+        """Test that the exit code reflects the scan outcome."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080,9999", "localhost"])
+        self.assertEqual(rc, 0)  ## At least one open port
+
+        stdout, stderr, rc = self._run_scanner(["-ports", "9999", "localhost"])
+        self.assertEqual(rc, 1)  ## Nothing open
+
+        stdout, stderr, rc = self._run_scanner(["-w", "0", "localhost"])
+        self.assertEqual(rc, 2)  ## Invalid configuration
+
+        stdout, stderr, rc = self._run_scanner(["-bogus-flag", "localhost"])
+        self.assertEqual(rc, 2)  ## Unknown flag
+
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "invalid.host.local"])
+        self.assertEqual(rc, 3)  ## DNS failure
+
+        ## -fail-on-open has its own contract: 0 completed and closed, 1 usage,
+        ## 2 unresolvable or unreachable, 3 open
+        stdout, stderr, rc = self._run_scanner(["-fail-on-open", "-ports", "8080,9999", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertEqual(rc, 3)
+
+        stdout, stderr, rc = self._run_scanner(["-fail-on-open", "-ports", "9999", "localhost"])
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-fail-on-open", "-ports", "8080", "invalid.host.local"])
+        self.assertEqual(rc, 2)
+
+        stdout, stderr, rc = self._run_scanner(["-fail-on-open", "-sn", "localhost"])
+        self.assertEqual(rc, 1)
+
+        stdout, stderr, rc = self._run_scanner(["-h"])
+        self.assertEqual(rc, 0)
+
     def test_invalid_port_range(self):
         """Test invalid port range handling."""
         stdout, stderr, rc = self._run_scanner(["-p", "65536", "-e", "65537", "localhost"])
@@ -125,14 +686,32 @@ class TestPortScanner(unittest.TestCase):
     def test_invalid_host(self):
         """Test invalid hostname handling."""
         stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "invalid.host.local"])
-        self.assertIn("No open ports found", stdout)
+        self.assertIn("Skipping host invalid.host.local: could not resolve", stdout)
+        self.assertNotIn("Port 8080", stdout)
+        self.assertEqual(rc, 3)
+
+    def test_resolution_once_per_host(self):
+        """Test that hostnames are resolved up front and reported with their address."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "localhost"])
+        self.assertIn("Scanning host: localhost (127.0.0.1)", stdout)
         self.assertEqual(rc, 0)
 
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-p", "8080", "-e", "8080", "localhost", ])
+        self.assertEqual(json.loads(stdout)[0]["ip"], "127.0.0.1")
+
+    def test_unresolvable_host_in_json(self):
+        """Test that unresolvable hosts appear in JSON output with an error instead of results."""
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-p", "8080", "-e", "8080", "invalid.host.local"])
+        self.assertEqual(rc, 3)
+        report = json.loads(stdout)
+        self.assertIn("could not resolve", report[0]["error"])
+        self.assertEqual(report[0]["results"], [])
+
     def test_show_all_ports(self):
         """Test showing all ports (including closed ones)."""
         stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8081", "-a", "localhost"])
-        self.assertIn("Port 8080: open", stdout)
-        self.assertIn("Port 8081: open", stdout)
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertIn("Port 8081/tcp open", stdout)
         self.assertEqual(rc, 0)
 
     def test_worker_count(self):
@@ -142,14 +721,38 @@ class TestPortScanner(unittest.TestCase):
         
         self.assertEqual(rc1, 0)
         self.assertEqual(rc2, 0)
-        self.assertIn("Port 8080: open", stdout1)
-        self.assertIn("Port 8080: open", stdout2)
+        self.assertIn("Port 8080/tcp open", stdout1)
+        self.assertIn("Port 8080/tcp open", stdout2)
+
+    def test_comments_in_files(self):
+        """Test that ports and hosts files can mix comments, section headers, blank lines and entries."""
+        ports_file = self._create_temp_file("# web\n8080  # http-alt\n\n   \n## proxies\n8081\r\n8082 # last\n")
+        hosts_file = self._create_temp_file("# lab\n\nlocalhost  # loopback\n   \n## more\n127.0.0.1\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-P", ports_file, "-f", hosts_file])
+            self.assertEqual(stdout.count("Scanning host:"), 2)
+            self.assertEqual(stdout.count("Port 8080/tcp open"), 2)
+            self.assertEqual(stdout.count("Port 8081/tcp open"), 2)
+            self.assertEqual(stdout.count("Port 8082/tcp open"), 2)
+            self.assertEqual(rc, 0)
+        finally:
+            os.unlink(ports_file)
+            os.unlink(hosts_file)
+
+        ports_file = self._create_temp_file("# only a comment\n\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-P", ports_file, "localhost"])
+            self.assertIn("Error reading ports file: empty ports file", stdout)
+            self.assertEqual(rc, 2)
+        finally:
+            os.unlink(ports_file)
 
     def test_invalid_ports_file(self):
         """Test handling of invalid ports file."""
         ports_file = self._create_temp_file("invalid\n8080\n")
         try:
             stdout, stderr, rc = self._run_scanner(["-P", ports_file, "localhost"])
+            self.assertIn("Error reading ports file: line 1:", stdout)
             self.assertNotEqual(rc, 0)
         finally:
             os.unlink(ports_file)
@@ -176,7 +779,7 @@ class TestPortScanner(unittest.TestCase):
         try:
             stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-p", "8080", "-e", "8082", "-w", "50"])
             self.assertIn("Scanning host: localhost", stdout)
-            self.assertIn("Port 8080: open", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
             self.assertEqual(rc, 0)
         finally:
             os.unlink(hosts_file)
@@ -195,8 +798,8 @@ class TestPortScanner(unittest.TestCase):
         ports_file = self._create_temp_file("8080\n8080\n8081\n8081\n")
         try:
             stdout, stderr, rc = self._run_scanner(["-P", ports_file, "localhost"])
-            self.assertIn("Port 8080: open", stdout)
-            self.assertIn("Port 8081: open", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertIn("Port 8081/tcp open", stdout)
             self.assertEqual(rc, 0)
         finally:
             os.unlink(ports_file)
@@ -204,9 +807,9 @@ class TestPortScanner(unittest.TestCase):
     def test_large_port_range(self):
         """Test handling of a large port range."""
         stdout, stderr, rc = self._run_scanner(["-p", "8000", "-e", "8100", "-w", "200", "localhost"])
-        self.assertIn("Port 8080: open", stdout)
-        self.assertIn("Port 8081: open", stdout)
-        self.assertIn("Port 8082: open", stdout)
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertIn("Port 8081/tcp open", stdout)
+        self.assertIn("Port 8082/tcp open", stdout)
         self.assertEqual(rc, 0)
 
     def test_zero_workers(self):
@@ -227,8 +830,8 @@ class TestPortScanner(unittest.TestCase):
     def test_invalid_host_format(self):
         """Test handling of invalid host format."""
         stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "invalid..host..format"])
-        self.assertIn("No open ports found", stdout)
-        self.assertEqual(rc, 0)
+        self.assertIn("Skipping host invalid..host..format", stdout)
+        self.assertEqual(rc, 3)
 
     def test_non_existent_files(self):
         """Test handling of non-existent files."""
@@ -247,6 +850,30 @@ class TestPortScanner(unittest.TestCase):
         finally:
             os.unlink(hosts_file)
 
+    def test_hosts_from_stdin(self):
+        """Test that hosts can be piped in, with -f - or without any host argument."""
+        hosts = "# from dig\r\nlocalhost\r\n\r\n127.0.0.1  # loopback\r\n"
+        for args in (["-f", "-"], []):
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080"], stdin=hosts)
+            self.assertIn("Scanning host: localhost", stdout)
+            self.assertIn("Scanning host: 127.0.0.1", stdout)
+            self.assertEqual(stdout.count("Scanning host:"), 2)
+            self.assertEqual(rc, 0)
+
+        ## A positional host wins over piped input
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "127.0.0.1"], stdin="localhost\n")
+        self.assertEqual(stdout.count("Scanning host:"), 1)
+        self.assertIn("Scanning host: 127.0.0.1", stdout)
+
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080"], stdin="# nothing here\n\n")
+        self.assertIn("Error reading hosts from stdin: no hosts found", stdout)
+        self.assertEqual(rc, 2)
+
+        ## Without piped input the usage is shown
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080"])
+        self.assertIn("Usage:", stderr)
+        self.assertEqual(rc, 2)
+
     def test_mixed_valid_invalid_ports(self):
         """Test handling of mixed valid and invalid ports in ports file."""
         ports_file = self._create_temp_file("8080\ninvalid\n8081\n-1\n65536\n8082\n")
@@ -256,68 +883,776 @@ class TestPortScanner(unittest.TestCase):
         finally:
             os.unlink(ports_file)
 
-    def test_mixed_valid_invalid_hosts(self):
-        """Test handling of mixed valid and invalid hosts in hosts file."""
-        hosts_file = self._create_temp_file("localhost\ninvalid.host\n127.0.0.1\n")
-        try:
-            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-p", "8080", "-e", "8080"])
-            self.assertIn("Scanning host: localhost", stdout)
-            self.assertIn("Scanning host: 127.0.0.1", stdout)
-            self.assertEqual(rc, 0)  ## Should continue with valid hosts
-        finally:
-            os.unlink(hosts_file)
+    def test_all_ips(self):
+        """Test that -all-ips scans every address a hostname resolves to."""
+        addresses = {info[4][0] for info in socket.getaddrinfo("localhost", None, proto=socket.IPPROTO_TCP)}
+        stdout, stderr, rc = self._run_scanner(["-all-ips", "-a", "-ports", "8080", "localhost"])
+        self.assertIn("Scanning host: localhost (127.0.0.1)", stdout)
+        self.assertEqual(stdout.count("Scanning host: localhost"), len(addresses))
 
-    def test_reverse_port_range(self):
-        """Test handling of reverse port range."""
-        stdout, stderr, rc = self._run_scanner(["-p", "8082", "-e", "8080", "localhost"])
-        self.assertNotEqual(rc, 0)  ## Should fail when start port > end port
+        ## Address family flags still narrow the set
+        stdout, stderr, rc = self._run_scanner(["-all-ips", "-4", "-ports", "8080", "localhost"])
+        self.assertEqual(stdout.count("Scanning host: localhost"), 1)
+        self.assertEqual(rc, 0)
 
-    def test_same_start_end_port(self):
-        """Test handling of same start and end port."""
-        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "localhost"])
-        self.assertIn("Port 8080: open", stdout)
+    def test_bind(self):
+        """Test that -bind sends probes from a local address and rejects ones that are not."""
+        stdout, stderr, rc = self._run_scanner(["-bind", "127.0.0.1", "-ports", "8080", "localhost"])
+        self.assertIn("Scanning host: localhost (127.0.0.1)", stdout)
+        self.assertIn("Port 8080/tcp open", stdout)
         self.assertEqual(rc, 0)
 
-    def test_whitespace_in_files(self):
-        """Test handling of whitespace in input files."""
-        hosts_file = self._create_temp_file("localhost\n  127.0.0.1  \n\n  \nlocalhost\n")
-        ports_file = self._create_temp_file("8080\n  8081  \n\n  \n8082\n")
+        stdout, stderr, rc = self._run_scanner(["-bind", "192.0.2.1", "localhost"])
+        self.assertIn("Error: invalid -bind address: 192.0.2.1 is not an address of any local interface", stdout)
+        self.assertEqual(rc, 2)
+
+        stdout, stderr, rc = self._run_scanner(["-bind", "127.0.0.1", "-6", "localhost"])
+        self.assertIn("-bind 127.0.0.1 is an IPv4 address, so it cannot be combined with -6", stdout)
+        self.assertEqual(rc, 2)
+
+        stdout, stderr, rc = self._run_scanner(["-source-ip", "192.0.2.1", "localhost"])
+        self.assertIn("Error: invalid -source-ip address", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_open_file_limit(self):
+        """Test that more workers than the open file limit allows are cut down with a warning instead of failing dials."""
+        if not hasattr(os, "fork") or sys.platform == "win32":
+            self.skipTest("Needs a Unix open file limit")
+        import resource
+
+        def lower_limit():
+            resource.setrlimit(resource.RLIMIT_NOFILE, (64, 64))
+
+        process = subprocess.run([self.exe_path, "scan", "-w", "500", "-p", "8079", "-e", "8082", "localhost"],
+                                 stdin=subprocess.DEVNULL, capture_output=True, text=True, preexec_fn=lower_limit)
+        self.assertIn("Warning: -w 500 needs more than the 64 open files this process may use; scanning with -w 12 instead.", process.stdout)
+        self.assertIn("Port 8080/tcp open", process.stdout)
+        self.assertNotIn("ran out of open files", process.stdout)
+        self.assertEqual(process.returncode, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-w", "500", "-p", "8079", "-e", "8082", "localhost"])
+        self.assertNotIn("Warning", stdout)
+
+    def test_ssh_jump(self):
+        """Test that -ssh-jump is validated and that a jump host it cannot log in to stops the run before scanning."""
+        for args, message in [
+            (["-ssh-jump", "ops@bastion", "-proto", "udp"], "Error: -ssh-jump only scans TCP, so it cannot be used with -proto udp or both"),
+            (["-ssh-jump", "ops@bastion", "-bind", "127.0.0.1"], "Error: -ssh-jump cannot be combined with -bind, -source-ip or -interface"),
+            (["-ssh-jump", "ops@bastion:99999"], 'Error: invalid -ssh-jump: "ops@bastion:99999" has an invalid port "99999"'),
+            (["-ssh-jump", "ops@bastion", "-ssh-max-channels", "0"], "Error: -ssh-max-channels must be greater than 0"),
+            (["-ssh-key", "id_ed25519"], "Error: -ssh-key only applies together with -ssh-jump"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080", "localhost"])
+            self.assertIn(message, stdout)
+            self.assertEqual(rc, 2)
+
+        with tempfile.TemporaryDirectory() as tmpdir:
+            known_hosts = os.path.join(tmpdir, "known_hosts")
+            open(known_hosts, "w").close()
+            key = os.path.join(tmpdir, "id_ed25519")
+            if not shutil.which("ssh-keygen"):
+                self.skipTest("Needs ssh-keygen to make a key")
+            subprocess.run(["ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", key], check=True)
+            stdout, stderr, rc = self._run_scanner(["-ssh-jump", "ops@127.0.0.1:8079", "-ssh-key", key, "-ssh-known-hosts", known_hosts, "-ports", "8080", "localhost"])
+            self.assertIn("Error: cannot log in to -ssh-jump host ops@127.0.0.1:8079:", stdout)
+            self.assertNotIn("Port 8080", stdout)
+            self.assertEqual(rc, 3)
+
+    def test_interface(self):
+        """Test that -interface sends probes out through an interface that exists."""
+        stdout, stderr, rc = self._run_scanner(["-interface", "no-such-interface", "localhost"])
+        if sys.platform.startswith("linux"):
+            self.assertIn("Error: invalid -interface: no interface called no-such-interface", stdout)
+        else:
+            self.assertIn("Error: -interface is not supported on", stdout)
+        self.assertEqual(rc, 2)
+
+        if not sys.platform.startswith("linux") or os.geteuid() != 0:
+            self.skipTest("Binding to an interface needs Linux and root")
+        stdout, stderr, rc = self._run_scanner(["-interface", "lo", "-source-ip", "127.0.0.1", "-ports", "8080", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_group(self):
+        """Test that -group prints ports under a header for their kind of service."""
+        stdout, stderr, rc = self._run_scanner(["-group", "-ports", "8079-8082", "localhost"])
+        self.assertIn("[web]\nPort 8080/tcp open http-alt (<t>)\n[other]\nPort 8081/tcp open tproxy (<t>)\nPort 8082/tcp open", self._mask_latency(stdout))
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-group", "-q", "-ports", "8079-8081", "localhost"])
+        self.assertEqual(self._mask_latency(stdout), "Port 8080/tcp open http-alt (<t>)\nPort 8081/tcp open tproxy (<t>)\n")
+
+        stdout, stderr, rc = self._run_scanner(["-group", "-o", "json", "localhost"])
+        self.assertIn("-group only applies to text output", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_quiet(self):
+        """Test that -q prints only port lines, with errors on stderr."""
+        hosts_file = self._create_temp_file("localhost\ninvalid.host.local\n")
         try:
-            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-P", ports_file])
-            self.assertIn("Port 8080: open", stdout)
-            self.assertIn("Port 8081: open", stdout)
-            self.assertEqual(rc, 0)
+            stdout, stderr, rc = self._run_scanner(["-q", "-f", hosts_file, "-p", "8079", "-e", "8081"])
+            self.assertEqual(self._mask_latency(stdout), "Port 8080/tcp open http-alt (<t>)\nPort 8081/tcp open tproxy (<t>)\n")
+            self.assertIn("Skipping host invalid.host.local", stderr)
+            self.assertEqual(rc, 3)
         finally:
             os.unlink(hosts_file)
-            os.unlink(ports_file)
 
-    def test_no_flags(self):
-        """Test running scanner without any flags."""
-        stdout, stderr, rc = self._run_scanner(["localhost"])
-        self.assertEqual(rc, 0)  ## Should work with default values
+        ## Machine-readable output is unchanged, only the summaries on stderr go away
+        stdout, stderr, rc = self._run_scanner(["-q", "-o", "json", "-ports", "8080", "localhost"])
+        self.assertEqual(json.loads(stdout)[0]["open_ports"], 1)
+        self.assertEqual(stderr, "")
 
-    def test_invalid_flag_combination(self):
-        """Test invalid flag combinations."""
-        ## Test -f with positional host argument
-        stdout, stderr, rc = self._run_scanner(["-f", "hosts.txt", "localhost"])
-        self.assertNotEqual(rc, 0)
+        stdout, stderr, rc = self._run_scanner(["-q", "-v", "localhost"])
+        self.assertIn("-v and -q cannot be used together", stdout)
+        self.assertEqual(rc, 2)
 
-    def test_timeout_handling(self):
-        """Test handling of connection timeouts."""
-        ## Test with a non-routable IP to force timeout
-        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "10.255.255.255"])
-        self.assertIn("No open ports found", stdout)
+    def test_verbose(self):
+        """Test that -v logs host lifecycle events and -vv every attempt to stderr, leaving stdout to the report."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8079", "-e", "8080", "127.0.0.1"])
+        self.assertEqual(stderr, "")
+        ## Latencies and timings change from run to run, so compare how each line starts
+        report = [line.split()[:2] for line in stdout.splitlines()]
+
+        stdout, stderr, rc = self._run_scanner(["-v", "-p", "8079", "-e", "8080", "127.0.0.1"])
+        self.assertIn("Scanning host: 127.0.0.1", stdout)
+        self.assertIn("Total open ports on 127.0.0.1: 1", stdout)
+        self.assertNotIn("level=", stdout)
+        self.assertIn("msg=resolved host=127.0.0.1 ip=127.0.0.1", stderr)
+        self.assertIn('msg="host scan started" host=127.0.0.1 ip=127.0.0.1 ports=2', stderr)
+        self.assertRegex(stderr, r'msg="host scanned" host=127\.0\.0\.1 ip=127\.0\.0\.1 scanned=2 total=2 open=1 elapsed=\S+')
+        self.assertRegex(stderr, r'msg="run finished" scanned=1 failed=0 down=0 skipped=0 open=1 elapsed=\S+')
+        self.assertNotIn("level=DEBUG", stderr)
         self.assertEqual(rc, 0)
 
-    def test_unicode_in_files(self):
-        """Test handling of Unicode characters in input files."""
-        ## Using simpler Unicode characters that are more likely to work across systems
-        hosts_file = self._create_temp_file("localhost\néxample.com\n127.0.0.1\n")
+        stdout, stderr, rc = self._run_scanner(["-vv", "-p", "8079", "-e", "8080", "127.0.0.1"])
+        self.assertRegex(stderr, r'level=DEBUG msg=attempt ip=127\.0\.0\.1 port=8079 protocol=tcp attempt=1 state=closed latency=\S+ error=".*refused"')
+        self.assertRegex(stderr, r"level=DEBUG msg=attempt ip=127\.0\.0\.1 port=8080 protocol=tcp attempt=1 state=open latency=\S+\n")
+        self.assertEqual([line.split()[:2] for line in stdout.splitlines()], report)
+        self.assertEqual(rc, 0)
+
+        log_file = self._create_temp_file("")
         try:
-            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-p", "8080", "-e", "8080"])
-            self.assertIn("Scanning host: localhost", stdout)
-            self.assertIn("Scanning host: 127.0.0.1", stdout)
-            self.assertEqual(rc, 0)
+            stdout, stderr, rc = self._run_scanner(["-v", "-log-json", "-log-file", log_file, "-ports", "8080", "127.0.0.1"])
+            lines = [json.loads(line) for line in stderr.splitlines()]
+            self.assertEqual({line["level"] for line in lines}, {"INFO"})
+            scanned = next(line for line in lines if line["msg"] == "host scanned")
+            self.assertEqual(scanned["open"], 1)
+            self.assertIsInstance(scanned["elapsed_ms"], float)
+            with open(log_file) as f:
+                self.assertEqual(f.read(), stderr)
+        finally:
+            os.unlink(log_file)
+
+        stdout, stderr, rc = self._run_scanner(["-log-file", "scan.log", "localhost"])
+        self.assertIn("-log-file and -log-json only apply together with -v or -vv", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_timing_template(self):
+        """Test that -timing sets its bundle of settings and explicit flags override single values."""
+        stdout, stderr, rc = self._run_scanner(["-v", "-timing", "polite", "-t", "3s", "-ports", "8080", "127.0.0.1"])
+        self.assertIn('msg=timing template=polite settings="workers 10, timeout 3s, retries 1, delay between dials 100ms"', stderr)
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-v", "-timing", "5", "-ports", "8080", "127.0.0.1"])
+        self.assertIn('msg=timing template=insane settings="workers 1000, timeout 250ms, retries 0, delay between dials none"', stderr)
+
+        stdout, stderr, rc = self._run_scanner(["-v", "-ports", "8080", "127.0.0.1"])
+        self.assertIn('msg=timing settings="workers 100, timeout 1s, retries 0, delay between dials none"', stderr)
+
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "127.0.0.1"])
+        self.assertNotIn("timing", stderr)
+
+        stdout, stderr, rc = self._run_scanner(["-timing", "turbo", "127.0.0.1"])
+        self.assertIn('unknown timing template "turbo"', stdout)
+        self.assertEqual(rc, 2)
+
+    def test_ping_discovery(self):
+        """Test that -ping scans hosts that answer and reports hosts that do not as down."""
+        ## 100::/64 is a discard prefix, so nothing there ever answers
+        hosts_file = self._create_temp_file("localhost\n100::1\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-ping", "-ping-timeout", "500ms", "-f", hosts_file, "-ports", "8080"])
+            self.assertIn("Host discovery: 1 of 2 host(s) up", stdout)
+            self.assertIn("Scanning host: localhost (127.0.0.1)", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertIn("Host 100::1 seems down (no-response), skipping", stdout)
+            self.assertNotIn("Scanning host: 100::1", stdout)
+            self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-ping", "-ping-timeout", "500ms", "-f", hosts_file, "-ports", "8080", "-o", "json"])
+            hosts = {host["host"]: host for host in json.loads(stdout)}
+            self.assertEqual(hosts["localhost"]["status"], "up")
+            self.assertIn(hosts["localhost"]["reason"], ("echo-reply", "syn-ack", "conn-refused"))
+            self.assertEqual(hosts["100::1"]["status"], "down")
+            self.assertEqual(hosts["100::1"]["reason"], "no-response")
+            self.assertEqual(hosts["100::1"]["results"], [])
+
+            stdout, stderr, rc = self._run_scanner(["-ping", "-ping-timeout", "500ms", "-f", hosts_file, "-ports", "8080", "-o", "grep"])
+            self.assertIn("Host: 100::1 ()\tStatus: Down", stdout)
+
+            ## -skip-ping wins and every host is scanned
+            stdout, stderr, rc = self._run_scanner(["-ping", "-skip-ping", "-t", "200ms", "-f", hosts_file, "-ports", "8080"])
+            self.assertNotIn("Host discovery", stdout)
+            self.assertIn("Scanning host: 100::1", stdout)
+        finally:
+            os.unlink(hosts_file)
+
+        stdout, stderr, rc = self._run_scanner(["-ping", "-ping-ports", "8080,3389", "-ports", "8080", "localhost"])
+        self.assertIn("Host discovery: 1 of 1 host(s) up", stdout)
+        self.assertIn("Port 8080/tcp open", stdout)
+
+        stdout, stderr, rc = self._run_scanner(["-ping-ports", "8080", "localhost"])
+        self.assertIn("-ping-ports only applies together with -ping or -sn", stdout)
+        self.assertEqual(rc, 2)
+
+        stdout, stderr, rc = self._run_scanner(["-ping", "-ping-ports", "http", "localhost"])
+        self.assertIn("Error parsing ping ports", stdout)
+        self.assertEqual(rc, 2)
+
+        ## Without -ping the JSON report has no status
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "-o", "json", "localhost"])
+        self.assertNotIn("status", json.loads(stdout)[0])
+
+    def test_color(self):
+        """Test that -color always colors port states and host headers in text output only, and -no-color leaves them plain."""
+        stdout, stderr, rc = self._run_scanner(["-color", "always", "-a", "-ports", "8079,8080", "127.0.0.1"])
+        self.assertIn("\x1b[1mScanning host: 127.0.0.1\x1b[0m", stdout)
+        self.assertIn("Port 8079/tcp \x1b[90mclosed\x1b[0m", stdout)
+        self.assertIn("Port 8080/tcp \x1b[32mopen\x1b[0m http-alt", stdout)
+
+        ## auto does not color when stdout is a pipe, and structured formats are never colored
+        for args in (["-color", "never"], ["-no-color"], ["--no-color"], [], ["-color", "always", "-o", "csv"], ["-color", "always", "-o", "json"]):
+            stdout, stderr, rc = self._run_scanner(args + ["-a", "-ports", "8079,8080", "127.0.0.1"])
+            self.assertNotIn("\x1b[", stdout, args)
+            self.assertEqual(rc, 0, args)
+
+        stdout, stderr, rc = self._run_scanner(["-no-color", "-color", "always", "127.0.0.1"])
+        self.assertIn("-no-color cannot be used with -color always", stdout)
+        self.assertEqual(rc, 2)
+
+        stdout, stderr, rc = self._run_scanner(["-color", "rainbow", "127.0.0.1"])
+        self.assertIn('Unknown color mode "rainbow"', stdout)
+        self.assertEqual(rc, 2)
+
+    def test_jsonl_output(self):
+        """Test that -o jsonl writes one complete JSON object per reported port."""
+        hosts_file = self._create_temp_file("localhost\n127.0.0.1\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "jsonl", "-host-parallelism", "2", "-a", "-f", hosts_file, "-ports", "8079,8080"])
+        finally:
+            os.unlink(hosts_file)
+        lines = [json.loads(line) for line in stdout.splitlines()]
+        self.assertEqual(len(lines), 4)
+        self.assertEqual(sorted((line["host"], line["port"], line["state"]) for line in lines), [
+            ("127.0.0.1", 8079, "closed"), ("127.0.0.1", 8080, "open"),
+            ("localhost", 8079, "closed"), ("localhost", 8080, "open"),
+        ])
+        self.assertTrue(all(line["ip"] == "127.0.0.1" and line["service"] for line in lines))
+        self.assertTrue(all(re.match(r"\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(\.\d+)?Z$", line["timestamp"]) for line in lines))
+        self.assertTrue(all("latency_ms" in line for line in lines))
+        self.assertIn("Scanning host: localhost", stderr)
+        self.assertEqual(rc, 0)
+
+        ## Without -a only open ports are written
+        stdout, stderr, rc = self._run_scanner(["-format", "jsonl", "-ports", "8079,8080", "localhost"])
+        self.assertEqual([json.loads(line)["port"] for line in stdout.splitlines()], [8080])
+
+    def test_ping_sweep(self):
+        """Test that -sn reports which hosts are up without scanning any ports."""
+        hosts_file = self._create_temp_file("localhost\n100::1\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-sn", "-ping-timeout", "500ms", "-f", hosts_file])
+            self.assertRegex(stdout, r"HOST +IP +STATUS +REASON +RTT")
+            self.assertRegex(stdout, r"localhost +127\.0\.0\.1 +up +\S+ +\S+")
+            self.assertRegex(stdout, r"100::1 +100::1 +down +no-response +-")
+            self.assertIn("Host discovery: 1 of 2 host(s) up", stdout)
+            self.assertNotIn("Scanning host", stdout)
+            self.assertNotIn("Port ", stdout)
+            self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-sn", "-o", "json", "-ping-timeout", "500ms", "-f", hosts_file])
+            hosts = {host["host"]: host for host in json.loads(stdout)}
+            self.assertEqual(hosts["localhost"]["status"], "up")
+            self.assertEqual(hosts["100::1"], {"host": "100::1", "ip": "100::1", "status": "down", "reason": "no-response"})
+
+            stdout, stderr, rc = self._run_scanner(["-discover", "-o", "csv", "-ping-timeout", "500ms", "-f", hosts_file])
+            rows = list(csv.reader(io.StringIO(stdout)))
+            self.assertEqual(rows[0], ["host", "ip", "status", "reason", "rtt_ms"])
+            self.assertEqual(rows[2], ["100::1", "100::1", "down", "no-response", ""])
+        finally:
+            os.unlink(hosts_file)
+
+        stdout, stderr, rc = self._run_scanner(["-sn", "-ping-timeout", "500ms", "100::1"])
+        self.assertEqual(rc, 1)
+
+        stdout, stderr, rc = self._run_scanner(["-sn", "-o", "xml", "localhost"])
+        self.assertIn("-sn only supports text, json and csv output", stdout)
+        self.assertEqual(rc, 2)
+
+        ## -sweep is the same mode, with -w pinging that many hosts at once and -t as the ping timeout
+        started = time.monotonic()
+        stdout, stderr, rc = self._run_scanner(["-sweep", "-w", "1", "-t", "300ms", "127.0.0.0/30,100::1"])
+        self.assertLess(time.monotonic() - started, 2)
+        self.assertRegex(stdout, r"127\.0\.0\.1 +127\.0\.0\.1 +up ")
+        self.assertRegex(stdout, r"127\.0\.0\.2 +127\.0\.0\.2 +up ")
+        self.assertIn("Host discovery: 2 of 3 host(s) up", stdout)
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-sweep", "-t", "1s", "-ping-timeout", "1s", "localhost"])
+        self.assertIn("-t and -ping-timeout cannot be used together with -sn", stdout)
+        self.assertEqual(rc, 2)
+
+        ## Without the privileges to send ICMP, hosts are still found through TCP connects.
+        ## Linux lets the groups in ping_group_range echo over unprivileged ICMP sockets.
+        if sys.platform.startswith("linux") and os.geteuid() == 0:
+            with open("/proc/sys/net/ipv4/ping_group_range") as f:
+                low, high = map(int, f.read().split())
+            directory = tempfile.mkdtemp()
+            try:
+                exe = shutil.copy(self.exe_path, directory)
+                os.chmod(directory, 0o755)
+                process = subprocess.run([exe, "scan", "-sweep", "-ping-ports", "8080", "127.0.0.1"], capture_output=True, text=True,
+                                         preexec_fn=lambda: (os.setgroups([]), os.setgid(65534), os.setuid(65534)))
+            finally:
+                shutil.rmtree(directory)
+            if low <= 65534 <= high:
+                self.assertNotIn("CAP_NET_RAW", process.stdout)
+                self.assertRegex(process.stdout, r"127\.0\.0\.1 +127\.0\.0\.1 +up ")
+            else:
+                self.assertIn("or root or CAP_NET_RAW, so hosts are only checked with TCP connects to port(s) 8080", process.stdout)
+                self.assertRegex(process.stdout, r"127\.0\.0\.1 +127\.0\.0\.1 +up +syn-ack ")
+            self.assertEqual(process.returncode, 0)
+
+    def test_config_file(self):
+        """Test that -config supplies flag defaults and command-line flags override them."""
+        toml_path = self._create_temp_file('# defaults\nstart_port = 8079\nend_port = 8080\nformat = "csv"\n', suffix=".toml")
+        json_path = self._create_temp_file('{"ports": "8080", "timeout": "nonsense"}', suffix=".json")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-config", toml_path, "-a", "127.0.0.1"])
+            rows = list(csv.reader(io.StringIO(stdout)))
+            self.assertEqual([row[2] for row in rows[1:]], ["8079", "8080"])
+            self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-config", toml_path, "-o", "text", "-e", "8079", "-a", "127.0.0.1"])
+            self.assertIn("Port 8079/tcp closed", stdout)
+            self.assertNotIn("Port 8080", stdout)
+
+            stdout, stderr, rc = self._run_scanner(["-config", json_path, "127.0.0.1"])
+            self.assertIn('Error in config', stdout)
+            self.assertIn('invalid timeout "nonsense"', stdout)
+            self.assertEqual(rc, 2)
+
+            ## An explicit flag for a bad key's value also skips it
+            stdout, stderr, rc = self._run_scanner(["-config", json_path, "-t", "1s", "127.0.0.1"])
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertEqual(rc, 0)
+        finally:
+            os.unlink(toml_path)
+            os.unlink(json_path)
+
+        stdout, stderr, rc = self._run_scanner(["-config", "/nonexistent/portscanner.toml", "127.0.0.1"])
+        self.assertIn("Error reading config", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_xml_output(self):
+        """Test that -o xml writes an nmaprun document that parses and carries each port state."""
+        hosts_file = self._create_temp_file("localhost\ninvalid.host.local\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "xml", "-a", "-4", "-f", hosts_file, "-ports", "8079,8080,8081"])
+        finally:
+            os.unlink(hosts_file)
+        self.assertEqual(rc, 3)
+        self.assertIn("Total open ports on localhost: 2", stderr)
+
+        root = ET.fromstring(stdout)
+        self.assertEqual(root.tag, "nmaprun")
+        self.assertLessEqual(int(root.get("start")), int(root.find("runstats/finished").get("time")))
+        scaninfo = root.find("scaninfo")
+        self.assertEqual((scaninfo.get("type"), scaninfo.get("protocol"), scaninfo.get("services")), ("connect", "tcp", "8079-8081"))
+
+        hosts = root.findall("host")
+        self.assertEqual(len(hosts), 1)
+        self.assertEqual(hosts[0].find("address").get("addr"), "127.0.0.1")
+        self.assertEqual(hosts[0].find("hostnames/hostname").get("name"), "localhost")
+        states = {port.get("portid"): port.find("state").get("state") for port in hosts[0].findall("ports/port")}
+        self.assertEqual(states, {"8079": "closed", "8080": "open", "8081": "open"})
+        self.assertEqual(hosts[0].find("ports/port[@portid='8080']/service").get("name"), "http-alt")
+
+        counts = root.find("runstats/hosts")
+        self.assertEqual((counts.get("up"), counts.get("down"), counts.get("total")), ("1", "1", "2"))
+
+    def test_grep_output(self):
+        """Test that -o grep writes one status line and one ports line per host."""
+        hosts_file = self._create_temp_file("localhost\ninvalid.host.local\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "grep", "-4", "-f", hosts_file, "-ports", "8079,8080,8081"])
+        finally:
+            os.unlink(hosts_file)
+        lines = stdout.splitlines()
+        self.assertRegex(lines[0], r"^# portscanner \S+ scan initiated ")
+        self.assertEqual(lines[1], "Host: 127.0.0.1 (localhost)\tStatus: Up")
+        self.assertEqual(lines[2], "Host: 127.0.0.1 (localhost)\tPorts: 8080/open/tcp//http-alt///, 8081/open/tcp//tproxy///")
+        self.assertEqual(lines[3], "Host: invalid.host.local ()\tStatus: Down")
+        self.assertRegex(lines[4], r"^# portscanner done at .* -- 2 IP address\(es\) \(1 host\(s\) up\) scanned in [\d.]+ seconds$")
+        self.assertEqual(len(lines), 5)
+        self.assertEqual(rc, 3)
+
+        ## Closed ports only appear with -a
+        stdout, stderr, rc = self._run_scanner(["-o", "grep", "-a", "-ports", "8079,8080", "127.0.0.1"])
+        self.assertIn("Host: 127.0.0.1 ()\tPorts: 8079/closed/tcp//unknown///, 8080/open/tcp//http-alt///\n", stdout)
+
+    def test_stats(self):
+        """Test that -stats ends the run with a summary of every host, and adds it to JSON reports."""
+        hosts_file = self._create_temp_file("localhost\n127.0.0.2\ninvalid.host.local\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-stats", "-4", "-f", hosts_file, "-ports", "8079,8080,8081"])
+            self.assertTrue(stdout.endswith("Hosts scanned: 2, open ports: 2\n"
+                                            "Most common open ports: 8080/tcp (http-alt) on 1 host(s), 8081/tcp (tproxy) on 1 host(s)\n"
+                                            "Most open ports: localhost (127.0.0.1) with 2\n"), stdout)
+            self.assertNotIn("in total", stdout)
+            self.assertEqual(rc, 3)
+
+            stdout, stderr, rc = self._run_scanner(["-stats", "-o", "json", "-4", "-f", hosts_file, "-ports", "8079,8080,8081"])
+            report = json.loads(stdout)
+            self.assertEqual(len(report["hosts"]), 3)
+            self.assertEqual(report["summary"]["hosts_scanned"], 2)
+            self.assertEqual(report["summary"]["open_ports"], 2)
+            self.assertEqual(report["summary"]["top_ports"][0], {"port": 8080, "protocol": "tcp", "service": "http-alt", "hosts": 1})
+            self.assertEqual(report["summary"]["top_hosts"][0], {"host": "localhost", "ip": "127.0.0.1", "open_ports": 2})
+            self.assertIn("Hosts scanned: 2, open ports: 2", stderr)
+        finally:
+            os.unlink(hosts_file)
+
+        stdout, stderr, rc = self._run_scanner(["-stats", "-sn", "localhost"])
+        self.assertIn("Error: -stats cannot be used with -sn", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_list_output(self):
+        """Test that -o list writes nothing but host:port for every open port."""
+        hosts_file = self._create_temp_file("localhost\ninvalid.host.local\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "list", "-a", "-4", "-f", hosts_file, "-ports", "8079,8080,8081"])
+        finally:
+            os.unlink(hosts_file)
+        self.assertEqual(stdout, "localhost:8080\nlocalhost:8081\n")
+        self.assertIn("Total open ports on localhost: 2", stderr)
+        self.assertEqual(rc, 3)
+
+        stdout, stderr, rc = self._run_scanner(["-o", "list", "-ports", "8080", "::1"])
+        if rc == 0:
+            self.assertEqual(stdout, "[::1]:8080\n")
+
+    def test_commands(self):
+        """Test that the first argument picks the command and that scans without one still run, with a pointer to scan."""
+        process = subprocess.run([self.exe_path], stdin=subprocess.DEVNULL, capture_output=True, text=True)
+        self.assertEqual(process.returncode, 2)
+        for name in ("scan", "ping", "resolve"):
+            self.assertRegex(process.stderr, rf"\n  {name} +\w")
+
+        process = subprocess.run([self.exe_path, "help", "ping"], capture_output=True, text=True)
+        self.assertEqual(process.returncode, 0)
+        self.assertIn("ping [flags] <host>...", process.stderr)
+        self.assertNotIn("-top-ports", process.stderr)
+
+        process = subprocess.run([self.exe_path, "-q", "-ports", "8080", "127.0.0.1"], capture_output=True, text=True)
+        self.assertEqual(self._mask_latency(process.stdout), "Port 8080/tcp open http-alt (<t>)\n")
+        self.assertIn("scan [flags] <host|cidr> instead", process.stderr)
+        self.assertEqual(process.returncode, 0)
+
+        process = subprocess.run([self.exe_path, "resolve", "-4", "localhost", "invalid.host.local"], capture_output=True, text=True)
+        self.assertIn("localhost: 127.0.0.1\n", process.stdout)
+        self.assertIn("invalid.host.local: could not resolve", process.stdout)
+        self.assertEqual(process.returncode, 3)
+
+        process = subprocess.run([self.exe_path, "ping", "-ports", "8080", "127.0.0.1"], capture_output=True, text=True)
+        self.assertRegex(process.stdout, r"^127\.0\.0\.1 is up \((echo-reply|syn-ack), ")
+        self.assertEqual(process.returncode, 0)
+
+    def test_target_expression(self):
+        """Test that one argument can name ranges in the last octet, CIDRs and hosts, separated by commas."""
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "127.0.0.1-2,localhost,127.0.0.2"])
+        self.assertEqual(re.findall(r"Scanning host: (.*)", stdout), ["127.0.0.1", "127.0.0.2", "localhost (127.0.0.1)"])
+        self.assertEqual(rc, 0)
+
+        for expr, message in [
+            ("127.0.0.5-2", "5 is greater than 2"),
+            ("127.0-1.0.1", "only the last octet can be a range"),
+            ("127.0.0.1,,localhost", "has an empty target"),
+            ("10.0.0.0/8,11.0.0.0/8", "names more than 16777216 addresses"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(["-ports", "8080", expr])
+            self.assertIn(message, stdout)
+            self.assertNotIn("Scanning host", stdout)
+            self.assertEqual(rc, 2)
+
+    def test_version(self):
+        """Test that --version describes the build and that reports and HTTP probes carry the same version."""
+        process = subprocess.run([self.exe_path, "--version"], capture_output=True, text=True)
+        self.assertEqual(process.returncode, 0)
+        self.assertRegex(process.stdout, r"^portscanner \S+ \(.*go\d")
+        version = process.stdout.split()[1]
+
+        process = subprocess.run([self.exe_path, "version", "-json"], capture_output=True, text=True)
+        self.assertEqual(json.loads(process.stdout)["version"], version)
+
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-ports", "8080", "127.0.0.1"])
+        self.assertEqual(json.loads(stdout)[0]["scanner_version"], version)
+        stdout, stderr, rc = self._run_scanner(["-o", "xml", "-ports", "8080", "127.0.0.1"])
+        self.assertEqual(ET.fromstring(stdout).get("version"), version)
+        stdout, stderr, rc = self._run_scanner(["-o", "html", "-ports", "8080", "127.0.0.1"])
+        self.assertIn(f"Scanner: portscanner {version}</p>", stdout)
+
+    def test_html_output(self):
+        """Test that -o html writes one self-contained page with a row per host and its ports."""
+        hosts_file = self._create_temp_file("localhost\ninvalid.host.local\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "html", "-a", "-4", "-f", hosts_file, "-ports", "8079,8080,8081"])
+        finally:
+            os.unlink(hosts_file)
+        self.assertEqual(rc, 3)
+        self.assertIn("Total open ports on localhost: 2", stderr)
+        self.assertTrue(stdout.startswith("<!DOCTYPE html>"))
+        self.assertTrue(stdout.rstrip().endswith("</html>"))
+        self.assertIn("<style>", stdout)
+        # Nothing is loaded from anywhere else
+        self.assertNotRegex(stdout, r"<(link|script|img)\b|src=|href=")
+
+        self.assertIn("<summary>localhost (127.0.0.1)</summary>", stdout)
+        self.assertIn('<tr><td>8080/tcp</td><td class="open">open</td><td>http-alt</td>', stdout)
+        self.assertIn('<tr><td>8079/tcp</td><td class="closed">closed</td>', stdout)
+        self.assertIn('<td class="error">error (could not resolve', stdout)
+        self.assertIn("2 host(s), 2 open port(s) in total.", stdout)
+
+        ## A report page cannot be appended to
+        stdout, stderr, rc = self._run_scanner(["-o", "html", "-out", "report.html", "-append", "localhost"])
+        self.assertIn("-append only works with line-oriented formats", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_markdown_output(self):
+        """Test that -o markdown writes a section with a port table per host and a summary."""
+        hosts_file = self._create_temp_file("localhost\ninvalid.host.local\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-o", "markdown", "-4", "-f", hosts_file, "-ports", "8079,8080,8081"])
+        finally:
+            os.unlink(hosts_file)
+        self.assertEqual(rc, 3)
+        self.assertIn("Total open ports on localhost: 2", stderr)
+        self.assertTrue(stdout.startswith("# Port scan report\n"))
+        self.assertRegex(stdout, r"- Command: `` .*-o markdown -4 -f .* ``\n")
+        self.assertIn("\n## localhost (127.0.0.1)\n\n2 open, 1 closed, 0 filtered, scanned in ", stdout)
+        self.assertIn("| 8080/tcp | open | http-alt | ", stdout)
+        self.assertIn("| 8081/tcp | open | tproxy | ", stdout)
+        # Closed ports only get a row with -a
+        self.assertNotIn("8079/tcp", stdout)
+        self.assertIn("\n## invalid.host.local\n\nNot scanned: could not resolve", stdout)
+        self.assertRegex(stdout, r"\n## Summary\n\nScanned 1 of 2 host\(s\) in .*, 2 open port\(s\) in total\.\n$")
+
+    def test_output_template(self):
+        """Test that -template renders every port, or every host with -template-host."""
+        stdout, stderr, rc = self._run_scanner(["-template", "{{.Host}}:{{.Port}}/{{.Protocol}} {{.Status}} {{.Service}}", "-a", "-ports", "8079-8081", "localhost"])
+        self.assertEqual(rc, 0)
+        self.assertEqual(stdout.splitlines(), ["localhost:8079/tcp closed unknown", "localhost:8080/tcp open http-alt", "localhost:8081/tcp open tproxy"])
+        self.assertIn("Total open ports on localhost: 2", stderr)
+
+        template_file = self._create_temp_file("{{.Host}} {{.Status}}{{range .Results}} {{.Port}}{{end}}{{with .Error}} ({{.}}){{end}}", ".tmpl")
+        hosts_file = self._create_temp_file("localhost\ninvalid.host.local\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-template", template_file, "-template-host", "-4", "-f", hosts_file, "-ports", "8079-8081"])
+        finally:
+            os.unlink(template_file)
+            os.unlink(hosts_file)
+        lines = stdout.splitlines()
+        self.assertEqual(lines[0], "localhost up 8080 8081")
+        self.assertTrue(lines[1].startswith("invalid.host.local error (could not resolve"), lines[1])
+        self.assertEqual(len(lines), 2)
+
+        ## Mistakes in the template are usage errors, found before scanning
+        for args, message in [
+            (["-template", "{{.Hostname}}"], "Error: invalid -template:"),
+            (["-template", "{{.Host"], "Error: invalid -template:"),
+            (["-template", "{{.Host}}", "-o", "json"], "-template replaces the -o format"),
+            (["-template-host"], "-template-host only applies together with -template"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080", "localhost"])
+            self.assertIn(message, stdout)
+            self.assertEqual(rc, 2)
+
+    def test_dry_run(self):
+        """Test that -dry-run lists what would be probed, after exclusions, without probing it."""
+        stdout, stderr, rc = self._run_scanner(["-dry-run", "-exclude", "10.0.0.0/25", "-ports", "22,80,443", "10.0.0.0/24"])
+        self.assertEqual(rc, 0)
+        lines = stdout.splitlines()
+        self.assertEqual(lines[0], "Excluded 127 target(s): 127 matching 10.0.0.0/25")
+        self.assertEqual(lines[1], "10.0.0.128: 22,80,443/tcp")
+        self.assertEqual(len([line for line in lines if line.startswith("10.0.0.")]), 10)
+        self.assertIn("... and 117 more address(es), use -v to list them all", lines)
+        self.assertEqual(lines[-1], "Dry run: 381 probe(s) to 127 address(es) of 127 host(s), nothing was sent")
+        self.assertNotIn("Scanning host", stdout)
+
+        ## -v lists every address
+        stdout, stderr, rc = self._run_scanner(["-dry-run", "-v", "-proto", "both", "-ports", "8080,8081", "10.0.0.0/28"])
+        self.assertEqual(rc, 0)
+        self.assertEqual(len([line for line in stdout.splitlines() if line.endswith(": 8080-8081/tcp,udp")]), 14)
+        self.assertNotIn("more address(es)", stdout)
+
+        ## Nothing is probed, so a listening port is not reported open
+        stdout, stderr, rc = self._run_scanner(["-dry-run", "-ports", "8080", "127.0.0.1"])
+        self.assertEqual(stdout, "127.0.0.1: 8080/tcp\nDry run: 1 probe(s) to 1 address(es) of 1 host(s), nothing was sent\n")
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-dry-run", "-ports", "8080", "invalid.host.local"])
+        self.assertIn("Skipping host invalid.host.local", stdout)
+        self.assertEqual(rc, 3)
+
+        stdout, stderr, rc = self._run_scanner(["-dry-run", "-o", "json", "127.0.0.1"])
+        self.assertIn('-dry-run only writes text output, not "json"', stdout)
+        self.assertEqual(rc, 2)
+
+    def test_randomize(self):
+        """Test that a randomized scan reports the same ports, still in ascending order."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8078", "-e", "8084", "localhost"])
+        expected = self._mask_latency(stdout)
+        for args in (["-randomize"], ["-randomize", "-seed", "7"]):
+            stdout, stderr, rc = self._run_scanner(args + ["-p", "8078", "-e", "8084", "localhost"])
+            self.assertEqual(self._mask_latency(stdout), expected)
+            self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-seed", "7", "localhost"])
+        self.assertIn("-seed only applies together with -randomize", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_streamed_results_sorted(self):
+        """Test that streamed results of a wide range come out complete and in port order."""
+        for fmt in ("text", "csv"):
+            stdout, stderr, rc = self._run_scanner(["-a", "-o", fmt, "-no-progress", "-p", "1", "-e", "5000", "127.0.0.1"])
+            if fmt == "text":
+                ports = [int(line.split()[1].split("/")[0]) for line in stdout.splitlines() if line.startswith("Port ")]
+            else:
+                ports = [int(row.split(",")[2]) for row in stdout.splitlines()[1:]]
+            self.assertEqual(ports, list(range(1, 5001)), fmt)
+
+    def test_exclude_cidr_overlapping_range(self):
+        """Test that a CIDR exclusion removes the overlapping part of a scanned range."""
+        stdout, stderr, rc = self._run_scanner(["-include-broadcast", "-ports", "8080", "-exclude", "127.0.0.0/31", "127.0.0.0/30"])
+        self.assertIn("Excluded 2 target(s): 2 matching 127.0.0.0/31", stdout)
+        self.assertNotIn("Scanning host: 127.0.0.0", stdout)
+        self.assertNotIn("Scanning host: 127.0.0.1", stdout)
+        self.assertIn("Scanning host: 127.0.0.2", stdout)
+        self.assertIn("Scanning host: 127.0.0.3", stdout)
+
+        ## Excluding the whole range leaves nothing to scan
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "-exclude", "127.0.0.0/24", "127.0.0.0/30"])
+        self.assertIn("Excluded 2 target(s): 2 matching 127.0.0.0/24", stdout)
+        self.assertNotIn("Scanning host:", stdout)
+        self.assertEqual(rc, 1)
+
+    def test_exclude_matches_ips(self):
+        """Test that excluding an IP also excludes a hostname that resolves to it."""
+        hosts_file = self._create_temp_file("localhost\n127.0.0.2\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-4", "-ports", "8080", "-exclude", "127.0.0.1", "-f", hosts_file])
+            self.assertIn("Excluded 1 target(s): 1 matching 127.0.0.1", stdout)
+            self.assertNotIn("Scanning host: localhost", stdout)
+            self.assertIn("Scanning host: 127.0.0.2", stdout)
+        finally:
+            os.unlink(hosts_file)
+
+        ## Excluding a hostname drops targets given by IP
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "-exclude", "localhost", "127.0.0.1"])
+        self.assertIn("Excluded 1 target(s): 1 matching localhost", stdout)
+        self.assertNotIn("Scanning host: 127.0.0.1", stdout)
+
+    def test_exclude_file(self):
+        """Test that exclusions are read from a file and counted per entry."""
+        exclude_file = self._create_temp_file("127.0.0.2\n\n127.0.0.3/32\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-include-broadcast", "-ports", "8080", "-exclude-file", exclude_file, "-exclude", "127.0.0.1", "127.0.0.0/30"])
+            self.assertIn("Excluded 3 target(s): 1 matching 127.0.0.1, 1 matching 127.0.0.2, 1 matching 127.0.0.3/32", stdout)
+            self.assertIn("Scanning host: 127.0.0.0", stdout)
+            self.assertEqual(stdout.count("Scanning host:"), 1)
+        finally:
+            os.unlink(exclude_file)
+
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "-exclude", "10.0.0.0/33", "localhost"])
+        self.assertIn("invalid CIDR", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_duplicate_hosts_scanned_once(self):
+        """Test that a host listed twice in the hosts file is only scanned once, where it first appears."""
+        hosts_file = self._create_temp_file("localhost\ninvalid.host.local\nlocalhost\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-ports", "8080"])
+            headers = [line for line in stdout.split("\n") if line.startswith(("Scanning host:", "Skipping host"))]
+            self.assertEqual(len(headers), 2)
+            self.assertTrue(headers[0].startswith("Scanning host: localhost"))
+            self.assertTrue(headers[1].startswith("Skipping host invalid.host.local"))
+            self.assertEqual(rc, 3)
+        finally:
+            os.unlink(hosts_file)
+
+    def test_mixed_valid_invalid_hosts(self):
+        """Test handling of mixed valid and invalid hosts in hosts file."""
+        hosts_file = self._create_temp_file("localhost\ninvalid.host\n127.0.0.1\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-p", "8080", "-e", "8080"])
+            self.assertIn("Scanning host: localhost", stdout)
+            self.assertIn("Scanning host: 127.0.0.1", stdout)
+            self.assertEqual(rc, 3)  ## Valid hosts are still scanned, but the failed lookup is reported
+        finally:
+            os.unlink(hosts_file)
+
+    def test_reverse_port_range(self):
+        """Test handling of reverse port range."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8082", "-e", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)  ## Should fail when start port > end port
+
+    def test_same_start_end_port(self):
+        """Test handling of same start and end port."""
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertEqual(rc, 0)
+
+    def test_whitespace_in_files(self):
+        """Test handling of whitespace in input files."""
+        hosts_file = self._create_temp_file("localhost\n  127.0.0.1  \n\n  \nlocalhost\n")
+        ports_file = self._create_temp_file("8080\n  8081  \n\n  \n8082\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-P", ports_file])
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertIn("Port 8081/tcp open", stdout)
+            self.assertEqual(rc, 0)
+        finally:
+            os.unlink(hosts_file)
+            os.unlink(ports_file)
+
+    def test_no_flags(self):
+        """Test running scanner without any flags."""
+        stdout, stderr, rc = self._run_scanner(["localhost"])
+        self.assertEqual(rc, 0)  ## Should work with default values
+
+    def test_invalid_flag_combination(self):
+        """Test invalid flag combinations."""
+        ## Test -f with positional host argument
+        stdout, stderr, rc = self._run_scanner(["-f", "hosts.txt", "localhost"])
+        self.assertNotEqual(rc, 0)
+
+    def test_timeout_handling(self):
+        """Test handling of connection timeouts."""
+        ## Test with a non-routable IP to force timeout
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "10.255.255.255"])
+        self.assertIn("No open ports found", stdout)
+        self.assertEqual(rc, 1)
+
+    def test_unicode_in_files(self):
+        """Test handling of Unicode characters in input files."""
+        ## Using simpler Unicode characters that are more likely to work across systems
+        hosts_file = self._create_temp_file("localhost\néxample.com\n127.0.0.1\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-p", "8080", "-e", "8080"])
+            self.assertIn("Scanning host: localhost", stdout)
+            self.assertIn("Scanning host: 127.0.0.1", stdout)
+            self.assertEqual(rc, 3)
         finally:
             os.unlink(hosts_file)
 
@@ -325,8 +1660,32 @@ class TestPortScanner(unittest.TestCase):
         """Test handling of very long hostnames."""
         long_hostname = "a" * 253 + ".com"  # Max DNS name length is 253 characters
         stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", long_hostname])
-        self.assertIn("No open ports found", stdout)
-        self.assertEqual(rc, 0)
+        self.assertIn(f"Skipping host {long_hostname}", stdout)
+        self.assertEqual(rc, 3)
+
+    def test_host_parallelism_keeps_input_order(self):
+        """Test that hosts scanned in parallel are still reported in input order without interleaving."""
+        hosts = ["localhost", "127.0.0.1"]
+        hosts_file = self._create_temp_file("\n".join(hosts) + "\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-host-parallelism", "4", "-p", "8080", "-e", "8082"])
+            self.assertEqual(rc, 0)
+            scanned = [line.split(": ", 1)[1].split(" (")[0] for line in stdout.split("\n") if line.startswith("Scanning host: ")]
+            self.assertEqual(scanned, hosts)
+
+            ## Each host block must be contiguous and end with its own summary
+            blocks = stdout.split("Scanning host: ")[1:]
+            for host, block in zip(hosts, blocks):
+                self.assertIn("Port 8080/tcp open", block)
+                self.assertIn(f"Total open ports on {host}: 3", block)
+            self.assertIn("Scanned 2 host(s), 6 open port(s) in total", stdout)
+        finally:
+            os.unlink(hosts_file)
+
+    def test_invalid_host_parallelism(self):
+        """Test that non-positive host parallelism is rejected."""
+        stdout, stderr, rc = self._run_scanner(["-host-parallelism", "0", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)
 
     def test_concurrent_port_and_host_scanning(self):
         """Test scanning multiple ports on multiple hosts concurrently."""
@@ -335,9 +1694,9 @@ class TestPortScanner(unittest.TestCase):
             stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-p", "8080", "-e", "8082", "-w", "50"])
             self.assertIn("Scanning host: localhost", stdout)
             self.assertIn("Scanning host: 127.0.0.1", stdout)
-            self.assertIn("Port 8080: open", stdout)
-            self.assertIn("Port 8081: open", stdout)
-            self.assertIn("Port 8082: open", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertIn("Port 8081/tcp open", stdout)
+            self.assertIn("Port 8082/tcp open", stdout)
             self.assertEqual(rc, 0)
         finally:
             os.unlink(hosts_file)
@@ -351,26 +1710,391 @@ class TestPortScanner(unittest.TestCase):
         """Test different types of connection failures."""
         ## Connection refused (port not listening)
         stdout, stderr, rc = self._run_scanner(["-p", "9999", "-e", "9999", "-a", "localhost"])
-        self.assertIn("Port 9999: closed", stdout)
-        self.assertEqual(rc, 0)
+        self.assertIn("Port 9999/tcp closed", stdout)
+        self.assertEqual(rc, 1)
 
         ## Connection timeout (non-routable IP, different from existing timeout test)
         stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "192.168.255.255"])
         self.assertIn("No open ports found", stdout)
+        self.assertEqual(rc, 1)
+
+    def test_port_state_classification(self):
+        """Test that refused, timed-out and unresolvable ports get distinct states."""
+        ## Connection refused (port not listening) is closed
+        stdout, stderr, rc = self._run_scanner(["-p", "9999", "-e", "9999", "-a", "localhost"])
+        self.assertIn("Port 9999/tcp closed", stdout)
+        self.assertIn("Closed: 1, Filtered: 0, Errors: 0", stdout)
+        self.assertEqual(rc, 1)
+
+        ## Timeout against a non-routable address is filtered
+        stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "-a", "-t", "300ms", "10.255.255.255"])
+        self.assertIn("Port 8080/tcp filtered", stdout)
+        self.assertEqual(rc, 1)
+
+        ## A closed port on a reachable host is never reported as an error
+        stdout, stderr, rc = self._run_scanner(["-p", "9999", "-e", "9999", "-a", "127.0.0.1"])
+        self.assertNotIn("Port 9999/tcp error", stdout)
+        self.assertEqual(rc, 1)
+
+    def test_json_output_state(self):
+        """Test that JSON output includes the port state."""
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-a", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertEqual(rc, 0)
+        self.assertEqual(json.loads(stdout)[0]["results"][0]["state"], "open")
+
+    def test_closed_port_error(self):
+        """Test that the error behind a port that is not open shows in JSON output and verbose text."""
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-a", "-ports", "8079,8080", "localhost"])
+        results = {result["port"]: result for result in json.loads(stdout)[0]["results"]}
+        self.assertEqual(results[8079]["error"], "connect: connection refused")
+        self.assertNotIn("error", results[8080])
+
+        stdout, stderr, rc = self._run_scanner(["-o", "jsonl", "-a", "-ports", "8079", "localhost"])
+        self.assertEqual(json.loads(stdout)["error"], "connect: connection refused")
+
+        stdout, stderr, rc = self._run_scanner(["-v", "-a", "-ports", "8079", "localhost"])
+        self.assertRegex(stdout, r"Port 8079/tcp closed unknown \(.+\) at \S+ \[error: connect: connection refused\]\n")
+
+        stdout, stderr, rc = self._run_scanner(["-a", "-ports", "8079", "localhost"])
+        self.assertNotIn("[error:", stdout)  ## Only shown with -v
+
+    def test_udp_open_and_closed(self):
+        """Test UDP scanning against a responding service and a closed port."""
+        server_socket = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        server_socket.bind(('127.0.0.1', 0))
+        udp_port = server_socket.getsockname()[1]
+
+        def server_thread():
+            while True:
+                try:
+                    data, addr = server_socket.recvfrom(512)
+                    server_socket.sendto(b"pong", addr)
+                except OSError:
+                    break
+
+        threading.Thread(target=server_thread, daemon=True).start()
+        try:
+            stdout, stderr, rc = self._run_scanner(["-proto", "udp", "-a", "-t", "500ms", "-ports", f"{udp_port},9999", "127.0.0.1"])
+            self.assertIn(f"Port {udp_port}/udp open", stdout)
+            self.assertIn("Port 9999/udp closed", stdout)
+            self.assertEqual(rc, 0)
+        finally:
+            server_socket.close()
+
+    def test_both_protocols(self):
+        """Test that -proto both scans each port over TCP and UDP."""
+        stdout, stderr, rc = self._run_scanner(["-proto", "both", "-a", "-t", "500ms", "-p", "8080", "-e", "8080", "127.0.0.1"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertIn("Port 8080/udp ", stdout)
         self.assertEqual(rc, 0)
 
+    def test_invalid_protocol(self):
+        """Test that unknown protocols are rejected."""
+        stdout, stderr, rc = self._run_scanner(["-proto", "sctp", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)
+
+    def _create_banner_server(self, banner: bytes) -> Tuple[socket.socket, int]:
+        """Create a TCP server that sends a banner to every client."""
+        server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        server_socket.bind(('127.0.0.1', 0))
+        server_socket.listen(5)
+
+        def server_thread():
+            while True:
+                try:
+                    conn, _ = server_socket.accept()
+                    conn.sendall(banner)
+                    conn.close()
+                except OSError:
+                    break
+
+        threading.Thread(target=server_thread, daemon=True).start()
+        return server_socket, server_socket.getsockname()[1]
+
+    def test_latency(self):
+        """Test that open and refused ports report latency in text, JSON and the per-host summary."""
+        stdout, stderr, rc = self._run_scanner(["-a", "-ports", "8080,8081,9999", "127.0.0.1"])
+        self.assertEqual(rc, 0)
+        self.assertRegex(stdout, r"Port 8080/tcp open http-alt \(\d+(\.\d+)?(µs|ms)\)\n")
+        self.assertRegex(stdout, r"Port 9999/tcp closed unknown \(\d+(\.\d+)?(µs|ms)\)\n")
+        self.assertRegex(stdout, r"Latency: min \S+, avg \S+, max \S+\n")
+
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-a", "-ports", "8080,9999", "127.0.0.1"])
+        self.assertEqual(rc, 0)
+        for result in json.loads(stdout)[0]["results"]:
+            self.assertGreater(result["latency_ms"], 0)
+
+        ## Closed-only scans have no open ports to summarize
+        stdout, stderr, rc = self._run_scanner(["-ports", "9999", "127.0.0.1"])
+        self.assertNotIn("Latency:", stdout)
+
+    def test_result_timestamps(self):
+        """Test that every result carries the time its probe finished, in JSON, CSV and -v text output."""
+        timestamp = r"\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(\.\d+)?Z"
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-a", "-ports", "8080,9999", "127.0.0.1"])
+        self.assertEqual(rc, 0)
+        for result in json.loads(stdout)[0]["results"]:
+            self.assertRegex(result["timestamp"], f"^{timestamp}$")
+
+        stdout, stderr, rc = self._run_scanner(["-o", "csv", "-a", "-ports", "8080,9999", "127.0.0.1"])
+        rows = list(csv.DictReader(io.StringIO(stdout)))
+        self.assertEqual(len(rows), 2)
+        for row in rows:
+            self.assertRegex(row["timestamp"], f"^{timestamp}$")
+
+        ## Text output only shows it with -v
+        stdout, stderr, rc = self._run_scanner(["-ports", "8080", "127.0.0.1"])
+        self.assertRegex(stdout, r"Port 8080/tcp open http-alt \(\S+\)\n")
+        stdout, stderr, rc = self._run_scanner(["-v", "-ports", "8080", "127.0.0.1"])
+        self.assertRegex(stdout, r"Port 8080/tcp open http-alt \(\S+\) at \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}(Z|[+-]\d\d:\d\d)\n")
+
+    def test_banner_grabbing(self):
+        """Test that -banner captures and sanitizes the first bytes sent by a service."""
+        server_socket, port = self._create_banner_server(b"SSH-2.0-Test_1.0\r\n\x00\x01binary")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-banner", "-p", str(port), "-e", str(port), "127.0.0.1"])
+            self.assertRegex(self._mask_latency(stdout), rf"Port {port}/tcp open [\w-]+ \(<t>\) \[SSH-2\.0-Test_1\.0\]")
+            self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-banner", "-o", "json", "-p", str(port), "-e", str(port), "127.0.0.1"])
+            self.assertEqual(rc, 0)
+            banner = json.loads(stdout)[0]["results"][0]["banner"]
+            self.assertEqual(banner, "SSH-2.0-Test_1.0\n..binary")
+        finally:
+            server_socket.close()
+
+    def test_banner_silent_service(self):
+        """Test that services which wait for the client get an empty banner."""
+        stdout, stderr, rc = self._run_scanner(["-banner", "-banner-timeout", "200ms", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertIn("Port 8080/tcp open http-alt (<t>)\n", self._mask_latency(stdout))
+        self.assertEqual(rc, 0)
+
+    def test_tls_probe(self):
+        """Test that -tls-probe leaves ports that do not speak TLS as they were."""
+        stdout, stderr, rc = self._run_scanner(["-tls-probe", "-tls-timeout", "500ms", "-ports", "8080,8081", "localhost"])
+        stdout = self._mask_latency(stdout)
+        self.assertIn("Port 8080/tcp open http-alt (<t>)\n", stdout)
+        self.assertIn("Port 8081/tcp open tproxy (<t>)\n", stdout)
+        self.assertNotIn("[tls:", stdout)
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-tls-probe", "-o", "json", "-ports", "8080", "localhost"])
+        self.assertNotIn("tls", json.loads(stdout)[0]["results"][0])
+
+        stdout, stderr, rc = self._run_scanner(["-tls-sni", "example.com", "localhost"])
+        self.assertIn("only apply together with -tls-probe", stdout)
+        self.assertEqual(rc, 2)
+
+        stdout, stderr, rc = self._run_scanner(["-tls-probe", "-tls-timeout", "0s", "localhost"])
+        self.assertIn("-tls-timeout", stdout)
+        self.assertEqual(rc, 2)
+
+    def _create_ssh_server(self, version: bytes, kexinit: bytes) -> Tuple[socket.socket, int]:
+        """Create a TCP server that identifies as SSH and answers the client's identification with kexinit."""
+        server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        server_socket.bind(('127.0.0.1', 0))
+        server_socket.listen(5)
+
+        def server_thread():
+            while True:
+                try:
+                    conn, _ = server_socket.accept()
+                    conn.settimeout(2)
+                    conn.sendall(version)
+                    if conn.recv(256).startswith(b"SSH-"):
+                        conn.sendall(kexinit)
+                    conn.close()
+                except OSError:
+                    break
+
+        threading.Thread(target=server_thread, daemon=True).start()
+        return server_socket, server_socket.getsockname()[1]
+
+    def test_ssh_probe(self):
+        """Test that -ssh-probe reports the SSH version and flags deprecated algorithms."""
+        lists = [b"curve25519-sha256,diffie-hellman-group1-sha1", b"ssh-ed25519,ssh-rsa",
+                 b"aes256-ctr,aes128-cbc", b"aes256-ctr,aes128-cbc", b"hmac-sha2-256", b"hmac-sha2-256",
+                 b"none", b"none", b"", b""]
+        payload = bytes([20]) + bytes(16) + b"".join(struct.pack(">I", len(l)) + l for l in lists) + bytes(5)
+        padding = 8 - (5 + len(payload)) % 8 + 8
+        kexinit = struct.pack(">IB", 1 + len(payload) + padding, padding) + payload + bytes(padding)
+        server, port = self._create_ssh_server(b"SSH-2.0-OpenSSH_9.6\r\n", kexinit)
+        try:
+            stdout, stderr, rc = self._run_scanner(["-banner", "-ssh-probe", "-ports", f"{port},8080", "127.0.0.1"])
+            self.assertIn("[SSH-2.0-OpenSSH_9.6] [ssh: SSH-2.0-OpenSSH_9.6, weak: diffie-hellman-group1-sha1, ssh-rsa, aes128-cbc]", stdout)
+            self.assertIn("Port 8080/tcp open http-alt (<t>)\n", self._mask_latency(stdout))
+            self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-banner", "-ssh-probe", "-o", "json", "-ports", str(port), "127.0.0.1"])
+            ssh = json.loads(stdout)[0]["results"][0]["ssh"]
+            self.assertEqual(ssh["version"], "SSH-2.0-OpenSSH_9.6")
+            self.assertEqual(ssh["kex_algorithms"], ["curve25519-sha256", "diffie-hellman-group1-sha1"])
+            self.assertEqual(ssh["host_key_algorithms"], ["ssh-ed25519", "ssh-rsa"])
+            self.assertEqual(ssh["ciphers"], ["aes256-ctr", "aes128-cbc"])
+            self.assertEqual(ssh["macs"], ["hmac-sha2-256"])
+            self.assertEqual(ssh["weak"], ["diffie-hellman-group1-sha1", "ssh-rsa", "aes128-cbc"])
+        finally:
+            server.close()
+
+        stdout, stderr, rc = self._run_scanner(["-ssh-timeout", "1s", "localhost"])
+        self.assertIn("only applies together with -ssh-probe", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_db_probe(self):
+        """Test that -db-probe leaves ports other than the database ones alone."""
+        stdout, stderr, rc = self._run_scanner(["-db-probe", "-db-timeout", "500ms", "-ports", "8080", "localhost"])
+        self.assertIn("Port 8080/tcp open http-alt (<t>)\n", self._mask_latency(stdout))
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-db-probe", "-o", "json", "-ports", "8080", "localhost"])
+        self.assertNotIn("annotations", json.loads(stdout)[0]["results"][0])
+
+        stdout, stderr, rc = self._run_scanner(["-db-timeout", "1s", "localhost"])
+        self.assertIn("only applies together with -db-probe", stdout)
+        self.assertEqual(rc, 2)
+
+    def _create_http_server(self, response: bytes) -> Tuple[socket.socket, int, List[bytes]]:
+        """Create a TCP server that answers every request with response, keeping the requests it got."""
+        server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        server_socket.bind(('127.0.0.1', 0))
+        server_socket.listen(5)
+        requests = []
+
+        def server_thread():
+            while True:
+                try:
+                    conn, _ = server_socket.accept()
+                    conn.settimeout(2)
+                    data = b""
+                    while b"\r\n\r\n" not in data:
+                        chunk = conn.recv(4096)
+                        if not chunk:
+                            break
+                        data += chunk
+                    requests.append(data)
+                    conn.sendall(response)
+                    conn.close()
+                except OSError:
+                    break
+
+        threading.Thread(target=server_thread, daemon=True).start()
+        return server_socket, server_socket.getsockname()[1], requests
+
+    def test_http_probe(self):
+        """Test that -http-probe reports the status, Server header, length and title of web ports."""
+        body = b"<html><title>Router &amp; admin</title></html>"
+        server_socket, port, requests = self._create_http_server(
+            b"HTTP/1.1 200 OK\r\nServer: TestHTTP/1.0\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s" % (len(body), body))
+        try:
+            stdout, stderr, rc = self._run_scanner(["-http-probe", "-http-ports", f"{port},8080", "-ports", f"{port},8080", "127.0.0.1"])
+            stdout = self._mask_latency(stdout)
+            self.assertIn(f'Port {port}/tcp open unknown (<t>) [http: 200, Server: TestHTTP/1.0, "Router & admin"]\n', stdout)
+            self.assertIn("Port 8080/tcp open http-alt (<t>)\n", stdout)  ## Hangs up without answering
+            self.assertEqual(rc, 0)
+            self.assertTrue(requests[-1].startswith(b"GET / HTTP/1.1\r\n"))  ## The first connection is the port scan itself
+
+            stdout, stderr, rc = self._run_scanner(["-http-probe", "-http-ports", str(port), "-o", "json", "-ports", str(port), "127.0.0.1"])
+            self.assertEqual(json.loads(stdout)[0]["results"][0]["http"], {
+                "url": f"http://127.0.0.1:{port}/", "status": 200, "server": "TestHTTP/1.0",
+                "content_length": len(body), "title": "Router & admin",
+            })
+
+            stdout, stderr, rc = self._run_scanner(["-http-probe", "-http-ports", str(port), "-o", "csv", "-ports", f"{port},8080", "127.0.0.1"])
+            rows = list(csv.reader(io.StringIO(stdout)))
+            self.assertEqual(rows[0][-4:], ["http_status", "http_server", "http_content_length", "http_title"])
+            columns = {int(row[2]): row[-4:] for row in rows[1:]}
+            self.assertEqual(columns[port], ["200", "TestHTTP/1.0", str(len(body)), "Router & admin"])
+            self.assertEqual(columns[8080], ["", "", "", ""])
+
+            ## The Host header carries the name the host was given
+            requests.clear()
+            self._run_scanner(["-http-probe", "-http-ports", str(port), "-ports", str(port), "localhost"])
+            self.assertIn(b"\r\nHost: localhost\r\n", requests[-1])
+
+            ## Ports outside -http-ports are not sent a request
+            requests.clear()
+            stdout, stderr, rc = self._run_scanner(["-http-probe", "-ports", str(port), "127.0.0.1"])
+            self.assertNotIn("[http:", stdout)
+            self.assertFalse(any(request.startswith(b"GET ") for request in requests))
+        finally:
+            server_socket.close()
+
+        stdout, stderr, rc = self._run_scanner(["-o", "csv", "-ports", "8080", "localhost"])
+        self.assertNotIn("http_status", stdout)
+
+        stdout, stderr, rc = self._run_scanner(["-follow-redirects", "localhost"])
+        self.assertIn("only apply together with -http-probe", stdout)
+        self.assertEqual(rc, 2)
+
+        stdout, stderr, rc = self._run_scanner(["-http-ports", "80", "localhost"])
+        self.assertIn("only apply together with -http-probe", stdout)
+        self.assertEqual(rc, 2)
+        stdout, stderr, rc = self._run_scanner(["-http-probe", "-http-ports", "80-x", "localhost"])
+        self.assertIn("Error parsing HTTP ports", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_service_names(self):
+        """Test that every reported port is named from the embedded service table."""
+        stdout, stderr, rc = self._run_scanner(["-a", "-ports", "22,8080,9999", "localhost"])
+        self.assertEqual(rc, 0)
+        stdout = self._mask_latency(stdout)
+        self.assertIn("Port 8080/tcp open http-alt (<t>)\n", stdout)
+        self.assertIn("Port 22/tcp closed ssh (<t>)\n", stdout)
+        self.assertIn("Port 9999/tcp closed unknown (<t>)\n", stdout)
+
+        ## -services is still accepted but no longer changes anything
+        stdout, stderr, rc = self._run_scanner(["-services", "-ports", "8080", "localhost"])
+        self.assertIn("Port 8080/tcp open http-alt (<t>)\n", self._mask_latency(stdout))
+
+        stdout, stderr, rc = self._run_scanner(["-o", "json", "-a", "-ports", "8080,9999", "localhost"])
+        services = {result["port"]: result["service"] for result in json.loads(stdout)[0]["results"]}
+        self.assertEqual(services, {8080: "http-alt", 9999: "unknown"})
+
+        stdout, stderr, rc = self._run_scanner(["-o", "csv", "-ports", "8080", "localhost"])
+        rows = list(csv.reader(io.StringIO(stdout)))
+        self.assertEqual(rows[1][self.CSV_HEADER.index("service")], "http-alt")
+
+    def test_retries(self):
+        """Test that -retries still finds open ports and never retries refused connections."""
+        stdout, stderr, rc = self._run_scanner(["-retries", "2", "-a", "-ports", "8080,9999", "localhost"])
+        self.assertEqual(rc, 0)
+        self.assertIn("Port 8080/tcp open http-alt (<t>)\n", self._mask_latency(stdout))
+        self.assertIn("Port 9999/tcp closed unknown (<t>)\n", self._mask_latency(stdout))
+
+        ## A refusal is definitive, so each port takes exactly one attempt
+        stdout, stderr, rc = self._run_scanner(["-retries", "3", "-a", "-o", "json", "-ports", "8080,9999", "localhost"])
+        self.assertEqual(rc, 0)
+        attempts = {result["port"]: result["attempts"] for result in json.loads(stdout)[0]["results"]}
+        self.assertEqual(attempts, {8080: 1, 9999: 1})
+
+        stdout, stderr, rc = self._run_scanner(["-retries", "-1", "-ports", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)
+
+    def test_rate_limit(self):
+        """Test that -rate caps connection attempts per second regardless of worker count."""
+        start = time.time()
+        stdout, stderr, rc = self._run_scanner(["-rate", "20", "-w", "100", "-p", "8070", "-e", "8089", "localhost"])
+        elapsed = time.time() - start
+        self.assertEqual(rc, 0)
+        self.assertIn("Port 8080/tcp open", stdout)
+        ## 20 ports at 20 per second cannot finish much faster than a second
+        self.assertGreaterEqual(elapsed, 0.9)
+
+        stdout, stderr, rc = self._run_scanner(["-rate", "-5", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)
+
     def test_resource_cleanup(self):
         """Test proper cleanup of resources."""
         # Run multiple scans to check for resource leaks
         for _ in range(5):
             stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8082", "-w", "50", "localhost"])
             self.assertEqual(rc, 0)
-            self.assertIn("Port 8080: open", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
             
         ## Run a final scan to verify resources are still available
         stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "localhost"])
         self.assertEqual(rc, 0)
-        self.assertIn("Port 8080: open", stdout)
+        self.assertIn("Port 8080/tcp open", stdout)
 
     def test_all_valid_flags_combination(self):
         """Test using all valid flags together."""
@@ -383,9 +2107,9 @@ class TestPortScanner(unittest.TestCase):
                 "-w", "50",
                 "-a"
             ])
-            self.assertIn("Port 8080: open", stdout)
-            self.assertIn("Port 8081: open", stdout)
-            self.assertIn("Port 8082: open", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
+            self.assertIn("Port 8081/tcp open", stdout)
+            self.assertIn("Port 8082/tcp open", stdout)
             self.assertEqual(rc, 0)
         finally:
             os.unlink(hosts_file)
@@ -396,7 +2120,7 @@ class TestPortScanner(unittest.TestCase):
         variants = ["localhost", "127.0.0.1"]
         for host in variants:
             stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", host])
-            self.assertIn("Port 8080: open", stdout)
+            self.assertIn("Port 8080/tcp open", stdout)
             self.assertEqual(rc, 0)
 
     def test_port_deduplication_and_order(self):
@@ -435,7 +2159,7 @@ class TestPortScanner(unittest.TestCase):
             os.kill(process.pid, signal.SIGINT)
 
         process = subprocess.Popen(
-            [self.exe_path, "-p", "1", "-e", "1000", "localhost"],
+            [self.exe_path, "scan", "-p", "1", "-e", "1000", "localhost"],
             stdout=subprocess.PIPE,
             stderr=subprocess.PIPE,
             text=True
@@ -458,6 +2182,523 @@ class TestPortScanner(unittest.TestCase):
         # Check if process exited
         self.assertIsNotNone(process.returncode, "Process did not exit")
 
+    def test_signal_reports_partial_results(self):
+        """Test that SIGINT stops the scan and still prints the results gathered so far."""
+        if sys.platform == "win32":
+            self.skipTest("Signal handling test skipped on Windows")
+            return
+
+        import signal
+
+        hosts_file = self._create_temp_file("localhost\n127.0.0.1\n")
+        try:
+            process = subprocess.Popen(
+                [self.exe_path, "scan", "-f", hosts_file, "-w", "1"],
+                stdout=subprocess.PIPE,
+                stderr=subprocess.PIPE,
+                text=True
+            )
+            time.sleep(1)
+            os.kill(process.pid, signal.SIGINT)
+            try:
+                stdout, stderr = process.communicate(timeout=5)
+            except subprocess.TimeoutExpired:
+                process.kill()
+                process.communicate()
+                self.fail("Process did not respond to SIGINT within timeout")
+
+            self.assertIn("Scan interrupted at port", stdout)
+            self.assertIn("remaining host(s) after interrupt", stdout)
+            self.assertIn("Total open ports", stdout)
+            self.assertIn("Interrupted", stderr)
+            self.assertEqual(process.returncode, 130)  ## Interrupted scans use a distinct exit code
+        finally:
+            os.unlink(hosts_file)
+
+    def test_deadline(self):
+        """Test that -deadline stops the run, reports partial results and exits with 124."""
+        hosts_file = self._create_temp_file("localhost\n127.0.0.1\n")
+        try:
+            start = time.time()
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-w", "1", "-deadline", "500ms"])
+            self.assertLess(time.time() - start, 5)
+            self.assertIn("Scan interrupted at port", stdout)
+            self.assertIn("Total open ports on localhost", stdout)
+            self.assertIn("Skipping 1 remaining host(s) after the deadline", stdout)
+            self.assertIn("Deadline of 500ms reached, the results are partial", stdout)
+            self.assertNotIn("Interrupted", stderr)
+            self.assertEqual(rc, 124)
+        finally:
+            os.unlink(hosts_file)
+
+        ## A deadline that is not reached changes nothing
+        stdout, stderr, rc = self._run_scanner(["-deadline", "1m", "-ports", "8080", "localhost"])
+        self.assertNotIn("Deadline", stdout)
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-deadline", "-1s", "localhost"])
+        self.assertIn("-deadline cannot be negative", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_diff(self):
+        """Test that -diff reports only the changes since an earlier JSON report and exits non-zero for new open ports."""
+        previous = [
+            {"host": "localhost", "ip": "127.0.0.1", "results": [
+                {"port": 8080, "protocol": "tcp", "open": True, "state": "open", "service": "http-alt"},
+                {"port": 8083, "protocol": "tcp", "open": True, "state": "open", "service": "us-srv"},
+            ]},
+            {"host": "decommissioned.example", "ip": "192.0.2.1", "results": []},
+        ]
+        previous_file = self._create_temp_file(json.dumps(previous), suffix=".json")
+        unchanged_file = None
+        try:
+            stdout, stderr, rc = self._run_scanner(["-diff", previous_file, "-ports", "8080-8083", "localhost"])
+            self.assertNotIn("Port 8080/tcp", stdout)
+            self.assertIn(f"Changes since {previous_file}:\n"
+                          "- host decommissioned.example is gone\n"
+                          "+ localhost: port 8081/tcp is now open (tproxy)\n"
+                          "+ localhost: port 8082/tcp is now open (unknown)\n"
+                          "- localhost: port 8083/tcp is no longer open (us-srv)\n", stdout)
+            self.assertEqual(rc, 5)
+
+            stdout, stderr, rc = self._run_scanner(["-diff", previous_file, "-diff-exit-code", "0", "-ports", "8080-8083", "localhost"])
+            self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-o", "json", "-diff", previous_file, "-ports", "8080-8083", "localhost"])
+            report = json.loads(stdout)
+            self.assertEqual([host["host"] for host in report["hosts"]], ["localhost"])
+            self.assertEqual(report["diff"]["gone_hosts"], ["decommissioned.example"])
+            self.assertEqual([change["port"] for change in report["diff"]["opened"]], [8081, 8082])
+            self.assertEqual([change["port"] for change in report["diff"]["closed"]], [8083])
+            self.assertEqual(rc, 5)
+
+            stdout, stderr, rc = self._run_scanner(["-o", "jsonl", "-diff", previous_file, "-ports", "8080-8083", "localhost"])
+            changes = [line for line in map(json.loads, stdout.splitlines()) if "change" in line]
+            self.assertEqual([(line["change"], line.get("port")) for line in changes],
+                             [("gone_host", None), ("opened", 8081), ("opened", 8082), ("closed", 8083)])
+
+            ## A JSON report written with -diff works as the next baseline, and nothing changed since
+            unchanged_file = self._create_temp_file(json.dumps(report), suffix=".json")
+            stdout, stderr, rc = self._run_scanner(["-q", "-diff", unchanged_file, "-ports", "8080-8083", "localhost"])
+            self.assertEqual(stdout, f"No changes since {unchanged_file}\n")
+            self.assertEqual(rc, 0)
+        finally:
+            os.unlink(previous_file)
+            if unchanged_file:
+                os.unlink(unchanged_file)
+
+        for args, message in [
+            (["-diff", "missing.json"], "Error reading previous report"),
+            (["-diff", "x.json", "-o", "csv"], "-diff only supports text, json and jsonl output"),
+            (["-diff", "x.json", "-fail-on-open"], "-diff and -fail-on-open cannot be used together"),
+            (["-diff-exit-code", "7"], "-diff-exit-code only applies together with -diff"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080", "localhost"])
+            self.assertIn(message, stdout)
+            ## -fail-on-open reports usage errors as 1
+            self.assertEqual(rc, 1 if "-fail-on-open" in args else 2)
+
+    def test_targets_file(self):
+        """Test that -targets scans each listed host:port pair once and skips malformed lines."""
+        targets_file = self._create_temp_file(
+            "localhost:8080\n127.0.0.1:8081\n# comment\nlocalhost:8082\nLOCALHOST:8080\nlocalhost\n127.0.0.1:99999\n"
+        )
+        try:
+            stdout, stderr, rc = self._run_scanner(["-a", "-o", "jsonl", "-targets", targets_file])
+            probed = [(line["host"], line["port"]) for line in map(json.loads, stdout.splitlines())]
+            self.assertEqual(probed, [("localhost", 8080), ("localhost", 8082), ("127.0.0.1", 8081)])
+            self.assertIn('Skipping targets file line 6: "localhost" is not host:port', stderr)
+            self.assertIn('Skipping targets file line 7: invalid port "99999" in "127.0.0.1:99999"', stderr)
+            self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-targets", "-"], stdin="127.0.0.1:8081\n")
+            self.assertIn("Port 8081/tcp open", stdout)
+            self.assertEqual(rc, 0)
+
+            for args, message in [
+                (["localhost"], "-targets cannot be combined with -f or a host argument"),
+                (["-ports", "22"], "-targets lists the ports itself"),
+                (["-sn"], "-targets cannot be used with -sn"),
+            ]:
+                stdout, stderr, rc = self._run_scanner(["-targets", targets_file] + args)
+                self.assertIn(message, stdout)
+                self.assertEqual(rc, 2)
+        finally:
+            os.unlink(targets_file)
+
+        stdout, stderr, rc = self._run_scanner(["-targets", "-"], stdin="localhost\n")
+        self.assertIn("Error reading targets file: no valid targets found", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_first_open(self):
+        """Test that -first-open stops scanning a host once enough open ports are found."""
+        stdout, stderr, rc = self._run_scanner(["-first-open", "1", "-w", "1", "-ports", "8080-8082,9000-9100", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertNotIn("Port 8082/tcp open", stdout)
+        self.assertRegex(stdout, r"Stopped after [12] open port\(s\), [0-9]+ of 104 ports scanned")
+        self.assertEqual(rc, 0)
+
+        stdout, stderr, rc = self._run_scanner(["-first-open", "-1", "-ports", "8080", "localhost"])
+        self.assertIn("Error: -first-open cannot be negative", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_watch(self):
+        """Test that -watch reports the open ports once, then only changes, until SIGINT ends it cleanly."""
+        if sys.platform == "win32":
+            self.skipTest("Signal handling test skipped on Windows")
+            return
+
+        import signal
+
+        process = subprocess.Popen(
+            [self.exe_path, "scan", "-watch", "200ms", "-ports", "8080-8082", "localhost"],
+            stdout=subprocess.PIPE,
+            stderr=subprocess.PIPE,
+            text=True
+        )
+        time.sleep(1.5)
+        os.kill(process.pid, signal.SIGINT)
+        try:
+            stdout, stderr = process.communicate(timeout=5)
+        except subprocess.TimeoutExpired:
+            process.kill()
+            process.communicate()
+            self.fail("Process did not respond to SIGINT within timeout")
+
+        self.assertIn("Watching 1 host(s) every 200ms", stdout)
+        self.assertRegex(stdout, r"\d{4}-\d\d-\d\d \d\d:\d\d:\d\d = localhost: port 8080/tcp is open \(http-alt\)")
+        self.assertEqual(stdout.count("port 8080/tcp"), 1)  ## Later scans found nothing new
+        self.assertNotIn("Scanning host", stdout)
+        self.assertRegex(stdout, r"Watched 1 host\(s\) for .* over [0-9]+ scan\(s\), 0 change\(s\)")
+        self.assertEqual(process.returncode, 0)
+
+        for args, message in [
+            (["-watch", "1m", "-o", "json"], '-watch only supports text and jsonl output, not "json"'),
+            (["-watch", "1m", "-diff", "report.json"], "-watch reports its own changes"),
+            (["-watch", "1m", "-webhook", "example.com/hook"], "-webhook must be an http or https URL"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080", "localhost"])
+            self.assertIn(message, stdout)
+            self.assertEqual(rc, 2)
+
+    def test_serve(self):
+        """Test that -serve answers POST /scan with a JSON host report and stops cleanly on SIGINT."""
+        if sys.platform == "win32":
+            self.skipTest("Signal handling test skipped on Windows")
+            return
+
+        import signal
+
+        with socket.socket() as sock:
+            sock.bind(("127.0.0.1", 0))
+            port = sock.getsockname()[1]
+        process = subprocess.Popen(
+            [self.exe_path, "scan", "-serve", f"127.0.0.1:{port}", "-w", "10", "-ports", "8080-8082"],
+            stdout=subprocess.PIPE,
+            stderr=subprocess.PIPE,
+            text=True
+        )
+
+        def post(body):
+            request = urllib.request.Request(f"http://127.0.0.1:{port}/scan", data=json.dumps(body).encode(), method="POST")
+            try:
+                with urllib.request.urlopen(request, timeout=10) as response:
+                    return response.status, json.load(response)
+            except urllib.error.HTTPError as e:
+                return e.code, json.load(e)
+
+        try:
+            for _ in range(50):
+                try:
+                    status, report = post({"host": "localhost"})
+                    break
+                except urllib.error.URLError:
+                    time.sleep(0.1)
+            else:
+                self.fail("-serve did not start listening")
+            self.assertEqual(status, 200)
+            self.assertEqual(report["ip"], "127.0.0.1")
+            self.assertEqual([r["port"] for r in report["results"]], [8080, 8081, 8082])
+
+            status, report = post({"host": "localhost", "ports": [8081, 9], "workers": 2})
+            self.assertEqual(status, 200)
+            self.assertEqual((report["open_ports"], report["closed_ports"]), (1, 1))
+
+            status, report = post({"host": "localhost", "workers": 50})
+            self.assertEqual(status, 400)
+            self.assertIn("workers must be between 1 and 10", report["error"])
+        finally:
+            os.kill(process.pid, signal.SIGINT)
+            try:
+                stdout, stderr = process.communicate(timeout=10)
+            except subprocess.TimeoutExpired:
+                process.kill()
+                process.communicate()
+                self.fail("Process did not respond to SIGINT within timeout")
+        self.assertIn(f"Serving scans on http://127.0.0.1:{port}/scan", stdout)
+        self.assertEqual(process.returncode, 0)
+
+        for args, message in [
+            (["-serve", ":0", "localhost"], "-serve takes its hosts from requests"),
+            (["-serve", ":0", "-watch", "1m"], "-serve cannot be used with -sn, -watch"),
+            (["-serve-max-scans", "2", "localhost"], "-serve-max-scans only applies together with -serve"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args)
+            self.assertIn(message, stdout)
+            self.assertEqual(rc, 2)
+
+    def test_webhook_errors(self):
+        """Test that -webhook settings are checked before anything is scanned."""
+        for args, message in [
+            (["-webhook", "example.com/hook"], "-webhook must be an http or https URL"),
+            (["-webhook-required"], "only apply together with -webhook"),
+            (["-webhook", "http://127.0.0.1:9/", "-webhook-header", "Authorization"], 'expected "Name: value"'),
+            (["-webhook", "http://127.0.0.1:9/", "-sn"], "-webhook cannot be used with -sn"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080", "localhost"])
+            self.assertIn(message, stdout + stderr)
+            self.assertEqual(rc, 2)
+
+    def test_metrics_listen(self):
+        """Test that -metrics-listen serves Prometheus metrics while a watch runs."""
+        if sys.platform == "win32":
+            self.skipTest("Signal handling test skipped on Windows")
+            return
+
+        import signal
+
+        with socket.socket() as sock:
+            sock.bind(("127.0.0.1", 0))
+            port = sock.getsockname()[1]
+        process = subprocess.Popen(
+            [self.exe_path, "scan", "-watch", "200ms", "-metrics-listen", f"127.0.0.1:{port}", "-ports", "8080-8082,9", "localhost"],
+            stdout=subprocess.PIPE,
+            stderr=subprocess.PIPE,
+            text=True
+        )
+        try:
+            metrics = None
+            for _ in range(50):
+                try:
+                    with urllib.request.urlopen(f"http://127.0.0.1:{port}/metrics", timeout=5) as response:
+                        metrics = response.read().decode()
+                    if re.search(r"^portscanner_host_scan_duration_seconds_count [1-9]", metrics, re.M):
+                        break
+                except urllib.error.URLError:
+                    pass
+                time.sleep(0.1)
+            self.assertIsNotNone(metrics, "-metrics-listen did not start listening")
+            self.assertIn("# TYPE portscanner_ports_scanned_total counter", metrics)
+            self.assertRegex(metrics, r'portscanner_ports_open_total\{host="localhost"\} [1-9]')
+            self.assertRegex(metrics, r'portscanner_connection_errors_total\{reason="refused"\} [1-9]')
+            self.assertIn("portscanner_scan_duration_seconds ", metrics)
+            # Every watch scan finds the same 3 open ports
+            self.assertRegex(metrics, r'portscanner_open_ports\{host="localhost",ip="[^"]+"\} 3\n')
+            self.assertIn('portscanner_host_scan_duration_seconds_bucket{le="+Inf"}', metrics)
+        finally:
+            os.kill(process.pid, signal.SIGINT)
+            try:
+                process.communicate(timeout=5)
+            except subprocess.TimeoutExpired:
+                process.kill()
+                process.communicate()
+                self.fail("Process did not respond to SIGINT within timeout")
+        self.assertEqual(process.returncode, 0)
+        with self.assertRaises(urllib.error.URLError):
+            urllib.request.urlopen(f"http://127.0.0.1:{port}/metrics", timeout=2)
+
+        stdout, stderr, rc = self._run_scanner(["-metrics", ":0", "-sn", "localhost"])
+        self.assertIn("-metrics-listen cannot be used with -sn or -serve", stdout)
+        self.assertEqual(rc, 2)
+
+    def test_syslog_errors(self):
+        """Test that -syslog problems are reported before anything is scanned."""
+        for args, message in [
+            (["-syslog", "-syslog-facility", "local9"], 'unknown facility "local9"'),
+            (["-syslog-tag", "scan"], "-syslog-facility and -syslog-tag only apply together with -syslog"),
+            (["-syslog", "-sn"], "-syslog cannot be used with -sn"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080", "localhost"])
+            self.assertIn(message, stdout)
+            self.assertNotIn("Scanning host", stdout)
+            self.assertEqual(rc, 2)
+
+    def test_baseline(self):
+        """Test that -baseline reports ports breaking the policy in every output format and exits with status 6."""
+        policy_file = self._create_temp_file('"*": [22]\nlocalhost:\n  - 8080\n  - 8081\n  - 9  # discard, not running\n', suffix=".yaml")
+        allowed_file = self._create_temp_file(json.dumps({"127.0.0.0/8": [8080, 8081, 8082]}), suffix=".json")
+        try:
+            args = ["-baseline", policy_file, "-ports", "8080-8082,9", "localhost"]
+            stdout, stderr, rc = self._run_scanner(args)
+            self.assertIn("Port 8082/tcp open", stdout)
+            self.assertIn(f"Policy violations against {policy_file}:\n"
+                          '! localhost (127.0.0.1): port 8082/tcp is open but entry "localhost" does not allow it (unknown)\n'
+                          '! localhost (127.0.0.1): port 9/tcp is not open but entry "localhost" expects it\n', stdout)
+            self.assertEqual(rc, 6)
+
+            stdout, stderr, rc = self._run_scanner(["-o", "json"] + args)
+            violations = json.loads(stdout)["policy"]["violations"]
+            self.assertEqual([(v["violation"], v["port"], v["entry"]) for v in violations],
+                             [("unexpected_open", 8082, "localhost"), ("expected_closed", 9, "localhost")])
+            self.assertEqual(rc, 6)
+
+            stdout, stderr, rc = self._run_scanner(["-o", "jsonl"] + args)
+            lines = [json.loads(line) for line in stdout.splitlines()]
+            self.assertEqual([(line["violation"], line["port"]) for line in lines if "violation" in line],
+                             [("unexpected_open", 8082), ("expected_closed", 9)])
+
+            stdout, stderr, rc = self._run_scanner(["-o", "csv"] + args)
+            rows = list(csv.reader(io.StringIO(stdout)))
+            self.assertEqual(rows[0], self.CSV_HEADER + ["violation"])
+            self.assertEqual({row[2]: row[9] for row in rows[1:]},
+                             {"8080": "", "8081": "", "8082": "unexpected_open", "9": "expected_closed"})
+
+            stdout, stderr, rc = self._run_scanner(["-o", "grep"] + args)
+            self.assertIn("Host: 127.0.0.1 (localhost)\tViolations: 8082/tcp/unexpected_open, 9/tcp/expected_closed\n", stdout)
+
+            stdout, stderr, rc = self._run_scanner(["-o", "xml"] + args)
+            script = ET.fromstring(stdout).find("host/hostscript/script")
+            self.assertEqual(script.get("id"), "baseline-violations")
+            self.assertIn("port 8082/tcp is open", script.get("output"))
+
+            ## The /8 covers 127.0.0.1, so nothing breaks the policy and the exit status says so
+            stdout, stderr, rc = self._run_scanner(["-baseline", allowed_file, "-ports", "8080-8082", "localhost"])
+            self.assertIn(f"No policy violations against {allowed_file}", stdout)
+            self.assertEqual(rc, 0)
+        finally:
+            os.unlink(policy_file)
+            os.unlink(allowed_file)
+
+        for args, message in [
+            (["-baseline", "missing.yaml"], "Error reading baseline"),
+            (["-baseline", "x.yaml", "-fail-on-open"], "-baseline and -fail-on-open cannot be used together"),
+            (["-baseline", "x.yaml", "-sn"], "-baseline cannot be used with -sn"),
+        ]:
+            stdout, stderr, rc = self._run_scanner(args + ["-ports", "8080", "localhost"])
+            self.assertIn(message, stdout)
+            ## -fail-on-open reports usage errors as 1
+            self.assertEqual(rc, 1 if "-fail-on-open" in args else 2)
+
+    def test_checkpoint_resume(self):
+        """Test that a scan cut short with -checkpoint can be finished with -resume."""
+        out_dir = tempfile.mkdtemp()
+        checkpoint = os.path.join(out_dir, "scan.ckpt")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-w", "1", "-p", "1", "-e", "65535", "-checkpoint", checkpoint, "-deadline", "200ms", "localhost"])
+            self.assertEqual(rc, 124)
+            with open(checkpoint) as f:
+                lines = f.read().splitlines()
+            header = json.loads(lines[0])
+            self.assertEqual(header["targets"], ["localhost"])
+            self.assertEqual(header["ports"], "1-65535")
+            self.assertGreater(len(lines), 1)
+            self.assertLess(len(lines), 65536)
+
+            ## Giving the same file again must not start it over
+            stdout, stderr, rc = self._run_scanner(["-p", "1", "-e", "65535", "-checkpoint", checkpoint, "localhost"])
+            self.assertIn("already exists (pass it to -resume to continue that scan)", stdout)
+            self.assertEqual(rc, 2)
+
+            stdout, stderr, rc = self._run_scanner(["-p", "1", "-e", "80", "-resume", checkpoint, "localhost"])
+            self.assertIn("cannot resume from", stdout)
+            self.assertIn("not 1-80", stdout)
+            self.assertEqual(rc, 2)
+
+            stdout, stderr, rc = self._run_scanner(["-p", "1", "-e", "65535", "-resume", checkpoint, "localhost"])
+            self.assertIn(f"Resuming from {checkpoint}, {len(lines) - 1} port(s) already scanned", stdout)
+            for port in (8080, 8081, 8082):
+                self.assertIn(f"Port {port}/tcp", stdout)
+            self.assertEqual(rc, 0)
+            with open(checkpoint) as f:
+                lines = f.read().splitlines()
+            self.assertEqual(len(lines), 65537)
+            self.assertIn("complete", json.loads(lines[-1]))
+
+            ## A finished scan has nothing left to resume
+            stdout, stderr, rc = self._run_scanner(["-p", "1", "-e", "65535", "-resume", checkpoint, "localhost"])
+            self.assertIn("that scan already finished at", stdout)
+            self.assertEqual(rc, 2)
+        finally:
+            if os.path.exists(checkpoint):
+                os.unlink(checkpoint)
+            os.rmdir(out_dir)
+
+        stdout, stderr, rc = self._run_scanner(["-sn", "-checkpoint", "scan.ckpt", "localhost"])
+        self.assertEqual(rc, 2)
+
+    def test_progress_only_on_terminal(self):
+        """Test that the progress line is shown on a terminal and hidden when output is piped."""
+        if sys.platform == "win32":
+            self.skipTest("Pseudo-terminal test skipped on Windows")
+            return
+
+        import pty
+
+        ## Piped output must stay free of progress noise
+        stdout, stderr, rc = self._run_scanner(["-p", "1", "-e", "2000", "localhost"])
+        self.assertNotIn("Progress:", stderr)
+        self.assertEqual(rc, 1)
+
+        hosts_file = self._create_temp_file("localhost\n127.0.0.1\n")
+        master, slave = pty.openpty()
+        try:
+            process = subprocess.Popen(
+                [self.exe_path, "scan", "-f", hosts_file, "-w", "1"],
+                stdout=slave,
+                stderr=slave,
+            )
+            os.close(slave)
+            output = b""
+            while True:
+                try:
+                    chunk = os.read(master, 4096)
+                except OSError:
+                    break
+                if not chunk:
+                    break
+                output += chunk
+            process.wait(timeout=30)
+            self.assertIn(b"Progress: host 1/2, ", output)
+            self.assertIn(b"/65535 ports", output)
+            self.assertIn(b"ports/s", output)
+            self.assertIn(b"ETA", output)
+        finally:
+            os.close(master)
+            os.unlink(hosts_file)
+
+    def test_no_progress_flag(self):
+        """Test that -no-progress hides the progress display even on a terminal."""
+        if sys.platform == "win32":
+            self.skipTest("Pseudo-terminal test skipped on Windows")
+            return
+
+        import pty
+
+        master, slave = pty.openpty()
+        try:
+            process = subprocess.Popen(
+                [self.exe_path, "scan", "-no-progress", "-progress-interval", "100ms", "-w", "1", "-p", "1", "-e", "20000", "localhost"],
+                stdout=subprocess.DEVNULL,
+                stderr=slave,
+            )
+            os.close(slave)
+            output = b""
+            while True:
+                try:
+                    chunk = os.read(master, 4096)
+                except OSError:
+                    break
+                if not chunk:
+                    break
+                output += chunk
+            process.wait(timeout=30)
+            self.assertNotIn(b"Progress:", output)
+        finally:
+            os.close(master)
+
+        stdout, stderr, rc = self._run_scanner(["-progress-interval", "0s", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)
+
     def test_ipv6_localhost(self):
         """Test IPv6 localhost scanning if supported."""
         try:
@@ -465,12 +2706,74 @@ class TestPortScanner(unittest.TestCase):
             sock.close()
             
             stdout, stderr, rc = self._run_scanner(["-p", "8080", "-e", "8080", "::1"])
-            self.assertEqual(rc, 0)
+            self.assertIn(rc, (0, 1))
             ## Note: Don't assert on open ports as IPv6 support may vary
         except socket.error:
             ## IPv6 not supported, skip test
             self.skipTest("IPv6 not supported on this system")
 
+    def _create_ipv6_test_server(self) -> Tuple[socket.socket, int]:
+        """Create a TCP server listening on ::1, skipping the test when IPv6 is unavailable."""
+        try:
+            server_socket = socket.socket(socket.AF_INET6, socket.SOCK_STREAM)
+            server_socket.bind(('::1', 0))
+        except OSError:
+            self.skipTest("IPv6 not supported on this system")
+        server_socket.listen(5)
+
+        def server_thread():
+            while True:
+                try:
+                    conn, _ = server_socket.accept()
+                    conn.close()
+                except OSError:
+                    break
+
+        threading.Thread(target=server_thread, daemon=True).start()
+        return server_socket, server_socket.getsockname()[1]
+
+    def test_ipv6_bracketed_literal(self):
+        """Test scanning bracketed and bare IPv6 literals against a listener on ::1."""
+        server_socket, port = self._create_ipv6_test_server()
+        try:
+            for host in ["[::1]", "::1"]:
+                stdout, stderr, rc = self._run_scanner(["-p", str(port), "-e", str(port), host])
+                self.assertIn("Scanning host: ::1", stdout)
+                self.assertIn(f"Port {port}/tcp open", stdout)
+                self.assertEqual(rc, 0)
+
+            stdout, stderr, rc = self._run_scanner(["-6", "-p", str(port), "-e", str(port), "[::1]"])
+            self.assertIn(f"Port {port}/tcp open", stdout)
+            self.assertEqual(rc, 0)
+        finally:
+            server_socket.close()
+
+    def test_ipv6_literal_in_hosts_file(self):
+        """Test that bracketed IPv6 literals in the hosts file are scanned correctly."""
+        server_socket, port = self._create_ipv6_test_server()
+        hosts_file = self._create_temp_file("[::1]\n")
+        try:
+            stdout, stderr, rc = self._run_scanner(["-f", hosts_file, "-p", str(port), "-e", str(port)])
+            self.assertIn(f"Port {port}/tcp open", stdout)
+            self.assertEqual(rc, 0)
+        finally:
+            server_socket.close()
+            os.unlink(hosts_file)
+
+    def test_force_address_family(self):
+        """Test that -4 and -6 restrict which address family a dual-stack name is dialed over."""
+        stdout, stderr, rc = self._run_scanner(["-4", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertIn("Port 8080/tcp open", stdout)
+        self.assertEqual(rc, 0)
+
+        ## An IPv6 literal can never be reached over IPv4
+        stdout, stderr, rc = self._run_scanner(["-4", "-a", "-p", "8080", "-e", "8080", "::1"])
+        self.assertNotIn("Port 8080/tcp open", stdout)
+        self.assertEqual(rc, 3)
+
+        stdout, stderr, rc = self._run_scanner(["-4", "-6", "-p", "8080", "-e", "8080", "localhost"])
+        self.assertNotEqual(rc, 0)
+
     def test_reliable_remote_hosts(self):
         """Test scanning well-known remote hosts that have high uptime."""
         ## Test cases: (host, port, expected_status)
@@ -486,7 +2789,7 @@ class TestPortScanner(unittest.TestCase):
             self.assertEqual(rc, 0, f"Scan failed for {host}:{port}")
             
             if expected_open:
-                self.assertIn(f"Port {port}: open", stdout, 
+                self.assertIn(f"Port {port}/tcp open", stdout, 
                     f"Expected port {port} to be open on {host}")
             else:
                 self.assertIn("No open ports found", stdout, 